@@ -3,9 +3,7 @@
 package api
 
 import (
-	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,24 +11,30 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
-	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/oauth/clients"
+	"github.com/katcipis/stonks/oauth/oidc"
+	"github.com/katcipis/stonks/ratelimit"
+	"github.com/katcipis/stonks/users/magiclink"
 	"github.com/katcipis/stonks/users/manager"
+	"github.com/katcipis/stonks/users/mfa"
+	"github.com/katcipis/stonks/users/passkeys"
+	"github.com/katcipis/stonks/users/recovery"
+	"github.com/katcipis/stonks/users/verification"
 )
 
-// CreateUserRequestBody is the request body required to create users
-type CreateUserRequestBody struct {
-	FullName string `json:"fullname"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
-}
+// Error contains error information used in error responses
+type Error struct {
+	Message string `json:"message"`
 
-// CreateUserResponse is the response body when a user is created with success
-type CreateUserResponse struct {
-	ID string `json:"id"`
+	// PasswordViolations are the rules of the password policy violated
+	// by a password, only present when the password is the error cause.
+	PasswordViolations []PasswordViolation `json:"password_violations,omitempty"`
 }
 
-// Error contains error information used in error responses
-type Error struct {
+// PasswordViolation is a rule of the password policy violated by a password
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
 	Message string `json:"message"`
 }
 
@@ -44,73 +48,155 @@ type ErrorResponse struct {
 // configurations.
 type Config struct {
 	CreateUserTimeout time.Duration
+	SigninTimeout     time.Duration
+
+	// RequestTimeout is the timeout of all requests that
+	// don't have a more specific timeout configuration.
+	RequestTimeout time.Duration
+
+	// RateLimits are the policies used when Services.RateLimiter is set
+	RateLimits RateLimits
+
+	// ClientIPHeader is the header with the IP of clients, like
+	// X-Forwarded-For, it must only be set when the service is behind
+	// a proxy that sets it. If empty the IP of the connection is used.
+	ClientIPHeader string
 }
 
-// New creates a new HTTP handler with all the service routes.
-func New(usersManager *manager.Manager, cfg Config) http.Handler {
-	const usersPath = "/v1/users"
+// Services has all the services exported by the API
+type Services struct {
+	UsersManager  *manager.Manager
+	Authorizer    *auth.Authorizer
+	Tokens        *auth.Tokens
+	RefreshTokens *auth.RefreshTokens
+	APIKeys       *auth.APIKeys
+	Recovery      *recovery.Recovery
+	MagicLink     *magiclink.MagicLink
+	Verification  *verification.Verification
+	MFA           *mfa.MFA
+
+	// RateLimiter is optional, if it is nil requests are not limited
+	RateLimiter *ratelimit.Limiter
+
+	// SigninAttempts protects sign ins with passwords and their second factor
+	// against brute force attacks.
+	SigninAttempts *auth.SigninAttempts
+
+	// Passkeys is optional, if it is nil passkeys are not available
+	Passkeys *passkeys.Passkeys
+
+	// Clients authenticates the OAuth clients that can use
+	// the OAuth endpoints, like token introspection.
+	Clients *clients.Clients
+
+	// Keys are the keys used to sign access tokens, they are
+	// optional and only required if tokens are signed.
+	Keys *auth.KeyRing
+
+	// OIDC is the OpenID Connect provider, it is optional and
+	// requires Keys since ID tokens are always signed.
+	OIDC *oidc.Provider
+}
+
+const (
+	usersPath                = "/v1/users"
+	userPath                 = "/v1/users/"
+	verifyUserPath           = "/v1/users/verify"
+	resendVerificationPath   = "/v1/users/verify/resend"
+	signinPath               = "/v1/auth/signin"
+	signinMFAPath            = "/v1/auth/signin/mfa"
+	signinPasskeyPath        = "/v1/auth/signin/passkey"
+	passkeyOptionsPath       = "/v1/auth/passkey/options"
+	signoutPath              = "/v1/auth/signout"
+	tokenPath                = "/v1/auth/token"
+	passwordResetPath        = "/v1/auth/password-reset"
+	passwordResetConfirmPath = "/v1/auth/password-reset/confirm"
+	magicLinkPath            = "/v1/auth/magic-link"
+	magicLinkConfirmPath     = "/v1/auth/magic-link/confirm"
+	introspectPath           = "/v1/oauth/introspect"
+	revokePath               = "/v1/oauth/revoke"
+	authorizePath            = "/v1/oauth/authorize"
+	oauthTokenPath           = "/v1/oauth/token"
+	userInfoPath             = "/v1/oauth/userinfo"
+	jwksPath                 = "/.well-known/jwks.json"
+	discoveryPath            = "/.well-known/openid-configuration"
+)
 
+// New creates a new HTTP handler with all the service routes.
+func New(s Services, cfg Config) http.Handler {
 	mux := http.NewServeMux()
-	userslog := log.WithFields(log.Fields{"path": usersPath})
-
-	mux.HandleFunc(usersPath, func(res http.ResponseWriter, req *http.Request) {
-		if req.Method != http.MethodPost {
-			res.WriteHeader(http.StatusMethodNotAllowed)
-			msg := fmt.Sprintf("method %q is not allowed", req.Method)
-			logResponseBodyWrite(userslog, res, errorResponse(msg))
-			userslog.WithFields(log.Fields{"error": msg}).Warning("method not allowed")
-			return
-		}
-		dec := json.NewDecoder(req.Body)
-		parsedReq := CreateUserRequestBody{}
-
-		err := dec.Decode(&parsedReq)
-		if err != nil {
-			msg := fmt.Sprintf("error parsing JSON request body: %v", err)
-			res.WriteHeader(http.StatusBadRequest)
-			logResponseBodyWrite(userslog, res, errorResponse(msg))
-			userslog.WithFields(log.Fields{"error": msg}).Warning("invalid request body")
-			return
-		}
-
-		ctx, cancel := context.WithTimeout(context.Background(), cfg.CreateUserTimeout)
-		defer cancel()
-
-		userID, err := usersManager.CreateUser(ctx, parsedReq.Email, parsedReq.FullName, parsedReq.Password)
-		if err != nil {
-			if errors.Is(err, users.InvalidUserParamErr) ||
-				errors.Is(err, users.UserAlreadyExistsErr) {
-				res.WriteHeader(http.StatusBadRequest)
-				// Invalid and duplicated user param errors are guaranteed
-				// to be safe to send to users (not much info added on the error context).
-				// If a service is external care must be taken to not leak details
-				// that can be a potential security threat.
-				// When that is not the case I like the idea of
-				// informative error responses as detailed here:
-				//
-				// - https://commandcenter.blogspot.com/2017/12/error-handling-in-upspin.html
-				//
-				// I'm specially fond to the idea of a cross service
-				// operational trace (instead of stack traces).
-				// But I never tried it yet.
-				logResponseBodyWrite(userslog, res, errorResponse(err.Error()))
-				userslog.WithFields(log.Fields{"error": err.Error()}).Warning("bad request error")
-				return
-			}
-			// Specially when you can't give much detail on errors for
-			// security reasons it would be a good idea to have
-			// a tracking id for errors to help map the error to
-			// the logs, not sure if I'm going to have time to add this.
-			res.WriteHeader(http.StatusInternalServerError)
-			logResponseBodyWrite(userslog, res, errorResponse("internal server error"))
-			userslog.WithFields(log.Fields{"error": err.Error()}).Error("internal server error")
-			return
-		}
-
-		res.WriteHeader(http.StatusCreated)
-		logResponseBodyWrite(userslog, res, jsonResponse(CreateUserResponse{ID: userID}))
-	})
-	return mux
+	mux.HandleFunc(usersPath, usersHandler(s.UsersManager, s.Authorizer, s.Tokens, s.APIKeys, s.Verification, cfg, pathLogger(usersPath)))
+	mux.HandleFunc(userPath, userHandler(s.UsersManager, s.Authorizer, s.Tokens, s.APIKeys, s.RefreshTokens, s.Verification, s.MFA, s.Passkeys, s.SigninAttempts, cfg, pathLogger(userPath)))
+	mux.HandleFunc(verifyUserPath, verifyUserHandler(s.Verification, cfg, pathLogger(verifyUserPath)))
+	mux.HandleFunc(resendVerificationPath, resendVerificationHandler(s.Verification, cfg, pathLogger(resendVerificationPath)))
+	mux.HandleFunc(signinPath, signinHandler(s.UsersManager, s.Tokens, s.RefreshTokens, s.MFA, s.Passkeys, s.SigninAttempts, cfg, pathLogger(signinPath)))
+	mux.HandleFunc(signinMFAPath, signinMFAHandler(s.UsersManager, s.Tokens, s.RefreshTokens, s.MFA, s.Passkeys, s.SigninAttempts, cfg, pathLogger(signinMFAPath)))
+	mux.HandleFunc(signoutPath, signoutHandler(s.Tokens, s.RefreshTokens, cfg, pathLogger(signoutPath)))
+	mux.HandleFunc(tokenPath, tokenHandler(s.UsersManager, s.Tokens, s.RefreshTokens, cfg, pathLogger(tokenPath)))
+	mux.HandleFunc(passwordResetPath, passwordResetHandler(s.Recovery, cfg, pathLogger(passwordResetPath)))
+	mux.HandleFunc(passwordResetConfirmPath, passwordResetConfirmHandler(s.Recovery, s.Tokens, s.RefreshTokens, s.APIKeys, cfg, pathLogger(passwordResetConfirmPath)))
+	mux.HandleFunc(magicLinkPath, magicLinkHandler(s.MagicLink, cfg, pathLogger(magicLinkPath)))
+	mux.HandleFunc(magicLinkConfirmPath, magicLinkConfirmHandler(s.MagicLink, s.Tokens, s.RefreshTokens, s.MFA, s.Passkeys, cfg, pathLogger(magicLinkConfirmPath)))
+	mux.HandleFunc(introspectPath, introspectHandler(s.UsersManager, s.Clients, s.Tokens, s.RefreshTokens, cfg, pathLogger(introspectPath)))
+	mux.HandleFunc(revokePath, revokeHandler(s.Clients, s.Tokens, s.RefreshTokens, cfg, pathLogger(revokePath)))
+	mux.HandleFunc(oauthTokenPath, oauthTokenHandler(s.Clients, s.Tokens, s.OIDC, cfg, pathLogger(oauthTokenPath)))
+	if s.Passkeys != nil {
+		mux.HandleFunc(passkeyOptionsPath, passkeyOptionsHandler(s.Passkeys, cfg, pathLogger(passkeyOptionsPath)))
+		mux.HandleFunc(signinPasskeyPath, signinPasskeyHandler(s.UsersManager, s.Tokens, s.RefreshTokens, s.Passkeys, cfg, pathLogger(signinPasskeyPath)))
+	}
+	if s.Keys != nil {
+		mux.HandleFunc(jwksPath, jwksHandler(s.Keys, pathLogger(jwksPath)))
+	}
+	if s.OIDC != nil {
+		mux.HandleFunc(discoveryPath, discoveryHandler(s.OIDC, s.Keys, pathLogger(discoveryPath)))
+		mux.HandleFunc(authorizePath, authorizeHandler(s.UsersManager, s.MFA, s.SigninAttempts, s.OIDC, cfg, pathLogger(authorizePath)))
+		mux.HandleFunc(userInfoPath, userInfoHandler(s.OIDC, cfg, pathLogger(userInfoPath)))
+	}
+	return rateLimitHandler(mux, s.RateLimiter, s, cfg)
+}
+
+func pathLogger(path string) *log.Entry {
+	return log.WithFields(log.Fields{"path": path})
+}
+
+func notFound(logger *log.Entry, res http.ResponseWriter, req *http.Request) {
+	msg := fmt.Sprintf("resource %q not found", req.URL.Path)
+	writeErrorResponse(logger, res, http.StatusNotFound, msg)
+}
+
+func methodNotAllowed(logger *log.Entry, res http.ResponseWriter, req *http.Request) {
+	msg := fmt.Sprintf("method %q is not allowed", req.Method)
+	writeErrorResponse(logger, res, http.StatusMethodNotAllowed, msg)
+}
+
+func parseJSONBody(logger *log.Entry, res http.ResponseWriter, req *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(req.Body)
+	err := dec.Decode(v)
+	if err != nil {
+		msg := fmt.Sprintf("error parsing JSON request body: %v", err)
+		writeErrorResponse(logger, res, http.StatusBadRequest, msg)
+		return false
+	}
+	return true
+}
+
+// writeErrorResponse writes an error response with a message that is
+// safe to be sent to the client, it should not be used for
+// internal errors (use internalServerError instead).
+func writeErrorResponse(logger *log.Entry, res http.ResponseWriter, status int, msg string) {
+	res.WriteHeader(status)
+	logResponseBodyWrite(logger, res, errorResponse(msg))
+	logger.WithFields(log.Fields{"error": msg, "status": status}).Warning("request failed")
+}
+
+func internalServerError(logger *log.Entry, res http.ResponseWriter, err error) {
+	// Specially when you can't give much detail on errors for
+	// security reasons it would be a good idea to have
+	// a tracking id for errors to help map the error to
+	// the logs, not sure if I'm going to have time to add this.
+	res.WriteHeader(http.StatusInternalServerError)
+	logResponseBodyWrite(logger, res, errorResponse("internal server error"))
+	logger.WithFields(log.Fields{"error": err.Error()}).Error("internal server error")
 }
 
 func logResponseBodyWrite(logger *log.Entry, w io.Writer, data []byte) {
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/manager"
+)
+
+// CreateAPIKeyRequestBody is the request body required to create API keys
+type CreateAPIKeyRequestBody struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// APIKeyResponse is the representation of an API key on response bodies,
+// the key itself is only available when it is created.
+type APIKeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// CreateAPIKeyResponse is the response body when an API key is created with success
+type CreateAPIKeyResponse struct {
+	APIKeyResponse
+	Key string `json:"key"`
+}
+
+// ListAPIKeysResponse is the response body when API keys are listed with success
+type ListAPIKeysResponse struct {
+	APIKeys []APIKeyResponse `json:"api_keys"`
+}
+
+func userAPIKeys(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+	keyID string,
+) {
+	switch {
+	case keyID == "" && req.Method == http.MethodPost:
+		createAPIKey(usersManager, tokens, apiKeys, cfg, logger, res, req, userID)
+	case keyID == "" && req.Method == http.MethodGet:
+		listAPIKeys(usersManager, authorizer, tokens, apiKeys, cfg, logger, res, req, userID)
+	case keyID != "" && req.Method == http.MethodDelete:
+		revokeAPIKey(usersManager, authorizer, tokens, apiKeys, cfg, logger, res, req, userID, keyID)
+	default:
+		methodNotAllowed(logger, res, req)
+	}
+}
+
+func createAPIKey(
+	usersManager *manager.Manager,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	// WHY: API keys can't create other API keys, otherwise
+	// scoped keys could create keys with more permissions.
+	s, ok := authenticate(ctx, tokens, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if _, ok := sessionUser(ctx, usersManager, s, logger, res); !ok {
+		return
+	}
+
+	if s.userID != userID {
+		writeErrorResponse(logger, res, http.StatusForbidden, "users can only create their own API keys")
+		return
+	}
+
+	parsedReq := CreateAPIKeyRequestBody{}
+	if !parseJSONBody(logger, res, req, &parsedReq) {
+		return
+	}
+
+	expiresAt := time.Time{}
+	if parsedReq.ExpiresAt != nil {
+		expiresAt = *parsedReq.ExpiresAt
+	}
+
+	key, token, err := apiKeys.Create(ctx, userID, parsedReq.Name, parsedReq.Scopes, expiresAt)
+	if err != nil {
+		if errors.Is(err, auth.InvalidAPIKeyParamErr) {
+			writeErrorResponse(logger, res, http.StatusBadRequest, err.Error())
+			return
+		}
+		internalServerError(logger, res, err)
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"user":   userID,
+		"apiKey": key.ID,
+		"scopes": key.Scopes,
+	}).Info("API key created")
+
+	// WHY: the key is shown only once, it must not be cached anywhere
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusCreated)
+	logResponseBodyWrite(logger, res, jsonResponse(CreateAPIKeyResponse{
+		APIKeyResponse: newAPIKeyResponse(key),
+		Key:            token,
+	}))
+}
+
+func listAPIKeys(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	requester, ok := authenticateRequester(ctx, usersManager, tokens, apiKeys, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if !authorizeUserAccess(authorizer, requester, userID, users.ReadUsersPermission, logger, res) {
+		return
+	}
+
+	keys, err := apiKeys.List(ctx, userID)
+	if err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+
+	listRes := ListAPIKeysResponse{APIKeys: make([]APIKeyResponse, len(keys))}
+	for i, key := range keys {
+		listRes.APIKeys[i] = newAPIKeyResponse(key)
+	}
+
+	res.WriteHeader(http.StatusOK)
+	logResponseBodyWrite(logger, res, jsonResponse(listRes))
+}
+
+func revokeAPIKey(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+	keyID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	requester, ok := authenticateRequester(ctx, usersManager, tokens, apiKeys, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if !authorizeUserAccess(authorizer, requester, userID, users.UpdateUsersPermission, logger, res) {
+		return
+	}
+
+	err := apiKeys.Revoke(ctx, userID, keyID)
+	if err != nil {
+		if errors.Is(err, auth.APIKeyNotFoundErr) {
+			notFound(logger, res, req)
+			return
+		}
+		internalServerError(logger, res, err)
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"user":      userID,
+		"apiKey":    keyID,
+		"requester": requester.id(),
+	}).Info("API key revoked")
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// parseItemPath parses subresources on the form {prefix}/{id},
+// where the ID is optional. It returns false if the subresource
+// doesn't have the given prefix.
+func parseItemPath(prefix string, subresource string) (string, bool) {
+	if subresource == prefix {
+		return "", true
+	}
+	itemID := strings.TrimPrefix(subresource, prefix+"/")
+	if itemID == subresource || itemID == "" || strings.Contains(itemID, "/") {
+		return "", false
+	}
+	return itemID, true
+}
+
+func newAPIKeyResponse(key auth.APIKey) APIKeyResponse {
+	scopes := key.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+	return APIKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Scopes:     scopes,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  optionalTime(key.ExpiresAt),
+		LastUsedAt: optionalTime(key.LastUsedAt),
+	}
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
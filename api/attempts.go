@@ -0,0 +1,206 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/manager"
+)
+
+func unlockUser(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	attempts *auth.SigninAttempts,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	requester, ok := authenticateRequester(ctx, usersManager, tokens, apiKeys, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if !authorize(authorizer, requester, users.SuspendUsersPermission, logger, res) {
+		return
+	}
+
+	user, err := usersManager.User(ctx, userID)
+	if err != nil {
+		if errors.Is(err, users.UserNotFoundErr) {
+			notFound(logger, res, req)
+			return
+		}
+		internalServerError(logger, res, err)
+		return
+	}
+
+	account := signinAccount(string(user.Email))
+	if err := attempts.Unlock(ctx, account); err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+
+	_, err = usersManager.UnlockUser(ctx, userID, "unlocked by "+requester.id())
+	if err != nil {
+		switch {
+		case errors.Is(err, users.InvalidStatusTransitionErr):
+			// WHY: unlocking users that are not locked by an administrator
+			// is not an error, they may just have a temporary lockout.
+		case errors.Is(err, users.VersionMismatchErr):
+			writeErrorResponse(logger, res, http.StatusConflict, "user has been modified concurrently")
+			return
+		case errors.Is(err, users.UserNotFoundErr):
+			notFound(logger, res, req)
+			return
+		default:
+			internalServerError(logger, res, err)
+			return
+		}
+	}
+
+	logger.WithFields(log.Fields{
+		"user":      userID,
+		"account":   account,
+		"requester": requester.id(),
+	}).Info("account unlocked")
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// beginSigninAttempt begins the sign in attempt if it is allowed, returning
+// for how long attempts are refused if it is not. Only unexpected errors
+// are returned, refused attempts are logged.
+func beginSigninAttempt(
+	ctx context.Context,
+	attempts *auth.SigninAttempts,
+	account string,
+	ip string,
+	logger *log.Entry,
+) (*auth.SigninAttempt, time.Duration, error) {
+	attempt, retryAfter, err := attempts.Begin(ctx, account, ip)
+	if err != nil {
+		if errors.Is(err, auth.TooManyAttemptsErr) {
+			logger.WithFields(log.Fields{
+				"account":     account,
+				"ip":          ip,
+				"retry_after": retryAfter.String(),
+				"error":       err.Error(),
+			}).Warning("sign in attempt refused")
+			return nil, retryAfter, nil
+		}
+		return nil, 0, err
+	}
+	return attempt, 0, nil
+}
+
+// allowSigninAttempt begins the sign in attempt if it is allowed, if it
+// isn't the error response is written on res and nil is returned.
+func allowSigninAttempt(
+	ctx context.Context,
+	attempts *auth.SigninAttempts,
+	account string,
+	ip string,
+	logger *log.Entry,
+	res http.ResponseWriter,
+) *auth.SigninAttempt {
+	attempt, retryAfter, err := beginSigninAttempt(ctx, attempts, account, ip, logger)
+	if err != nil {
+		internalServerError(logger, res, err)
+		return nil
+	}
+	if attempt == nil {
+		setRetryAfter(res, retryAfter)
+		writeErrorResponse(logger, res, http.StatusTooManyRequests, "too many failed sign in attempts, try again later")
+		return nil
+	}
+	return attempt
+}
+
+// signinFailed records a failed sign in attempt, logging if
+// the account got locked because of it.
+func signinFailed(
+	ctx context.Context,
+	attempts *auth.SigninAttempts,
+	attempt *auth.SigninAttempt,
+	account string,
+	ip string,
+	logger *log.Entry,
+) {
+	locked, err := attempts.Failed(ctx, attempt)
+	if err != nil {
+		// WHY: the attempt already failed, failing to record
+		// it should not change the response.
+		logger.WithFields(log.Fields{"error": err.Error()}).Error("recording failed sign in attempt")
+		return
+	}
+	if locked {
+		logger.WithFields(log.Fields{
+			"account": account,
+			"ip":      ip,
+		}).Warning("account locked after too many failed sign in attempts")
+	}
+}
+
+// signinSucceeded records a successful sign in attempt
+func signinSucceeded(ctx context.Context, attempts *auth.SigninAttempts, attempt *auth.SigninAttempt, logger *log.Entry) {
+	if err := attempts.Succeeded(ctx, attempt); err != nil {
+		logger.WithFields(log.Fields{"error": err.Error()}).Error("recording successful sign in attempt")
+	}
+}
+
+// releaseSigninAttempt releases a sign in attempt that neither
+// failed nor succeeded, like when an unexpected error happened.
+func releaseSigninAttempt(ctx context.Context, attempts *auth.SigninAttempts, attempt *auth.SigninAttempt, logger *log.Entry) {
+	if err := attempts.Release(ctx, attempt); err != nil {
+		logger.WithFields(log.Fields{"error": err.Error()}).Error("releasing sign in attempt")
+	}
+}
+
+// signinAccount identifies the account of sign in attempts by the email,
+// which doesn't need to be valid or to belong to an user.
+func signinAccount(email string) string {
+	// WHY: otherwise the limits could be bypassed just
+	// by changing the case of the email.
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// clientIP returns the IP of the client that sent the request. When the
+// service is behind a proxy the IP is taken from the configured header.
+func clientIP(req *http.Request, cfg Config) string {
+	if cfg.ClientIPHeader != "" {
+		// WHY: proxies append the IP they received the request from,
+		// previous entries are sent by the client and can't be trusted.
+		vals := strings.Split(req.Header.Get(cfg.ClientIPHeader), ",")
+		if ip := strings.TrimSpace(vals[len(vals)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// setRetryAfter sets the Retry-After header, in seconds (rounded up)
+func setRetryAfter(res http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	res.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
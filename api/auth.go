@@ -0,0 +1,852 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/webauthn"
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/manager"
+	"github.com/katcipis/stonks/users/mfa"
+	"github.com/katcipis/stonks/users/passkeys"
+	"github.com/katcipis/stonks/users/recovery"
+)
+
+// SigninRequestBody is the request body required to sign in
+type SigninRequestBody struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// SigninResponse is the response body when a sign in succeeds
+type SigninResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// MFAChallengeResponse is the response body when the password is valid
+// but the user has MFA enabled, the sign in must be completed by sending
+// the MFA token along with a code or a passkey assertion. The methods
+// are the second factors the user can use.
+type MFAChallengeResponse struct {
+	MFARequired bool     `json:"mfa_required"`
+	MFAToken    string   `json:"mfa_token"`
+	MFAMethods  []string `json:"mfa_methods"`
+}
+
+// SigninMFARequestBody is the request body required to complete a sign in
+// of users with MFA enabled, the code is either a TOTP code from their
+// authenticator app or one of their recovery codes. Instead of a code
+// an assertion of one of their passkeys can be sent.
+type SigninMFARequestBody struct {
+	MFAToken string                        `json:"mfa_token"`
+	Code     string                        `json:"code"`
+	Passkey  *webauthn.AssertionCredential `json:"passkey,omitempty"`
+}
+
+// TokenRequestBody is the request body required to obtain a new access
+// token using a refresh token.
+type TokenRequestBody struct {
+	GrantType    string `json:"grant_type"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// SignoutRequestBody is the optional request body of a sign out,
+// allowing to also revoke a refresh token.
+type SignoutRequestBody struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// PasswordResetRequestBody is the request body required to request a password reset
+type PasswordResetRequestBody struct {
+	Email string `json:"email"`
+}
+
+// PasswordResetConfirmRequestBody is the request body required to
+// confirm a password reset, choosing a new password.
+type PasswordResetConfirmRequestBody struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+const (
+	bearerTokenType       = "bearer"
+	refreshTokenGrantType = "refresh_token"
+
+	totpMFAMethod    = "totp"
+	passkeyMFAMethod = "passkey"
+)
+
+// session represents an authenticated request
+type session struct {
+	userID      string
+	accessToken string
+}
+
+// requester is who does an authenticated request, either an user or an
+// OAuth client using a token obtained with the client credentials grant.
+type requester struct {
+	user users.User
+
+	// clientID is only set for clients
+	clientID string
+
+	// scopes restrict the permissions of the requester when scoped.
+	// Clients are always scoped, users only when using scoped API keys.
+	scopes []string
+	scoped bool
+}
+
+func (r requester) isClient() bool {
+	return r.clientID != ""
+}
+
+// id identifies the requester on logs
+func (r requester) id() string {
+	if r.isClient() {
+		return "client:" + r.clientID
+	}
+	return r.user.ID
+}
+
+// hasPermission checks the permission using the role of users,
+// clients are only granted the permissions on their token scopes.
+func (r requester) hasPermission(authorizer *auth.Authorizer, perm users.Permission) bool {
+	if !r.hasScope(perm) {
+		return false
+	}
+	if r.isClient() {
+		return true
+	}
+	return authorizer.HasPermission(r.user.Role, perm)
+}
+
+// hasScope returns true if the requester is not scoped or
+// if the permission is granted by one of its scopes.
+func (r requester) hasScope(perm users.Permission) bool {
+	if !r.scoped {
+		return true
+	}
+	for _, scope := range r.scopes {
+		granted := users.Permission(scope)
+		if granted == perm || granted == users.AnyPermission {
+			return true
+		}
+	}
+	return false
+}
+
+func signinHandler(
+	usersManager *manager.Manager,
+	tokens *auth.Tokens,
+	refreshTokens *auth.RefreshTokens,
+	mfaAuth *mfa.MFA,
+	passkeysAuth *passkeys.Passkeys,
+	attempts *auth.SigninAttempts,
+	cfg Config,
+	logger *log.Entry,
+) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+		parsedReq := SigninRequestBody{}
+		if !parseJSONBody(logger, res, req, &parsedReq) {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.SigninTimeout)
+		defer cancel()
+
+		// WHY: attempts are checked before the password, even correct
+		// passwords are refused while the account is locked.
+		account := signinAccount(parsedReq.Email)
+		ip := clientIP(req, cfg)
+		attempt := allowSigninAttempt(ctx, attempts, account, ip, logger, res)
+		if attempt == nil {
+			return
+		}
+
+		user, err := authenticateUser(ctx, usersManager, parsedReq.Email, parsedReq.Password, logger)
+		if err != nil {
+			if errors.Is(err, users.InvalidCredentialsErr) {
+				signinFailed(ctx, attempts, attempt, account, ip, logger)
+				// WHY: the error details are not sent since they
+				// could reveal if the email belongs to a registered user.
+				writeErrorResponse(logger, res, http.StatusUnauthorized, "invalid email or password")
+				return
+			}
+			releaseSigninAttempt(ctx, attempts, attempt, logger)
+			writeSigninError(logger, res, err)
+			return
+		}
+
+		mfaEnabled, err := mfaAuth.Enabled(ctx, user.ID)
+		if err != nil {
+			releaseSigninAttempt(ctx, attempts, attempt, logger)
+			internalServerError(logger, res, err)
+			return
+		}
+		// WHY: the failures of the account are only forgotten after the
+		// second factor passes, otherwise knowing the password would
+		// allow guessing MFA codes without limits.
+		if mfaEnabled {
+			releaseSigninAttempt(ctx, attempts, attempt, logger)
+		} else {
+			signinSucceeded(ctx, attempts, attempt, logger)
+		}
+		completeSignin(ctx, tokens, refreshTokens, mfaAuth, passkeysAuth, user.ID, logger, res)
+	}
+}
+
+// completeSignin writes the response of users authenticated with their first
+// factor, which is an MFA challenge if they have MFA enabled or their tokens.
+func completeSignin(
+	ctx context.Context,
+	tokens *auth.Tokens,
+	refreshTokens *auth.RefreshTokens,
+	mfaAuth *mfa.MFA,
+	passkeysAuth *passkeys.Passkeys,
+	userID string,
+	logger *log.Entry,
+	res http.ResponseWriter,
+) {
+	mfaEnabled, err := mfaAuth.Enabled(ctx, userID)
+	if err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+
+	if !mfaEnabled {
+		writeSigninResponse(ctx, tokens, refreshTokens, userID, logger, res)
+		return
+	}
+
+	methods, err := mfaMethods(ctx, passkeysAuth, userID)
+	if err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+	challenge, err := mfaAuth.Challenge(ctx, userID)
+	if err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusOK)
+	logResponseBodyWrite(logger, res, jsonResponse(MFAChallengeResponse{
+		MFARequired: true,
+		MFAToken:    challenge,
+		MFAMethods:  methods,
+	}))
+}
+
+func signinMFAHandler(
+	usersManager *manager.Manager,
+	tokens *auth.Tokens,
+	refreshTokens *auth.RefreshTokens,
+	mfaAuth *mfa.MFA,
+	passkeysAuth *passkeys.Passkeys,
+	attempts *auth.SigninAttempts,
+	cfg Config,
+	logger *log.Entry,
+) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+		parsedReq := SigninMFARequestBody{}
+		if !parseJSONBody(logger, res, req, &parsedReq) {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.SigninTimeout)
+		defer cancel()
+
+		// WHY: the challenge is consumed on each attempt, even if the
+		// second factor is invalid.
+		userID, err := mfaAuth.ConsumeChallenge(ctx, parsedReq.MFAToken)
+		if err != nil {
+			if errors.Is(err, auth.InvalidTokenErr) {
+				writeErrorResponse(logger, res, http.StatusUnauthorized, "invalid or expired MFA token")
+				return
+			}
+			internalServerError(logger, res, err)
+			return
+		}
+
+		// WHY: the user may have been suspended or locked after
+		// the password was checked.
+		user, ok, err := activeUser(ctx, usersManager, userID)
+		if err != nil {
+			internalServerError(logger, res, err)
+			return
+		}
+		if !ok {
+			writeErrorResponse(logger, res, http.StatusForbidden, "user is not allowed to sign in")
+			return
+		}
+
+		// WHY: failed second factors count against the account, since
+		// a correct password can get new challenges without limits.
+		account := signinAccount(string(user.Email))
+		ip := clientIP(req, cfg)
+		attempt := allowSigninAttempt(ctx, attempts, account, ip, logger, res)
+		if attempt == nil {
+			return
+		}
+
+		if parsedReq.Passkey != nil {
+			err = verifyMFAPasskey(ctx, passkeysAuth, user.ID, *parsedReq.Passkey)
+		} else {
+			err = mfaAuth.VerifyCode(ctx, user.ID, parsedReq.Code)
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, mfa.InvalidCodeErr), errors.Is(err, mfa.NotEnrolledErr):
+				signinFailed(ctx, attempts, attempt, account, ip, logger)
+				logger.WithFields(log.Fields{"error": err.Error()}).Warning("invalid MFA code")
+				writeErrorResponse(logger, res, http.StatusUnauthorized, "invalid MFA code")
+			case errors.Is(err, passkeys.InvalidPasskeyErr):
+				signinFailed(ctx, attempts, attempt, account, ip, logger)
+				logger.WithFields(log.Fields{"error": err.Error()}).Warning("invalid MFA passkey")
+				writeErrorResponse(logger, res, http.StatusUnauthorized, "invalid passkey")
+			default:
+				releaseSigninAttempt(ctx, attempts, attempt, logger)
+				internalServerError(logger, res, err)
+			}
+			return
+		}
+
+		signinSucceeded(ctx, attempts, attempt, logger)
+		writeSigninResponse(ctx, tokens, refreshTokens, user.ID, logger, res)
+	}
+}
+
+func tokenHandler(
+	usersManager *manager.Manager,
+	tokens *auth.Tokens,
+	refreshTokens *auth.RefreshTokens,
+	cfg Config,
+	logger *log.Entry,
+) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+		parsedReq := TokenRequestBody{}
+		if !parseJSONBody(logger, res, req, &parsedReq) {
+			return
+		}
+
+		if parsedReq.GrantType != refreshTokenGrantType {
+			msg := fmt.Sprintf("unsupported grant type %q", parsedReq.GrantType)
+			writeErrorResponse(logger, res, http.StatusBadRequest, msg)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		defer cancel()
+
+		userID, refreshToken, err := refreshTokens.Rotate(ctx, parsedReq.RefreshToken)
+		if err != nil {
+			switch {
+			case errors.Is(err, auth.RefreshTokenReusedErr):
+				logger.WithFields(log.Fields{"error": err.Error()}).Warning("refresh token reused")
+				writeErrorResponse(logger, res, http.StatusUnauthorized, "invalid or expired refresh token")
+			case errors.Is(err, auth.InvalidTokenErr):
+				writeErrorResponse(logger, res, http.StatusUnauthorized, "invalid or expired refresh token")
+			default:
+				internalServerError(logger, res, err)
+			}
+			return
+		}
+
+		user, ok, err := activeUser(ctx, usersManager, userID)
+		if err != nil {
+			internalServerError(logger, res, err)
+			return
+		}
+		if !ok {
+			// WHY: refresh tokens may outlive the user access to the service
+			if err := refreshTokens.Revoke(ctx, refreshToken); err != nil {
+				internalServerError(logger, res, err)
+				return
+			}
+			writeErrorResponse(logger, res, http.StatusUnauthorized, "invalid or expired refresh token")
+			return
+		}
+
+		token, err := tokens.Create(ctx, user.ID)
+		if err != nil {
+			internalServerError(logger, res, err)
+			return
+		}
+
+		res.WriteHeader(http.StatusCreated)
+		logResponseBodyWrite(logger, res, jsonResponse(SigninResponse{
+			AccessToken:  token.AccessToken,
+			TokenType:    bearerTokenType,
+			ExpiresIn:    int64(token.ExpiresIn.Seconds()),
+			RefreshToken: refreshToken,
+		}))
+	}
+}
+
+func signoutHandler(tokens *auth.Tokens, refreshTokens *auth.RefreshTokens, cfg Config, logger *log.Entry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		defer cancel()
+
+		s, ok := authenticate(ctx, tokens, logger, res, req)
+		if !ok {
+			return
+		}
+
+		// WHY: the body is optional, clients without
+		// refresh tokens can sign out without one.
+		parsedReq := SignoutRequestBody{}
+		if req.ContentLength != 0 && !parseJSONBody(logger, res, req, &parsedReq) {
+			return
+		}
+
+		err := tokens.Revoke(ctx, s.accessToken)
+		if err != nil {
+			internalServerError(logger, res, err)
+			return
+		}
+
+		if parsedReq.RefreshToken != "" {
+			err := refreshTokens.Revoke(ctx, parsedReq.RefreshToken)
+			if err != nil {
+				internalServerError(logger, res, err)
+				return
+			}
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func passwordResetHandler(rec *recovery.Recovery, cfg Config, logger *log.Entry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+		parsedReq := PasswordResetRequestBody{}
+		if !parseJSONBody(logger, res, req, &parsedReq) {
+			return
+		}
+
+		if _, err := users.ParseEmail(parsedReq.Email); err != nil {
+			writeErrorResponse(logger, res, http.StatusBadRequest, fmt.Sprintf("invalid email: %v", err))
+			return
+		}
+
+		// WHY: the reset is requested in the background, otherwise
+		// the response time would reveal if the email belongs to
+		// a registered user (no email is sent otherwise).
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+			defer cancel()
+
+			err := rec.RequestPasswordReset(ctx, parsedReq.Email)
+			if err != nil {
+				logger.WithFields(log.Fields{"error": err.Error()}).Error("requesting password reset")
+			}
+		}()
+
+		res.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func passwordResetConfirmHandler(
+	rec *recovery.Recovery,
+	tokens *auth.Tokens,
+	refreshTokens *auth.RefreshTokens,
+	apiKeys *auth.APIKeys,
+	cfg Config,
+	logger *log.Entry,
+) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+		parsedReq := PasswordResetConfirmRequestBody{}
+		if !parseJSONBody(logger, res, req, &parsedReq) {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		defer cancel()
+
+		userID, err := rec.ResetPassword(ctx, parsedReq.Token, parsedReq.NewPassword)
+		if err != nil {
+			switch {
+			case errors.Is(err, users.InvalidUserParamErr):
+				invalidUserParam(logger, res, err)
+			case errors.Is(err, auth.InvalidTokenErr), errors.Is(err, users.UserNotFoundErr):
+				writeErrorResponse(logger, res, http.StatusBadRequest, "invalid or expired password reset token")
+			default:
+				internalServerError(logger, res, err)
+			}
+			return
+		}
+
+		// WHY: whoever had access to the account before the
+		// reset should not keep it.
+		err = revokeUserTokens(ctx, tokens, refreshTokens, userID, "")
+		if err != nil {
+			internalServerError(logger, res, err)
+			return
+		}
+		if err := apiKeys.RevokeUserKeys(ctx, userID); err != nil {
+			internalServerError(logger, res, err)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func jwksHandler(keys *auth.KeyRing, logger *log.Entry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+
+		// WHY: allowing caches avoids other services fetching the keys
+		// for every token they verify. Keys must be published for longer
+		// than this before they are used to sign tokens.
+		res.Header().Set("Cache-Control", "public, max-age=300")
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		logResponseBodyWrite(logger, res, jsonResponse(keys.JWKS()))
+	}
+}
+
+// authenticateUser authenticates the user with its password just like
+// manager.Authenticate, but failures to upgrade outdated password hashes
+// are only logged since they don't fail the authentication.
+func authenticateUser(
+	ctx context.Context,
+	usersManager *manager.Manager,
+	email string,
+	password string,
+	logger *log.Entry,
+) (users.User, error) {
+	user, err := usersManager.Authenticate(ctx, email, password)
+	if errors.Is(err, users.PasswordRehashErr) {
+		logger.WithFields(log.Fields{
+			"user":  user.ID,
+			"error": err.Error(),
+		}).Error("upgrading outdated password hash")
+		return user, nil
+	}
+	return user, err
+}
+
+// writeSigninError writes the response of users that can't sign in
+// because of their status, any other error is an internal error.
+func writeSigninError(logger *log.Entry, res http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, users.UserNotVerifiedErr):
+		writeErrorResponse(logger, res, http.StatusForbidden, "email not verified")
+	case errors.Is(err, users.UserSuspendedErr):
+		writeErrorResponse(logger, res, http.StatusForbidden, "user suspended")
+	case errors.Is(err, users.UserLockedErr):
+		writeErrorResponse(logger, res, http.StatusForbidden, "user locked")
+	default:
+		internalServerError(logger, res, err)
+	}
+}
+
+// writeSigninResponse creates the access and refresh tokens
+// of a signed in user and writes them on the response.
+func writeSigninResponse(
+	ctx context.Context,
+	tokens *auth.Tokens,
+	refreshTokens *auth.RefreshTokens,
+	userID string,
+	logger *log.Entry,
+	res http.ResponseWriter,
+) {
+	token, err := tokens.Create(ctx, userID)
+	if err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+
+	refreshToken, err := refreshTokens.Create(ctx, userID)
+	if err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+
+	res.WriteHeader(http.StatusCreated)
+	logResponseBodyWrite(logger, res, jsonResponse(SigninResponse{
+		AccessToken:  token.AccessToken,
+		TokenType:    bearerTokenType,
+		ExpiresIn:    int64(token.ExpiresIn.Seconds()),
+		RefreshToken: refreshToken,
+	}))
+}
+
+// revokeUserTokens revokes all access and refresh tokens of the user,
+// except for the access token to keep (if any).
+func revokeUserTokens(
+	ctx context.Context,
+	tokens *auth.Tokens,
+	refreshTokens *auth.RefreshTokens,
+	userID string,
+	keepAccessToken string,
+) error {
+	if err := tokens.RevokeUserTokens(ctx, userID, keepAccessToken); err != nil {
+		return err
+	}
+	return refreshTokens.RevokeUserTokens(ctx, userID)
+}
+
+// authenticate authenticates the request using the bearer token sent on
+// the Authorization header, as specified on RFC 6750.
+// If the authentication fails the error response is written on res and
+// false is returned, the caller should not write anything else on res.
+func authenticate(
+	ctx context.Context,
+	tokens *auth.Tokens,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+) (session, bool) {
+	// WHY: API keys are not accepted for session only operations,
+	// like signing out or changing the password.
+	accessToken, info, ok := introspectBearerToken(ctx, tokens, nil, logger, res, req)
+	if !ok {
+		return session{}, false
+	}
+
+	// WHY: client tokens are not owned by an user, they can only
+	// be used on endpoints that authenticate requesters.
+	if info.UserID == "" {
+		res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeErrorResponse(logger, res, http.StatusUnauthorized, "bearer token is not owned by an user")
+		return session{}, false
+	}
+
+	// WHY: tokens delegated to OAuth clients are restricted to their
+	// scopes, they can't act as a session of the user.
+	if len(info.Scopes) > 0 {
+		res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeErrorResponse(logger, res, http.StatusUnauthorized, "bearer token is restricted to scopes")
+		return session{}, false
+	}
+
+	return session{
+		userID:      info.UserID,
+		accessToken: accessToken,
+	}, true
+}
+
+// authenticateRequester authenticates the request, accepting user tokens,
+// client tokens and API keys. For users it also retrieves the user, failing
+// if the user is not allowed to access the service anymore.
+func authenticateRequester(
+	ctx context.Context,
+	usersManager *manager.Manager,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+) (requester, bool) {
+	accessToken, info, ok := introspectBearerToken(ctx, tokens, apiKeys, logger, res, req)
+	if !ok {
+		return requester{}, false
+	}
+
+	if info.UserID == "" {
+		return requester{clientID: info.ClientID, scopes: info.Scopes, scoped: true}, true
+	}
+
+	user, ok := sessionUser(ctx, usersManager, session{userID: info.UserID, accessToken: accessToken}, logger, res)
+	if !ok {
+		return requester{}, false
+	}
+	return requester{user: user, scopes: info.Scopes, scoped: len(info.Scopes) > 0}, true
+}
+
+// introspectBearerToken validates the bearer token of the request, which
+// may also be an API key if apiKeys is not nil.
+// If it fails the error response is written on res and false is returned.
+func introspectBearerToken(
+	ctx context.Context,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+) (string, auth.TokenInfo, bool) {
+	accessToken, ok := bearerToken(req)
+	if !ok {
+		// From: https://tools.ietf.org/html/rfc6750#section-3.1
+		// If the request lacks any authentication information the
+		// response should not include an error code.
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		writeErrorResponse(logger, res, http.StatusUnauthorized, "missing bearer token on Authorization header")
+		return "", auth.TokenInfo{}, false
+	}
+
+	introspect := tokens.Introspect
+	if auth.IsAPIKey(accessToken) {
+		if apiKeys == nil {
+			res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeErrorResponse(logger, res, http.StatusUnauthorized, "API keys can't be used on this endpoint")
+			return "", auth.TokenInfo{}, false
+		}
+		introspect = apiKeys.Introspect
+	}
+
+	// WHY: API keys are introspected with a read and a write on the
+	// database, which should not be done twice for the same request.
+	if info, ok := introspectedToken(req, accessToken); ok {
+		return accessToken, info, true
+	}
+
+	info, err := introspect(ctx, accessToken)
+	if err != nil {
+		if errors.Is(err, auth.InvalidTokenErr) {
+			res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeErrorResponse(logger, res, http.StatusUnauthorized, "invalid or expired bearer token")
+			return "", auth.TokenInfo{}, false
+		}
+		internalServerError(logger, res, err)
+		return "", auth.TokenInfo{}, false
+	}
+	return accessToken, info, true
+}
+
+// sessionUser retrieves the user of the session, failing if the user
+// is not allowed to access the service anymore.
+// If it fails the error response is written on res and false is returned.
+func sessionUser(
+	ctx context.Context,
+	usersManager *manager.Manager,
+	s session,
+	logger *log.Entry,
+	res http.ResponseWriter,
+) (users.User, bool) {
+	user, err := usersManager.User(ctx, s.userID)
+	if err != nil {
+		// WHY: tokens may outlive the user they were issued for
+		if errors.Is(err, users.UserNotFoundErr) {
+			res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeErrorResponse(logger, res, http.StatusUnauthorized, "invalid or expired bearer token")
+			return users.User{}, false
+		}
+		internalServerError(logger, res, err)
+		return users.User{}, false
+	}
+
+	// WHY: tokens may have been issued before the user was suspended or locked
+	if err := user.Status.CheckAccess(); err != nil {
+		res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeErrorResponse(logger, res, http.StatusUnauthorized, err.Error())
+		return users.User{}, false
+	}
+	return user, true
+}
+
+// activeUser retrieves the user with the given ID, returning false if the
+// user doesn't exist anymore or is not allowed to access the service.
+func activeUser(ctx context.Context, usersManager *manager.Manager, userID string) (users.User, bool, error) {
+	user, err := usersManager.User(ctx, userID)
+	if err != nil {
+		if errors.Is(err, users.UserNotFoundErr) {
+			return users.User{}, false, nil
+		}
+		return users.User{}, false, err
+	}
+	if err := user.Status.CheckAccess(); err != nil {
+		return users.User{}, false, nil
+	}
+	return user, true, nil
+}
+
+// authorize checks if the requester has the given permission.
+// If the requester doesn't have the permission the error response
+// is written on res and false is returned.
+func authorize(
+	authorizer *auth.Authorizer,
+	r requester,
+	perm users.Permission,
+	logger *log.Entry,
+	res http.ResponseWriter,
+) bool {
+	if !r.hasScope(perm) {
+		// WHY: as defined on: https://tools.ietf.org/html/rfc6750#section-3.1
+		res.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, perm))
+		writeErrorResponse(logger, res, http.StatusForbidden, fmt.Sprintf("token lacks scope %q", perm))
+		return false
+	}
+	if r.hasPermission(authorizer, perm) {
+		return true
+	}
+	msg := fmt.Sprintf("user lacks permission %q", perm)
+	writeErrorResponse(logger, res, http.StatusForbidden, msg)
+	return false
+}
+
+// authorizeUserAccess checks if the requester can access the resources of
+// the user with the given ID. Users can always access their own resources,
+// accessing resources of other users requires the given permission.
+// Scoped API keys still need the permission scope for their own resources.
+func authorizeUserAccess(
+	authorizer *auth.Authorizer,
+	r requester,
+	userID string,
+	perm users.Permission,
+	logger *log.Entry,
+	res http.ResponseWriter,
+) bool {
+	if !r.isClient() && r.user.ID == userID && r.hasScope(perm) {
+		return true
+	}
+	return authorize(authorizer, r, perm, logger, res)
+}
+
+// bearerToken extracts the bearer token from the Authorization header
+// as defined on: https://tools.ietf.org/html/rfc6750#section-2.1
+func bearerToken(req *http.Request) (string, bool) {
+	const scheme = "bearer "
+
+	header := req.Header.Get("Authorization")
+	if len(header) <= len(scheme) {
+		return "", false
+	}
+	// WHY: auth schemes are case insensitive, as defined on:
+	// https://tools.ietf.org/html/rfc7235#section-2.1
+	if !strings.EqualFold(header[:len(scheme)], scheme) {
+		return "", false
+	}
+	token := strings.TrimSpace(header[len(scheme):])
+	return token, token != ""
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/magiclink"
+	"github.com/katcipis/stonks/users/mfa"
+	"github.com/katcipis/stonks/users/passkeys"
+)
+
+// MagicLinkRequestBody is the request body required to request a magic link
+type MagicLinkRequestBody struct {
+	Email string `json:"email"`
+}
+
+// MagicLinkConfirmRequestBody is the request body required to sign in
+// with the token sent on a magic link.
+type MagicLinkConfirmRequestBody struct {
+	Token string `json:"token"`
+}
+
+func magicLinkHandler(links *magiclink.MagicLink, cfg Config, logger *log.Entry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+		parsedReq := MagicLinkRequestBody{}
+		if !parseJSONBody(logger, res, req, &parsedReq) {
+			return
+		}
+
+		if _, err := users.ParseEmail(parsedReq.Email); err != nil {
+			writeErrorResponse(logger, res, http.StatusBadRequest, fmt.Sprintf("invalid email: %v", err))
+			return
+		}
+
+		// WHY: the link is requested in the background, otherwise
+		// the response time would reveal if the email belongs to
+		// a registered user (no email is sent otherwise).
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+			defer cancel()
+
+			err := links.RequestLink(ctx, parsedReq.Email)
+			if err != nil {
+				logger.WithFields(log.Fields{"error": err.Error()}).Error("requesting magic link")
+			}
+		}()
+
+		res.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func magicLinkConfirmHandler(
+	links *magiclink.MagicLink,
+	tokens *auth.Tokens,
+	refreshTokens *auth.RefreshTokens,
+	mfaAuth *mfa.MFA,
+	passkeysAuth *passkeys.Passkeys,
+	cfg Config,
+	logger *log.Entry,
+) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+		parsedReq := MagicLinkConfirmRequestBody{}
+		if !parseJSONBody(logger, res, req, &parsedReq) {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.SigninTimeout)
+		defer cancel()
+
+		user, err := links.Signin(ctx, parsedReq.Token)
+		if err != nil {
+			if errors.Is(err, auth.InvalidTokenErr) || errors.Is(err, users.UserNotFoundErr) {
+				writeErrorResponse(logger, res, http.StatusUnauthorized, "invalid or expired magic link")
+				return
+			}
+			writeSigninError(logger, res, err)
+			return
+		}
+
+		// WHY: the magic link only replaces the password,
+		// users with MFA enabled still need their second factor.
+		completeSignin(ctx, tokens, refreshTokens, mfaAuth, passkeysAuth, user.ID, logger, res)
+	}
+}
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/manager"
+	"github.com/katcipis/stonks/users/mfa"
+)
+
+// MFAStatusResponse is the response body when the MFA status of an user is retrieved
+type MFAStatusResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+// EnrollTOTPResponse is the response body when a TOTP enrollment is started,
+// the URI is usually shown as a QR code to be scanned by authenticator apps.
+type EnrollTOTPResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// ConfirmTOTPRequestBody is the request body required to confirm a TOTP enrollment
+type ConfirmTOTPRequestBody struct {
+	Code string `json:"code"`
+}
+
+// ConfirmTOTPResponse is the response body when a TOTP enrollment is confirmed,
+// the recovery codes are only available on this response.
+type ConfirmTOTPResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func userMFA(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	mfaAuth *mfa.MFA,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+	subresource string,
+) {
+	switch {
+	case subresource == "mfa" && req.Method == http.MethodGet:
+		getMFAStatus(usersManager, authorizer, tokens, apiKeys, mfaAuth, cfg, logger, res, req, userID)
+	case subresource == "mfa" && req.Method == http.MethodDelete:
+		resetMFA(usersManager, authorizer, tokens, apiKeys, mfaAuth, cfg, logger, res, req, userID)
+	case subresource == "mfa/totp" && req.Method == http.MethodPost:
+		enrollTOTP(usersManager, tokens, mfaAuth, cfg, logger, res, req, userID)
+	case subresource == "mfa/totp/confirm" && req.Method == http.MethodPost:
+		confirmTOTP(usersManager, tokens, mfaAuth, cfg, logger, res, req, userID)
+	default:
+		methodNotAllowed(logger, res, req)
+	}
+}
+
+func getMFAStatus(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	mfaAuth *mfa.MFA,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	requester, ok := authenticateRequester(ctx, usersManager, tokens, apiKeys, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if !authorizeUserAccess(authorizer, requester, userID, users.ReadUsersPermission, logger, res) {
+		return
+	}
+
+	enabled, err := mfaAuth.Enabled(ctx, userID)
+	if err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+	logResponseBodyWrite(logger, res, jsonResponse(MFAStatusResponse{Enabled: enabled}))
+}
+
+func enrollTOTP(
+	usersManager *manager.Manager,
+	tokens *auth.Tokens,
+	mfaAuth *mfa.MFA,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	s, ok := authenticate(ctx, tokens, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if _, ok := sessionUser(ctx, usersManager, s, logger, res); !ok {
+		return
+	}
+
+	if s.userID != userID {
+		writeErrorResponse(logger, res, http.StatusForbidden, "users can only enroll MFA for themselves")
+		return
+	}
+
+	enrollment, err := mfaAuth.Enroll(ctx, userID)
+	if err != nil {
+		if errors.Is(err, mfa.AlreadyEnabledErr) {
+			writeErrorResponse(logger, res, http.StatusConflict, "MFA is already enabled")
+			return
+		}
+		internalServerError(logger, res, err)
+		return
+	}
+
+	// WHY: the secret must not be cached anywhere
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusCreated)
+	logResponseBodyWrite(logger, res, jsonResponse(EnrollTOTPResponse{
+		Secret: enrollment.Secret,
+		URI:    enrollment.URI,
+	}))
+}
+
+func confirmTOTP(
+	usersManager *manager.Manager,
+	tokens *auth.Tokens,
+	mfaAuth *mfa.MFA,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	s, ok := authenticate(ctx, tokens, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if _, ok := sessionUser(ctx, usersManager, s, logger, res); !ok {
+		return
+	}
+
+	if s.userID != userID {
+		writeErrorResponse(logger, res, http.StatusForbidden, "users can only enroll MFA for themselves")
+		return
+	}
+
+	parsedReq := ConfirmTOTPRequestBody{}
+	if !parseJSONBody(logger, res, req, &parsedReq) {
+		return
+	}
+
+	recoveryCodes, err := mfaAuth.Confirm(ctx, userID, parsedReq.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, mfa.InvalidCodeErr):
+			writeErrorResponse(logger, res, http.StatusBadRequest, "invalid MFA code")
+		case errors.Is(err, mfa.NotEnrolledErr):
+			writeErrorResponse(logger, res, http.StatusConflict, "there is no pending MFA enrollment")
+		case errors.Is(err, mfa.AlreadyEnabledErr):
+			writeErrorResponse(logger, res, http.StatusConflict, "MFA is already enabled")
+		default:
+			internalServerError(logger, res, err)
+		}
+		return
+	}
+
+	logger.WithFields(log.Fields{"user": userID}).Info("MFA enabled")
+
+	// WHY: the recovery codes are shown only once, they must not be cached anywhere
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusOK)
+	logResponseBodyWrite(logger, res, jsonResponse(ConfirmTOTPResponse{RecoveryCodes: recoveryCodes}))
+}
+
+func resetMFA(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	mfaAuth *mfa.MFA,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	requester, ok := authenticateRequester(ctx, usersManager, tokens, apiKeys, logger, res, req)
+	if !ok {
+		return
+	}
+
+	// WHY: users can't disable their own MFA, otherwise a stolen
+	// session would be enough to remove the second factor.
+	if !authorize(authorizer, requester, users.ResetMFAPermission, logger, res) {
+		return
+	}
+
+	err := mfaAuth.Reset(ctx, userID)
+	if err != nil {
+		if errors.Is(err, mfa.NotEnrolledErr) {
+			notFound(logger, res, req)
+			return
+		}
+		internalServerError(logger, res, err)
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"user":      userID,
+		"requester": requester.id(),
+	}).Info("MFA reset")
+
+	res.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,487 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/oauth"
+	"github.com/katcipis/stonks/oauth/clients"
+	"github.com/katcipis/stonks/oauth/oidc"
+	"github.com/katcipis/stonks/users/manager"
+)
+
+// OAuthErrorResponse is the response body of failed OAuth requests, as
+// defined on: https://tools.ietf.org/html/rfc6749#section-5.2
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// IntrospectionResponse is the response body of a token introspection,
+// as defined on: https://tools.ietf.org/html/rfc7662#section-2.2
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Subject   string `json:"sub,omitempty"`
+	Username  string `json:"username,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// OAuthTokenResponse is the response body of a successful OAuth token
+// request, as defined on: https://tools.ietf.org/html/rfc6749#section-5.1
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+const (
+	refreshTokenTypeHint       = "refresh_token"
+	authorizationCodeGrantType = "authorization_code"
+	clientCredentialsGrantType = "client_credentials"
+)
+
+// oauthTokenHandler handles the OAuth token endpoint. The authorization
+// code grant is only supported if the OpenID Connect provider is
+// configured, so provider may be nil.
+func oauthTokenHandler(
+	oauthClients *clients.Clients,
+	tokens *auth.Tokens,
+	provider *oidc.Provider,
+	cfg Config,
+	logger *log.Entry,
+) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+		if err := req.ParseForm(); err != nil {
+			writeOAuthError(logger, res, http.StatusBadRequest, "invalid_request", "invalid form encoded body")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		defer cancel()
+
+		grantType := req.PostForm.Get("grant_type")
+		switch {
+		case grantType == clientCredentialsGrantType:
+			clientCredentialsGrant(ctx, oauthClients, tokens, logger, res, req)
+		case grantType == authorizationCodeGrantType && provider != nil:
+			authorizationCodeGrant(ctx, provider, logger, res, req)
+		default:
+			writeOAuthError(logger, res, http.StatusBadRequest, "unsupported_grant_type", "unsupported grant type "+grantType)
+		}
+	}
+}
+
+// clientCredentialsGrant issues a client token, restricted to the
+// requested scopes, as defined on: https://tools.ietf.org/html/rfc6749#section-4.4
+func clientCredentialsGrant(
+	ctx context.Context,
+	oauthClients *clients.Clients,
+	tokens *auth.Tokens,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+) {
+	client, ok := authenticateClient(ctx, oauthClients, logger, res, req)
+	if !ok {
+		return
+	}
+
+	scopes, err := client.GrantScopes(oauth.ParseScope(req.PostForm.Get("scope")))
+	if err != nil {
+		writeOAuthError(logger, res, http.StatusBadRequest, oauthErrorCode(err), err.Error())
+		return
+	}
+
+	// WHY: no refresh token is issued since the client can
+	// just authenticate again, as recommended on:
+	// https://tools.ietf.org/html/rfc6749#section-4.4.3
+	token, err := tokens.CreateClientToken(ctx, client.ID, scopes)
+	if err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"client": client.ID,
+		"scopes": scopes,
+	}).Info("client token issued")
+
+	writeOAuthTokenResponse(logger, res, OAuthTokenResponse{
+		AccessToken: token.AccessToken,
+		TokenType:   bearerTokenType,
+		ExpiresIn:   int64(token.ExpiresIn.Seconds()),
+		Scope:       oauth.FormatScope(scopes),
+	})
+}
+
+// authorizationCodeGrant exchanges an authorization code obtained on the
+// OpenID Connect authorization endpoint for tokens.
+func authorizationCodeGrant(
+	ctx context.Context,
+	provider *oidc.Provider,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+) {
+	clientID, secret, ok := clientCredentials(logger, res, req)
+	if !ok {
+		return
+	}
+
+	token, err := provider.Exchange(ctx, oidc.TokenRequest{
+		ClientID:     clientID,
+		ClientSecret: secret,
+		Code:         req.PostForm.Get("code"),
+		RedirectURI:  req.PostForm.Get("redirect_uri"),
+		CodeVerifier: req.PostForm.Get("code_verifier"),
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, oauth.InvalidClientErr):
+			res.Header().Set("WWW-Authenticate", "Basic")
+			writeOAuthError(logger, res, http.StatusUnauthorized, oauthErrorCode(err), "client authentication failed")
+		case errors.Is(err, oauth.InvalidGrantErr):
+			writeOAuthError(logger, res, http.StatusBadRequest, oauthErrorCode(err), "invalid or expired authorization code")
+		default:
+			internalServerError(logger, res, err)
+		}
+		return
+	}
+
+	writeOAuthTokenResponse(logger, res, OAuthTokenResponse{
+		AccessToken: token.AccessToken,
+		TokenType:   bearerTokenType,
+		ExpiresIn:   int64(token.ExpiresIn.Seconds()),
+		IDToken:     token.IDToken,
+		Scope:       token.Scope,
+	})
+}
+
+func introspectHandler(
+	usersManager *manager.Manager,
+	oauthClients *clients.Clients,
+	tokens *auth.Tokens,
+	refreshTokens *auth.RefreshTokens,
+	cfg Config,
+	logger *log.Entry,
+) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		defer cancel()
+
+		client, ok := authenticateClient(ctx, oauthClients, logger, res, req)
+		if !ok {
+			return
+		}
+
+		token := req.PostForm.Get("token")
+		if token == "" {
+			writeOAuthError(logger, res, http.StatusBadRequest, "invalid_request", "missing token")
+			return
+		}
+
+		// WHY: introspection responses must not be cached, as defined on:
+		// https://tools.ietf.org/html/rfc7662#section-4
+		res.Header().Set("Cache-Control", "no-store")
+		res.Header().Set("Content-Type", "application/json")
+
+		info, tokenType, err := introspectToken(ctx, tokens, refreshTokens, token, req.PostForm.Get("token_type_hint"))
+		if err != nil {
+			if errors.Is(err, auth.InvalidTokenErr) {
+				res.WriteHeader(http.StatusOK)
+				logResponseBodyWrite(logger, res, jsonResponse(IntrospectionResponse{Active: false}))
+				return
+			}
+			internalServerError(logger, res, err)
+			return
+		}
+
+		// WHY: only gateways may introspect tokens of other clients
+		// or users, which are handled like invalid tokens as allowed on:
+		// https://tools.ietf.org/html/rfc7662#section-2.2
+		if !client.CanHandleToken(info.ClientID) {
+			logger.WithFields(log.Fields{
+				"client":      client.ID,
+				"tokenClient": info.ClientID,
+			}).Warn("client not allowed to introspect token")
+
+			res.WriteHeader(http.StatusOK)
+			logResponseBodyWrite(logger, res, jsonResponse(IntrospectionResponse{Active: false}))
+			return
+		}
+
+		if info.UserID == "" {
+			logger.WithFields(log.Fields{
+				"client":      client.ID,
+				"tokenClient": info.ClientID,
+			}).Debug("client token introspected")
+
+			res.WriteHeader(http.StatusOK)
+			logResponseBodyWrite(logger, res, jsonResponse(IntrospectionResponse{
+				Active:    true,
+				Subject:   info.ClientID,
+				ClientID:  info.ClientID,
+				Scope:     oauth.FormatScope(info.Scopes),
+				TokenType: tokenType,
+				IssuedAt:  unixTime(info.IssuedAt),
+				ExpiresAt: unixTime(info.ExpiresAt),
+			}))
+			return
+		}
+
+		user, ok, err := activeUser(ctx, usersManager, info.UserID)
+		if err != nil {
+			internalServerError(logger, res, err)
+			return
+		}
+		if !ok {
+			// WHY: tokens may outlive the user access to the service
+			res.WriteHeader(http.StatusOK)
+			logResponseBodyWrite(logger, res, jsonResponse(IntrospectionResponse{Active: false}))
+			return
+		}
+
+		logger.WithFields(log.Fields{
+			"client": client.ID,
+			"user":   user.ID,
+		}).Debug("token introspected")
+
+		res.WriteHeader(http.StatusOK)
+		logResponseBodyWrite(logger, res, jsonResponse(IntrospectionResponse{
+			Active:    true,
+			Subject:   user.ID,
+			Username:  string(user.Email),
+			TokenType: tokenType,
+			IssuedAt:  unixTime(info.IssuedAt),
+			ExpiresAt: unixTime(info.ExpiresAt),
+		}))
+	}
+}
+
+func revokeHandler(
+	oauthClients *clients.Clients,
+	tokens *auth.Tokens,
+	refreshTokens *auth.RefreshTokens,
+	cfg Config,
+	logger *log.Entry,
+) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		defer cancel()
+
+		client, ok := authenticateClient(ctx, oauthClients, logger, res, req)
+		if !ok {
+			return
+		}
+
+		token := req.PostForm.Get("token")
+		if token == "" {
+			writeOAuthError(logger, res, http.StatusBadRequest, "invalid_request", "missing token")
+			return
+		}
+
+		info, tokenType, err := introspectToken(ctx, tokens, refreshTokens, token, req.PostForm.Get("token_type_hint"))
+		if err != nil {
+			// WHY: revoking an invalid token is not an error, as defined on:
+			// https://tools.ietf.org/html/rfc7009#section-2.2
+			if errors.Is(err, auth.InvalidTokenErr) {
+				res.WriteHeader(http.StatusOK)
+				return
+			}
+			internalServerError(logger, res, err)
+			return
+		}
+
+		// WHY: clients can only revoke the tokens issued to them, as
+		// defined on: https://tools.ietf.org/html/rfc7009#section-2.1
+		if !client.CanHandleToken(info.ClientID) {
+			logger.WithFields(log.Fields{
+				"client":      client.ID,
+				"tokenClient": info.ClientID,
+			}).Warn("client not allowed to revoke token")
+
+			writeOAuthError(logger, res, http.StatusBadRequest, "unauthorized_client", "token not issued to the client")
+			return
+		}
+
+		revoke := tokens.Revoke
+		if tokenType == refreshTokenTypeHint {
+			revoke = refreshTokens.Revoke
+		}
+		if err := revoke(ctx, token); err != nil {
+			internalServerError(logger, res, err)
+			return
+		}
+
+		logger.WithFields(log.Fields{"client": client.ID}).Info("token revoked")
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+// introspectToken introspects the token as the hinted type first,
+// falling back to the other type, as defined on:
+// https://tools.ietf.org/html/rfc7662#section-2.1
+func introspectToken(
+	ctx context.Context,
+	tokens *auth.Tokens,
+	refreshTokens *auth.RefreshTokens,
+	token string,
+	hint string,
+) (auth.TokenInfo, string, error) {
+	type introspector struct {
+		tokenType  string
+		introspect func(context.Context, string) (auth.TokenInfo, error)
+	}
+
+	introspectors := []introspector{
+		{tokenType: bearerTokenType, introspect: tokens.Introspect},
+		{tokenType: refreshTokenTypeHint, introspect: refreshTokens.Introspect},
+	}
+	if hint == refreshTokenTypeHint {
+		introspectors[0], introspectors[1] = introspectors[1], introspectors[0]
+	}
+
+	for _, i := range introspectors {
+		info, err := i.introspect(ctx, token)
+		if err == nil {
+			return info, i.tokenType, nil
+		}
+		if !errors.Is(err, auth.InvalidTokenErr) {
+			return auth.TokenInfo{}, "", err
+		}
+	}
+	return auth.TokenInfo{}, "", auth.InvalidTokenErr
+}
+
+// authenticateClient authenticates the OAuth client using HTTP Basic
+// authentication or the client credentials sent on the form encoded
+// request body, as defined on:
+// https://tools.ietf.org/html/rfc6749#section-2.3.1
+// It also parses the request form, so req.PostForm can be used afterwards.
+// If the authentication fails the error response is written on res and
+// false is returned, the caller should not write anything else on res.
+func authenticateClient(
+	ctx context.Context,
+	oauthClients *clients.Clients,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+) (oauth.Client, bool) {
+	if err := req.ParseForm(); err != nil {
+		writeOAuthError(logger, res, http.StatusBadRequest, "invalid_request", "invalid form encoded body")
+		return oauth.Client{}, false
+	}
+
+	clientID, secret, ok := clientCredentials(logger, res, req)
+	if !ok {
+		return oauth.Client{}, false
+	}
+
+	client, err := oauthClients.Authenticate(ctx, clientID, secret)
+	if err != nil {
+		if errors.Is(err, oauth.InvalidClientErr) {
+			res.Header().Set("WWW-Authenticate", "Basic")
+			writeOAuthError(logger, res, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+			return oauth.Client{}, false
+		}
+		internalServerError(logger, res, err)
+		return oauth.Client{}, false
+	}
+	return client, true
+}
+
+// clientCredentials extracts the client credentials sent using HTTP Basic
+// authentication or the form encoded request body, which must be already
+// parsed. If the credentials are malformed the error response is written
+// on res and false is returned.
+func clientCredentials(logger *log.Entry, res http.ResponseWriter, req *http.Request) (string, string, bool) {
+	clientID, secret, usedBasicAuth := req.BasicAuth()
+	if !usedBasicAuth {
+		return req.PostForm.Get("client_id"), req.PostForm.Get("client_secret"), true
+	}
+
+	// WHY: credentials are form encoded before being
+	// encoded as basic auth credentials.
+	clientID, idErr := url.QueryUnescape(clientID)
+	secret, secretErr := url.QueryUnescape(secret)
+	if idErr != nil || secretErr != nil {
+		writeOAuthError(logger, res, http.StatusBadRequest, "invalid_request", "invalid client credentials encoding")
+		return "", "", false
+	}
+	return clientID, secret, true
+}
+
+// oauthErrorCode maps errors to the error codes defined on:
+// https://tools.ietf.org/html/rfc6749#section-4.1.2.1
+// https://tools.ietf.org/html/rfc6749#section-5.2
+func oauthErrorCode(err error) string {
+	switch {
+	case errors.Is(err, oauth.InvalidClientErr):
+		return "invalid_client"
+	case errors.Is(err, oauth.InvalidGrantErr):
+		return "invalid_grant"
+	case errors.Is(err, oauth.InvalidScopeErr):
+		return "invalid_scope"
+	case errors.Is(err, oauth.UnsupportedResponseTypeErr):
+		return "unsupported_response_type"
+	case errors.Is(err, oauth.UnsupportedGrantTypeErr):
+		return "unsupported_grant_type"
+	default:
+		return "invalid_request"
+	}
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func writeOAuthTokenResponse(logger *log.Entry, res http.ResponseWriter, token OAuthTokenResponse) {
+	// WHY: responses with tokens must not be cached, as defined on:
+	// https://tools.ietf.org/html/rfc6749#section-5.1
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("Pragma", "no-cache")
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	logResponseBodyWrite(logger, res, jsonResponse(token))
+}
+
+// writeOAuthError writes an error response using the format of
+// the OAuth specs, which is expected by OAuth clients.
+func writeOAuthError(logger *log.Entry, res http.ResponseWriter, status int, code string, description string) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	logResponseBodyWrite(logger, res, jsonResponse(OAuthErrorResponse{
+		Error:            code,
+		ErrorDescription: description,
+	}))
+	logger.WithFields(log.Fields{"error": code, "description": description, "status": status}).Warning("request failed")
+}
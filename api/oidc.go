@@ -0,0 +1,411 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/oauth"
+	"github.com/katcipis/stonks/oauth/oidc"
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/manager"
+	"github.com/katcipis/stonks/users/mfa"
+)
+
+// DiscoveryResponse is the OpenID Connect provider metadata, as defined on:
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type DiscoveryResponse struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+func discoveryHandler(provider *oidc.Provider, keys *auth.KeyRing, logger *log.Entry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+
+		issuer := provider.Issuer()
+		discovery := DiscoveryResponse{
+			Issuer:                            issuer,
+			AuthorizationEndpoint:             issuer + authorizePath,
+			TokenEndpoint:                     issuer + oauthTokenPath,
+			UserInfoEndpoint:                  issuer + userInfoPath,
+			JWKSURI:                           issuer + jwksPath,
+			IntrospectionEndpoint:             issuer + introspectPath,
+			RevocationEndpoint:                issuer + revokePath,
+			ScopesSupported:                   oidc.SupportedScopes,
+			ResponseTypesSupported:            []string{oidc.CodeResponseType},
+			GrantTypesSupported:               []string{authorizationCodeGrantType, clientCredentialsGrantType},
+			SubjectTypesSupported:             []string{"public"},
+			IDTokenSigningAlgValuesSupported:  signingAlgorithms(keys),
+			TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+			CodeChallengeMethodsSupported:     []string{oidc.S256ChallengeMethod},
+			ClaimsSupported: []string{
+				"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce",
+				"email", "email_verified", "name",
+			},
+		}
+
+		res.Header().Set("Cache-Control", "public, max-age=300")
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		logResponseBodyWrite(logger, res, jsonResponse(discovery))
+	}
+}
+
+func authorizeHandler(
+	usersManager *manager.Manager,
+	mfaAuth *mfa.MFA,
+	attempts *auth.SigninAttempts,
+	provider *oidc.Provider,
+	cfg Config,
+	logger *log.Entry,
+) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		var params url.Values
+
+		switch req.Method {
+		case http.MethodGet:
+			params = req.URL.Query()
+		case http.MethodPost:
+			if err := req.ParseForm(); err != nil {
+				renderLoginPage(logger, res, http.StatusBadRequest, loginPage{Error: "Invalid sign in request."})
+				return
+			}
+			params = req.PostForm
+		default:
+			methodNotAllowed(logger, res, req)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.SigninTimeout)
+		defer cancel()
+
+		authReq := oidc.AuthorizationRequest{
+			ClientID:            params.Get("client_id"),
+			RedirectURI:         params.Get("redirect_uri"),
+			ResponseType:        params.Get("response_type"),
+			Scope:               params.Get("scope"),
+			State:               params.Get("state"),
+			Nonce:               params.Get("nonce"),
+			CodeChallenge:       params.Get("code_challenge"),
+			CodeChallengeMethod: params.Get("code_challenge_method"),
+		}
+
+		client, err := provider.ValidateClient(ctx, authReq)
+		if err != nil {
+			// WHY: the redirect URI can't be trusted, so the error is
+			// shown to the user instead of redirecting, as defined on:
+			// https://tools.ietf.org/html/rfc6749#section-4.1.2.1
+			if errors.Is(err, oauth.InvalidClientErr) || errors.Is(err, oauth.InvalidRedirectURIErr) {
+				logger.WithFields(log.Fields{"error": err.Error()}).Warning("invalid authorization request")
+				renderLoginPage(logger, res, http.StatusBadRequest, loginPage{
+					Error: "Invalid sign in request, the application is not registered.",
+				})
+				return
+			}
+			internalServerError(logger, res, err)
+			return
+		}
+
+		if err := provider.ValidateRequest(authReq); err != nil {
+			redirectAuthorizationError(logger, res, req, authReq, err)
+			return
+		}
+
+		page := loginPage{
+			ClientName: client.Name,
+			Action:     authorizePath,
+			Params:     authorizationParams(authReq),
+		}
+
+		if req.Method == http.MethodGet {
+			renderLoginPage(logger, res, http.StatusOK, page)
+			return
+		}
+
+		page.Email = params.Get("email")
+		account := signinAccount(page.Email)
+		ip := clientIP(req, cfg)
+
+		attempt, retryAfter, err := beginSigninAttempt(ctx, attempts, account, ip, logger)
+		if err != nil {
+			internalServerError(logger, res, err)
+			return
+		}
+		if attempt == nil {
+			setRetryAfter(res, retryAfter)
+			page.Error = "Too many failed sign in attempts, try again later."
+			renderLoginPage(logger, res, http.StatusTooManyRequests, page)
+			return
+		}
+
+		user, err := authenticateUser(ctx, usersManager, page.Email, params.Get("password"), logger)
+		if err != nil {
+			if !errors.Is(err, users.InvalidCredentialsErr) {
+				releaseSigninAttempt(ctx, attempts, attempt, logger)
+			}
+			switch {
+			case errors.Is(err, users.InvalidCredentialsErr):
+				signinFailed(ctx, attempts, attempt, account, ip, logger)
+				page.Error = "Invalid email or password."
+				renderLoginPage(logger, res, http.StatusUnauthorized, page)
+			case errors.Is(err, users.UserNotVerifiedErr):
+				page.Error = "Your email is not verified yet."
+				renderLoginPage(logger, res, http.StatusForbidden, page)
+			case errors.Is(err, users.UserSuspendedErr), errors.Is(err, users.UserLockedErr):
+				page.Error = "Your account is not allowed to sign in."
+				renderLoginPage(logger, res, http.StatusForbidden, page)
+			default:
+				internalServerError(logger, res, err)
+			}
+			return
+		}
+
+		if !verifyLoginMFA(ctx, mfaAuth, attempts, attempt, account, ip, user.ID, params.Get("mfa_code"), logger, res, page) {
+			return
+		}
+
+		code, err := provider.Authorize(ctx, authReq, user.ID)
+		if err != nil {
+			internalServerError(logger, res, err)
+			return
+		}
+
+		redirectTo(res, req, authReq, url.Values{"code": {code}})
+	}
+}
+
+func userInfoHandler(provider *oidc.Provider, cfg Config, logger *log.Entry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+
+		accessToken, ok := bearerToken(req)
+		if !ok {
+			res.Header().Set("WWW-Authenticate", "Bearer")
+			writeErrorResponse(logger, res, http.StatusUnauthorized, "missing bearer token on Authorization header")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		defer cancel()
+
+		info, err := provider.UserInfo(ctx, accessToken)
+		if err != nil {
+			if errors.Is(err, auth.InvalidTokenErr) {
+				res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeErrorResponse(logger, res, http.StatusUnauthorized, "invalid or expired bearer token")
+				return
+			}
+			internalServerError(logger, res, err)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		logResponseBodyWrite(logger, res, jsonResponse(info))
+	}
+}
+
+// verifyLoginMFA verifies the MFA code sent on the login form, if the user
+// has MFA enabled. If the code is missing or invalid the login page is
+// rendered again asking for it and false is returned. The result of the
+// sign in attempt is recorded, the code is part of the attempt.
+func verifyLoginMFA(
+	ctx context.Context,
+	mfaAuth *mfa.MFA,
+	attempts *auth.SigninAttempts,
+	attempt *auth.SigninAttempt,
+	account string,
+	ip string,
+	userID string,
+	code string,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	page loginPage,
+) bool {
+	enabled, err := mfaAuth.Enabled(ctx, userID)
+	if err != nil {
+		releaseSigninAttempt(ctx, attempts, attempt, logger)
+		internalServerError(logger, res, err)
+		return false
+	}
+	if !enabled {
+		signinSucceeded(ctx, attempts, attempt, logger)
+		return true
+	}
+
+	page.MFARequired = true
+	if code == "" {
+		releaseSigninAttempt(ctx, attempts, attempt, logger)
+		page.Error = "Enter the code from your authenticator app or a recovery code."
+		renderLoginPage(logger, res, http.StatusUnauthorized, page)
+		return false
+	}
+
+	err = mfaAuth.VerifyCode(ctx, userID, code)
+	if err != nil {
+		if errors.Is(err, mfa.InvalidCodeErr) || errors.Is(err, mfa.NotEnrolledErr) {
+			logger.WithFields(log.Fields{"error": err.Error()}).Warning("invalid MFA code")
+			// WHY: codes can be guessed on the login page without a
+			// new challenge per attempt, so failures are also counted.
+			signinFailed(ctx, attempts, attempt, account, ip, logger)
+			page.Error = "Invalid authentication code."
+			renderLoginPage(logger, res, http.StatusUnauthorized, page)
+			return false
+		}
+		releaseSigninAttempt(ctx, attempts, attempt, logger)
+		internalServerError(logger, res, err)
+		return false
+	}
+	signinSucceeded(ctx, attempts, attempt, logger)
+	return true
+}
+
+// redirectAuthorizationError redirects the user back to the client with
+// the error, as defined on: https://tools.ietf.org/html/rfc6749#section-4.1.2.1
+func redirectAuthorizationError(
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	authReq oidc.AuthorizationRequest,
+	err error,
+) {
+	logger.WithFields(log.Fields{"error": err.Error()}).Warning("invalid authorization request")
+	redirectTo(res, req, authReq, url.Values{
+		"error":             {oauthErrorCode(err)},
+		"error_description": {err.Error()},
+	})
+}
+
+// redirectTo redirects the user to the validated redirect URI of the
+// request with the given params, besides the state of the request.
+func redirectTo(res http.ResponseWriter, req *http.Request, authReq oidc.AuthorizationRequest, params url.Values) {
+	// WHY: the redirect URI was validated against the registered ones
+	// and may already have a query that must be kept.
+	redirectURI, _ := url.Parse(authReq.RedirectURI)
+
+	query := redirectURI.Query()
+	for name, vals := range params {
+		query[name] = vals
+	}
+	if authReq.State != "" {
+		query.Set("state", authReq.State)
+	}
+	redirectURI.RawQuery = query.Encode()
+
+	http.Redirect(res, req, redirectURI.String(), http.StatusFound)
+}
+
+func signingAlgorithms(keys *auth.KeyRing) []string {
+	set := map[string]struct{}{}
+	for _, key := range keys.JWKS().Keys {
+		set[key.Algorithm] = struct{}{}
+	}
+
+	algs := make([]string, 0, len(set))
+	for alg := range set {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	return algs
+}
+
+type formParam struct {
+	Name  string
+	Value string
+}
+
+type loginPage struct {
+	ClientName string
+	Action     string
+	Params     []formParam
+	Email      string
+	Error      string
+
+	// MFARequired shows the MFA code field, the password is
+	// still required since it is never kept on the page.
+	MFARequired bool
+}
+
+// authorizationParams are the params of the authorization request, they
+// are kept as hidden inputs on the login form so they are sent again.
+func authorizationParams(authReq oidc.AuthorizationRequest) []formParam {
+	return []formParam{
+		{Name: "client_id", Value: authReq.ClientID},
+		{Name: "redirect_uri", Value: authReq.RedirectURI},
+		{Name: "response_type", Value: authReq.ResponseType},
+		{Name: "scope", Value: authReq.Scope},
+		{Name: "state", Value: authReq.State},
+		{Name: "nonce", Value: authReq.Nonce},
+		{Name: "code_challenge", Value: authReq.CodeChallenge},
+		{Name: "code_challenge_method", Value: authReq.CodeChallengeMethod},
+	}
+}
+
+func renderLoginPage(logger *log.Entry, res http.ResponseWriter, status int, page loginPage) {
+	body := bytes.Buffer{}
+	if err := loginTemplate.Execute(&body, page); err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+
+	// WHY: the login page must not be framed by other sites, otherwise
+	// users could be tricked into signing in (clickjacking).
+	res.Header().Set("X-Frame-Options", "DENY")
+	res.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.WriteHeader(status)
+	logResponseBodyWrite(logger, res, body.Bytes())
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Sign in</title>
+</head>
+<body>
+  <h1>Sign in{{if .ClientName}} to {{.ClientName}}{{end}}</h1>
+  {{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+  {{if .Action}}
+  <form method="post" action="{{.Action}}">
+    {{range .Params}}<input type="hidden" name="{{.Name}}" value="{{.Value}}">
+    {{end}}
+    <label>Email <input type="email" name="email" value="{{.Email}}" required autofocus></label>
+    <label>Password <input type="password" name="password" required></label>
+    {{if .MFARequired}}<label>Authentication code <input type="text" name="mfa_code" autocomplete="one-time-code" required></label>
+    {{end}}
+    <button type="submit">Sign in</button>
+  </form>
+  {{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,369 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/webauthn"
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/manager"
+	"github.com/katcipis/stonks/users/passkeys"
+)
+
+// CreatePasskeyRequestBody is the request body required to register a passkey,
+// the credential is the one created by the authenticator with the registration options.
+type CreatePasskeyRequestBody struct {
+	Name       string                          `json:"name"`
+	Credential webauthn.RegistrationCredential `json:"credential"`
+}
+
+// PasskeyResponse is the representation of a passkey on response bodies
+type PasskeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// ListPasskeysResponse is the response body when passkeys are listed with success
+type ListPasskeysResponse struct {
+	Passkeys []PasskeyResponse `json:"passkeys"`
+}
+
+// SigninPasskeyRequestBody is the request body required to sign in with a passkey,
+// the credential is the assertion obtained with the passkey sign in options.
+type SigninPasskeyRequestBody struct {
+	Credential webauthn.AssertionCredential `json:"credential"`
+}
+
+func userPasskeys(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	passkeysAuth *passkeys.Passkeys,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+	passkeyID string,
+) {
+	switch {
+	case passkeyID == "" && req.Method == http.MethodPost:
+		createPasskey(usersManager, tokens, passkeysAuth, cfg, logger, res, req, userID)
+	case passkeyID == "" && req.Method == http.MethodGet:
+		listPasskeys(usersManager, authorizer, tokens, apiKeys, passkeysAuth, cfg, logger, res, req, userID)
+	case passkeyID != "" && req.Method == http.MethodDelete:
+		deletePasskey(usersManager, authorizer, tokens, apiKeys, passkeysAuth, cfg, logger, res, req, userID, passkeyID)
+	default:
+		methodNotAllowed(logger, res, req)
+	}
+}
+
+func beginPasskeyRegistration(
+	usersManager *manager.Manager,
+	tokens *auth.Tokens,
+	passkeysAuth *passkeys.Passkeys,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	// WHY: passkeys can be used to sign in, so API keys
+	// must not be able to register them.
+	s, ok := authenticate(ctx, tokens, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if _, ok := sessionUser(ctx, usersManager, s, logger, res); !ok {
+		return
+	}
+
+	if s.userID != userID {
+		writeErrorResponse(logger, res, http.StatusForbidden, "users can only register their own passkeys")
+		return
+	}
+
+	opts, err := passkeysAuth.BeginRegistration(ctx, userID)
+	if err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusOK)
+	logResponseBodyWrite(logger, res, jsonResponse(opts))
+}
+
+func createPasskey(
+	usersManager *manager.Manager,
+	tokens *auth.Tokens,
+	passkeysAuth *passkeys.Passkeys,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	s, ok := authenticate(ctx, tokens, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if _, ok := sessionUser(ctx, usersManager, s, logger, res); !ok {
+		return
+	}
+
+	if s.userID != userID {
+		writeErrorResponse(logger, res, http.StatusForbidden, "users can only register their own passkeys")
+		return
+	}
+
+	parsedReq := CreatePasskeyRequestBody{}
+	if !parseJSONBody(logger, res, req, &parsedReq) {
+		return
+	}
+
+	passkey, err := passkeysAuth.FinishRegistration(ctx, userID, parsedReq.Name, parsedReq.Credential)
+	if err != nil {
+		switch {
+		case errors.Is(err, passkeys.InvalidPasskeyParamErr):
+			writeErrorResponse(logger, res, http.StatusBadRequest, err.Error())
+		case errors.Is(err, passkeys.InvalidPasskeyErr):
+			logger.WithFields(log.Fields{"error": err.Error()}).Warning("invalid passkey registration")
+			writeErrorResponse(logger, res, http.StatusBadRequest, "invalid passkey credential")
+		case errors.Is(err, passkeys.PasskeyAlreadyExistsErr):
+			writeErrorResponse(logger, res, http.StatusConflict, "passkey already registered")
+		default:
+			internalServerError(logger, res, err)
+		}
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"user":    userID,
+		"passkey": passkey.ID,
+	}).Info("passkey registered")
+
+	res.WriteHeader(http.StatusCreated)
+	logResponseBodyWrite(logger, res, jsonResponse(newPasskeyResponse(passkey)))
+}
+
+func listPasskeys(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	passkeysAuth *passkeys.Passkeys,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	requester, ok := authenticateRequester(ctx, usersManager, tokens, apiKeys, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if !authorizeUserAccess(authorizer, requester, userID, users.ReadUsersPermission, logger, res) {
+		return
+	}
+
+	found, err := passkeysAuth.Passkeys(ctx, userID)
+	if err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+
+	listRes := ListPasskeysResponse{Passkeys: make([]PasskeyResponse, len(found))}
+	for i, passkey := range found {
+		listRes.Passkeys[i] = newPasskeyResponse(passkey)
+	}
+
+	res.WriteHeader(http.StatusOK)
+	logResponseBodyWrite(logger, res, jsonResponse(listRes))
+}
+
+func deletePasskey(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	passkeysAuth *passkeys.Passkeys,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+	passkeyID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	requester, ok := authenticateRequester(ctx, usersManager, tokens, apiKeys, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if !authorizeUserAccess(authorizer, requester, userID, users.UpdateUsersPermission, logger, res) {
+		return
+	}
+
+	err := passkeysAuth.Delete(ctx, userID, passkeyID)
+	if err != nil {
+		if errors.Is(err, passkeys.PasskeyNotFoundErr) {
+			notFound(logger, res, req)
+			return
+		}
+		internalServerError(logger, res, err)
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"user":      userID,
+		"passkey":   passkeyID,
+		"requester": requester.id(),
+	}).Info("passkey deleted")
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func passkeyOptionsHandler(passkeysAuth *passkeys.Passkeys, cfg Config, logger *log.Entry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		defer cancel()
+
+		opts, err := passkeysAuth.BeginSignin(ctx)
+		if err != nil {
+			internalServerError(logger, res, err)
+			return
+		}
+
+		res.Header().Set("Cache-Control", "no-store")
+		res.WriteHeader(http.StatusOK)
+		logResponseBodyWrite(logger, res, jsonResponse(opts))
+	}
+}
+
+func signinPasskeyHandler(
+	usersManager *manager.Manager,
+	tokens *auth.Tokens,
+	refreshTokens *auth.RefreshTokens,
+	passkeysAuth *passkeys.Passkeys,
+	cfg Config,
+	logger *log.Entry,
+) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+		parsedReq := SigninPasskeyRequestBody{}
+		if !parseJSONBody(logger, res, req, &parsedReq) {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.SigninTimeout)
+		defer cancel()
+
+		// WHY: a passkey with user verification is already multi-factor
+		// (something the user has plus a PIN or biometrics), so no
+		// other factor is required, even if the user has MFA enabled.
+		passkey, err := passkeysAuth.Authenticate(ctx, parsedReq.Credential, true)
+		if err != nil {
+			if errors.Is(err, passkeys.InvalidPasskeyErr) {
+				logger.WithFields(log.Fields{"error": err.Error()}).Warning("invalid passkey sign in")
+				writeErrorResponse(logger, res, http.StatusUnauthorized, "invalid passkey")
+				return
+			}
+			internalServerError(logger, res, err)
+			return
+		}
+
+		user, err := usersManager.SigninUser(ctx, passkey.UserID)
+		if err != nil {
+			if errors.Is(err, users.UserNotFoundErr) {
+				writeErrorResponse(logger, res, http.StatusUnauthorized, "invalid passkey")
+				return
+			}
+			writeSigninError(logger, res, err)
+			return
+		}
+
+		writeSigninResponse(ctx, tokens, refreshTokens, user.ID, logger, res)
+	}
+}
+
+// verifyMFAPasskey verifies a passkey assertion as the second
+// factor of the user that answered the MFA challenge.
+func verifyMFAPasskey(
+	ctx context.Context,
+	passkeysAuth *passkeys.Passkeys,
+	userID string,
+	cred webauthn.AssertionCredential,
+) error {
+	if passkeysAuth == nil {
+		return fmt.Errorf("%w:passkeys are not enabled", passkeys.InvalidPasskeyErr)
+	}
+
+	// WHY: the password was already checked, so the user presence is enough
+	passkey, err := passkeysAuth.Authenticate(ctx, cred, false)
+	if err != nil {
+		return err
+	}
+	if passkey.UserID != userID {
+		return fmt.Errorf("%w:passkey %s is not from user %s", passkeys.InvalidPasskeyErr, passkey.ID, userID)
+	}
+	return nil
+}
+
+// mfaMethods returns the second factors the user can use, TOTP is always
+// available since MFA is only enabled by a TOTP enrollment.
+func mfaMethods(ctx context.Context, passkeysAuth *passkeys.Passkeys, userID string) ([]string, error) {
+	methods := []string{totpMFAMethod}
+	if passkeysAuth == nil {
+		return methods, nil
+	}
+
+	found, err := passkeysAuth.Passkeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) > 0 {
+		methods = append(methods, passkeyMFAMethod)
+	}
+	return methods, nil
+}
+
+func newPasskeyResponse(passkey passkeys.Passkey) PasskeyResponse {
+	return PasskeyResponse{
+		ID:         passkey.ID,
+		Name:       passkey.Name,
+		CreatedAt:  passkey.CreatedAt,
+		LastUsedAt: optionalTime(passkey.LastUsedAt),
+	}
+}
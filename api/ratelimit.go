@@ -0,0 +1,174 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/ratelimit"
+)
+
+// RateLimits has the policies limiting the requests of each client, clients
+// are identified by their user, OAuth client or API key when the request
+// has valid credentials, otherwise by their IP.
+type RateLimits struct {
+	// Default is the policy of routes without a specific policy,
+	// if it is not enabled these routes are not limited.
+	Default ratelimit.Policy
+
+	// Routes has the policies of specific routes, identified by their path
+	// (like /v1/users) optionally prefixed by the method (like "POST /v1/users").
+	// Each route has its own limits, even if they have the same policy.
+	Routes map[string]ratelimit.Policy
+}
+
+// policy returns the policy of the request to the route registered
+// with the given pattern, along with the name of the route.
+func (r RateLimits) policy(method string, pattern string) (string, ratelimit.Policy) {
+	if route := method + " " + pattern; r.Routes[route].Enabled() {
+		return route, r.Routes[route]
+	}
+	if r.Routes[pattern].Enabled() {
+		return pattern, r.Routes[pattern]
+	}
+	return pattern, r.Default
+}
+
+// rateLimitHandler limits the requests to the routes of the mux.
+// If limiter is nil requests are not limited.
+func rateLimitHandler(mux *http.ServeMux, limiter *ratelimit.Limiter, s Services, cfg Config) http.Handler {
+	if limiter == nil {
+		return mux
+	}
+
+	// WHY: limits must still be enforced when the shared store
+	// is unavailable, even if each process has its own limits.
+	fallback := ratelimit.New(ratelimit.NewInMemory())
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, pattern := mux.Handler(req)
+		route, policy := cfg.RateLimits.policy(req.Method, pattern)
+		if !policy.Enabled() {
+			mux.ServeHTTP(res, req)
+			return
+		}
+
+		logger := pathLogger(pattern)
+		req, ok := allowRequest(limiter, fallback, s, cfg, route, policy, logger, res, req)
+		if !ok {
+			return
+		}
+		mux.ServeHTTP(res, req)
+	})
+}
+
+// allowRequest checks if the request is allowed by the policy of the route,
+// writing the rate limit headers. The request is returned with the result of
+// the introspection of its credentials, so they are not introspected again.
+// If the request is not allowed the error response is written on res and
+// false is returned.
+func allowRequest(
+	limiter *ratelimit.Limiter,
+	fallback *ratelimit.Limiter,
+	s Services,
+	cfg Config,
+	route string,
+	policy ratelimit.Policy,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+) (*http.Request, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	client, req := rateLimitClient(ctx, s.Tokens, s.APIKeys, cfg, req)
+	key := route + ":" + client
+	now := time.Now()
+
+	result, err := limiter.Allow(ctx, key, policy, now)
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err.Error()}).Warning("rate limiter failed, using in-process limits")
+		result, err = fallback.Allow(ctx, key, policy, now)
+		if err != nil {
+			internalServerError(logger, res, err)
+			return nil, false
+		}
+	}
+
+	// WHY: as defined on: https://tools.ietf.org/html/draft-ietf-httpapi-ratelimit-headers
+	res.Header().Set("RateLimit-Limit", strconv.FormatInt(result.Limit, 10))
+	res.Header().Set("RateLimit-Remaining", strconv.FormatInt(result.Remaining, 10))
+	res.Header().Set("RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(result.Reset.Seconds())), 10))
+
+	if !result.Allowed {
+		logger.WithFields(log.Fields{
+			"route":  route,
+			"client": client,
+		}).Warning("request rate limited")
+		setRetryAfter(res, result.RetryAfter)
+		writeErrorResponse(logger, res, http.StatusTooManyRequests, "too many requests, try again later")
+		return nil, false
+	}
+	return req, true
+}
+
+// rateLimitClient identifies the client of the request. Credentials are only
+// used if they are valid, otherwise clients could bypass their limits just
+// by sending different invalid credentials. The request is returned with
+// the introspection of valid credentials, see introspectedToken.
+func rateLimitClient(
+	ctx context.Context,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	cfg Config,
+	req *http.Request,
+) (string, *http.Request) {
+	if token, ok := bearerToken(req); ok {
+		if auth.IsAPIKey(token) {
+			if info, err := apiKeys.Introspect(ctx, token); err == nil {
+				// WHY: API keys are secrets, so they are hashed
+				// since clients identifiers are also logged.
+				sum := sha256.Sum256([]byte(token))
+				return "api-key:" + hex.EncodeToString(sum[:]), withIntrospectedToken(req, token, info)
+			}
+		} else if info, err := tokens.Introspect(ctx, token); err == nil {
+			req = withIntrospectedToken(req, token, info)
+			if info.UserID != "" {
+				return "user:" + info.UserID, req
+			}
+			return "client:" + info.ClientID, req
+		}
+	}
+	return "ip:" + clientIP(req, cfg), req
+}
+
+type introspectedTokenKey struct{}
+
+type introspectedTokenValue struct {
+	token string
+	info  auth.TokenInfo
+}
+
+// withIntrospectedToken returns the request with the
+// introspection of its valid token on its context.
+func withIntrospectedToken(req *http.Request, token string, info auth.TokenInfo) *http.Request {
+	val := introspectedTokenValue{token: token, info: info}
+	return req.WithContext(context.WithValue(req.Context(), introspectedTokenKey{}, val))
+}
+
+// introspectedToken returns the introspection of the token done while
+// rate limiting the request, if there is one.
+func introspectedToken(req *http.Request, token string) (auth.TokenInfo, bool) {
+	val, ok := req.Context().Value(introspectedTokenKey{}).(introspectedTokenValue)
+	if !ok || val.token != token {
+		return auth.TokenInfo{}, false
+	}
+	return val.info, true
+}
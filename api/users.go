@@ -0,0 +1,777 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/manager"
+	"github.com/katcipis/stonks/users/mfa"
+	"github.com/katcipis/stonks/users/passkeys"
+	"github.com/katcipis/stonks/users/verification"
+)
+
+// CreateUserRequestBody is the request body required to create users
+type CreateUserRequestBody struct {
+	FullName string `json:"fullname"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// CreateUserResponse is the response body when a user is created with success
+type CreateUserResponse struct {
+	ID string `json:"id"`
+}
+
+// UserResponse is the representation of a user on response bodies
+type UserResponse struct {
+	ID       string `json:"id"`
+	FullName string `json:"fullname"`
+	Email    string `json:"email"`
+	Status   string `json:"status"`
+
+	// StatusReason is only available to users with permission
+	// to suspend users.
+	StatusReason string `json:"status_reason,omitempty"`
+}
+
+// ChangeStatusRequestBody is the request body required to suspend, reactivate or lock users
+type ChangeStatusRequestBody struct {
+	Reason string `json:"reason"`
+}
+
+// VerifyUserRequestBody is the request body required to verify a user email
+type VerifyUserRequestBody struct {
+	Token string `json:"token"`
+}
+
+// ResendVerificationRequestBody is the request body required to resend
+// the verification email of a user
+type ResendVerificationRequestBody struct {
+	Email string `json:"email"`
+}
+
+// UpdateUserRequestBody is the request body used to update users,
+// only the informed fields are updated.
+type UpdateUserRequestBody struct {
+	FullName *string `json:"fullname,omitempty"`
+	Email    *string `json:"email,omitempty"`
+}
+
+// ChangePasswordRequestBody is the request body used to change passwords
+type ChangePasswordRequestBody struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ListUsersResponse is the response body when users are listed with success
+type ListUsersResponse struct {
+	Users      []UserResponse `json:"users"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// DefaultListLimit is the limit of users listed when none is informed
+const DefaultListLimit = 50
+
+func usersHandler(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	verifier *verification.Verification,
+	cfg Config,
+	logger *log.Entry,
+) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodPost:
+			createUser(usersManager, verifier, cfg, logger, res, req)
+		case http.MethodGet:
+			listUsers(usersManager, authorizer, tokens, apiKeys, cfg, logger, res, req)
+		default:
+			methodNotAllowed(logger, res, req)
+		}
+	}
+}
+
+func createUser(
+	usersManager *manager.Manager,
+	verifier *verification.Verification,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+) {
+	parsedReq := CreateUserRequestBody{}
+	if !parseJSONBody(logger, res, req, &parsedReq) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.CreateUserTimeout)
+	defer cancel()
+
+	userID, err := usersManager.CreateUser(ctx, parsedReq.Email, parsedReq.FullName, parsedReq.Password)
+	if err != nil {
+		if errors.Is(err, users.InvalidUserParamErr) {
+			invalidUserParam(logger, res, err)
+			return
+		}
+		if errors.Is(err, users.UserAlreadyExistsErr) {
+			// Invalid and duplicated user param errors are guaranteed
+			// to be safe to send to users (not much info added on the error context).
+			// If a service is external care must be taken to not leak details
+			// that can be a potential security threat.
+			// When that is not the case I like the idea of
+			// informative error responses as detailed here:
+			//
+			// - https://commandcenter.blogspot.com/2017/12/error-handling-in-upspin.html
+			//
+			// I'm specially fond to the idea of a cross service
+			// operational trace (instead of stack traces).
+			// But I never tried it yet.
+			writeErrorResponse(logger, res, http.StatusBadRequest, err.Error())
+			return
+		}
+		internalServerError(logger, res, err)
+		return
+	}
+
+	// WHY: the user is already created, failing to send the email
+	// should not fail the request (retrying would fail since the
+	// user exists), so it is sent in the background.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		defer cancel()
+
+		err := verifier.RequestVerification(ctx, userID)
+		if err != nil {
+			logger.WithFields(log.Fields{"error": err.Error(), "user": userID}).Error("requesting email verification")
+		}
+	}()
+
+	res.WriteHeader(http.StatusCreated)
+	logResponseBodyWrite(logger, res, jsonResponse(CreateUserResponse{ID: userID}))
+}
+
+func verifyUserHandler(verifier *verification.Verification, cfg Config, logger *log.Entry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+		parsedReq := VerifyUserRequestBody{}
+		if !parseJSONBody(logger, res, req, &parsedReq) {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		defer cancel()
+
+		_, err := verifier.Verify(ctx, parsedReq.Token)
+		if err != nil {
+			if errors.Is(err, auth.InvalidTokenErr) || errors.Is(err, users.UserNotFoundErr) {
+				writeErrorResponse(logger, res, http.StatusBadRequest, "invalid or expired verification token")
+				return
+			}
+			internalServerError(logger, res, err)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func resendVerificationHandler(verifier *verification.Verification, cfg Config, logger *log.Entry) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			methodNotAllowed(logger, res, req)
+			return
+		}
+		parsedReq := ResendVerificationRequestBody{}
+		if !parseJSONBody(logger, res, req, &parsedReq) {
+			return
+		}
+
+		if _, err := users.ParseEmail(parsedReq.Email); err != nil {
+			writeErrorResponse(logger, res, http.StatusBadRequest, fmt.Sprintf("invalid email: %v", err))
+			return
+		}
+
+		// WHY: sent in the background, otherwise the response time
+		// would reveal if the email belongs to a user pending
+		// verification (no email is sent otherwise).
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+			defer cancel()
+
+			err := verifier.ResendVerification(ctx, parsedReq.Email)
+			if err != nil {
+				logger.WithFields(log.Fields{"error": err.Error()}).Error("resending email verification")
+			}
+		}()
+
+		res.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func listUsers(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	requester, ok := authenticateRequester(ctx, usersManager, tokens, apiKeys, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if !authorize(authorizer, requester, users.ListUsersPermission, logger, res) {
+		return
+	}
+
+	var err error
+	query := req.URL.Query()
+	limit := DefaultListLimit
+
+	if rawLimit := query.Get("limit"); rawLimit != "" {
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil {
+			writeErrorResponse(logger, res, http.StatusBadRequest, fmt.Sprintf("invalid limit %q", rawLimit))
+			return
+		}
+	}
+
+	listed, nextCursor, err := usersManager.ListUsers(ctx, limit, query.Get("cursor"))
+	if err != nil {
+		if errors.Is(err, users.InvalidListParamErr) {
+			writeErrorResponse(logger, res, http.StatusBadRequest, err.Error())
+			return
+		}
+		internalServerError(logger, res, err)
+		return
+	}
+
+	listRes := ListUsersResponse{
+		Users:      make([]UserResponse, len(listed)),
+		NextCursor: nextCursor,
+	}
+	for i, user := range listed {
+		listRes.Users[i] = newUserResponseFor(authorizer, requester, user)
+	}
+
+	res.WriteHeader(http.StatusOK)
+	logResponseBodyWrite(logger, res, jsonResponse(listRes))
+}
+
+func userHandler(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	refreshTokens *auth.RefreshTokens,
+	verifier *verification.Verification,
+	mfaAuth *mfa.MFA,
+	passkeysAuth *passkeys.Passkeys,
+	attempts *auth.SigninAttempts,
+	cfg Config,
+	logger *log.Entry,
+) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		userID, subresource := parseUserPath(req.URL.Path)
+		if userID == "" {
+			notFound(logger, res, req)
+			return
+		}
+
+		switch subresource {
+		case "":
+		case "password":
+			if req.Method != http.MethodPost {
+				methodNotAllowed(logger, res, req)
+				return
+			}
+			changePassword(usersManager, tokens, apiKeys, refreshTokens, attempts, cfg, logger, res, req, userID)
+			return
+		case "suspend", "reactivate", "lock":
+			if req.Method != http.MethodPost {
+				methodNotAllowed(logger, res, req)
+				return
+			}
+			status := users.SuspendedStatus
+			switch subresource {
+			case "reactivate":
+				status = users.ActiveStatus
+			case "lock":
+				status = users.LockedStatus
+			}
+			changeUserStatus(usersManager, authorizer, tokens, apiKeys, refreshTokens, cfg, logger, res, req, userID, status)
+			return
+		case "unlock":
+			if req.Method != http.MethodPost {
+				methodNotAllowed(logger, res, req)
+				return
+			}
+			unlockUser(usersManager, authorizer, tokens, apiKeys, attempts, cfg, logger, res, req, userID)
+			return
+		case "mfa", "mfa/totp", "mfa/totp/confirm":
+			userMFA(usersManager, authorizer, tokens, apiKeys, mfaAuth, cfg, logger, res, req, userID, subresource)
+			return
+		case "passkeys/registration":
+			if passkeysAuth == nil {
+				notFound(logger, res, req)
+				return
+			}
+			if req.Method != http.MethodPost {
+				methodNotAllowed(logger, res, req)
+				return
+			}
+			beginPasskeyRegistration(usersManager, tokens, passkeysAuth, cfg, logger, res, req, userID)
+			return
+		default:
+			if passkeyID, ok := parseItemPath("passkeys", subresource); ok && passkeysAuth != nil {
+				userPasskeys(usersManager, authorizer, tokens, apiKeys, passkeysAuth, cfg, logger, res, req, userID, passkeyID)
+				return
+			}
+			keyID, ok := parseItemPath("api-keys", subresource)
+			if !ok {
+				notFound(logger, res, req)
+				return
+			}
+			userAPIKeys(usersManager, authorizer, tokens, apiKeys, cfg, logger, res, req, userID, keyID)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			getUser(usersManager, authorizer, tokens, apiKeys, cfg, logger, res, req, userID)
+		case http.MethodPatch:
+			updateUser(usersManager, authorizer, tokens, apiKeys, verifier, cfg, logger, res, req, userID)
+		case http.MethodDelete:
+			deleteUser(usersManager, authorizer, tokens, apiKeys, cfg, logger, res, req, userID)
+		default:
+			methodNotAllowed(logger, res, req)
+		}
+	}
+}
+
+func getUser(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	requester, ok := authenticateRequester(ctx, usersManager, tokens, apiKeys, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if !authorizeUserAccess(authorizer, requester, userID, users.ReadUsersPermission, logger, res) {
+		return
+	}
+
+	user, err := usersManager.User(ctx, userID)
+	if err != nil {
+		if errors.Is(err, users.UserNotFoundErr) {
+			notFound(logger, res, req)
+			return
+		}
+		internalServerError(logger, res, err)
+		return
+	}
+
+	res.Header().Set("ETag", userETag(user))
+	res.WriteHeader(http.StatusOK)
+	logResponseBodyWrite(logger, res, jsonResponse(newUserResponseFor(authorizer, requester, user)))
+}
+
+func updateUser(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	verifier *verification.Verification,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	requester, ok := authenticateRequester(ctx, usersManager, tokens, apiKeys, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if !authorizeUserAccess(authorizer, requester, userID, users.UpdateUsersPermission, logger, res) {
+		return
+	}
+
+	// WHY: updates without If-Match could silently overwrite
+	// concurrent updates, as defined on: https://tools.ietf.org/html/rfc6585#section-3
+	if req.Header.Get("If-Match") == "" {
+		writeErrorResponse(logger, res, http.StatusPreconditionRequired, "If-Match header with the user ETag is required")
+		return
+	}
+
+	parsedReq := UpdateUserRequestBody{}
+	if !parseJSONBody(logger, res, req, &parsedReq) {
+		return
+	}
+
+	user, err := usersManager.User(ctx, userID)
+	if err != nil {
+		if errors.Is(err, users.UserNotFoundErr) {
+			notFound(logger, res, req)
+			return
+		}
+		internalServerError(logger, res, err)
+		return
+	}
+
+	if !ifMatch(req, userETag(user)) {
+		writeErrorResponse(logger, res, http.StatusPreconditionFailed, "user has been modified, If-Match doesn't match current ETag")
+		return
+	}
+
+	updated, err := usersManager.UpdateUser(ctx, userID, user.Version, users.UserUpdate{
+		FullName: parsedReq.FullName,
+		Email:    parsedReq.Email,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, users.InvalidUserParamErr), errors.Is(err, users.UserAlreadyExistsErr):
+			writeErrorResponse(logger, res, http.StatusBadRequest, err.Error())
+		case errors.Is(err, users.VersionMismatchErr):
+			// WHY: the user was modified concurrently after we checked If-Match
+			writeErrorResponse(logger, res, http.StatusPreconditionFailed, "user has been modified concurrently")
+		case errors.Is(err, users.InvalidStatusTransitionErr):
+			writeErrorResponse(logger, res, http.StatusConflict, "email can't be changed while the user is suspended or locked")
+		case errors.Is(err, users.UserNotFoundErr):
+			notFound(logger, res, req)
+		default:
+			internalServerError(logger, res, err)
+		}
+		return
+	}
+
+	if updated.Email != user.Email {
+		// WHY: the new email must be verified, like on user creation
+		// the email is sent in the background so failures don't fail
+		// the update (it can be resent).
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+			defer cancel()
+
+			err := verifier.RequestVerification(ctx, userID)
+			if err != nil {
+				logger.WithFields(log.Fields{"error": err.Error(), "user": userID}).Error("requesting email verification")
+			}
+		}()
+	}
+
+	res.Header().Set("ETag", userETag(updated))
+	res.WriteHeader(http.StatusOK)
+	logResponseBodyWrite(logger, res, jsonResponse(newUserResponseFor(authorizer, requester, updated)))
+}
+
+func deleteUser(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	requester, ok := authenticateRequester(ctx, usersManager, tokens, apiKeys, logger, res, req)
+	if !ok {
+		return
+	}
+
+	if !authorizeUserAccess(authorizer, requester, userID, users.DeleteUsersPermission, logger, res) {
+		return
+	}
+
+	err := usersManager.DeleteUser(ctx, userID)
+	if err != nil {
+		if errors.Is(err, users.UserNotFoundErr) {
+			notFound(logger, res, req)
+			return
+		}
+		internalServerError(logger, res, err)
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func changeUserStatus(
+	usersManager *manager.Manager,
+	authorizer *auth.Authorizer,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	refreshTokens *auth.RefreshTokens,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+	status users.Status,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	requester, ok := authenticateRequester(ctx, usersManager, tokens, apiKeys, logger, res, req)
+	if !ok {
+		return
+	}
+
+	// WHY: users can't change their own status, otherwise
+	// suspended users could just reactivate themselves.
+	if !authorize(authorizer, requester, users.SuspendUsersPermission, logger, res) {
+		return
+	}
+
+	parsedReq := ChangeStatusRequestBody{}
+	if !parseJSONBody(logger, res, req, &parsedReq) {
+		return
+	}
+
+	var (
+		updated users.User
+		err     error
+	)
+	switch status {
+	case users.ActiveStatus:
+		// WHY: only suspended users are reactivated, users pending
+		// verification or locked have their own ways to become active.
+		updated, err = usersManager.ReactivateUser(ctx, userID, parsedReq.Reason)
+	case users.LockedStatus:
+		updated, err = usersManager.LockUser(ctx, userID, parsedReq.Reason)
+	default:
+		updated, err = usersManager.ChangeStatus(ctx, userID, status, parsedReq.Reason)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, users.InvalidUserParamErr):
+			writeErrorResponse(logger, res, http.StatusBadRequest, err.Error())
+		case errors.Is(err, users.InvalidStatusTransitionErr):
+			writeErrorResponse(logger, res, http.StatusConflict, err.Error())
+		case errors.Is(err, users.VersionMismatchErr):
+			writeErrorResponse(logger, res, http.StatusConflict, "user has been modified concurrently")
+		case errors.Is(err, users.UserNotFoundErr):
+			notFound(logger, res, req)
+		default:
+			internalServerError(logger, res, err)
+		}
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"user":      userID,
+		"requester": requester.id(),
+		"status":    status,
+		"reason":    parsedReq.Reason,
+	}).Info("user status changed")
+
+	if status == users.SuspendedStatus || status == users.LockedStatus {
+		err = revokeUserTokens(ctx, tokens, refreshTokens, userID, "")
+		if err != nil {
+			internalServerError(logger, res, err)
+			return
+		}
+	}
+
+	res.Header().Set("ETag", userETag(updated))
+	res.WriteHeader(http.StatusOK)
+	logResponseBodyWrite(logger, res, jsonResponse(newUserResponseFor(authorizer, requester, updated)))
+}
+
+func changePassword(
+	usersManager *manager.Manager,
+	tokens *auth.Tokens,
+	apiKeys *auth.APIKeys,
+	refreshTokens *auth.RefreshTokens,
+	attempts *auth.SigninAttempts,
+	cfg Config,
+	logger *log.Entry,
+	res http.ResponseWriter,
+	req *http.Request,
+	userID string,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	s, ok := authenticate(ctx, tokens, logger, res, req)
+	if !ok {
+		return
+	}
+
+	user, ok := sessionUser(ctx, usersManager, s, logger, res)
+	if !ok {
+		return
+	}
+
+	// WHY: no permission allows changing passwords of other users,
+	// the current password is required anyway.
+	if s.userID != userID {
+		writeErrorResponse(logger, res, http.StatusForbidden, "users can only change their own password")
+		return
+	}
+
+	parsedReq := ChangePasswordRequestBody{}
+	if !parseJSONBody(logger, res, req, &parsedReq) {
+		return
+	}
+
+	// WHY: checking the current password is a sign in, otherwise stolen
+	// tokens could be used to guess the password without any limits.
+	account := signinAccount(string(user.Email))
+	ip := clientIP(req, cfg)
+	attempt := allowSigninAttempt(ctx, attempts, account, ip, logger, res)
+	if attempt == nil {
+		return
+	}
+
+	err := usersManager.ChangePassword(ctx, userID, parsedReq.CurrentPassword, parsedReq.NewPassword)
+	if err != nil {
+		if errors.Is(err, users.InvalidCredentialsErr) {
+			signinFailed(ctx, attempts, attempt, account, ip, logger)
+		} else {
+			releaseSigninAttempt(ctx, attempts, attempt, logger)
+		}
+
+		switch {
+		case errors.Is(err, users.InvalidUserParamErr):
+			invalidUserParam(logger, res, err)
+		case errors.Is(err, users.InvalidCredentialsErr):
+			writeErrorResponse(logger, res, http.StatusForbidden, "current password doesn't match")
+		case errors.Is(err, users.UserNotFoundErr):
+			notFound(logger, res, req)
+		default:
+			internalServerError(logger, res, err)
+		}
+		return
+	}
+	signinSucceeded(ctx, attempts, attempt, logger)
+
+	// WHY: the refresh tokens of the current session are revoked too,
+	// there is no way to tell which family belongs to it.
+	err = revokeUserTokens(ctx, tokens, refreshTokens, userID, s.accessToken)
+	if err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+	// WHY: API keys created by whoever knew the old password
+	// would keep working after the password changes.
+	if err := apiKeys.RevokeUserKeys(ctx, userID); err != nil {
+		internalServerError(logger, res, err)
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// parseUserPath parses paths on the form /v1/users/{id}/{subresource},
+// where the subresource is optional (and may have multiple segments).
+// If there is no user ID on the path the returned ID is empty.
+func parseUserPath(path string) (string, string) {
+	const prefix = "/v1/users/"
+
+	parts := strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// userETag returns a strong entity tag for the user, as defined on:
+// https://tools.ietf.org/html/rfc7232#section-2.3
+func userETag(user users.User) string {
+	return `"` + strconv.FormatInt(user.Version, 10) + `"`
+}
+
+// ifMatch evaluates the If-Match header against the current etag, as defined on:
+// https://tools.ietf.org/html/rfc7232#section-3.1
+// Returns true if the header is exactly the etag, false otherwise (including
+// when it is absent). Weak entity tags, lists and "*" never match.
+func ifMatch(req *http.Request, etag string) bool {
+	// WHY: "*" matches any version and lists can hold guessed versions,
+	// both would defeat the protection against lost updates.
+	return strings.TrimSpace(req.Header.Get("If-Match")) == etag
+}
+
+func newUserResponse(user users.User) UserResponse {
+	return UserResponse{
+		ID:       user.ID,
+		FullName: user.FullName,
+		Email:    string(user.Email),
+		Status:   string(user.Status),
+	}
+}
+
+// newUserResponseFor creates the user response as seen by the requester,
+// only users allowed to suspend users can see the status reason.
+func newUserResponseFor(authorizer *auth.Authorizer, r requester, user users.User) UserResponse {
+	userRes := newUserResponse(user)
+	if r.hasPermission(authorizer, users.SuspendUsersPermission) {
+		userRes.StatusReason = user.StatusReason
+	}
+	return userRes
+}
+
+// invalidUserParam writes the response of users.InvalidUserParamErr errors,
+// informing the violated rules when the error is caused by the password policy.
+func invalidUserParam(logger *log.Entry, res http.ResponseWriter, err error) {
+	var policyErr *users.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		writeErrorResponse(logger, res, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	violations := make([]PasswordViolation, len(policyErr.Violations))
+	for i, violation := range policyErr.Violations {
+		violations[i] = PasswordViolation{
+			Rule:    string(violation.Rule),
+			Message: violation.Message,
+		}
+	}
+
+	res.WriteHeader(http.StatusBadRequest)
+	logResponseBodyWrite(logger, res, jsonResponse(ErrorResponse{
+		Error: Error{
+			Message:            policyErr.Error(),
+			PasswordViolations: violations,
+		},
+	}))
+	logger.WithFields(log.Fields{"error": err.Error(), "status": http.StatusBadRequest}).Warning("request failed")
+}
@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	APIKeyNotFoundErr     Error = "API key not found"
+	InvalidAPIKeyParamErr Error = "invalid API key parameter"
+)
+
+// APIKey is a long lived personal API key of an user. The key itself
+// is only known when it is created, only its hash is stored.
+type APIKey struct {
+	ID     string
+	UserID string
+	Name   string
+	Hash   string
+
+	// Scopes restrict the permissions of the user when using the key,
+	// if there are no scopes the key has all the user permissions.
+	Scopes []string
+
+	CreatedAt time.Time
+	// ExpiresAt is zero if the key never expires
+	ExpiresAt time.Time
+	// LastUsedAt is zero if the key was never used
+	LastUsedAt time.Time
+}
+
+// APIKeysStore is where API keys are stored.
+type APIKeysStore interface {
+	// AddAPIKey adds the API key, returning its ID.
+	AddAPIKey(ctx context.Context, key APIKey) (string, error)
+
+	// APIKeyByHash MUST return APIKeyNotFoundErr (possibly wrapped)
+	// if there is no API key with the given hash.
+	APIKeyByHash(ctx context.Context, hash string) (APIKey, error)
+
+	// APIKeys retrieves all API keys of the given user.
+	APIKeys(ctx context.Context, userID string) ([]APIKey, error)
+
+	// DeleteAPIKey MUST return APIKeyNotFoundErr (possibly wrapped)
+	// if the user has no API key with the given ID.
+	DeleteAPIKey(ctx context.Context, userID string, id string) error
+
+	// DeleteUserAPIKeys deletes all API keys of the given user.
+	DeleteUserAPIKeys(ctx context.Context, userID string) error
+
+	UpdateAPIKeyLastUsed(ctx context.Context, id string, lastUsed time.Time) error
+}
+
+// APIKeys is responsible for creating and validating personal API keys.
+type APIKeys struct {
+	store APIKeysStore
+}
+
+const (
+	// WHY: the prefix tells API keys apart from other tokens
+	// and makes leaked keys easy to find by secret scanners.
+	apiKeyPrefix = "stk_"
+
+	maxAPIKeyNameLen = 100
+
+	// WHY: recording every single use would mean a write on
+	// every request, the last used time doesn't need to be precise.
+	lastUsedResolution = time.Minute
+)
+
+// NewAPIKeys creates a new APIKeys that stores the keys on the given store.
+func NewAPIKeys(store APIKeysStore) *APIKeys {
+	return &APIKeys{store: store}
+}
+
+// IsAPIKey returns true if the given token has the format of an API key,
+// it doesn't validate the key.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// Create creates a new API key for the given user with the given name and
+// optional scopes and expiration time (zero means it never expires).
+// It returns the created key and the key itself, which must be shown to the
+// user since it can't be retrieved anymore.
+//
+// If any parameter is invalid it returns InvalidAPIKeyParamErr.
+func (k *APIKeys) Create(
+	ctx context.Context,
+	userID string,
+	name string,
+	scopes []string,
+	expiresAt time.Time,
+) (APIKey, string, error) {
+	now := time.Now()
+	key, err := newAPIKey(userID, name, scopes, expiresAt, now)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	token = apiKeyPrefix + token
+	key.Hash = apiKeyHash(token)
+
+	key.ID, err = k.store.AddAPIKey(ctx, key)
+	if err != nil {
+		return APIKey{}, "", fmt.Errorf("error storing API key:%v", err)
+	}
+	return key, token, nil
+}
+
+// List lists all API keys of the given user.
+func (k *APIKeys) List(ctx context.Context, userID string) ([]APIKey, error) {
+	return k.store.APIKeys(ctx, userID)
+}
+
+// Revoke revokes the API key with the given ID of the given user.
+// If the user has no such key it returns APIKeyNotFoundErr.
+func (k *APIKeys) Revoke(ctx context.Context, userID string, id string) error {
+	return k.store.DeleteAPIKey(ctx, userID, id)
+}
+
+// RevokeUserKeys revokes all API keys of the given user.
+func (k *APIKeys) RevokeUserKeys(ctx context.Context, userID string) error {
+	if err := k.store.DeleteUserAPIKeys(ctx, userID); err != nil {
+		return fmt.Errorf("error revoking API keys of user %q:%v", userID, err)
+	}
+	return nil
+}
+
+// Introspect validates the given API key and returns information about it,
+// also recording that the key has been used. If the key is invalid, revoked
+// or expired it returns InvalidTokenErr.
+func (k *APIKeys) Introspect(ctx context.Context, token string) (TokenInfo, error) {
+	if !IsAPIKey(token) {
+		return TokenInfo{}, fmt.Errorf("%w:not an API key", InvalidTokenErr)
+	}
+
+	key, err := k.store.APIKeyByHash(ctx, apiKeyHash(token))
+	if err != nil {
+		if errors.Is(err, APIKeyNotFoundErr) {
+			return TokenInfo{}, InvalidTokenErr
+		}
+		return TokenInfo{}, fmt.Errorf("error retrieving API key:%v", err)
+	}
+
+	now := time.Now()
+	if !key.ExpiresAt.IsZero() && !now.Before(key.ExpiresAt) {
+		return TokenInfo{}, fmt.Errorf("%w:API key %s expired", InvalidTokenErr, key.ID)
+	}
+
+	if now.Sub(key.LastUsedAt) >= lastUsedResolution {
+		err := k.store.UpdateAPIKeyLastUsed(ctx, key.ID, now)
+		if err != nil {
+			return TokenInfo{}, fmt.Errorf("error updating API key last used time:%v", err)
+		}
+	}
+
+	return TokenInfo{
+		UserID:    key.UserID,
+		Scopes:    key.Scopes,
+		IssuedAt:  key.CreatedAt,
+		ExpiresAt: key.ExpiresAt,
+	}, nil
+}
+
+func newAPIKey(userID string, name string, scopes []string, expiresAt time.Time, now time.Time) (APIKey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return APIKey{}, fmt.Errorf("%w:name can't be empty", InvalidAPIKeyParamErr)
+	}
+	if len(name) > maxAPIKeyNameLen {
+		return APIKey{}, fmt.Errorf("%w:name exceeds %d characters", InvalidAPIKeyParamErr, maxAPIKeyNameLen)
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(now) {
+		return APIKey{}, fmt.Errorf("%w:expiration time must be in the future", InvalidAPIKeyParamErr)
+	}
+
+	validScopes := []string{}
+	for _, scope := range scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t\n") {
+			return APIKey{}, fmt.Errorf("%w:invalid scope %q", InvalidAPIKeyParamErr, scope)
+		}
+		if !contains(validScopes, scope) {
+			validScopes = append(validScopes, scope)
+		}
+	}
+
+	return APIKey{
+		UserID:    userID,
+		Name:      name,
+		Scopes:    validScopes,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// WHY: API keys have enough entropy that a plain hash is safe, unlike
+// passwords, and it allows finding the key by its hash.
+func apiKeyHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func contains(vals []string, val string) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
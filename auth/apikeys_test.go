@@ -0,0 +1,270 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katcipis/stonks/auth"
+)
+
+func TestAPIKeys(t *testing.T) {
+	const userID = "13"
+
+	store := newAPIKeysStore()
+	apiKeys := auth.NewAPIKeys(store)
+	ctx := context.Background()
+
+	key, token, err := apiKeys.Create(ctx, userID, " deploy bot ", []string{"users:read", "users:read"}, time.Time{})
+	assertNoErr(t, err)
+
+	if !auth.IsAPIKey(token) {
+		t.Fatalf("created key %q doesn't have the API key format", token)
+	}
+	if key.ID == "" || key.UserID != userID || key.Name != "deploy bot" {
+		t.Fatalf("got unexpected API key %+v", key)
+	}
+	if !reflect.DeepEqual(key.Scopes, []string{"users:read"}) {
+		t.Fatalf("got scopes %v", key.Scopes)
+	}
+	if strings.Contains(key.Hash, token) || store.hasToken(token) {
+		t.Fatal("API keys must be stored hashed")
+	}
+
+	info, err := apiKeys.Introspect(ctx, token)
+	assertNoErr(t, err)
+
+	if info.UserID != userID || !reflect.DeepEqual(info.Scopes, key.Scopes) || !info.ExpiresAt.IsZero() {
+		t.Fatalf("got token info %+v for key %+v", info, key)
+	}
+
+	listed, err := apiKeys.List(ctx, userID)
+	assertNoErr(t, err)
+
+	if len(listed) != 1 || listed[0].ID != key.ID || listed[0].LastUsedAt.IsZero() {
+		t.Fatalf("got listed keys %+v, want used key %+v", listed, key)
+	}
+
+	err = apiKeys.Revoke(ctx, "other user", key.ID)
+	if !errors.Is(err, auth.APIKeyNotFoundErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.APIKeyNotFoundErr)
+	}
+
+	assertNoErr(t, apiKeys.Revoke(ctx, userID, key.ID))
+
+	_, err = apiKeys.Introspect(ctx, token)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	err = apiKeys.Revoke(ctx, userID, key.ID)
+	if !errors.Is(err, auth.APIKeyNotFoundErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.APIKeyNotFoundErr)
+	}
+}
+
+func TestRevokeUserAPIKeys(t *testing.T) {
+	apiKeys := auth.NewAPIKeys(newAPIKeysStore())
+	ctx := context.Background()
+
+	_, token, err := apiKeys.Create(ctx, "1", "first", nil, time.Time{})
+	assertNoErr(t, err)
+
+	_, anotherToken, err := apiKeys.Create(ctx, "1", "second", nil, time.Time{})
+	assertNoErr(t, err)
+
+	_, otherUserToken, err := apiKeys.Create(ctx, "2", "other user", nil, time.Time{})
+	assertNoErr(t, err)
+
+	assertNoErr(t, apiKeys.RevokeUserKeys(ctx, "1"))
+
+	for _, revoked := range []string{token, anotherToken} {
+		_, err := apiKeys.Introspect(ctx, revoked)
+		if !errors.Is(err, auth.InvalidTokenErr) {
+			t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+		}
+	}
+
+	_, err = apiKeys.Introspect(ctx, otherUserToken)
+	assertNoErr(t, err)
+}
+
+func TestAPIKeyExpiration(t *testing.T) {
+	store := newAPIKeysStore()
+	apiKeys := auth.NewAPIKeys(store)
+	ctx := context.Background()
+
+	key, token, err := apiKeys.Create(ctx, "1", "expiring", nil, time.Now().Add(time.Hour))
+	assertNoErr(t, err)
+
+	_, err = apiKeys.Introspect(ctx, token)
+	assertNoErr(t, err)
+
+	store.setExpiration(key.ID, time.Now().Add(-time.Second))
+
+	_, err = apiKeys.Introspect(ctx, token)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+func TestAPIKeyLastUsedIsNotRecordedOnEveryUse(t *testing.T) {
+	store := newAPIKeysStore()
+	apiKeys := auth.NewAPIKeys(store)
+	ctx := context.Background()
+
+	_, token, err := apiKeys.Create(ctx, "1", "busy", nil, time.Time{})
+	assertNoErr(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err := apiKeys.Introspect(ctx, token)
+		assertNoErr(t, err)
+	}
+
+	if store.lastUsedUpdates != 1 {
+		t.Fatalf("got %d last used updates, want 1", store.lastUsedUpdates)
+	}
+}
+
+func TestInvalidAPIKeys(t *testing.T) {
+	apiKeys := auth.NewAPIKeys(newAPIKeysStore())
+	ctx := context.Background()
+
+	type Test struct {
+		name      string
+		keyName   string
+		scopes    []string
+		expiresAt time.Time
+	}
+
+	tests := []Test{
+		{name: "EmptyName", keyName: " "},
+		{name: "NameTooLong", keyName: strings.Repeat("k", 101)},
+		{name: "EmptyScope", keyName: "key", scopes: []string{""}},
+		{name: "ScopeWithSpaces", keyName: "key", scopes: []string{"users:read users:list"}},
+		{name: "ExpiredOnCreation", keyName: "key", expiresAt: time.Now().Add(-time.Minute)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := apiKeys.Create(ctx, "1", test.keyName, test.scopes, test.expiresAt)
+			if !errors.Is(err, auth.InvalidAPIKeyParamErr) {
+				t.Fatalf("got err[%v] want[%v]", err, auth.InvalidAPIKeyParamErr)
+			}
+		})
+	}
+
+	for _, token := range []string{"", "invalid", "stk_unknown"} {
+		_, err := apiKeys.Introspect(ctx, token)
+		if !errors.Is(err, auth.InvalidTokenErr) {
+			t.Fatalf("token %q: got err[%v] want[%v]", token, err, auth.InvalidTokenErr)
+		}
+	}
+}
+
+type apiKeysStore struct {
+	mutex           sync.Mutex
+	nextID          int
+	keys            map[string]auth.APIKey
+	lastUsedUpdates int
+}
+
+func newAPIKeysStore() *apiKeysStore {
+	return &apiKeysStore{keys: map[string]auth.APIKey{}}
+}
+
+func (s *apiKeysStore) AddAPIKey(ctx context.Context, key auth.APIKey) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.nextID++
+	key.ID = strconv.Itoa(s.nextID)
+	s.keys[key.ID] = key
+	return key.ID, nil
+}
+
+func (s *apiKeysStore) APIKeyByHash(ctx context.Context, hash string) (auth.APIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, key := range s.keys {
+		if key.Hash == hash {
+			return key, nil
+		}
+	}
+	return auth.APIKey{}, auth.APIKeyNotFoundErr
+}
+
+func (s *apiKeysStore) APIKeys(ctx context.Context, userID string) ([]auth.APIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keys := []auth.APIKey{}
+	for _, key := range s.keys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *apiKeysStore) DeleteAPIKey(ctx context.Context, userID string, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok || key.UserID != userID {
+		return auth.APIKeyNotFoundErr
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+func (s *apiKeysStore) DeleteUserAPIKeys(ctx context.Context, userID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, key := range s.keys {
+		if key.UserID == userID {
+			delete(s.keys, id)
+		}
+	}
+	return nil
+}
+
+func (s *apiKeysStore) UpdateAPIKeyLastUsed(ctx context.Context, id string, lastUsed time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := s.keys[id]
+	key.LastUsedAt = lastUsed
+	s.keys[id] = key
+	s.lastUsedUpdates++
+	return nil
+}
+
+func (s *apiKeysStore) setExpiration(id string, expiresAt time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := s.keys[id]
+	key.ExpiresAt = expiresAt
+	s.keys[id] = key
+}
+
+func (s *apiKeysStore) hasToken(token string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, key := range s.keys {
+		if key.Hash == token {
+			return true
+		}
+	}
+	return false
+}
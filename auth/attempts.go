@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/katcipis/stonks/auth/kvstore"
+)
+
+const (
+	TooManyAttemptsErr Error = "too many failed attempts"
+)
+
+// SigninAttemptsConfig has all configuration needed to protect
+// sign ins against brute force attacks.
+type SigninAttemptsConfig struct {
+	// Window is for how long failed attempts are counted
+	Window time.Duration
+
+	// MaxAccountFailures is how many failed attempts on an account,
+	// during the window, lock the account.
+	MaxAccountFailures int64
+
+	// MaxIPFailures is how many failed attempts from an IP, on any
+	// account, during the window, block new attempts from the IP.
+	MaxIPFailures int64
+
+	// Lockout is for how long accounts stay locked
+	Lockout time.Duration
+
+	// Delay is the minimum delay between attempts on an account after
+	// a failed attempt, it doubles after each failure up to MaxDelay.
+	// If zero there is no delay between attempts.
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// SigninAttempts keeps track of failed sign in attempts, per account and
+// per IP, to protect against brute force attacks like credential stuffing.
+// Failed attempts are kept on the store, so they are shared by all
+// processes using the same store.
+type SigninAttempts struct {
+	store KVStore
+	cfg   SigninAttemptsConfig
+}
+
+// SigninAttempt is a sign in attempt allowed by SigninAttempts.Begin,
+// its result must be recorded with Succeeded, Failed or Release.
+type SigninAttempt struct {
+	account      string
+	ip           string
+	accountEvent string
+	ipEvent      string
+	// accountFailures includes the attempt itself
+	accountFailures int64
+}
+
+// NewSigninAttempts creates a new SigninAttempts that will
+// keep failed attempts on the given store.
+func NewSigninAttempts(store KVStore, cfg SigninAttemptsConfig) *SigninAttempts {
+	return &SigninAttempts{store: store, cfg: cfg}
+}
+
+// Begin checks if a sign in attempt on the account from the IP is allowed,
+// it must be called before verifying the credentials. Accounts are any
+// identifier of users, like their email, they don't need to exist.
+// If the attempt is not allowed it returns TooManyAttemptsErr (possibly
+// wrapped) and for how long attempts will still be refused.
+//
+// Allowed attempts are counted as failed until their result is recorded,
+// so concurrent attempts (even on different processes) can't get around
+// the limits by all being checked before any of them fails.
+func (s *SigninAttempts) Begin(ctx context.Context, account string, ip string) (*SigninAttempt, time.Duration, error) {
+	now := time.Now()
+
+	lockedUntil, err := s.lockedUntil(ctx, account)
+	if err != nil {
+		return nil, 0, err
+	}
+	if now.Before(lockedUntil) {
+		return nil, lockedUntil.Sub(now), fmt.Errorf("%w:account is locked", TooManyAttemptsErr)
+	}
+
+	ipFailures, ipEvent, err := s.store.WindowReserve(ctx, s.ipKey(ip), now, s.cfg.Window)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reserving sign in attempt of IP:%v", err)
+	}
+	attempt := &SigninAttempt{account: account, ip: ip, ipEvent: ipEvent}
+
+	if ipFailures.Count >= s.cfg.MaxIPFailures {
+		// WHY: refused attempts are not counted, so after a window
+		// without attempts being counted the IP is unblocked.
+		retryAfter := ipFailures.Last.Add(s.cfg.Window).Sub(now)
+		return nil, retryAfter, s.refuse(ctx, attempt, fmt.Errorf(
+			"%w:IP has %d failed attempts", TooManyAttemptsErr, ipFailures.Count))
+	}
+
+	accountFailures, accountEvent, err := s.store.WindowReserve(ctx, s.accountKey(account), now, s.cfg.Window)
+	if err != nil {
+		return nil, 0, s.refuse(ctx, attempt, fmt.Errorf("error reserving sign in attempt of account:%v", err))
+	}
+	attempt.accountEvent = accountEvent
+	attempt.accountFailures = accountFailures.Count + 1
+
+	if accountFailures.Count == 0 {
+		return attempt, 0, nil
+	}
+
+	// WHY: failures that would lock the account may be still in flight,
+	// further attempts must wait for them instead of being verified too.
+	if accountFailures.Count >= s.cfg.MaxAccountFailures {
+		return nil, s.delay(accountFailures.Count), s.refuse(ctx, attempt, fmt.Errorf(
+			"%w:account has %d failed attempts", TooManyAttemptsErr, accountFailures.Count))
+	}
+
+	allowedAt := accountFailures.Last.Add(s.delay(accountFailures.Count))
+	if now.Before(allowedAt) {
+		return nil, allowedAt.Sub(now), s.refuse(ctx, attempt, fmt.Errorf(
+			"%w:account has %d failed attempts, delaying next attempt", TooManyAttemptsErr, accountFailures.Count))
+	}
+	return attempt, 0, nil
+}
+
+// Succeeded records that the sign in attempt succeeded, forgetting
+// the failed attempts of its account.
+func (s *SigninAttempts) Succeeded(ctx context.Context, attempt *SigninAttempt) error {
+	if err := s.store.WindowRemove(ctx, s.ipKey(attempt.ip), attempt.ipEvent); err != nil {
+		return fmt.Errorf("error removing sign in attempt of IP:%v", err)
+	}
+	if err := s.store.Delete(ctx, s.accountKey(attempt.account)); err != nil {
+		return fmt.Errorf("error clearing failed sign in attempts of account:%v", err)
+	}
+	return nil
+}
+
+// Failed records that the sign in attempt failed, returning
+// true if the account got locked because of it.
+func (s *SigninAttempts) Failed(ctx context.Context, attempt *SigninAttempt) (bool, error) {
+	// WHY: the attempt is already counted as failed since Begin
+	if attempt.accountFailures < s.cfg.MaxAccountFailures {
+		return false, nil
+	}
+
+	lockedUntil := time.Now().Add(s.cfg.Lockout)
+	val := []byte(strconv.FormatInt(lockedUntil.UnixNano(), 10))
+	if err := s.store.Put(ctx, s.lockKey(attempt.account), val, s.cfg.Lockout); err != nil {
+		return false, fmt.Errorf("error locking account:%v", err)
+	}
+	// WHY: after the lockout the account gets a fresh set of attempts,
+	// otherwise any failure would lock it again until the window slides.
+	if err := s.store.Delete(ctx, s.accountKey(attempt.account)); err != nil {
+		return false, fmt.Errorf("error clearing failed sign in attempts of account:%v", err)
+	}
+	return true, nil
+}
+
+// Release forgets the sign in attempt without recording any result, like
+// when the credentials could not be verified because of an internal error.
+func (s *SigninAttempts) Release(ctx context.Context, attempt *SigninAttempt) error {
+	if err := s.store.WindowRemove(ctx, s.ipKey(attempt.ip), attempt.ipEvent); err != nil {
+		return fmt.Errorf("error removing sign in attempt of IP:%v", err)
+	}
+	if attempt.accountEvent == "" {
+		return nil
+	}
+	if err := s.store.WindowRemove(ctx, s.accountKey(attempt.account), attempt.accountEvent); err != nil {
+		return fmt.Errorf("error removing sign in attempt of account:%v", err)
+	}
+	return nil
+}
+
+// refuse releases a refused attempt, returning err
+func (s *SigninAttempts) refuse(ctx context.Context, attempt *SigninAttempt, err error) error {
+	if releaseErr := s.Release(ctx, attempt); releaseErr != nil {
+		return fmt.Errorf("%w:%v", err, releaseErr)
+	}
+	return err
+}
+
+// Unlock unlocks the account, also forgetting its failed attempts.
+// Unlocking accounts that are not locked is not considered an error.
+func (s *SigninAttempts) Unlock(ctx context.Context, account string) error {
+	if err := s.store.Delete(ctx, s.lockKey(account)); err != nil {
+		return fmt.Errorf("error unlocking account:%v", err)
+	}
+	if err := s.store.Delete(ctx, s.accountKey(account)); err != nil {
+		return fmt.Errorf("error clearing failed sign in attempts of account:%v", err)
+	}
+	return nil
+}
+
+func (s *SigninAttempts) lockedUntil(ctx context.Context, account string) (time.Time, error) {
+	val, err := s.store.Get(ctx, s.lockKey(account))
+	if err != nil {
+		if errors.Is(err, kvstore.KeyNotFoundErr) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, fmt.Errorf("error retrieving account lock:%v", err)
+	}
+	nanos, err := strconv.ParseInt(string(val), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid account lock %q:%v", val, err)
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// delay returns the minimum delay between attempts after the given failures
+func (s *SigninAttempts) delay(failures int64) time.Duration {
+	delay := s.cfg.Delay
+	for i := int64(1); i < failures && delay < s.cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.cfg.MaxDelay {
+		return s.cfg.MaxDelay
+	}
+	return delay
+}
+
+func (s *SigninAttempts) accountKey(account string) string {
+	// WHY: accounts and IPs are hashed, so the store
+	// doesn't keep the emails and IPs of users.
+	return hashedKey("signin-failures:account", account)
+}
+
+func (s *SigninAttempts) ipKey(ip string) string {
+	return hashedKey("signin-failures:ip", ip)
+}
+
+func (s *SigninAttempts) lockKey(account string) string {
+	return hashedKey("signin-lock:account", account)
+}
@@ -0,0 +1,254 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/kvstore"
+)
+
+func TestSigninAttemptsLockout(t *testing.T) {
+	const (
+		account = "locked@test.com"
+		ip      = "10.0.0.1"
+		lockout = time.Hour
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	attempts := auth.NewSigninAttempts(kvstore.New(m.Addr(), ""), auth.SigninAttemptsConfig{
+		Window:             time.Hour,
+		MaxAccountFailures: 3,
+		MaxIPFailures:      100,
+		Lockout:            lockout,
+	})
+	ctx := context.Background()
+
+	lock := func() {
+		t.Helper()
+
+		for i := 1; i <= 3; i++ {
+			attempt := beginSignin(t, attempts, account, ip)
+
+			locked, err := attempts.Failed(ctx, attempt)
+			assertNoErr(t, err)
+
+			if wantLocked := i == 3; locked != wantLocked {
+				t.Fatalf("failure %d: got locked %t want %t", i, locked, wantLocked)
+			}
+		}
+
+		retryAfter := assertSigninRefused(t, attempts, account, ip)
+		if retryAfter <= lockout-time.Minute || retryAfter > lockout {
+			t.Fatalf("got retry after %v want close to %v", retryAfter, lockout)
+		}
+		// WHY: locking an account must not affect the others
+		assertSigninAllowed(t, attempts, "another@test.com", ip)
+	}
+
+	lock()
+	m.FastForward(lockout)
+
+	// After the lockout the account has all its attempts again
+	locked, err := attempts.Failed(ctx, beginSignin(t, attempts, account, ip))
+	assertNoErr(t, err)
+
+	if locked {
+		t.Fatal("account locked again by its first failure after the lockout")
+	}
+
+	assertNoErr(t, attempts.Unlock(ctx, account))
+	lock()
+
+	assertNoErr(t, attempts.Unlock(ctx, account))
+	assertSigninAllowed(t, attempts, account, ip)
+
+	// Unlocking accounts that are not locked is fine
+	assertNoErr(t, attempts.Unlock(ctx, "notlocked@test.com"))
+}
+
+func TestSigninAttemptsIPBlock(t *testing.T) {
+	const ip = "10.0.0.1"
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	attempts := auth.NewSigninAttempts(kvstore.New(m.Addr(), ""), auth.SigninAttemptsConfig{
+		Window:             time.Hour,
+		MaxAccountFailures: 100,
+		MaxIPFailures:      3,
+		Lockout:            time.Hour,
+	})
+	ctx := context.Background()
+
+	accounts := []string{"first@test.com", "second@test.com", "third@test.com"}
+	for _, account := range accounts {
+		locked, err := attempts.Failed(ctx, beginSignin(t, attempts, account, ip))
+		assertNoErr(t, err)
+
+		if locked {
+			t.Fatalf("account %q locked by a single failure", account)
+		}
+	}
+
+	retryAfter := assertSigninRefused(t, attempts, "fourth@test.com", ip)
+	if retryAfter <= 59*time.Minute || retryAfter > time.Hour {
+		t.Fatalf("got retry after %v want close to %v", retryAfter, time.Hour)
+	}
+
+	assertSigninAllowed(t, attempts, "fourth@test.com", "10.0.0.2")
+}
+
+func TestSigninAttemptsProgressiveDelay(t *testing.T) {
+	const (
+		account  = "delayed@test.com"
+		ip       = "10.0.0.1"
+		delay    = 50 * time.Millisecond
+		maxDelay = 4 * delay
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	attempts := auth.NewSigninAttempts(kvstore.New(m.Addr(), ""), auth.SigninAttemptsConfig{
+		Window:             time.Hour,
+		MaxAccountFailures: 100,
+		MaxIPFailures:      100,
+		Lockout:            time.Hour,
+		Delay:              delay,
+		MaxDelay:           maxDelay,
+	})
+	ctx := context.Background()
+
+	wantDelays := []time.Duration{delay, 2 * delay, 4 * delay, maxDelay, maxDelay}
+
+	for i, wantDelay := range wantDelays {
+		_, err := attempts.Failed(ctx, beginSignin(t, attempts, account, ip))
+		assertNoErr(t, err)
+
+		retryAfter := assertSigninRefused(t, attempts, account, ip)
+		if retryAfter > wantDelay || retryAfter <= wantDelay/2 {
+			t.Fatalf("failure %d: got retry after %v want close to %v", i+1, retryAfter, wantDelay)
+		}
+
+		// WHY: delays only apply to the account
+		assertSigninAllowed(t, attempts, "another@test.com", ip)
+
+		time.Sleep(retryAfter)
+	}
+}
+
+func TestSigninAttemptsAreReserved(t *testing.T) {
+	const (
+		account = "concurrent@test.com"
+		ip      = "10.0.0.1"
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	attempts := auth.NewSigninAttempts(kvstore.New(m.Addr(), ""), auth.SigninAttemptsConfig{
+		Window:             time.Hour,
+		MaxAccountFailures: 3,
+		MaxIPFailures:      5,
+		Lockout:            time.Hour,
+	})
+	ctx := context.Background()
+
+	// WHY: attempts in flight count as failures, so concurrent
+	// attempts can't all be checked before any of them fails.
+	inFlight := []*auth.SigninAttempt{
+		beginSignin(t, attempts, account, ip),
+		beginSignin(t, attempts, account, ip),
+		beginSignin(t, attempts, account, ip),
+	}
+	assertSigninRefused(t, attempts, account, ip)
+
+	// Refused attempts are not counted, the IP still has two attempts
+	beginSignin(t, attempts, "another@test.com", ip)
+	beginSignin(t, attempts, "another@test.com", ip)
+	assertSigninRefused(t, attempts, "yetanother@test.com", ip)
+
+	// Released attempts are not counted
+	for _, attempt := range inFlight {
+		assertNoErr(t, attempts.Release(ctx, attempt))
+	}
+	for i := 1; i <= 3; i++ {
+		locked, err := attempts.Failed(ctx, beginSignin(t, attempts, account, ip))
+		assertNoErr(t, err)
+
+		if wantLocked := i == 3; locked != wantLocked {
+			t.Fatalf("failure %d: got locked %t want %t", i, locked, wantLocked)
+		}
+	}
+	assertSigninRefused(t, attempts, account, ip)
+}
+
+func TestSigninAttemptsSuccessClearsFailures(t *testing.T) {
+	const (
+		account = "success@test.com"
+		ip      = "10.0.0.1"
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	attempts := auth.NewSigninAttempts(kvstore.New(m.Addr(), ""), auth.SigninAttemptsConfig{
+		Window:             time.Hour,
+		MaxAccountFailures: 3,
+		MaxIPFailures:      100,
+		Lockout:            time.Hour,
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 2; j++ {
+			locked, err := attempts.Failed(ctx, beginSignin(t, attempts, account, ip))
+			assertNoErr(t, err)
+
+			if locked {
+				t.Fatalf("round %d: account locked even with a success after each two failures", i)
+			}
+		}
+		assertNoErr(t, attempts.Succeeded(ctx, beginSignin(t, attempts, account, ip)))
+	}
+}
+
+// beginSignin begins a sign in attempt, failing the test if it is refused
+func beginSignin(t *testing.T, attempts *auth.SigninAttempts, account string, ip string) *auth.SigninAttempt {
+	t.Helper()
+
+	attempt, retryAfter, err := attempts.Begin(context.Background(), account, ip)
+	assertNoErr(t, err)
+
+	if retryAfter != 0 {
+		t.Fatalf("got retry after %v on allowed attempt", retryAfter)
+	}
+	return attempt
+}
+
+// assertSigninAllowed checks that a sign in attempt is allowed
+// without counting it, by releasing it right away.
+func assertSigninAllowed(t *testing.T, attempts *auth.SigninAttempts, account string, ip string) {
+	t.Helper()
+
+	attempt := beginSignin(t, attempts, account, ip)
+	assertNoErr(t, attempts.Release(context.Background(), attempt))
+}
+
+func assertSigninRefused(t *testing.T, attempts *auth.SigninAttempts, account string, ip string) time.Duration {
+	t.Helper()
+
+	attempt, retryAfter, err := attempts.Begin(context.Background(), account, ip)
+	if !errors.Is(err, auth.TooManyAttemptsErr) {
+		t.Fatalf("got err [%v] want [%v]", err, auth.TooManyAttemptsErr)
+	}
+	if attempt != nil {
+		t.Fatal("got attempt on refused sign in")
+	}
+	return retryAfter
+}
@@ -1,27 +1,125 @@
 package auth
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/katcipis/stonks/users"
+)
 
 // Authorizer is responsible for authorization and security related operations
 type Authorizer struct {
+	mutex   sync.RWMutex
+	roles   map[string]map[users.Permission]struct{}
+	hashing PasswordHashing
 }
 
-// New creates a new Authorizer
+// New creates a new Authorizer with only the builtin roles:
+//
+// - users.UserRole: no permissions besides acting upon itself
+// - users.AdminRole: all permissions
+//
+// Custom roles can be added with AddRole.
+// Passwords are hashed with bcrypt using its default cost,
+// see NewWithPasswordHashing to use other schemes.
 func New() *Authorizer {
-	return &Authorizer{}
+	return &Authorizer{
+		roles: map[string]map[users.Permission]struct{}{
+			users.UserRole:  newPermissionSet(),
+			users.AdminRole: newPermissionSet(users.AnyPermission),
+		},
+		hashing: PasswordHashing{
+			Scheme:     BcryptScheme,
+			BcryptCost: bcrypt.DefaultCost,
+		}.withDefaults(),
+	}
+}
+
+// NewWithPasswordHashing creates a new Authorizer just like New, but
+// passwords are hashed with the given configuration. When the scheme
+// is not set argon2id is used.
+//
+// Prefer argon2id or scrypt, bcrypt ignores everything after the
+// first 72 bytes of passwords (unless a pepper is used).
+func NewWithPasswordHashing(hashing PasswordHashing) (*Authorizer, error) {
+	hashing = hashing.withDefaults()
+	if err := hashing.validate(); err != nil {
+		return nil, fmt.Errorf("invalid password hashing:%v", err)
+	}
+
+	a := New()
+	a.hashing = hashing
+	return a, nil
 }
 
 // PasswordHash is responsible for creating safe hashes from
 // passwords, suitable for storage and comparison later
-// using IsPasswordMatch.
-func (*Authorizer) PasswordHash(pass string) (string, error) {
-	v, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
-	return string(v), err
+// using HashMatchesPassword.
+func (a *Authorizer) PasswordHash(pass string) (string, error) {
+	return a.hashing.hash(pass)
 }
 
 // HashMatchesPassword checks if the salted hash matches the
 // given plain text password, returning true if there is a match,
-// false otherwise.
-func (*Authorizer) HashMatchesPassword(saltedhash string, password string) bool {
-	return bcrypt.CompareHashAndPassword([]byte(saltedhash), []byte(password)) == nil
+// false otherwise. Hashes of any supported scheme are accepted,
+// independent of how the Authorizer creates new hashes.
+func (a *Authorizer) HashMatchesPassword(saltedhash string, password string) bool {
+	return a.hashing.matches(saltedhash, password)
+}
+
+// PasswordNeedsRehash returns true if the given hash was not created
+// with the current scheme, parameters and pepper, in which case the password
+// should be hashed again (when it is known, like after signing in).
+// Invalid hashes never need a rehash, since they can't be matched.
+func (a *Authorizer) PasswordNeedsRehash(saltedhash string) bool {
+	return a.hashing.outdated(saltedhash)
+}
+
+// AddRole adds a custom role, if a custom role with the same name
+// already exists it is replaced. Builtin roles can't be replaced.
+func (a *Authorizer) AddRole(role users.Role) error {
+	if role.Name == "" {
+		return fmt.Errorf("role must have a name")
+	}
+	if role.Name == users.UserRole || role.Name == users.AdminRole {
+		return fmt.Errorf("builtin role %q can't be redefined", role.Name)
+	}
+	for _, perm := range role.Permissions {
+		if perm == "" {
+			return fmt.Errorf("role %q has an empty permission", role.Name)
+		}
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.roles[role.Name] = newPermissionSet(role.Permissions...)
+	return nil
+}
+
+// HasPermission returns true if the given role grants the given
+// permission, false otherwise. Unknown roles have no permissions.
+func (a *Authorizer) HasPermission(role string, perm users.Permission) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	perms, ok := a.roles[role]
+	if !ok {
+		return false
+	}
+	if _, ok := perms[users.AnyPermission]; ok {
+		return true
+	}
+	_, ok = perms[perm]
+	return ok
+}
+
+func newPermissionSet(perms ...users.Permission) map[users.Permission]struct{} {
+	set := map[users.Permission]struct{}{}
+	for _, perm := range perms {
+		set[perm] = struct{}{}
+	}
+	return set
 }
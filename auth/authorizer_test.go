@@ -0,0 +1,103 @@
+package auth_test
+
+import (
+	"testing"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/users"
+)
+
+func TestBuiltinRolesPermissions(t *testing.T) {
+	authorizer := auth.New()
+
+	if authorizer.HasPermission(users.UserRole, users.ListUsersPermission) {
+		t.Errorf("role %q should not have permission %q", users.UserRole, users.ListUsersPermission)
+	}
+	if !authorizer.HasPermission(users.AdminRole, users.ListUsersPermission) {
+		t.Errorf("role %q should have permission %q", users.AdminRole, users.ListUsersPermission)
+	}
+	if !authorizer.HasPermission(users.AdminRole, users.Permission("some:future:permission")) {
+		t.Errorf("role %q should have all permissions", users.AdminRole)
+	}
+	if authorizer.HasPermission("unknown", users.ListUsersPermission) {
+		t.Error("unknown roles should have no permissions")
+	}
+}
+
+func TestCustomRoles(t *testing.T) {
+	const (
+		roleName       = "support"
+		otherPerm      = users.Permission("other:permission")
+		anotherPerm    = users.Permission("another:permission")
+		notGrantedPerm = users.Permission("not:granted")
+	)
+
+	authorizer := auth.New()
+
+	err := authorizer.AddRole(users.Role{
+		Name:        roleName,
+		Permissions: []users.Permission{users.ListUsersPermission, otherPerm},
+	})
+	assertNoErr(t, err)
+
+	for _, perm := range []users.Permission{users.ListUsersPermission, otherPerm} {
+		if !authorizer.HasPermission(roleName, perm) {
+			t.Errorf("role %q should have permission %q", roleName, perm)
+		}
+	}
+	if authorizer.HasPermission(roleName, notGrantedPerm) {
+		t.Errorf("role %q should not have permission %q", roleName, notGrantedPerm)
+	}
+
+	err = authorizer.AddRole(users.Role{
+		Name:        roleName,
+		Permissions: []users.Permission{anotherPerm},
+	})
+	assertNoErr(t, err)
+
+	if authorizer.HasPermission(roleName, otherPerm) {
+		t.Errorf("replaced role %q should not have permission %q", roleName, otherPerm)
+	}
+	if !authorizer.HasPermission(roleName, anotherPerm) {
+		t.Errorf("replaced role %q should have permission %q", roleName, anotherPerm)
+	}
+}
+
+func TestInvalidCustomRoles(t *testing.T) {
+	type Test struct {
+		name string
+		role users.Role
+	}
+
+	tests := []Test{
+		{
+			name: "EmptyName",
+			role: users.Role{},
+		},
+		{
+			name: "RedefiningUserRole",
+			role: users.Role{Name: users.UserRole},
+		},
+		{
+			name: "RedefiningAdminRole",
+			role: users.Role{Name: users.AdminRole},
+		},
+		{
+			name: "EmptyPermission",
+			role: users.Role{
+				Name:        "custom",
+				Permissions: []users.Permission{""},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authorizer := auth.New()
+			err := authorizer.AddRole(test.role)
+			if err == nil {
+				t.Fatal("expected error, got none")
+			}
+		})
+	}
+}
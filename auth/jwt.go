@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AccessTokenJWTType is the typ header of signed access tokens, as defined on:
+// https://tools.ietf.org/html/rfc9068#section-2.1
+// It distinguishes them from other JWTs signed with the same keys, like ID tokens.
+const AccessTokenJWTType = "at+jwt"
+
+// JWTClaims are the claims of the signed access tokens, as defined on:
+// https://tools.ietf.org/html/rfc7519#section-4.1
+type JWTClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+
+	// ClientID and Scope are only set on tokens issued to clients
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// SignJWT signs a JWT with the given claims using the signing key of
+// the ring. It allows other token types, like OpenID Connect ID tokens,
+// to be signed with the same keys of the access tokens.
+// The signed JWTs have the generic "JWT" typ header, so they are never
+// accepted as access tokens.
+func (r *KeyRing) SignJWT(claims interface{}) (string, error) {
+	return signJWT(r.signingKey(), "JWT", claims)
+}
+
+func signJWT(key SigningKey, typ string, claims interface{}) (string, error) {
+	alg, err := keyAlgorithm(key.Signer.Public())
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(jwtHeader{Algorithm: alg, Type: typ, KeyID: key.ID})
+	if err != nil {
+		return "", fmt.Errorf("error serializing JWT header:%v", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("error serializing JWT claims:%v", err)
+	}
+
+	signingInput := encodeSegment(header) + "." + encodeSegment(payload)
+
+	var signature []byte
+	switch alg {
+	case RS256:
+		digest := sha256.Sum256([]byte(signingInput))
+		signature, err = key.Signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case EdDSA:
+		// WHY: Ed25519 signs the message itself, not a digest
+		signature, err = key.Signer.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	}
+	if err != nil {
+		return "", fmt.Errorf("error signing JWT:%v", err)
+	}
+	return signingInput + "." + encodeSegment(signature), nil
+}
+
+// verifyJWT verifies the type, the signature and the expiration of the token,
+// returning its claims. If the token is invalid it returns InvalidTokenErr.
+func verifyJWT(keys *KeyRing, token string, typ string, now time.Time) (JWTClaims, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return JWTClaims{}, fmt.Errorf("%w:malformed JWT", InvalidTokenErr)
+	}
+
+	header := jwtHeader{}
+	if err := decodeSegment(segments[0], &header); err != nil {
+		return JWTClaims{}, fmt.Errorf("%w:invalid JWT header:%v", InvalidTokenErr, err)
+	}
+	// WHY: other JWTs signed with the same keys, like ID tokens,
+	// must not be accepted in place of the expected type.
+	if header.Type != typ {
+		return JWTClaims{}, fmt.Errorf("%w:JWT type %q is not %q", InvalidTokenErr, header.Type, typ)
+	}
+
+	key, ok := keys.verificationKey(header.KeyID)
+	if !ok {
+		return JWTClaims{}, fmt.Errorf("%w:unknown key %q", InvalidTokenErr, header.KeyID)
+	}
+
+	// WHY: the algorithm comes from the key, never from the token header,
+	// otherwise forged tokens could choose a weaker algorithm (or none).
+	alg, err := keyAlgorithm(key.Public)
+	if err != nil || alg != header.Algorithm {
+		return JWTClaims{}, fmt.Errorf("%w:algorithm %q doesn't match key %q", InvalidTokenErr, header.Algorithm, key.ID)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return JWTClaims{}, fmt.Errorf("%w:invalid JWT signature encoding:%v", InvalidTokenErr, err)
+	}
+
+	signingInput := segments[0] + "." + segments[1]
+	switch k := key.Public.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, []byte(signingInput), signature) {
+			err = fmt.Errorf("ed25519 signature mismatch")
+		}
+	}
+	if err != nil {
+		return JWTClaims{}, fmt.Errorf("%w:invalid JWT signature:%v", InvalidTokenErr, err)
+	}
+
+	claims := JWTClaims{}
+	if err := decodeSegment(segments[1], &claims); err != nil {
+		return JWTClaims{}, fmt.Errorf("%w:invalid JWT claims:%v", InvalidTokenErr, err)
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return JWTClaims{}, fmt.Errorf("%w:expired JWT", InvalidTokenErr)
+	}
+	return claims, nil
+}
+
+func encodeSegment(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,367 @@
+package auth_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/kvstore"
+)
+
+func TestSignedTokens(t *testing.T) {
+	const (
+		userID = "42"
+		issuer = "https://stonks.test"
+		ttl    = time.Hour
+	)
+
+	keys := map[string]auth.SigningKey{
+		auth.RS256: newRSAKey(t, "rsa-key"),
+		auth.EdDSA: newEd25519Key(t, "ed-key"),
+	}
+
+	for alg, key := range keys {
+		t.Run(alg, func(t *testing.T) {
+			m := newTestRedis(t)
+			defer m.Close()
+
+			ring, err := auth.NewKeyRing(key)
+			assertNoErr(t, err)
+
+			tokens := auth.NewSignedTokens(kvstore.New(m.Addr(), ""), ttl, ring, issuer)
+			ctx := context.Background()
+
+			before := time.Now().Unix()
+			token, err := tokens.Create(ctx, userID)
+			assertNoErr(t, err)
+
+			if token.ExpiresIn != ttl {
+				t.Fatalf("got expires in %v want %v", token.ExpiresIn, ttl)
+			}
+
+			gotUserID, err := tokens.UserID(ctx, token.AccessToken)
+			assertNoErr(t, err)
+
+			if gotUserID != userID {
+				t.Fatalf("got user ID %q want %q", gotUserID, userID)
+			}
+
+			// Other services verify tokens using only the JWKS
+			header, claims := verifyWithJWKS(t, ring.JWKS(), token.AccessToken)
+
+			if header.Algorithm != alg || header.KeyID != key.ID || header.Type != auth.AccessTokenJWTType {
+				t.Errorf("got header %+v", header)
+			}
+			if claims.Subject != userID || claims.Issuer != issuer || claims.ID == "" {
+				t.Errorf("got claims %+v", claims)
+			}
+			if claims.IssuedAt < before || claims.ExpiresAt != claims.IssuedAt+int64(ttl.Seconds()) {
+				t.Errorf("got claims %+v issued before %d", claims, before)
+			}
+
+			anotherToken, err := tokens.Create(ctx, userID)
+			assertNoErr(t, err)
+
+			if anotherToken.AccessToken == token.AccessToken {
+				t.Fatalf("created the same token %q twice", token.AccessToken)
+			}
+
+			assertNoErr(t, tokens.Revoke(ctx, token.AccessToken))
+
+			_, err = tokens.UserID(ctx, token.AccessToken)
+			if !errors.Is(err, auth.InvalidTokenErr) {
+				t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+			}
+
+			assertNoErr(t, tokens.RevokeUserTokens(ctx, userID, ""))
+
+			_, err = tokens.UserID(ctx, anotherToken.AccessToken)
+			if !errors.Is(err, auth.InvalidTokenErr) {
+				t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+			}
+		})
+	}
+}
+
+func TestSignedClientTokens(t *testing.T) {
+	const clientID = "batch-job"
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	ring, err := auth.NewKeyRing(newEd25519Key(t, "ed-key"))
+	assertNoErr(t, err)
+
+	tokens := auth.NewSignedTokens(kvstore.New(m.Addr(), ""), time.Hour, ring, "stonks")
+	token, err := tokens.CreateClientToken(context.Background(), clientID, []string{"users:list", "users:read"})
+	assertNoErr(t, err)
+
+	_, claims := verifyWithJWKS(t, ring.JWKS(), token.AccessToken)
+
+	if claims.Subject != clientID || claims.ClientID != clientID || claims.Scope != "users:list users:read" {
+		t.Fatalf("got claims %+v", claims)
+	}
+}
+
+func TestSignedDelegatedTokens(t *testing.T) {
+	const (
+		userID   = "42"
+		clientID = "webapp"
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	ring, err := auth.NewKeyRing(newEd25519Key(t, "ed-key"))
+	assertNoErr(t, err)
+
+	tokens := auth.NewSignedTokens(kvstore.New(m.Addr(), ""), time.Hour, ring, "stonks")
+	ctx := context.Background()
+
+	token, err := tokens.CreateDelegatedToken(ctx, userID, clientID, []string{"openid", "email"})
+	assertNoErr(t, err)
+
+	_, claims := verifyWithJWKS(t, ring.JWKS(), token.AccessToken)
+
+	if claims.Subject != userID || claims.ClientID != clientID || claims.Scope != "openid email" {
+		t.Fatalf("got claims %+v", claims)
+	}
+
+	info, err := tokens.Introspect(ctx, token.AccessToken)
+	assertNoErr(t, err)
+
+	if info.UserID != userID || info.ClientID != clientID || strings.Join(info.Scopes, " ") != "openid email" {
+		t.Fatalf("got token info %+v", info)
+	}
+
+	_, err = tokens.CreateDelegatedToken(ctx, userID, "", nil)
+	if err == nil {
+		t.Fatal("want error creating delegated token without client")
+	}
+}
+
+func TestSignedTokensRejectOtherJWTs(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	ring, err := auth.NewKeyRing(newEd25519Key(t, "ed-key"))
+	assertNoErr(t, err)
+
+	tokens := auth.NewSignedTokens(kvstore.New(m.Addr(), ""), time.Hour, ring, "stonks")
+
+	// WHY: JWTs signed with the same keys, like ID tokens,
+	// can't be used as access tokens even with the same claims.
+	now := time.Now()
+	idToken, err := ring.SignJWT(auth.JWTClaims{
+		Issuer:    "stonks",
+		Subject:   "42",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Hour).Unix(),
+		ID:        "id-token",
+	})
+	assertNoErr(t, err)
+
+	header, _ := verifyWithJWKS(t, ring.JWKS(), idToken)
+	if header.Type == auth.AccessTokenJWTType {
+		t.Fatalf("got access token type on other JWT: %+v", header)
+	}
+
+	_, err = tokens.Introspect(context.Background(), idToken)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+func TestSignedTokensKeyRotation(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	oldKey := newEd25519Key(t, "old-key")
+	newKey := newRSAKey(t, "new-key")
+
+	ring, err := auth.NewKeyRing(oldKey)
+	assertNoErr(t, err)
+
+	tokens := auth.NewSignedTokens(kvstore.New(m.Addr(), ""), time.Hour, ring, "issuer")
+	ctx := context.Background()
+
+	oldToken := createToken(t, tokens, "1")
+
+	// The next key is published before being used to sign tokens
+	assertNoErr(t, ring.AddVerificationKey(auth.VerificationKey{ID: newKey.ID, Public: newKey.Signer.Public()}))
+
+	if header, _ := verifyWithJWKS(t, ring.JWKS(), createToken(t, tokens, "1")); header.KeyID != oldKey.ID {
+		t.Fatalf("got token signed by key %q want %q", header.KeyID, oldKey.ID)
+	}
+
+	assertNoErr(t, ring.Rotate(newKey))
+
+	newToken := createToken(t, tokens, "1")
+	if header, _ := verifyWithJWKS(t, ring.JWKS(), newToken); header.KeyID != newKey.ID {
+		t.Fatalf("got token signed by key %q want %q", header.KeyID, newKey.ID)
+	}
+
+	// Tokens signed by the old key remain valid until it is removed
+	_, err = tokens.UserID(ctx, oldToken)
+	assertNoErr(t, err)
+
+	assertNoErr(t, ring.Remove(oldKey.ID))
+
+	_, err = tokens.UserID(ctx, oldToken)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	_, err = tokens.UserID(ctx, newToken)
+	assertNoErr(t, err)
+}
+
+func TestSignedTokensRejectsForgedTokens(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	key := newEd25519Key(t, "key")
+	ring, err := auth.NewKeyRing(key)
+	assertNoErr(t, err)
+
+	store := kvstore.New(m.Addr(), "")
+	tokens := auth.NewSignedTokens(store, time.Hour, ring, "issuer")
+	token := createToken(t, tokens, "1")
+	segments := strings.Split(token, ".")
+
+	// Signed by an unknown key with the same ID
+	otherRing, err := auth.NewKeyRing(newEd25519Key(t, "key"))
+	assertNoErr(t, err)
+	otherKeyToken := createToken(t, auth.NewSignedTokens(store, time.Hour, otherRing, "issuer"), "1")
+
+	// Signed by a trusted key but for another issuer
+	otherIssuerToken := createToken(t, auth.NewSignedTokens(store, time.Hour, ring, "other issuer"), "1")
+
+	forged := map[string]string{
+		"Malformed":          "not.a.jwt.at.all",
+		"ChangedSubject":     segments[0] + "." + b64(toJSON(t, map[string]interface{}{"sub": "2"})) + "." + segments[2],
+		"NoneAlgorithm":      b64(toJSON(t, map[string]string{"alg": "none", "kid": "key"})) + "." + segments[1] + ".",
+		"UnknownKeyID":       b64(toJSON(t, map[string]string{"alg": auth.EdDSA, "kid": "unknown"})) + "." + segments[1] + "." + segments[2],
+		"WrongAlgorithm":     b64(toJSON(t, map[string]string{"alg": auth.RS256, "kid": "key"})) + "." + segments[1] + "." + segments[2],
+		"SignedByUnknownKey": otherKeyToken,
+		"OtherIssuer":        otherIssuerToken,
+	}
+
+	for name, forgedToken := range forged {
+		t.Run(name, func(t *testing.T) {
+			_, err := tokens.UserID(context.Background(), forgedToken)
+			if !errors.Is(err, auth.InvalidTokenErr) {
+				t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+			}
+		})
+	}
+}
+
+func TestKeyRingSignsCustomClaims(t *testing.T) {
+	key := newRSAKey(t, "key")
+	ring, err := auth.NewKeyRing(key)
+	assertNoErr(t, err)
+
+	token, err := ring.SignJWT(map[string]string{"sub": "1", "nonce": "some nonce"})
+	assertNoErr(t, err)
+
+	header, _ := verifyWithJWKS(t, ring.JWKS(), token)
+	if header.KeyID != key.ID || header.Algorithm != auth.RS256 {
+		t.Fatalf("got header %+v", header)
+	}
+
+	claims := map[string]string{}
+	fromB64JSON(t, strings.Split(token, ".")[1], &claims)
+
+	if claims["sub"] != "1" || claims["nonce"] != "some nonce" {
+		t.Fatalf("got claims %v", claims)
+	}
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// verifyWithJWKS verifies the token just like other services would,
+// using only the published JWKS.
+func verifyWithJWKS(t *testing.T, jwks auth.JWKSet, token string) (jwtHeader, auth.JWTClaims) {
+	t.Helper()
+
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		t.Fatalf("token %q is not a JWT", token)
+	}
+
+	header := jwtHeader{}
+	fromB64JSON(t, segments[0], &header)
+
+	signingInput := []byte(segments[0] + "." + segments[1])
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	assertNoErr(t, err)
+
+	for _, jwk := range jwks.Keys {
+		if jwk.KeyID != header.KeyID {
+			continue
+		}
+		switch jwk.KeyType {
+		case "RSA":
+			public := &rsa.PublicKey{
+				N: new(big.Int).SetBytes(fromB64(t, jwk.Modulus)),
+				E: int(new(big.Int).SetBytes(fromB64(t, jwk.Exponent)).Int64()),
+			}
+			digest := sha256.Sum256(signingInput)
+			assertNoErr(t, rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature))
+		case "OKP":
+			if !ed25519.Verify(ed25519.PublicKey(fromB64(t, jwk.X)), signingInput, signature) {
+				t.Fatalf("invalid signature on token %q", token)
+			}
+		default:
+			t.Fatalf("unexpected key type %q", jwk.KeyType)
+		}
+
+		claims := auth.JWTClaims{}
+		fromB64JSON(t, segments[1], &claims)
+		return header, claims
+	}
+
+	t.Fatalf("key %q not found on JWKS %v", header.KeyID, jwks)
+	return jwtHeader{}, auth.JWTClaims{}
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func fromB64(t *testing.T, s string) []byte {
+	t.Helper()
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	assertNoErr(t, err)
+	return data
+}
+
+func fromB64JSON(t *testing.T, s string, v interface{}) {
+	t.Helper()
+
+	assertNoErr(t, json.Unmarshal(fromB64(t, s), v))
+}
+
+func toJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	assertNoErr(t, err)
+	return data
+}
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+)
+
+// Algorithms used to sign JWTs, as defined on:
+// https://tools.ietf.org/html/rfc7518#section-3.1
+// https://tools.ietf.org/html/rfc8037#section-3.1
+const (
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+// SigningKey is a private key used to sign tokens.
+// Supported keys are *rsa.PrivateKey (RS256) and ed25519.PrivateKey (EdDSA).
+type SigningKey struct {
+	ID     string
+	Signer crypto.Signer
+}
+
+// VerificationKey is a public key used only to verify tokens.
+// Supported keys are *rsa.PublicKey (RS256) and ed25519.PublicKey (EdDSA).
+type VerificationKey struct {
+	ID     string
+	Public crypto.PublicKey
+}
+
+// JWK is a public JSON Web Key, as defined on:
+// https://tools.ietf.org/html/rfc7517#section-4
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+
+	// RSA keys parameters
+	Modulus  string `json:"n,omitempty"`
+	Exponent string `json:"e,omitempty"`
+
+	// Ed25519 keys parameters
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKSet is a set of public JSON Web Keys, as defined on:
+// https://tools.ietf.org/html/rfc7517#section-5
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// KeyRing holds the key used to sign tokens and all keys that
+// can be used to verify tokens. Keys are rotated with overlapping
+// validity: new keys can be published for verification before they
+// are used for signing, and keys that stopped signing remain valid
+// for verification until they are removed.
+// It is safe to use a KeyRing concurrently.
+type KeyRing struct {
+	mutex        sync.RWMutex
+	signing      SigningKey
+	verification map[string]VerificationKey
+}
+
+// NewKeyRing creates a new key ring that signs with the given signing key
+// and verifies tokens signed by it or by any of the verification keys.
+func NewKeyRing(signing SigningKey, verification ...VerificationKey) (*KeyRing, error) {
+	r := &KeyRing{verification: map[string]VerificationKey{}}
+	for _, key := range verification {
+		if err := r.addVerificationKey(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.setSigningKey(signing); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Rotate makes the given key the signing key. The previous signing key
+// is kept as a verification key, so the tokens it signed remain valid.
+func (r *KeyRing) Rotate(signing SigningKey) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.setSigningKey(signing)
+}
+
+// AddVerificationKey adds a key that is only used to verify tokens,
+// like the next signing key that must be published before rotation.
+func (r *KeyRing) AddVerificationKey(key VerificationKey) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.addVerificationKey(key)
+}
+
+// Remove removes the verification key with the given ID, tokens signed
+// by it become invalid. The signing key can't be removed.
+func (r *KeyRing) Remove(id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if id == r.signing.ID {
+		return fmt.Errorf("can't remove signing key %q", id)
+	}
+	delete(r.verification, id)
+	return nil
+}
+
+// JWKS returns the public keys of all keys on the ring.
+func (r *KeyRing) JWKS() JWKSet {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	set := JWKSet{Keys: make([]JWK, 0, len(r.verification))}
+	for _, key := range r.verification {
+		// WHY: keys are validated when added, so this can't fail
+		jwk, _ := newJWK(key)
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].KeyID < set.Keys[j].KeyID
+	})
+	return set
+}
+
+func (r *KeyRing) signingKey() SigningKey {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.signing
+}
+
+func (r *KeyRing) verificationKey(id string) (VerificationKey, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	key, ok := r.verification[id]
+	return key, ok
+}
+
+func (r *KeyRing) setSigningKey(key SigningKey) error {
+	if key.Signer == nil {
+		return errors.New("missing signer on signing key")
+	}
+	err := r.addVerificationKey(VerificationKey{ID: key.ID, Public: key.Signer.Public()})
+	if err != nil {
+		return err
+	}
+	r.signing = key
+	return nil
+}
+
+func (r *KeyRing) addVerificationKey(key VerificationKey) error {
+	if key.ID == "" {
+		return errors.New("empty key ID")
+	}
+	if _, err := keyAlgorithm(key.Public); err != nil {
+		return fmt.Errorf("key %q:%v", key.ID, err)
+	}
+	if current, ok := r.verification[key.ID]; ok && !samePublicKey(current.Public, key.Public) {
+		return fmt.Errorf("key ID %q already used by another key", key.ID)
+	}
+	r.verification[key.ID] = key
+	return nil
+}
+
+// ParseSigningKey parses a PEM encoded PKCS #8 private key.
+func ParseSigningKey(id string, data []byte) (SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, fmt.Errorf("key %q:no PEM data found", id)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("key %q:%v", id, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return SigningKey{}, fmt.Errorf("key %q:unsupported key type %T", id, key)
+	}
+	if _, err := keyAlgorithm(signer.Public()); err != nil {
+		return SigningKey{}, fmt.Errorf("key %q:%v", id, err)
+	}
+	return SigningKey{ID: id, Signer: signer}, nil
+}
+
+// ParseVerificationKey parses a PEM encoded PKIX public key.
+func ParseVerificationKey(id string, data []byte) (VerificationKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return VerificationKey{}, fmt.Errorf("key %q:no PEM data found", id)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return VerificationKey{}, fmt.Errorf("key %q:%v", id, err)
+	}
+	if _, err := keyAlgorithm(key); err != nil {
+		return VerificationKey{}, fmt.Errorf("key %q:%v", id, err)
+	}
+	return VerificationKey{ID: id, Public: key}, nil
+}
+
+func keyAlgorithm(key crypto.PublicKey) (string, error) {
+	// From: https://tools.ietf.org/html/rfc7518#section-3.3
+	const minRSABits = 2048
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSABits {
+			return "", fmt.Errorf("RSA keys must have at least %d bits, got %d", minRSABits, k.N.BitLen())
+		}
+		return RS256, nil
+	case ed25519.PublicKey:
+		return EdDSA, nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
+
+func newJWK(key VerificationKey) (JWK, error) {
+	alg, err := keyAlgorithm(key.Public)
+	if err != nil {
+		return JWK{}, err
+	}
+
+	jwk := JWK{
+		KeyID:     key.ID,
+		Use:       "sig",
+		Algorithm: alg,
+	}
+	switch k := key.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.Modulus = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+		jwk.Exponent = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(k)
+	}
+	return jwk, nil
+}
+
+func samePublicKey(a crypto.PublicKey, b crypto.PublicKey) bool {
+	encodedA, errA := x509.MarshalPKIXPublicKey(a)
+	encodedB, errB := x509.MarshalPKIXPublicKey(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
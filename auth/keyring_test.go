@@ -0,0 +1,151 @@
+package auth_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/katcipis/stonks/auth"
+)
+
+func TestKeyRingJWKS(t *testing.T) {
+	rsaKey := newRSAKey(t, "rsa-key")
+	edKey := newEd25519Key(t, "ed-key")
+
+	ring, err := auth.NewKeyRing(rsaKey, auth.VerificationKey{ID: edKey.ID, Public: edKey.Signer.Public()})
+	assertNoErr(t, err)
+
+	jwks := ring.JWKS()
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("got %d keys want 2: %v", len(jwks.Keys), jwks)
+	}
+
+	edJWK, rsaJWK := jwks.Keys[0], jwks.Keys[1]
+
+	wantEdJWK := auth.JWK{
+		KeyType:   "OKP",
+		KeyID:     "ed-key",
+		Use:       "sig",
+		Algorithm: auth.EdDSA,
+		Curve:     "Ed25519",
+		X:         b64(edKey.Signer.Public().(ed25519.PublicKey)),
+	}
+	if edJWK != wantEdJWK {
+		t.Errorf("got JWK %v want %v", edJWK, wantEdJWK)
+	}
+
+	rsaPublic := rsaKey.Signer.Public().(*rsa.PublicKey)
+	wantRSAJWK := auth.JWK{
+		KeyType:   "RSA",
+		KeyID:     "rsa-key",
+		Use:       "sig",
+		Algorithm: auth.RS256,
+		Modulus:   b64(rsaPublic.N.Bytes()),
+		Exponent:  "AQAB",
+	}
+	if rsaJWK != wantRSAJWK {
+		t.Errorf("got JWK %v want %v", rsaJWK, wantRSAJWK)
+	}
+
+	assertNoErr(t, ring.Remove("ed-key"))
+
+	if got := ring.JWKS(); len(got.Keys) != 1 || got.Keys[0].KeyID != "rsa-key" {
+		t.Fatalf("got JWKS %v after removing key", got)
+	}
+}
+
+func TestKeyRingRejectsInvalidKeys(t *testing.T) {
+	edKey := newEd25519Key(t, "ed-key")
+	otherEdKey := newEd25519Key(t, "ed-key")
+
+	weakRSAKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assertNoErr(t, err)
+
+	_, err = auth.NewKeyRing(auth.SigningKey{ID: "weak", Signer: weakRSAKey})
+	if err == nil {
+		t.Error("expected error with weak RSA key, got none")
+	}
+
+	_, err = auth.NewKeyRing(auth.SigningKey{Signer: edKey.Signer})
+	if err == nil {
+		t.Error("expected error with empty key ID, got none")
+	}
+
+	_, err = auth.NewKeyRing(auth.SigningKey{ID: "no-signer"})
+	if err == nil {
+		t.Error("expected error with no signer, got none")
+	}
+
+	ring, err := auth.NewKeyRing(edKey)
+	assertNoErr(t, err)
+
+	err = ring.AddVerificationKey(auth.VerificationKey{ID: "ed-key", Public: otherEdKey.Signer.Public()})
+	if err == nil {
+		t.Error("expected error reusing key ID, got none")
+	}
+
+	err = ring.Rotate(otherEdKey)
+	if err == nil {
+		t.Error("expected error rotating to a key with a reused ID, got none")
+	}
+
+	err = ring.Remove("ed-key")
+	if err == nil {
+		t.Error("expected error removing signing key, got none")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys := map[string]auth.SigningKey{
+		"RSA":     newRSAKey(t, "rsa-key"),
+		"Ed25519": newEd25519Key(t, "ed-key"),
+	}
+
+	for name, key := range keys {
+		t.Run(name, func(t *testing.T) {
+			privateDER, err := x509.MarshalPKCS8PrivateKey(key.Signer)
+			assertNoErr(t, err)
+			publicDER, err := x509.MarshalPKIXPublicKey(key.Signer.Public())
+			assertNoErr(t, err)
+
+			privatePEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})
+			publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+			signing, err := auth.ParseSigningKey("parsed", privatePEM)
+			assertNoErr(t, err)
+
+			verification, err := auth.ParseVerificationKey("parsed", publicPEM)
+			assertNoErr(t, err)
+
+			// Keys must be the same, so adding both to a ring works
+			_, err = auth.NewKeyRing(signing, verification)
+			assertNoErr(t, err)
+
+			if _, err := auth.ParseSigningKey("invalid", publicPEM); err == nil {
+				t.Error("expected error parsing public key as signing key, got none")
+			}
+			if _, err := auth.ParseVerificationKey("invalid", []byte("not PEM")); err == nil {
+				t.Error("expected error parsing invalid PEM, got none")
+			}
+		})
+	}
+}
+
+func newRSAKey(t *testing.T, id string) auth.SigningKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assertNoErr(t, err)
+	return auth.SigningKey{ID: id, Signer: key}
+}
+
+func newEd25519Key(t *testing.T, id string) auth.SigningKey {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assertNoErr(t, err)
+	return auth.SigningKey{ID: id, Signer: key}
+}
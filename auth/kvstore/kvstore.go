@@ -2,6 +2,10 @@ package kvstore
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -60,7 +64,191 @@ func (kv *KVStore) Get(ctx context.Context, key string) ([]byte, error) {
 	return val, nil
 }
 
+// Take atomically retrieves the value associated with the given key and
+// removes it, guaranteeing that the value is retrieved only once even
+// with concurrent calls. If the key does not exists returns a
+// KeyNotFound error, or any non-nil error in case of other failures.
+func (kv *KVStore) Take(ctx context.Context, key string) ([]byte, error) {
+	var get *redis.StringCmd
+
+	_, err := kv.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, key)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	val, err := get.Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, KeyNotFoundErr
+		}
+		return nil, err
+	}
+	return val, nil
+}
+
+// Delete removes the given key from the storage.
+// Deleting a key that does not exist is not considered an error.
+func (kv *KVStore) Delete(ctx context.Context, key string) error {
+	icmd := kv.client.Del(ctx, key)
+	_, err := icmd.Result()
+	return err
+}
+
+// SetAdd adds the given members to the set stored at key, creating the set
+// if it doesn't exist. The ttl of the whole set is reset to the given ttl.
+func (kv *KVStore) SetAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error {
+	_, err := kv.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, key, toInterfaces(members)...)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	return err
+}
+
+// SetMembers retrieves all members of the set stored at key.
+// If the set does not exist an empty set is returned.
+func (kv *KVStore) SetMembers(ctx context.Context, key string) ([]string, error) {
+	return kv.client.SMembers(ctx, key).Result()
+}
+
+// SetRemove removes the given members from the set stored at key.
+// Removing members that are not on the set is not considered an error.
+func (kv *KVStore) SetRemove(ctx context.Context, key string, members ...string) error {
+	return kv.client.SRem(ctx, key, toInterfaces(members)...).Err()
+}
+
+// Incr increments the counter stored at key, returning its new value. If the
+// counter doesn't exist it is created with zero before being incremented.
+// The ttl of the counter is reset to the given ttl.
+func (kv *KVStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	var incr *redis.IntCmd
+
+	_, err := kv.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.PExpire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Result()
+}
+
+// Counter retrieves the value of the counter stored at key.
+// If the counter does not exist zero is returned.
+func (kv *KVStore) Counter(ctx context.Context, key string) (int64, error) {
+	val, err := kv.client.Get(ctx, key).Int64()
+	if err != nil {
+		if err == redis.Nil {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return val, nil
+}
+
+// Window is the state of a sliding window of events, like failed attempts
+type Window struct {
+	// Count is the number of events on the window
+	Count int64
+	// Last is when the last event of the window happened,
+	// it is zero if there are no events on the window.
+	Last time.Time
+}
+
+// WindowReserve adds an event that happened at the given time to the sliding
+// window stored at key, returning the window as it was right before the event
+// was added and the added event, which can be removed with WindowRemove.
+// Only events from the given size up to the given time are kept on the window
+// and the whole window expires after size without new events.
+// The window is updated atomically, so concurrent processes reserving
+// events on the same window always see each other events.
+func (kv *KVStore) WindowReserve(ctx context.Context, key string, at time.Time, size time.Duration) (Window, string, error) {
+	member, err := windowMember(at)
+	if err != nil {
+		return Window{}, "", err
+	}
+
+	var (
+		count *redis.IntCmd
+		last  *redis.ZSliceCmd
+	)
+	_, err = kv.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "("+windowScore(at.Add(-size)))
+		count = pipe.ZCard(ctx, key)
+		last = pipe.ZRevRangeWithScores(ctx, key, 0, 0)
+		pipe.ZAdd(ctx, key, &redis.Z{Score: float64(windowTime(at)), Member: member})
+		pipe.PExpire(ctx, key, size)
+		return nil
+	})
+	if err != nil {
+		return Window{}, "", err
+	}
+	window, err := newWindow(count, last)
+	if err != nil {
+		return Window{}, "", err
+	}
+	return window, member, nil
+}
+
+// WindowRemove removes the event reserved with WindowReserve from the
+// window stored at key. Removing events that are not on the window
+// is not considered an error.
+func (kv *KVStore) WindowRemove(ctx context.Context, key string, event string) error {
+	return kv.client.ZRem(ctx, key, event).Err()
+}
+
 // Error returns the string representation of the error
 func (e Error) Error() string {
 	return string(e)
 }
+
+func toInterfaces(vals []string) []interface{} {
+	res := make([]interface{}, len(vals))
+	for i, v := range vals {
+		res[i] = v
+	}
+	return res
+}
+
+func newWindow(count *redis.IntCmd, last *redis.ZSliceCmd) (Window, error) {
+	n, err := count.Result()
+	if err != nil {
+		return Window{}, err
+	}
+	lastEvents, err := last.Result()
+	if err != nil {
+		return Window{}, err
+	}
+
+	window := Window{Count: n}
+	if len(lastEvents) > 0 {
+		window.Last = time.Unix(0, int64(lastEvents[0].Score)*int64(time.Microsecond))
+	}
+	return window, nil
+}
+
+// windowTime is the time of events as scores of the sorted sets used by windows
+func windowTime(t time.Time) int64 {
+	// WHY: scores are float64, unlike nanoseconds
+	// microseconds are represented exactly.
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+func windowScore(t time.Time) string {
+	return strconv.FormatInt(windowTime(t), 10)
+}
+
+// windowMember creates an unique member for an event, since events
+// that happen at the same time must still be counted separately.
+func windowMember(at time.Time) (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("error generating window member:%v", err)
+	}
+	return fmt.Sprintf("%d:%s", at.UnixNano(), hex.EncodeToString(random)), nil
+}
@@ -3,6 +3,8 @@ package kvstore_test
 import (
 	"context"
 	"errors"
+	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -56,6 +58,234 @@ func TestKVStoreKeyDoesNotExist(t *testing.T) {
 	}
 }
 
+func TestKVStoreDeleteKey(t *testing.T) {
+	const password = "test-kvstore-db-pass-delete"
+
+	m := newTestRedis(t, password)
+	defer m.Close()
+
+	s := kvstore.New(m.Addr(), password)
+
+	const key = "testkey"
+	ctx := context.Background()
+
+	err := s.Put(ctx, key, []byte("testval"), time.Minute)
+	assertNoErr(t, err)
+
+	err = s.Delete(ctx, key)
+	assertNoErr(t, err)
+
+	_, err = s.Get(ctx, key)
+	if !errors.Is(err, kvstore.KeyNotFoundErr) {
+		t.Fatalf("got err[%v] want[%v]", err, kvstore.KeyNotFoundErr)
+	}
+
+	// Deleting again should not fail
+	err = s.Delete(ctx, key)
+	assertNoErr(t, err)
+}
+
+func TestKVStoreTakeKey(t *testing.T) {
+	const password = "test-kvstore-db-pass-take"
+
+	m := newTestRedis(t, password)
+	defer m.Close()
+
+	s := kvstore.New(m.Addr(), password)
+
+	const key = "testkey"
+	ctx := context.Background()
+
+	err := s.Put(ctx, key, []byte("testval"), time.Minute)
+	assertNoErr(t, err)
+
+	val, err := s.Take(ctx, key)
+	assertNoErr(t, err)
+
+	if string(val) != "testval" {
+		t.Fatalf("got val %q want %q", string(val), "testval")
+	}
+
+	_, err = s.Take(ctx, key)
+	if !errors.Is(err, kvstore.KeyNotFoundErr) {
+		t.Fatalf("got err[%v] want[%v]", err, kvstore.KeyNotFoundErr)
+	}
+
+	_, err = s.Get(ctx, key)
+	if !errors.Is(err, kvstore.KeyNotFoundErr) {
+		t.Fatalf("got err[%v] want[%v]", err, kvstore.KeyNotFoundErr)
+	}
+}
+
+func TestKVStoreSets(t *testing.T) {
+	const password = "test-kvstore-db-pass-sets"
+
+	m := newTestRedis(t, password)
+	defer m.Close()
+
+	s := kvstore.New(m.Addr(), password)
+
+	const key = "testset"
+	const ttl = time.Minute
+	ctx := context.Background()
+
+	members, err := s.SetMembers(ctx, key)
+	assertNoErr(t, err)
+	assertMembers(t, members, []string{})
+
+	err = s.SetAdd(ctx, key, ttl, "a", "b")
+	assertNoErr(t, err)
+
+	err = s.SetAdd(ctx, key, 2*ttl, "b", "c")
+	assertNoErr(t, err)
+
+	members, err = s.SetMembers(ctx, key)
+	assertNoErr(t, err)
+	assertMembers(t, members, []string{"a", "b", "c"})
+
+	gotTTL := m.TTL(key)
+	if gotTTL != 2*ttl {
+		t.Fatalf("got TTL %d want %d", gotTTL, 2*ttl)
+	}
+
+	err = s.SetRemove(ctx, key, "a", "c", "notmember")
+	assertNoErr(t, err)
+
+	members, err = s.SetMembers(ctx, key)
+	assertNoErr(t, err)
+	assertMembers(t, members, []string{"b"})
+
+	m.FastForward(2 * ttl)
+
+	members, err = s.SetMembers(ctx, key)
+	assertNoErr(t, err)
+	assertMembers(t, members, []string{})
+}
+
+func TestKVStoreCounters(t *testing.T) {
+	m := newTestRedis(t, "")
+	defer m.Close()
+
+	s := kvstore.New(m.Addr(), "")
+	ctx := context.Background()
+
+	const (
+		key = "testcounter"
+		ttl = time.Minute
+	)
+
+	count, err := s.Counter(ctx, key)
+	assertNoErr(t, err)
+
+	if count != 0 {
+		t.Fatalf("got count %d for inexistent counter", count)
+	}
+
+	for want := int64(1); want <= 3; want++ {
+		count, err := s.Incr(ctx, key, ttl)
+		assertNoErr(t, err)
+
+		if count != want {
+			t.Fatalf("got incremented count %d want %d", count, want)
+		}
+
+		count, err = s.Counter(ctx, key)
+		assertNoErr(t, err)
+
+		if count != want {
+			t.Fatalf("got count %d want %d", count, want)
+		}
+	}
+
+	m.FastForward(ttl)
+
+	count, err = s.Counter(ctx, key)
+	assertNoErr(t, err)
+
+	if count != 0 {
+		t.Fatalf("got count %d for expired counter", count)
+	}
+}
+
+func TestKVStoreWindowReservations(t *testing.T) {
+	m := newTestRedis(t, "")
+	defer m.Close()
+
+	s := kvstore.New(m.Addr(), "")
+	ctx := context.Background()
+
+	const (
+		key  = "testreservations"
+		size = time.Minute
+	)
+	start := time.Date(2020, time.June, 1, 10, 0, 0, 0, time.UTC)
+
+	// Reservations return the window before the event
+	window, first, err := s.WindowReserve(ctx, key, start, size)
+	assertNoErr(t, err)
+	assertWindow(t, window, kvstore.Window{})
+
+	// Events at the same time are counted separately
+	window, second, err := s.WindowReserve(ctx, key, start, size)
+	assertNoErr(t, err)
+	assertWindow(t, window, kvstore.Window{Count: 1, Last: start})
+
+	if first == second {
+		t.Fatalf("got the same event %q for different reservations", first)
+	}
+
+	assertNoErr(t, s.WindowRemove(ctx, key, second))
+
+	// Removing events again is fine
+	assertNoErr(t, s.WindowRemove(ctx, key, second))
+
+	later := start.Add(30 * time.Second)
+	window, _, err = s.WindowReserve(ctx, key, later, size)
+	assertNoErr(t, err)
+	assertWindow(t, window, kvstore.Window{Count: 1, Last: start})
+
+	// The window slides, older events are not counted anymore
+	latest := start.Add(size + time.Second)
+	window, _, err = s.WindowReserve(ctx, key, latest, size)
+	assertNoErr(t, err)
+	assertWindow(t, window, kvstore.Window{Count: 1, Last: later})
+
+	// The whole window expires without new events
+	m.FastForward(size + time.Second)
+
+	if m.Exists(key) {
+		t.Fatalf("window %q should have expired", key)
+	}
+
+	// Windows can be deleted like any other key
+	_, _, err = s.WindowReserve(ctx, key, latest, size)
+	assertNoErr(t, err)
+	assertNoErr(t, s.Delete(ctx, key))
+
+	window, _, err = s.WindowReserve(ctx, key, latest, size)
+	assertNoErr(t, err)
+	assertWindow(t, window, kvstore.Window{})
+}
+
+func assertWindow(t *testing.T, got kvstore.Window, want kvstore.Window) {
+	t.Helper()
+
+	if got.Count != want.Count || !got.Last.Equal(want.Last) {
+		t.Fatalf("got window %+v want %+v", got, want)
+	}
+}
+
+func assertMembers(t *testing.T, got []string, want []string) {
+	t.Helper()
+
+	sort.Strings(got)
+	sort.Strings(want)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got members %v want %v", got, want)
+	}
+}
+
 func newTestRedis(t *testing.T, password string) *miniredis.Miniredis {
 	t.Helper()
 
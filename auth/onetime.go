@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/katcipis/stonks/auth/kvstore"
+)
+
+// OneTimeTokens creates single use tokens bound to a subject (like an user ID),
+// useful for flows like password reset. Each OneTimeTokens has a purpose,
+// tokens created for one purpose can't be used for another one.
+type OneTimeTokens struct {
+	store   KVStore
+	purpose string
+	ttl     time.Duration
+}
+
+// NewOneTimeTokens creates a new OneTimeTokens for the given purpose that
+// will store tokens on the given store, each token is valid for the given ttl.
+func NewOneTimeTokens(store KVStore, purpose string, ttl time.Duration) *OneTimeTokens {
+	return &OneTimeTokens{
+		store:   store,
+		purpose: purpose,
+		ttl:     ttl,
+	}
+}
+
+// Create creates a new single use token for the given subject
+func (o *OneTimeTokens) Create(ctx context.Context, subject string) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = o.store.Put(ctx, o.key(token), []byte(subject), o.ttl)
+	if err != nil {
+		return "", fmt.Errorf("error storing %s token:%v", o.purpose, err)
+	}
+	return token, nil
+}
+
+// Consume validates the given token, returning the subject it was created for.
+// After being consumed the token is not valid anymore, even if
+// Consume is called concurrently only one call will succeed.
+// If the token is invalid, expired or already consumed it returns InvalidTokenErr.
+func (o *OneTimeTokens) Consume(ctx context.Context, token string) (string, error) {
+	subject, err := o.store.Take(ctx, o.key(token))
+	if err != nil {
+		if errors.Is(err, kvstore.KeyNotFoundErr) {
+			return "", fmt.Errorf("%w:%s token not found", InvalidTokenErr, o.purpose)
+		}
+		return "", fmt.Errorf("error retrieving %s token:%v", o.purpose, err)
+	}
+	return string(subject), nil
+}
+
+// Subject validates the given token, returning the subject it was created for,
+// without consuming it. Useful to validate a request before consuming its token.
+// If the token is invalid, expired or already consumed it returns InvalidTokenErr.
+func (o *OneTimeTokens) Subject(ctx context.Context, token string) (string, error) {
+	subject, err := o.store.Get(ctx, o.key(token))
+	if err != nil {
+		if errors.Is(err, kvstore.KeyNotFoundErr) {
+			return "", fmt.Errorf("%w:%s token not found", InvalidTokenErr, o.purpose)
+		}
+		return "", fmt.Errorf("error retrieving %s token:%v", o.purpose, err)
+	}
+	return string(subject), nil
+}
+
+func (o *OneTimeTokens) key(token string) string {
+	return hashedKey("one-time-tokens:"+o.purpose, token)
+}
@@ -0,0 +1,109 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/kvstore"
+)
+
+func TestOneTimeTokens(t *testing.T) {
+	const subject = "666"
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	tokens := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "test", time.Hour)
+	ctx := context.Background()
+
+	token, err := tokens.Create(ctx, subject)
+	assertNoErr(t, err)
+
+	anotherToken, err := tokens.Create(ctx, subject)
+	assertNoErr(t, err)
+
+	if token == anotherToken {
+		t.Fatalf("created the same token %q twice", token)
+	}
+
+	gotSubject, err := tokens.Subject(ctx, token)
+	assertNoErr(t, err)
+
+	if gotSubject != subject {
+		t.Fatalf("got subject %q want %q", gotSubject, subject)
+	}
+
+	gotSubject, err = tokens.Consume(ctx, token)
+	assertNoErr(t, err)
+
+	if gotSubject != subject {
+		t.Fatalf("got subject %q want %q", gotSubject, subject)
+	}
+
+	_, err = tokens.Subject(ctx, token)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("subject of consumed token: got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	_, err = tokens.Consume(ctx, token)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("consuming token twice: got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	gotSubject, err = tokens.Consume(ctx, anotherToken)
+	assertNoErr(t, err)
+
+	if gotSubject != subject {
+		t.Fatalf("got subject %q want %q", gotSubject, subject)
+	}
+}
+
+func TestOneTimeTokensExpiration(t *testing.T) {
+	const ttl = time.Minute
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	tokens := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "test", ttl)
+	ctx := context.Background()
+
+	token, err := tokens.Create(ctx, "subject")
+	assertNoErr(t, err)
+
+	m.FastForward(ttl)
+
+	_, err = tokens.Consume(ctx, token)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+func TestOneTimeTokensArePurposeBound(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	store := kvstore.New(m.Addr(), "")
+	resetTokens := auth.NewOneTimeTokens(store, "reset", time.Hour)
+	verifyTokens := auth.NewOneTimeTokens(store, "verify", time.Hour)
+	accessTokens := auth.NewTokens(store, time.Hour)
+	ctx := context.Background()
+
+	token, err := resetTokens.Create(ctx, "subject")
+	assertNoErr(t, err)
+
+	_, err = verifyTokens.Consume(ctx, token)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	_, err = accessTokens.UserID(ctx, token)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	_, err = resetTokens.Consume(ctx, token)
+	assertNoErr(t, err)
+}
@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordScheme is an algorithm used to hash passwords
+type PasswordScheme string
+
+const (
+	Argon2idScheme PasswordScheme = "argon2id"
+	ScryptScheme   PasswordScheme = "scrypt"
+	BcryptScheme   PasswordScheme = "bcrypt"
+)
+
+// PasswordHashing configures how new password hashes are created.
+// Hashes created with other schemes or parameters are still verified,
+// see Authorizer.PasswordNeedsRehash on how to upgrade them.
+//
+// Zero parameters are replaced by the recommended defaults.
+type PasswordHashing struct {
+	Scheme     PasswordScheme
+	Argon2id   Argon2idParams
+	Scrypt     ScryptParams
+	BcryptCost int
+
+	// Pepper is applied to the passwords of new hashes,
+	// if it has no ID new hashes are not peppered.
+	Pepper Pepper
+
+	// OldPeppers are only used to verify existing hashes, so
+	// the pepper can be rotated without invalidating them.
+	OldPeppers []Pepper
+}
+
+// Argon2idParams are the parameters of the argon2id scheme,
+// the defaults are the ones recommended on RFC 9106.
+type Argon2idParams struct {
+	// Memory is the amount of memory used in KiB (defaults to 64 MiB)
+	Memory uint32
+	// Iterations is the number of passes over the memory (defaults to 3)
+	Iterations uint32
+	// Parallelism is the number of threads used (defaults to 4)
+	Parallelism uint8
+}
+
+// ScryptParams are the parameters of the scrypt scheme
+type ScryptParams struct {
+	// CostLog2 is the log2 of the CPU/memory cost N (defaults to 15)
+	CostLog2 uint8
+	// BlockSize is the block size r (defaults to 8)
+	BlockSize int
+	// Parallelism is the parallelization p (defaults to 1)
+	Parallelism int
+}
+
+const (
+	passwordSaltSize = 16
+	passwordKeySize  = 32
+)
+
+// WHY: argon2id and scrypt hashes use the PHC string format, which
+// identifies the scheme and its parameters like bcrypt hashes do:
+// https://github.com/P-H-C/phc-string-format/blob/master/phc-sf-spec.md
+var phcEncoding = base64.RawStdEncoding
+
+func (h PasswordHashing) withDefaults() PasswordHashing {
+	if h.Scheme == "" {
+		h.Scheme = Argon2idScheme
+	}
+	if h.Argon2id.Memory == 0 {
+		h.Argon2id.Memory = 64 * 1024
+	}
+	if h.Argon2id.Iterations == 0 {
+		h.Argon2id.Iterations = 3
+	}
+	if h.Argon2id.Parallelism == 0 {
+		h.Argon2id.Parallelism = 4
+	}
+	if h.Scrypt.CostLog2 == 0 {
+		h.Scrypt.CostLog2 = 15
+	}
+	if h.Scrypt.BlockSize == 0 {
+		h.Scrypt.BlockSize = 8
+	}
+	if h.Scrypt.Parallelism == 0 {
+		h.Scrypt.Parallelism = 1
+	}
+	if h.BcryptCost == 0 {
+		h.BcryptCost = bcrypt.DefaultCost
+	}
+	return h
+}
+
+func (h PasswordHashing) validate() error {
+	switch h.Scheme {
+	case Argon2idScheme, ScryptScheme, BcryptScheme:
+	default:
+		return fmt.Errorf("unknown password scheme %q", h.Scheme)
+	}
+	if h.Argon2id.Memory < 8*uint32(h.Argon2id.Parallelism) {
+		return fmt.Errorf("argon2id memory must be at least 8 KiB per thread, got %d KiB", h.Argon2id.Memory)
+	}
+	if h.Scrypt.CostLog2 >= 32 {
+		return fmt.Errorf("scrypt cost log2 %d is too big", h.Scrypt.CostLog2)
+	}
+	if _, err := scrypt.Key(nil, nil, 2, h.Scrypt.BlockSize, h.Scrypt.Parallelism, passwordKeySize); err != nil {
+		return fmt.Errorf("invalid scrypt parameters:%v", err)
+	}
+	if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt cost %d outside of allowed range [%d, %d]", h.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	peppers := h.OldPeppers
+	if h.Pepper.ID != "" {
+		peppers = append([]Pepper{h.Pepper}, peppers...)
+	}
+	ids := map[string]struct{}{}
+	for _, pepper := range peppers {
+		if err := pepper.validate(); err != nil {
+			return err
+		}
+		if _, ok := ids[pepper.ID]; ok {
+			return fmt.Errorf("pepper ID %q used more than once", pepper.ID)
+		}
+		ids[pepper.ID] = struct{}{}
+	}
+	return nil
+}
+
+func (h PasswordHashing) hash(password string) (string, error) {
+	if h.Pepper.ID == "" {
+		return h.schemeHash(password)
+	}
+	hashed, err := h.schemeHash(h.Pepper.apply(password))
+	if err != nil {
+		return "", err
+	}
+	return pepperPrefix + h.Pepper.ID + hashed, nil
+}
+
+// matches checks if the given hash, created with any scheme
+// and known pepper, matches the password.
+func (h PasswordHashing) matches(hash string, password string) bool {
+	parsed, err := parsePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+	if parsed.pepperID != "" {
+		pepper, ok := h.pepper(parsed.pepperID)
+		if !ok {
+			return false
+		}
+		password = pepper.apply(password)
+	}
+	return parsed.matches(password)
+}
+
+// outdated returns true if the given hash was not created with the current
+// scheme, parameters and pepper. Invalid hashes are never outdated.
+func (h PasswordHashing) outdated(hash string) bool {
+	parsed, err := parsePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+	if parsed.pepperID != h.Pepper.ID {
+		return true
+	}
+	return parsed.outdated(h)
+}
+
+func (h PasswordHashing) pepper(id string) (Pepper, bool) {
+	if id == h.Pepper.ID {
+		return h.Pepper, true
+	}
+	for _, pepper := range h.OldPeppers {
+		if pepper.ID == id {
+			return pepper, true
+		}
+	}
+	return Pepper{}, false
+}
+
+func (h PasswordHashing) schemeHash(password string) (string, error) {
+	if h.Scheme == BcryptScheme {
+		v, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(v), err
+	}
+
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating password salt:%v", err)
+	}
+
+	if h.Scheme == ScryptScheme {
+		key, err := scryptKey(password, salt, h.Scrypt, passwordKeySize)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+			h.Scrypt.CostLog2, h.Scrypt.BlockSize, h.Scrypt.Parallelism,
+			phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+	}
+
+	key := argon2idKey(password, salt, h.Argon2id, passwordKeySize)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Argon2id.Memory, h.Argon2id.Iterations, h.Argon2id.Parallelism,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+// parsedPasswordHash is a password hash parsed on the hashing
+// configuration that would create it.
+type parsedPasswordHash struct {
+	hashing  PasswordHashing
+	pepperID string
+	salt     []byte
+	key      []byte
+	raw      string
+}
+
+func parsePasswordHash(hash string) (parsedPasswordHash, error) {
+	pepperID, hash, err := splitPepperedHash(hash)
+	if err != nil {
+		return parsedPasswordHash{}, err
+	}
+	parsed := parsedPasswordHash{raw: hash, pepperID: pepperID}
+
+	if strings.HasPrefix(hash, "$2") {
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return parsedPasswordHash{}, fmt.Errorf("invalid bcrypt hash:%v", err)
+		}
+		parsed.hashing = PasswordHashing{Scheme: BcryptScheme, BcryptCost: cost}
+		return parsed, nil
+	}
+
+	fields := strings.Split(hash, "$")
+	if len(fields) < 2 || fields[0] != "" {
+		return parsedPasswordHash{}, fmt.Errorf("unknown password hash format")
+	}
+
+	scheme := PasswordScheme(fields[1])
+	parsed.hashing.Scheme = scheme
+
+	var params string
+
+	switch scheme {
+	case Argon2idScheme:
+		if len(fields) != 6 {
+			return parsedPasswordHash{}, fmt.Errorf("invalid argon2id hash")
+		}
+		var version int
+		if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return parsedPasswordHash{}, fmt.Errorf("unsupported argon2id version %q", fields[2])
+		}
+		p := &parsed.hashing.Argon2id
+		_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism)
+		if err == nil && (p.Iterations == 0 || p.Parallelism == 0) {
+			err = fmt.Errorf("iterations and parallelism must be positive")
+		}
+		params = fields[3]
+		fields = fields[4:]
+	case ScryptScheme:
+		if len(fields) != 5 {
+			return parsedPasswordHash{}, fmt.Errorf("invalid scrypt hash")
+		}
+		p := &parsed.hashing.Scrypt
+		_, err = fmt.Sscanf(fields[2], "ln=%d,r=%d,p=%d", &p.CostLog2, &p.BlockSize, &p.Parallelism)
+		if err == nil && (p.CostLog2 == 0 || p.CostLog2 >= 32 || p.BlockSize <= 0 || p.Parallelism <= 0) {
+			err = fmt.Errorf("parameters out of range")
+		}
+		params = fields[2]
+		fields = fields[3:]
+	default:
+		return parsedPasswordHash{}, fmt.Errorf("unknown password scheme %q", scheme)
+	}
+	if err != nil {
+		return parsedPasswordHash{}, fmt.Errorf("invalid %s parameters %q:%v", scheme, params, err)
+	}
+
+	parsed.salt, err = phcEncoding.DecodeString(fields[0])
+	if err != nil {
+		return parsedPasswordHash{}, fmt.Errorf("invalid salt:%v", err)
+	}
+	parsed.key, err = phcEncoding.DecodeString(fields[1])
+	if err != nil {
+		return parsedPasswordHash{}, fmt.Errorf("invalid key:%v", err)
+	}
+	if len(parsed.key) == 0 {
+		return parsedPasswordHash{}, fmt.Errorf("empty key")
+	}
+	return parsed, nil
+}
+
+func (p parsedPasswordHash) matches(password string) bool {
+	switch p.hashing.Scheme {
+	case BcryptScheme:
+		return bcrypt.CompareHashAndPassword([]byte(p.raw), []byte(password)) == nil
+	case ScryptScheme:
+		key, err := scryptKey(password, p.salt, p.hashing.Scrypt, len(p.key))
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare(key, p.key) == 1
+	case Argon2idScheme:
+		key := argon2idKey(password, p.salt, p.hashing.Argon2id, uint32(len(p.key)))
+		return subtle.ConstantTimeCompare(key, p.key) == 1
+	}
+	return false
+}
+
+// outdated returns true if the hash was not created with
+// the scheme and parameters of the given hashing
+func (p parsedPasswordHash) outdated(h PasswordHashing) bool {
+	if p.hashing.Scheme != h.Scheme {
+		return true
+	}
+	switch h.Scheme {
+	case BcryptScheme:
+		return p.hashing.BcryptCost != h.BcryptCost
+	case ScryptScheme:
+		return p.hashing.Scrypt != h.Scrypt || len(p.key) != passwordKeySize
+	case Argon2idScheme:
+		return p.hashing.Argon2id != h.Argon2id || len(p.key) != passwordKeySize
+	}
+	return true
+}
+
+func argon2idKey(password string, salt []byte, p Argon2idParams, size uint32) []byte {
+	return argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, size)
+}
+
+func scryptKey(password string, salt []byte, p ScryptParams, size int) ([]byte, error) {
+	key, err := scrypt.Key([]byte(password), salt, 1<<p.CostLog2, p.BlockSize, p.Parallelism, size)
+	if err != nil {
+		return nil, fmt.Errorf("error creating scrypt key:%v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,304 @@
+package auth_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/katcipis/stonks/auth"
+)
+
+func TestPasswordHashing(t *testing.T) {
+	type Test struct {
+		name       string
+		hashing    auth.PasswordHashing
+		hashPrefix string
+	}
+
+	tests := []Test{
+		{
+			name:       "Argon2id",
+			hashing:    testArgon2idHashing(),
+			hashPrefix: "$argon2id$v=19$m=64,t=1,p=1$",
+		},
+		{
+			name:       "Scrypt",
+			hashing:    testScryptHashing(),
+			hashPrefix: "$scrypt$ln=4,r=8,p=1$",
+		},
+		{
+			name:       "Bcrypt",
+			hashing:    testBcryptHashing(),
+			hashPrefix: "$2a$04$",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			const password = "some password"
+
+			authorizer, err := auth.NewWithPasswordHashing(test.hashing)
+			assertNoErr(t, err)
+
+			hash, err := authorizer.PasswordHash(password)
+			assertNoErr(t, err)
+
+			if !strings.HasPrefix(hash, test.hashPrefix) {
+				t.Fatalf("got hash %q want prefix %q", hash, test.hashPrefix)
+			}
+			if !authorizer.HashMatchesPassword(hash, password) {
+				t.Fatalf("hash %q should match password %q", hash, password)
+			}
+			if authorizer.HashMatchesPassword(hash, "wrong password") {
+				t.Fatalf("hash %q should not match wrong password", hash)
+			}
+			if authorizer.PasswordNeedsRehash(hash) {
+				t.Fatalf("hash %q created with current hashing should not need rehash", hash)
+			}
+
+			otherHash, err := authorizer.PasswordHash(password)
+			assertNoErr(t, err)
+
+			if otherHash == hash {
+				t.Fatal("hashes of the same password should be salted")
+			}
+		})
+	}
+}
+
+func TestPasswordHashesFromOtherSchemesAreVerified(t *testing.T) {
+	const password = "some password"
+
+	hashings := []auth.PasswordHashing{
+		testArgon2idHashing(),
+		testScryptHashing(),
+		testBcryptHashing(),
+	}
+
+	for _, hashing := range hashings {
+		authorizer, err := auth.NewWithPasswordHashing(hashing)
+		assertNoErr(t, err)
+
+		hash, err := authorizer.PasswordHash(password)
+		assertNoErr(t, err)
+
+		for _, otherHashing := range hashings {
+			other, err := auth.NewWithPasswordHashing(otherHashing)
+			assertNoErr(t, err)
+
+			if !other.HashMatchesPassword(hash, password) {
+				t.Errorf("%s: hash %q should match password", otherHashing.Scheme, hash)
+			}
+
+			needsRehash := hashing.Scheme != otherHashing.Scheme
+			if got := other.PasswordNeedsRehash(hash); got != needsRehash {
+				t.Errorf("%s: hash %q needs rehash: got %t want %t", otherHashing.Scheme, hash, got, needsRehash)
+			}
+		}
+	}
+}
+
+func TestPasswordNeedsRehashWhenParametersChange(t *testing.T) {
+	const password = "some password"
+
+	type Test struct {
+		name    string
+		old     auth.PasswordHashing
+		current auth.PasswordHashing
+	}
+
+	changed := func(h auth.PasswordHashing, change func(*auth.PasswordHashing)) auth.PasswordHashing {
+		change(&h)
+		return h
+	}
+
+	tests := []Test{
+		{
+			name: "Argon2id",
+			old:  testArgon2idHashing(),
+			current: changed(testArgon2idHashing(), func(h *auth.PasswordHashing) {
+				h.Argon2id.Iterations++
+			}),
+		},
+		{
+			name: "Scrypt",
+			old:  testScryptHashing(),
+			current: changed(testScryptHashing(), func(h *auth.PasswordHashing) {
+				h.Scrypt.CostLog2++
+			}),
+		},
+		{
+			name: "Bcrypt",
+			old:  testBcryptHashing(),
+			current: changed(testBcryptHashing(), func(h *auth.PasswordHashing) {
+				h.BcryptCost++
+			}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			old, err := auth.NewWithPasswordHashing(test.old)
+			assertNoErr(t, err)
+
+			current, err := auth.NewWithPasswordHashing(test.current)
+			assertNoErr(t, err)
+
+			hash, err := old.PasswordHash(password)
+			assertNoErr(t, err)
+
+			if !current.PasswordNeedsRehash(hash) {
+				t.Fatalf("hash %q should need rehash", hash)
+			}
+			if !current.HashMatchesPassword(hash, password) {
+				t.Fatalf("hash %q should match password", hash)
+			}
+		})
+	}
+}
+
+func TestPasswordHashingDefaults(t *testing.T) {
+	authorizer, err := auth.NewWithPasswordHashing(auth.PasswordHashing{})
+	assertNoErr(t, err)
+
+	hash, err := authorizer.PasswordHash("some password")
+	assertNoErr(t, err)
+
+	const wantPrefix = "$argon2id$v=19$m=65536,t=3,p=4$"
+	if !strings.HasPrefix(hash, wantPrefix) {
+		t.Fatalf("got hash %q want prefix %q", hash, wantPrefix)
+	}
+
+	hash, err = auth.New().PasswordHash("some password")
+	assertNoErr(t, err)
+
+	if !strings.HasPrefix(hash, "$2a$10$") {
+		t.Fatalf("got hash %q want a bcrypt hash with default cost", hash)
+	}
+}
+
+func TestLongPasswordsAreNotTruncated(t *testing.T) {
+	password := strings.Repeat("a", 72)
+
+	for _, hashing := range []auth.PasswordHashing{testArgon2idHashing(), testScryptHashing()} {
+		authorizer, err := auth.NewWithPasswordHashing(hashing)
+		assertNoErr(t, err)
+
+		hash, err := authorizer.PasswordHash(password + "b")
+		assertNoErr(t, err)
+
+		if authorizer.HashMatchesPassword(hash, password+"c") {
+			t.Errorf("%s: passwords differing after 72 bytes should not match", hashing.Scheme)
+		}
+	}
+}
+
+func TestInvalidPasswordHashing(t *testing.T) {
+	type Test struct {
+		name    string
+		hashing auth.PasswordHashing
+	}
+
+	tests := []Test{
+		{
+			name:    "UnknownScheme",
+			hashing: auth.PasswordHashing{Scheme: "md5"},
+		},
+		{
+			name: "Argon2idNotEnoughMemory",
+			hashing: auth.PasswordHashing{
+				Argon2id: auth.Argon2idParams{Memory: 15, Parallelism: 2},
+			},
+		},
+		{
+			name: "ScryptCostTooBig",
+			hashing: auth.PasswordHashing{
+				Scheme: auth.ScryptScheme,
+				Scrypt: auth.ScryptParams{CostLog2: 32},
+			},
+		},
+		{
+			name: "ScryptNegativeBlockSize",
+			hashing: auth.PasswordHashing{
+				Scheme: auth.ScryptScheme,
+				Scrypt: auth.ScryptParams{BlockSize: -1},
+			},
+		},
+		{
+			name: "BcryptCostTooSmall",
+			hashing: auth.PasswordHashing{
+				Scheme:     auth.BcryptScheme,
+				BcryptCost: 3,
+			},
+		},
+		{
+			name: "BcryptCostTooBig",
+			hashing: auth.PasswordHashing{
+				Scheme:     auth.BcryptScheme,
+				BcryptCost: 32,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := auth.NewWithPasswordHashing(test.hashing)
+			if err == nil {
+				t.Fatal("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestInvalidPasswordHashesDontMatch(t *testing.T) {
+	authorizer, err := auth.NewWithPasswordHashing(testArgon2idHashing())
+	assertNoErr(t, err)
+
+	hashes := []string{
+		"",
+		"password",
+		"$md5$abc",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ",
+		"$argon2id$v=19$invalid$c2FsdHNhbHQ$a2V5a2V5",
+		"$scrypt$ln=0,r=8,p=1$c2FsdHNhbHQ$a2V5a2V5",
+		"$scrypt$ln=4,r=8,p=1$!!!$a2V5a2V5",
+		"$2a$invalid",
+		"$pepper$",
+		"$pepper$$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5",
+		"$pepper$unknown$argon2id$v=19$invalid$c2FsdHNhbHQ$a2V5a2V5",
+	}
+
+	for _, hash := range hashes {
+		if authorizer.HashMatchesPassword(hash, "password") {
+			t.Errorf("invalid hash %q should not match", hash)
+		}
+		if authorizer.PasswordNeedsRehash(hash) {
+			t.Errorf("invalid hash %q should not need rehash", hash)
+		}
+	}
+}
+
+// WHY: the weakest parameters possible, keeping tests fast
+
+func testArgon2idHashing() auth.PasswordHashing {
+	return auth.PasswordHashing{
+		Scheme:   auth.Argon2idScheme,
+		Argon2id: auth.Argon2idParams{Memory: 64, Iterations: 1, Parallelism: 1},
+	}
+}
+
+func testScryptHashing() auth.PasswordHashing {
+	return auth.PasswordHashing{
+		Scheme: auth.ScryptScheme,
+		Scrypt: auth.ScryptParams{CostLog2: 4},
+	}
+}
+
+func testBcryptHashing() auth.PasswordHashing {
+	return auth.PasswordHashing{
+		Scheme:     auth.BcryptScheme,
+		BcryptCost: 4,
+	}
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Pepper is a secret applied to passwords (with HMAC-SHA256) before
+// they are hashed. Unlike salts peppers are not stored with the hashes,
+// so leaked hashes can't be cracked offline without the pepper.
+type Pepper struct {
+	ID     string
+	Secret []byte
+}
+
+// MinPepperSize is the minimum size in bytes of pepper secrets
+const MinPepperSize = 32
+
+// WHY: the pepper ID is stored with the hash, so peppers can be rotated
+// without invalidating existing hashes, like:
+// $pepper$<id>$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+const pepperPrefix = "$pepper$"
+
+// ParsePepper parses a pepper secret, like the contents of a secret file.
+// Leading and trailing whitespace is ignored.
+func ParsePepper(id string, data []byte) (Pepper, error) {
+	pepper := Pepper{ID: id, Secret: bytes.TrimSpace(data)}
+	if err := pepper.validate(); err != nil {
+		return Pepper{}, err
+	}
+	return pepper, nil
+}
+
+func (p Pepper) validate() error {
+	if p.ID == "" {
+		return errors.New("empty pepper ID")
+	}
+	if strings.Contains(p.ID, "$") {
+		return fmt.Errorf("pepper %q:ID can't contain '$'", p.ID)
+	}
+	if len(p.Secret) < MinPepperSize {
+		return fmt.Errorf("pepper %q:secret must have at least %d bytes, got %d", p.ID, MinPepperSize, len(p.Secret))
+	}
+	return nil
+}
+
+// apply returns the password peppered, ready to be hashed.
+func (p Pepper) apply(password string) string {
+	mac := hmac.New(sha256.New, p.Secret)
+	mac.Write([]byte(password))
+	// WHY: encoded as text so any scheme can hash it, and the 44 bytes
+	// encoded are below the 72 bytes bcrypt truncates passwords to.
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// splitPepperedHash returns the pepper ID and the hash without the
+// pepper prefix, hashes without a pepper have an empty ID.
+func splitPepperedHash(hash string) (string, string, error) {
+	if !strings.HasPrefix(hash, pepperPrefix) {
+		return "", hash, nil
+	}
+	rest := strings.TrimPrefix(hash, pepperPrefix)
+	i := strings.Index(rest, "$")
+	if i <= 0 {
+		return "", "", errors.New("invalid peppered hash")
+	}
+	return rest[:i], rest[i:], nil
+}
@@ -0,0 +1,228 @@
+package auth_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/katcipis/stonks/auth"
+)
+
+func TestPepperedPasswordHashes(t *testing.T) {
+	const password = "some password"
+
+	oldPepper := newTestPepper(t, "old", "a")
+	newPepper := newTestPepper(t, "new", "b")
+
+	hashing := testArgon2idHashing()
+	hashing.Pepper = oldPepper
+
+	authorizer, err := auth.NewWithPasswordHashing(hashing)
+	assertNoErr(t, err)
+
+	oldHash, err := authorizer.PasswordHash(password)
+	assertNoErr(t, err)
+
+	if !strings.HasPrefix(oldHash, "$pepper$old$argon2id$") {
+		t.Fatalf("got hash %q want it peppered with %q", oldHash, oldPepper.ID)
+	}
+	if !authorizer.HashMatchesPassword(oldHash, password) {
+		t.Fatalf("hash %q should match password", oldHash)
+	}
+	if authorizer.HashMatchesPassword(oldHash, "wrong password") {
+		t.Fatalf("hash %q should not match wrong password", oldHash)
+	}
+	if authorizer.PasswordNeedsRehash(oldHash) {
+		t.Fatalf("hash %q should not need rehash", oldHash)
+	}
+
+	hashing.Pepper = newPepper
+	hashing.OldPeppers = []auth.Pepper{oldPepper}
+
+	rotated, err := auth.NewWithPasswordHashing(hashing)
+	assertNoErr(t, err)
+
+	if !rotated.HashMatchesPassword(oldHash, password) {
+		t.Fatalf("hash %q should match password after pepper rotation", oldHash)
+	}
+	if !rotated.PasswordNeedsRehash(oldHash) {
+		t.Fatalf("hash %q with old pepper should need rehash", oldHash)
+	}
+
+	newHash, err := rotated.PasswordHash(password)
+	assertNoErr(t, err)
+
+	if !strings.HasPrefix(newHash, "$pepper$new$argon2id$") {
+		t.Fatalf("got hash %q want it peppered with %q", newHash, newPepper.ID)
+	}
+	if !rotated.HashMatchesPassword(newHash, password) {
+		t.Fatalf("hash %q should match password", newHash)
+	}
+	if rotated.PasswordNeedsRehash(newHash) {
+		t.Fatalf("hash %q should not need rehash", newHash)
+	}
+
+	// Hashes with removed or unknown peppers can't be verified
+	hashing.OldPeppers = nil
+
+	removed, err := auth.NewWithPasswordHashing(hashing)
+	assertNoErr(t, err)
+
+	if removed.HashMatchesPassword(oldHash, password) {
+		t.Fatalf("hash %q should not match after its pepper is removed", oldHash)
+	}
+
+	hashing.Pepper = newTestPepper(t, "old", "c")
+
+	otherSecret, err := auth.NewWithPasswordHashing(hashing)
+	assertNoErr(t, err)
+
+	if otherSecret.HashMatchesPassword(oldHash, password) {
+		t.Fatalf("hash %q should not match with another pepper secret", oldHash)
+	}
+
+	unpeppered, err := auth.NewWithPasswordHashing(testArgon2idHashing())
+	assertNoErr(t, err)
+
+	if unpeppered.HashMatchesPassword(newHash, password) {
+		t.Fatalf("hash %q should not match without the pepper", newHash)
+	}
+}
+
+func TestPasswordHashesWithoutPepperAreUpgraded(t *testing.T) {
+	const password = "some password"
+
+	unpeppered, err := auth.NewWithPasswordHashing(testArgon2idHashing())
+	assertNoErr(t, err)
+
+	hash, err := unpeppered.PasswordHash(password)
+	assertNoErr(t, err)
+
+	hashing := testArgon2idHashing()
+	hashing.Pepper = newTestPepper(t, "pepper", "a")
+
+	peppered, err := auth.NewWithPasswordHashing(hashing)
+	assertNoErr(t, err)
+
+	if !peppered.HashMatchesPassword(hash, password) {
+		t.Fatalf("hash %q should match password", hash)
+	}
+	if !peppered.PasswordNeedsRehash(hash) {
+		t.Fatalf("hash %q without pepper should need rehash", hash)
+	}
+}
+
+func TestPepperedBcryptDoesNotTruncatePasswords(t *testing.T) {
+	password := strings.Repeat("a", 72)
+
+	hashing := testBcryptHashing()
+	hashing.Pepper = newTestPepper(t, "pepper", "a")
+
+	authorizer, err := auth.NewWithPasswordHashing(hashing)
+	assertNoErr(t, err)
+
+	hash, err := authorizer.PasswordHash(password + "b")
+	assertNoErr(t, err)
+
+	if !authorizer.HashMatchesPassword(hash, password+"b") {
+		t.Fatalf("hash %q should match password", hash)
+	}
+	if authorizer.HashMatchesPassword(hash, password+"c") {
+		t.Fatal("passwords differing after 72 bytes should not match")
+	}
+}
+
+func TestParsePepper(t *testing.T) {
+	secret := strings.Repeat("s", auth.MinPepperSize)
+
+	pepper, err := auth.ParsePepper("2020-08", []byte("\n "+secret+"\n"))
+	assertNoErr(t, err)
+
+	if pepper.ID != "2020-08" {
+		t.Fatalf("got pepper ID %q want %q", pepper.ID, "2020-08")
+	}
+	if string(pepper.Secret) != secret {
+		t.Fatalf("got pepper secret %q want %q", pepper.Secret, secret)
+	}
+
+	type Test struct {
+		name   string
+		id     string
+		secret string
+	}
+
+	tests := []Test{
+		{
+			name:   "EmptyID",
+			id:     "",
+			secret: secret,
+		},
+		{
+			name:   "InvalidID",
+			id:     "pep$per",
+			secret: secret,
+		},
+		{
+			name:   "ShortSecret",
+			id:     "pepper",
+			secret: secret[1:] + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := auth.ParsePepper(test.id, []byte(test.secret))
+			if err == nil {
+				t.Fatal("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestInvalidPeppers(t *testing.T) {
+	type Test struct {
+		name    string
+		hashing auth.PasswordHashing
+	}
+
+	secret := []byte(strings.Repeat("s", auth.MinPepperSize))
+
+	tests := []Test{
+		{
+			name: "ShortSecret",
+			hashing: auth.PasswordHashing{
+				Pepper: auth.Pepper{ID: "pepper", Secret: secret[1:]},
+			},
+		},
+		{
+			name: "OldPepperWithoutID",
+			hashing: auth.PasswordHashing{
+				Pepper:     auth.Pepper{ID: "pepper", Secret: secret},
+				OldPeppers: []auth.Pepper{{Secret: secret}},
+			},
+		},
+		{
+			name: "DuplicatedID",
+			hashing: auth.PasswordHashing{
+				Pepper:     auth.Pepper{ID: "pepper", Secret: secret},
+				OldPeppers: []auth.Pepper{{ID: "pepper", Secret: secret}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := auth.NewWithPasswordHashing(test.hashing)
+			if err == nil {
+				t.Fatal("expected error, got none")
+			}
+		})
+	}
+}
+
+func newTestPepper(t *testing.T, id string, secret string) auth.Pepper {
+	t.Helper()
+
+	pepper, err := auth.ParsePepper(id, []byte(strings.Repeat(secret, auth.MinPepperSize)))
+	assertNoErr(t, err)
+	return pepper
+}
@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/katcipis/stonks/auth/kvstore"
+)
+
+const (
+	// RefreshTokenReusedErr happens when an already used refresh token is used again
+	RefreshTokenReusedErr Error = "refresh token reused"
+)
+
+// RefreshTokens is responsible for creating and rotating refresh tokens.
+//
+// Refresh tokens are single use, each use returns a new refresh token of
+// the same family. All refresh tokens created from a sign in are part of
+// the same family, if an already used refresh token is used again the
+// whole family is revoked since it indicates that the token was stolen:
+//
+// - https://tools.ietf.org/html/draft-ietf-oauth-security-topics-15#section-4.12.2
+type RefreshTokens struct {
+	store KVStore
+	ttl   time.Duration
+}
+
+type refreshRecord struct {
+	UserID    string `json:"user_id"`
+	FamilyID  string `json:"family_id"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// NewRefreshTokens creates a new RefreshTokens that will store tokens on
+// the given store. Each refresh token is valid for the given ttl, so
+// a family of tokens expires if it is not used during the ttl.
+func NewRefreshTokens(store KVStore, ttl time.Duration) *RefreshTokens {
+	return &RefreshTokens{
+		store: store,
+		ttl:   ttl,
+	}
+}
+
+// TTL is how long created refresh tokens are valid
+func (r *RefreshTokens) TTL() time.Duration {
+	return r.ttl
+}
+
+// Create creates a new refresh token for the given user ID,
+// starting a new family of refresh tokens.
+func (r *RefreshTokens) Create(ctx context.Context, userID string) (string, error) {
+	familyID, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	// WHY: indexing the families by user allows revoking all refresh
+	// tokens of an user. Since families are refreshed at each use the
+	// index is refreshed along with them.
+	err = r.store.SetAdd(ctx, userRefreshFamiliesKey(userID), r.ttl, familyID)
+	if err != nil {
+		return "", fmt.Errorf("error indexing refresh token family:%v", err)
+	}
+	return r.create(ctx, refreshRecord{UserID: userID, FamilyID: familyID})
+}
+
+// Rotate uses the given refresh token, returning the ID of the user that
+// owns it and a new refresh token that replaces it. After that the given
+// refresh token can't be used anymore.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the token is invalid, expired or revoked: InvalidTokenErr
+// - If the token was already used: RefreshTokenReusedErr (the family is revoked)
+//
+// All other errors are to be considered internal errors.
+func (r *RefreshTokens) Rotate(ctx context.Context, refreshToken string) (string, string, error) {
+	// WHY: taking the token guarantees that concurrent uses
+	// of the same token can't both succeed.
+	val, err := r.store.Take(ctx, refreshTokenKey(refreshToken))
+	if err != nil {
+		if errors.Is(err, kvstore.KeyNotFoundErr) {
+			return "", "", r.detectReuse(ctx, refreshToken)
+		}
+		return "", "", fmt.Errorf("error retrieving refresh token:%v", err)
+	}
+
+	record := refreshRecord{}
+	if err := json.Unmarshal(val, &record); err != nil {
+		return "", "", fmt.Errorf("error parsing refresh token record:%v", err)
+	}
+
+	_, err = r.store.Get(ctx, refreshFamilyKey(record.FamilyID))
+	if err != nil {
+		if errors.Is(err, kvstore.KeyNotFoundErr) {
+			return "", "", fmt.Errorf("%w:revoked refresh token family", InvalidTokenErr)
+		}
+		return "", "", fmt.Errorf("error retrieving refresh token family:%v", err)
+	}
+
+	err = r.store.Put(ctx, usedRefreshTokenKey(refreshToken), []byte(record.FamilyID), r.ttl)
+	if err != nil {
+		return "", "", fmt.Errorf("error marking refresh token as used:%v", err)
+	}
+
+	err = r.store.SetAdd(ctx, userRefreshFamiliesKey(record.UserID), r.ttl, record.FamilyID)
+	if err != nil {
+		return "", "", fmt.Errorf("error indexing refresh token family:%v", err)
+	}
+
+	newToken, err := r.create(ctx, record)
+	if err != nil {
+		return "", "", err
+	}
+	return record.UserID, newToken, nil
+}
+
+// Introspect validates the given refresh token without using it, returning
+// information about it. If the token is invalid, expired, revoked or
+// already used it returns InvalidTokenErr.
+func (r *RefreshTokens) Introspect(ctx context.Context, refreshToken string) (TokenInfo, error) {
+	val, err := r.store.Get(ctx, refreshTokenKey(refreshToken))
+	if err != nil {
+		if errors.Is(err, kvstore.KeyNotFoundErr) {
+			return TokenInfo{}, InvalidTokenErr
+		}
+		return TokenInfo{}, fmt.Errorf("error retrieving refresh token:%v", err)
+	}
+
+	record := refreshRecord{}
+	if err := json.Unmarshal(val, &record); err != nil {
+		return TokenInfo{}, fmt.Errorf("error parsing refresh token record:%v", err)
+	}
+
+	_, err = r.store.Get(ctx, refreshFamilyKey(record.FamilyID))
+	if err != nil {
+		if errors.Is(err, kvstore.KeyNotFoundErr) {
+			return TokenInfo{}, fmt.Errorf("%w:revoked refresh token family", InvalidTokenErr)
+		}
+		return TokenInfo{}, fmt.Errorf("error retrieving refresh token family:%v", err)
+	}
+
+	return TokenInfo{
+		UserID:    record.UserID,
+		IssuedAt:  time.Unix(record.IssuedAt, 0),
+		ExpiresAt: time.Unix(record.ExpiresAt, 0),
+	}, nil
+}
+
+// Revoke revokes the whole family of the given refresh token. Revoking
+// an invalid or already expired refresh token is not an error.
+func (r *RefreshTokens) Revoke(ctx context.Context, refreshToken string) error {
+	val, err := r.store.Get(ctx, refreshTokenKey(refreshToken))
+	if err != nil {
+		if errors.Is(err, kvstore.KeyNotFoundErr) {
+			return nil
+		}
+		return fmt.Errorf("error retrieving refresh token:%v", err)
+	}
+
+	record := refreshRecord{}
+	if err := json.Unmarshal(val, &record); err != nil {
+		return fmt.Errorf("error parsing refresh token record:%v", err)
+	}
+	return r.revokeFamily(ctx, record.FamilyID)
+}
+
+// RevokeUserTokens revokes all refresh tokens of the given user.
+func (r *RefreshTokens) RevokeUserTokens(ctx context.Context, userID string) error {
+	indexKey := userRefreshFamiliesKey(userID)
+	families, err := r.store.SetMembers(ctx, indexKey)
+	if err != nil {
+		return fmt.Errorf("error retrieving user refresh token families:%v", err)
+	}
+
+	for _, familyID := range families {
+		if err := r.revokeFamily(ctx, familyID); err != nil {
+			return err
+		}
+	}
+
+	if len(families) == 0 {
+		return nil
+	}
+
+	err = r.store.SetRemove(ctx, indexKey, families...)
+	if err != nil {
+		return fmt.Errorf("error removing revoked refresh token families from index:%v", err)
+	}
+	return nil
+}
+
+func (r *RefreshTokens) create(ctx context.Context, record refreshRecord) (string, error) {
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	record.IssuedAt = now.Unix()
+	record.ExpiresAt = now.Add(r.ttl).Unix()
+
+	val, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("error serializing refresh token record:%v", err)
+	}
+
+	err = r.store.Put(ctx, refreshTokenKey(refreshToken), val, r.ttl)
+	if err != nil {
+		return "", fmt.Errorf("error storing refresh token:%v", err)
+	}
+
+	// WHY: the family expires along with its newest token, unless revoked
+	err = r.store.Put(ctx, refreshFamilyKey(record.FamilyID), []byte(record.UserID), r.ttl)
+	if err != nil {
+		return "", fmt.Errorf("error storing refresh token family:%v", err)
+	}
+	return refreshToken, nil
+}
+
+func (r *RefreshTokens) detectReuse(ctx context.Context, refreshToken string) error {
+	familyID, err := r.store.Get(ctx, usedRefreshTokenKey(refreshToken))
+	if err != nil {
+		if errors.Is(err, kvstore.KeyNotFoundErr) {
+			return InvalidTokenErr
+		}
+		return fmt.Errorf("error checking refresh token reuse:%v", err)
+	}
+
+	if err := r.revokeFamily(ctx, string(familyID)); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w:family revoked", RefreshTokenReusedErr)
+}
+
+func (r *RefreshTokens) revokeFamily(ctx context.Context, familyID string) error {
+	err := r.store.Delete(ctx, refreshFamilyKey(familyID))
+	if err != nil {
+		return fmt.Errorf("error revoking refresh token family:%v", err)
+	}
+	return nil
+}
+
+func refreshTokenKey(refreshToken string) string {
+	return hashedKey("refresh-tokens", refreshToken)
+}
+
+func usedRefreshTokenKey(refreshToken string) string {
+	return hashedKey("used-refresh-tokens", refreshToken)
+}
+
+func refreshFamilyKey(familyID string) string {
+	return hashedKey("refresh-token-families", familyID)
+}
+
+func userRefreshFamiliesKey(userID string) string {
+	return "user-refresh-token-families:" + userID
+}
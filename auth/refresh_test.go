@@ -0,0 +1,204 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/kvstore"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+	const userID = "13"
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	refreshTokens := auth.NewRefreshTokens(kvstore.New(m.Addr(), ""), time.Hour)
+	ctx := context.Background()
+
+	token, err := refreshTokens.Create(ctx, userID)
+	assertNoErr(t, err)
+
+	gotUserID, rotated, err := refreshTokens.Rotate(ctx, token)
+	assertNoErr(t, err)
+
+	if gotUserID != userID {
+		t.Fatalf("got user ID %q want %q", gotUserID, userID)
+	}
+	if rotated == "" || rotated == token {
+		t.Fatalf("got rotated token %q from token %q", rotated, token)
+	}
+
+	gotUserID, rotatedAgain, err := refreshTokens.Rotate(ctx, rotated)
+	assertNoErr(t, err)
+
+	if gotUserID != userID {
+		t.Fatalf("got user ID %q want %q", gotUserID, userID)
+	}
+
+	// Each rotation extends the family lifetime
+	m.FastForward(30 * time.Minute)
+	_, lastToken, err := refreshTokens.Rotate(ctx, rotatedAgain)
+	assertNoErr(t, err)
+
+	m.FastForward(45 * time.Minute)
+	_, _, err = refreshTokens.Rotate(ctx, lastToken)
+	assertNoErr(t, err)
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	const userID = "13"
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	refreshTokens := auth.NewRefreshTokens(kvstore.New(m.Addr(), ""), time.Hour)
+	ctx := context.Background()
+
+	token, err := refreshTokens.Create(ctx, userID)
+	assertNoErr(t, err)
+
+	otherFamilyToken, err := refreshTokens.Create(ctx, userID)
+	assertNoErr(t, err)
+
+	_, rotated, err := refreshTokens.Rotate(ctx, token)
+	assertNoErr(t, err)
+
+	_, _, err = refreshTokens.Rotate(ctx, token)
+	if !errors.Is(err, auth.RefreshTokenReusedErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.RefreshTokenReusedErr)
+	}
+
+	// The legitimate token of the family is revoked too
+	_, _, err = refreshTokens.Rotate(ctx, rotated)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	// Other families are not affected
+	_, _, err = refreshTokens.Rotate(ctx, otherFamilyToken)
+	assertNoErr(t, err)
+}
+
+func TestRefreshTokenRevocation(t *testing.T) {
+	const (
+		userID      = "1"
+		otherUserID = "2"
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	refreshTokens := auth.NewRefreshTokens(kvstore.New(m.Addr(), ""), time.Hour)
+	ctx := context.Background()
+
+	revoked := createRefreshToken(t, refreshTokens, userID)
+	assertNoErr(t, refreshTokens.Revoke(ctx, revoked))
+
+	_, _, err := refreshTokens.Rotate(ctx, revoked)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	userTokens := []string{
+		createRefreshToken(t, refreshTokens, userID),
+		createRefreshToken(t, refreshTokens, userID),
+	}
+	otherUserToken := createRefreshToken(t, refreshTokens, otherUserID)
+
+	assertNoErr(t, refreshTokens.RevokeUserTokens(ctx, userID))
+
+	for _, token := range userTokens {
+		_, _, err := refreshTokens.Rotate(ctx, token)
+		if !errors.Is(err, auth.InvalidTokenErr) {
+			t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+		}
+	}
+
+	_, _, err = refreshTokens.Rotate(ctx, otherUserToken)
+	assertNoErr(t, err)
+
+	// Revoking invalid tokens or users without tokens is not an error
+	assertNoErr(t, refreshTokens.Revoke(ctx, "invalid"))
+	assertNoErr(t, refreshTokens.RevokeUserTokens(ctx, "unknown"))
+}
+
+func TestRefreshTokenIntrospection(t *testing.T) {
+	const (
+		userID = "7"
+		ttl    = time.Hour
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	refreshTokens := auth.NewRefreshTokens(kvstore.New(m.Addr(), ""), ttl)
+	ctx := context.Background()
+
+	before := time.Now().Unix()
+	token := createRefreshToken(t, refreshTokens, userID)
+
+	// Introspecting doesn't use the token, so it can be done many times
+	for i := 0; i < 2; i++ {
+		info, err := refreshTokens.Introspect(ctx, token)
+		assertNoErr(t, err)
+
+		if info.UserID != userID {
+			t.Fatalf("got user ID %q want %q", info.UserID, userID)
+		}
+		if info.IssuedAt.Unix() < before || info.ExpiresAt != info.IssuedAt.Add(ttl) {
+			t.Fatalf("got token info %+v for token issued after %d", info, before)
+		}
+	}
+
+	_, rotated, err := refreshTokens.Rotate(ctx, token)
+	assertNoErr(t, err)
+
+	_, err = refreshTokens.Introspect(ctx, token)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	_, err = refreshTokens.Introspect(ctx, rotated)
+	assertNoErr(t, err)
+
+	assertNoErr(t, refreshTokens.Revoke(ctx, rotated))
+
+	_, err = refreshTokens.Introspect(ctx, rotated)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+func TestRefreshTokenExpiration(t *testing.T) {
+	const ttl = time.Hour
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	refreshTokens := auth.NewRefreshTokens(kvstore.New(m.Addr(), ""), ttl)
+	token := createRefreshToken(t, refreshTokens, "1")
+
+	m.FastForward(ttl)
+
+	_, _, err := refreshTokens.Rotate(context.Background(), token)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	_, _, err = refreshTokens.Rotate(context.Background(), "unknown")
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+func createRefreshToken(t *testing.T, refreshTokens *auth.RefreshTokens, userID string) string {
+	t.Helper()
+
+	token, err := refreshTokens.Create(context.Background(), userID)
+	assertNoErr(t, err)
+	return token
+}
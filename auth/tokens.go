@@ -0,0 +1,355 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/katcipis/stonks/auth/kvstore"
+)
+
+// Error represents errors related to authentication.
+// They should always be checked using errors.Is since the
+// error may be wrapped with more context.
+type Error string
+
+const (
+	InvalidTokenErr Error = "invalid token"
+)
+
+// KVStore is a key value store with support to TTL per key.
+// Keys that are not found MUST return kvstore.KeyNotFoundErr (possibly wrapped).
+type KVStore interface {
+	Put(ctx context.Context, key string, val []byte, ttl time.Duration) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Take(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+	SetAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error
+	SetMembers(ctx context.Context, key string) ([]string, error)
+	SetRemove(ctx context.Context, key string, members ...string) error
+	WindowReserve(ctx context.Context, key string, at time.Time, size time.Duration) (kvstore.Window, string, error)
+	WindowRemove(ctx context.Context, key string, event string) error
+}
+
+// Token is an access token that can be used to authenticate requests
+type Token struct {
+	AccessToken string
+	ExpiresIn   time.Duration
+}
+
+// Tokens is responsible for creating and validating access tokens.
+// Tokens are opaque by default, but they can also be signed JWTs
+// (see NewSignedTokens).
+type Tokens struct {
+	store KVStore
+	ttl   time.Duration
+
+	// keys and issuer are only set for signed tokens
+	keys   *KeyRing
+	issuer string
+}
+
+// TokenInfo has information about a valid token. Tokens are either
+// owned by an user or by an OAuth client (see CreateClientToken),
+// client tokens have no UserID and are restricted to their Scopes.
+// Tokens owned by an user may also be issued to an OAuth client
+// (see CreateDelegatedToken), having both and restricted to their Scopes.
+type TokenInfo struct {
+	UserID    string
+	ClientID  string
+	Scopes    []string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+type tokenRecord struct {
+	UserID    string   `json:"user_id,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+}
+
+// NewTokens creates a new Tokens that will store tokens on the given
+// store, each created token is valid for the given ttl.
+func NewTokens(store KVStore, ttl time.Duration) *Tokens {
+	return &Tokens{
+		store: store,
+		ttl:   ttl,
+	}
+}
+
+// NewSignedTokens creates a new Tokens just like NewTokens, but the
+// created tokens are JWTs signed with the signing key of the given key
+// ring and with the given issuer, so they can be verified by other services
+// using just the public keys of the ring.
+//
+// Revoked tokens are only rejected by the returned Tokens, services that
+// verify tokens just using the public keys will accept them until they
+// expire. Keep the ttl short to limit the impact of this.
+func NewSignedTokens(store KVStore, ttl time.Duration, keys *KeyRing, issuer string) *Tokens {
+	return &Tokens{
+		store:  store,
+		ttl:    ttl,
+		keys:   keys,
+		issuer: issuer,
+	}
+}
+
+// Create creates a new access token for the given user ID.
+func (t *Tokens) Create(ctx context.Context, userID string) (Token, error) {
+	return t.create(ctx, tokenRecord{UserID: userID})
+}
+
+// CreateClientToken creates a new access token for the given OAuth
+// client ID, restricted to the given scopes. Client tokens are not
+// owned by any user, so they are rejected by UserID.
+func (t *Tokens) CreateClientToken(ctx context.Context, clientID string, scopes []string) (Token, error) {
+	if clientID == "" {
+		return Token{}, errors.New("client tokens must have a client ID")
+	}
+	return t.create(ctx, tokenRecord{ClientID: clientID, Scopes: scopes})
+}
+
+// CreateDelegatedToken creates a new access token owned by the given user
+// but issued to the given OAuth client, restricted to the given scopes,
+// like the tokens issued to OpenID Connect relying parties.
+func (t *Tokens) CreateDelegatedToken(ctx context.Context, userID string, clientID string, scopes []string) (Token, error) {
+	if userID == "" || clientID == "" {
+		return Token{}, errors.New("delegated tokens must have an user ID and a client ID")
+	}
+	return t.create(ctx, tokenRecord{UserID: userID, ClientID: clientID, Scopes: scopes})
+}
+
+// UserID validates the given access token and returns the ID of
+// the user that owns it. If the token is invalid, expired or
+// is not owned by an user it returns InvalidTokenErr.
+func (t *Tokens) UserID(ctx context.Context, accessToken string) (string, error) {
+	info, err := t.Introspect(ctx, accessToken)
+	if err != nil {
+		return "", err
+	}
+	if info.UserID == "" {
+		return "", fmt.Errorf("%w:token owned by client %q", InvalidTokenErr, info.ClientID)
+	}
+	return info.UserID, nil
+}
+
+// Introspect validates the given access token and returns information
+// about it. If the token is invalid or expired it returns InvalidTokenErr.
+func (t *Tokens) Introspect(ctx context.Context, accessToken string) (TokenInfo, error) {
+	if t.keys != nil {
+		// WHY: forged or expired tokens are rejected
+		// without needing to access the store.
+		claims, err := verifyJWT(t.keys, accessToken, AccessTokenJWTType, time.Now())
+		if err != nil {
+			return TokenInfo{}, err
+		}
+		if claims.Issuer != t.issuer {
+			return TokenInfo{}, fmt.Errorf("%w:unknown issuer %q", InvalidTokenErr, claims.Issuer)
+		}
+	}
+
+	val, err := t.store.Get(ctx, tokenKey(accessToken))
+	if err != nil {
+		if errors.Is(err, kvstore.KeyNotFoundErr) {
+			return TokenInfo{}, InvalidTokenErr
+		}
+		return TokenInfo{}, fmt.Errorf("error retrieving token:%v", err)
+	}
+
+	record := tokenRecord{}
+	err = json.Unmarshal(val, &record)
+	if err != nil {
+		return TokenInfo{}, fmt.Errorf("error parsing token record:%v", err)
+	}
+	return record.info(), nil
+}
+
+// Revoke revokes the given access token, after that it can't be used
+// anymore. Revoking an invalid or already expired token is not an error.
+func (t *Tokens) Revoke(ctx context.Context, accessToken string) error {
+	info, err := t.Introspect(ctx, accessToken)
+	if err != nil {
+		if errors.Is(err, InvalidTokenErr) {
+			return nil
+		}
+		return err
+	}
+
+	key := tokenKey(accessToken)
+	err = t.store.Delete(ctx, key)
+	if err != nil {
+		return fmt.Errorf("error revoking token:%v", err)
+	}
+
+	if info.UserID == "" {
+		return nil
+	}
+
+	err = t.store.SetRemove(ctx, userTokensKey(info.UserID), key)
+	if err != nil {
+		return fmt.Errorf("error removing revoked token from index:%v", err)
+	}
+	return nil
+}
+
+// RevokeUserTokens revokes all tokens of the given user, except the
+// given access token, which is kept valid. To revoke all tokens of
+// the user provide an empty access token.
+func (t *Tokens) RevokeUserTokens(ctx context.Context, userID string, keepAccessToken string) error {
+	indexKey := userTokensKey(userID)
+	keys, err := t.store.SetMembers(ctx, indexKey)
+	if err != nil {
+		return fmt.Errorf("error retrieving user tokens:%v", err)
+	}
+
+	keepKey := ""
+	if keepAccessToken != "" {
+		keepKey = tokenKey(keepAccessToken)
+	}
+
+	revokedKeys := []string{}
+	for _, key := range keys {
+		if key == keepKey {
+			continue
+		}
+		err := t.store.Delete(ctx, key)
+		if err != nil {
+			return fmt.Errorf("error revoking user token:%v", err)
+		}
+		revokedKeys = append(revokedKeys, key)
+	}
+
+	if len(revokedKeys) == 0 {
+		return nil
+	}
+
+	err = t.store.SetRemove(ctx, indexKey, revokedKeys...)
+	if err != nil {
+		return fmt.Errorf("error removing revoked tokens from index:%v", err)
+	}
+	return nil
+}
+
+// Error returns the string representation of the error
+func (e Error) Error() string {
+	return string(e)
+}
+
+func (t *Tokens) create(ctx context.Context, record tokenRecord) (Token, error) {
+	now := time.Now()
+	record.IssuedAt = now.Unix()
+	record.ExpiresAt = now.Add(t.ttl).Unix()
+
+	accessToken, err := t.newToken(record)
+	if err != nil {
+		return Token{}, err
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return Token{}, fmt.Errorf("error serializing token record:%v", err)
+	}
+
+	key := tokenKey(accessToken)
+	err = t.store.Put(ctx, key, data, t.ttl)
+	if err != nil {
+		return Token{}, fmt.Errorf("error storing token:%v", err)
+	}
+
+	// WHY: indexing the tokens by user allows revoking all tokens of
+	// an user. Since all tokens have the same ttl the index can
+	// expire along with the newest token.
+	if record.UserID != "" {
+		err = t.store.SetAdd(ctx, userTokensKey(record.UserID), t.ttl, key)
+		if err != nil {
+			return Token{}, fmt.Errorf("error indexing token:%v", err)
+		}
+	}
+
+	return Token{
+		AccessToken: accessToken,
+		ExpiresIn:   t.ttl,
+	}, nil
+}
+
+func (t *Tokens) newToken(record tokenRecord) (string, error) {
+	if t.keys == nil {
+		return newOpaqueToken()
+	}
+
+	// WHY: a random ID guarantees that tokens are unique even
+	// when created for the same user at the same second.
+	id, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	claims := JWTClaims{
+		Issuer:    t.issuer,
+		Subject:   record.UserID,
+		IssuedAt:  record.IssuedAt,
+		ExpiresAt: record.ExpiresAt,
+		ID:        id,
+	}
+	if record.ClientID != "" {
+		claims.ClientID = record.ClientID
+		claims.Scope = strings.Join(record.Scopes, " ")
+	}
+	// WHY: client tokens use the client as subject, as defined on:
+	// https://tools.ietf.org/html/rfc9068#section-2.2
+	if record.UserID == "" {
+		claims.Subject = record.ClientID
+	}
+	return signJWT(t.keys.signingKey(), AccessTokenJWTType, claims)
+}
+
+func (r tokenRecord) info() TokenInfo {
+	info := TokenInfo{
+		UserID:   r.UserID,
+		ClientID: r.ClientID,
+		Scopes:   r.Scopes,
+	}
+	// WHY: records stored before timestamps were added don't have them
+	if r.IssuedAt != 0 {
+		info.IssuedAt = time.Unix(r.IssuedAt, 0)
+	}
+	if r.ExpiresAt != 0 {
+		info.ExpiresAt = time.Unix(r.ExpiresAt, 0)
+	}
+	return info
+}
+
+func newOpaqueToken() (string, error) {
+	const tokenSize = 32
+
+	token := make([]byte, tokenSize)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", fmt.Errorf("error generating random token:%v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func tokenKey(accessToken string) string {
+	return hashedKey("tokens", accessToken)
+}
+
+// WHY: only the hash of the token is stored, so leaking the
+// contents of the store does not give access to valid tokens.
+func hashedKey(prefix string, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return prefix + ":" + hex.EncodeToString(sum[:])
+}
+
+func userTokensKey(userID string) string {
+	return "user-tokens:" + userID
+}
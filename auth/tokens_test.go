@@ -0,0 +1,258 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/kvstore"
+)
+
+func TestTokenCreation(t *testing.T) {
+	const (
+		userID = "666"
+		ttl    = time.Hour
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	tokens := auth.NewTokens(kvstore.New(m.Addr(), ""), ttl)
+	ctx := context.Background()
+
+	token, err := tokens.Create(ctx, userID)
+	assertNoErr(t, err)
+
+	if token.AccessToken == "" {
+		t.Fatal("got empty access token")
+	}
+	if token.ExpiresIn != ttl {
+		t.Fatalf("got expires in %v want %v", token.ExpiresIn, ttl)
+	}
+
+	gotUserID, err := tokens.UserID(ctx, token.AccessToken)
+	assertNoErr(t, err)
+
+	if gotUserID != userID {
+		t.Fatalf("got user ID %q want %q", gotUserID, userID)
+	}
+
+	anotherToken, err := tokens.Create(ctx, userID)
+	assertNoErr(t, err)
+
+	if anotherToken.AccessToken == token.AccessToken {
+		t.Fatalf("created the same token %q twice", token.AccessToken)
+	}
+}
+
+func TestTokenIntrospection(t *testing.T) {
+	const (
+		userID = "42"
+		ttl    = time.Hour
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	tokens := auth.NewTokens(kvstore.New(m.Addr(), ""), ttl)
+	ctx := context.Background()
+
+	before := time.Now().Unix()
+	token := createToken(t, tokens, userID)
+
+	info, err := tokens.Introspect(ctx, token)
+	assertNoErr(t, err)
+
+	if info.UserID != userID {
+		t.Fatalf("got user ID %q want %q", info.UserID, userID)
+	}
+	if info.IssuedAt.Unix() < before || info.ExpiresAt != info.IssuedAt.Add(ttl) {
+		t.Fatalf("got token info %+v for token issued after %d", info, before)
+	}
+
+	assertNoErr(t, tokens.Revoke(ctx, token))
+
+	_, err = tokens.Introspect(ctx, token)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+func TestTokenExpiration(t *testing.T) {
+	const ttl = time.Minute
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	tokens := auth.NewTokens(kvstore.New(m.Addr(), ""), ttl)
+	ctx := context.Background()
+
+	token, err := tokens.Create(ctx, "1")
+	assertNoErr(t, err)
+
+	m.FastForward(ttl)
+
+	_, err = tokens.UserID(ctx, token.AccessToken)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+func TestTokenRevocation(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	tokens := auth.NewTokens(kvstore.New(m.Addr(), ""), time.Hour)
+	ctx := context.Background()
+
+	token, err := tokens.Create(ctx, "1")
+	assertNoErr(t, err)
+
+	anotherToken, err := tokens.Create(ctx, "1")
+	assertNoErr(t, err)
+
+	err = tokens.Revoke(ctx, token.AccessToken)
+	assertNoErr(t, err)
+
+	_, err = tokens.UserID(ctx, token.AccessToken)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	// Other tokens from the same user must remain valid
+	_, err = tokens.UserID(ctx, anotherToken.AccessToken)
+	assertNoErr(t, err)
+
+	err = tokens.Revoke(ctx, token.AccessToken)
+	assertNoErr(t, err)
+}
+
+func TestRevokeUserTokens(t *testing.T) {
+	const (
+		userID      = "1"
+		otherUserID = "2"
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	tokens := auth.NewTokens(kvstore.New(m.Addr(), ""), time.Hour)
+	ctx := context.Background()
+
+	keep := createToken(t, tokens, userID)
+	revoked := []string{
+		createToken(t, tokens, userID),
+		createToken(t, tokens, userID),
+	}
+	otherUserToken := createToken(t, tokens, otherUserID)
+
+	err := tokens.RevokeUserTokens(ctx, userID, keep)
+	assertNoErr(t, err)
+
+	for _, token := range revoked {
+		_, err = tokens.UserID(ctx, token)
+		if !errors.Is(err, auth.InvalidTokenErr) {
+			t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+		}
+	}
+
+	_, err = tokens.UserID(ctx, keep)
+	assertNoErr(t, err)
+
+	_, err = tokens.UserID(ctx, otherUserToken)
+	assertNoErr(t, err)
+
+	err = tokens.RevokeUserTokens(ctx, userID, "")
+	assertNoErr(t, err)
+
+	_, err = tokens.UserID(ctx, keep)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	_, err = tokens.UserID(ctx, otherUserToken)
+	assertNoErr(t, err)
+
+	// Users with no tokens
+	err = tokens.RevokeUserTokens(ctx, "unknown", "")
+	assertNoErr(t, err)
+}
+
+func TestClientTokens(t *testing.T) {
+	const clientID = "batch-job"
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	tokens := auth.NewTokens(kvstore.New(m.Addr(), ""), time.Hour)
+	ctx := context.Background()
+
+	scopes := []string{"users:list", "users:read"}
+	token, err := tokens.CreateClientToken(ctx, clientID, scopes)
+	assertNoErr(t, err)
+
+	info, err := tokens.Introspect(ctx, token.AccessToken)
+	assertNoErr(t, err)
+
+	if info.ClientID != clientID || info.UserID != "" || !reflect.DeepEqual(info.Scopes, scopes) {
+		t.Fatalf("got token info %+v for client %q with scopes %v", info, clientID, scopes)
+	}
+
+	// Client tokens can't be used as user tokens
+	_, err = tokens.UserID(ctx, token.AccessToken)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	assertNoErr(t, tokens.Revoke(ctx, token.AccessToken))
+
+	_, err = tokens.Introspect(ctx, token.AccessToken)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	_, err = tokens.CreateClientToken(ctx, "", scopes)
+	if err == nil {
+		t.Fatal("want error creating client token without client ID")
+	}
+}
+
+func TestUnknownTokenIsInvalid(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	tokens := auth.NewTokens(kvstore.New(m.Addr(), ""), time.Hour)
+
+	_, err := tokens.UserID(context.Background(), "unknown")
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+func createToken(t *testing.T, tokens *auth.Tokens, userID string) string {
+	t.Helper()
+
+	token, err := tokens.Create(context.Background(), userID)
+	assertNoErr(t, err)
+	return token.AccessToken
+}
+
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+
+	m, err := miniredis.Run()
+	assertNoErr(t, err)
+	return m
+}
+
+func assertNoErr(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,112 @@
+package auth_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/katcipis/stonks/auth"
+)
+
+func TestTOTPCodes(t *testing.T) {
+	// Test vectors from RFC 6238 (SHA1), which have 8 digits,
+	// 6 digits codes are the last 6 digits of them.
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	type Test struct {
+		unix int64
+		code string
+	}
+
+	tests := []Test{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1111111111, code: "050471"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+		{unix: 20000000000, code: "353130"},
+	}
+
+	for _, test := range tests {
+		now := time.Unix(test.unix, 0)
+
+		code, err := auth.TOTPCode(secret, now)
+		assertNoErr(t, err)
+
+		if code != test.code {
+			t.Errorf("got code %q at %d want %q", code, test.unix, test.code)
+		}
+
+		step, ok := auth.ValidateTOTP(secret, test.code, now)
+		if !ok || step != auth.TOTPStep(now) {
+			t.Errorf("code %q at %d: got step %d valid %t", test.code, test.unix, step, ok)
+		}
+	}
+}
+
+func TestTOTPValidation(t *testing.T) {
+	secret, err := auth.NewTOTPSecret()
+	assertNoErr(t, err)
+
+	anotherSecret, err := auth.NewTOTPSecret()
+	assertNoErr(t, err)
+
+	if secret == anotherSecret {
+		t.Fatalf("created the same secret %q twice", secret)
+	}
+
+	now := time.Now()
+	code := totpCode(t, secret, now)
+
+	// Codes of adjacent time steps are accepted to tolerate clock drift
+	for _, at := range []time.Time{now.Add(-auth.TOTPPeriod), now, now.Add(auth.TOTPPeriod)} {
+		if _, ok := auth.ValidateTOTP(secret, code, at); !ok {
+			t.Errorf("code %q generated at %v is invalid at %v", code, now, at)
+		}
+	}
+
+	invalid := map[string]struct {
+		secret string
+		code   string
+		at     time.Time
+	}{
+		"Expired":       {secret: secret, code: code, at: now.Add(3 * auth.TOTPPeriod)},
+		"FromTheFuture": {secret: secret, code: code, at: now.Add(-3 * auth.TOTPPeriod)},
+		"OtherSecret":   {secret: anotherSecret, code: code, at: now},
+		"Empty":         {secret: secret, code: "", at: now},
+		"TooLong":       {secret: secret, code: code + "0", at: now},
+		"InvalidSecret": {secret: "not base32!", code: code, at: now},
+	}
+
+	for name, test := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, ok := auth.ValidateTOTP(test.secret, test.code, test.at); ok {
+				t.Fatalf("code %q is valid at %v", test.code, test.at)
+			}
+		})
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	uri, err := url.Parse(auth.TOTPURI("Stonks", "hi@stonks.com", secret))
+	assertNoErr(t, err)
+
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Stonks:hi@stonks.com" {
+		t.Fatalf("got URI %q", uri)
+	}
+
+	query := uri.Query()
+	if query.Get("secret") != secret || query.Get("issuer") != "Stonks" || query.Get("digits") != "6" {
+		t.Fatalf("got URI %q", uri)
+	}
+}
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+
+	code, err := auth.TOTPCode(secret, at)
+	assertNoErr(t, err)
+	return code
+}
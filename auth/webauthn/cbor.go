@@ -0,0 +1,173 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// WHY: authenticators encode data with the CTAP2 canonical CBOR encoding,
+// so only definite lengths and the few types used by WebAuthn are supported.
+// Nesting is limited so malicious data can't exhaust the stack.
+const maxCBORDepth = 16
+
+// decodeCBOR decodes a single CBOR item that must use all the data.
+// Maps are decoded as map[interface{}]interface{} with int64 or string keys,
+// integers as int64, byte strings as []byte and text strings as string.
+func decodeCBOR(data []byte) (interface{}, error) {
+	d := cborDecoder{data: data}
+	item, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("%w:%d trailing bytes after CBOR item", InvalidResponseErr, len(data)-d.pos)
+	}
+	return item, nil
+}
+
+// cborItemLen returns the length of the CBOR item at the start of data,
+// useful when the item is followed by other data.
+func cborItemLen(data []byte) (int, error) {
+	d := cborDecoder{data: data}
+	if _, err := d.decode(0); err != nil {
+		return 0, err
+	}
+	return d.pos, nil
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxCBORDepth {
+		return nil, fmt.Errorf("%w:CBOR nesting exceeds %d", InvalidResponseErr, maxCBORDepth)
+	}
+	if d.pos >= len(d.data) {
+		return nil, fmt.Errorf("%w:unexpected end of CBOR data", InvalidResponseErr)
+	}
+
+	initial := d.data[d.pos]
+	d.pos++
+	major, info := initial>>5, initial&0x1f
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w:unsupported CBOR simple value %d", InvalidResponseErr, info)
+	}
+
+	n, err := d.argument(info)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("%w:CBOR integer overflow", InvalidResponseErr)
+		}
+		return int64(n), nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("%w:CBOR integer overflow", InvalidResponseErr)
+		}
+		return -1 - int64(n), nil
+	case 2, 3:
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("%w:CBOR string exceeds data", InvalidResponseErr)
+		}
+		raw := d.data[d.pos : d.pos+int(n)]
+		d.pos += int(n)
+		if major == 3 {
+			return string(raw), nil
+		}
+		return append([]byte{}, raw...), nil
+	case 4:
+		// WHY: each item has at least one byte, checking it before
+		// allocating avoids huge allocations from tiny payloads.
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, fmt.Errorf("%w:CBOR array exceeds data", InvalidResponseErr)
+		}
+		items := make([]interface{}, 0, int(n))
+		for i := uint64(0); i < n; i++ {
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case 5:
+		if n > uint64(len(d.data)-d.pos)/2 {
+			return nil, fmt.Errorf("%w:CBOR map exceeds data", InvalidResponseErr)
+		}
+		items := make(map[interface{}]interface{}, int(n))
+		for i := uint64(0); i < n; i++ {
+			key, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, fmt.Errorf("%w:unsupported CBOR map key %v", InvalidResponseErr, key)
+			}
+			if _, ok := items[key]; ok {
+				return nil, fmt.Errorf("%w:duplicated CBOR map key %v", InvalidResponseErr, key)
+			}
+			val, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items[key] = val
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("%w:unsupported CBOR major type %d", InvalidResponseErr, major)
+}
+
+// argument decodes the argument of the item, which is its value or length
+func (d *cborDecoder) argument(info byte) (uint64, error) {
+	if info < 24 {
+		return uint64(info), nil
+	}
+
+	size := 0
+	switch info {
+	case 24:
+		size = 1
+	case 25:
+		size = 2
+	case 26:
+		size = 4
+	case 27:
+		size = 8
+	default:
+		return 0, fmt.Errorf("%w:unsupported CBOR argument %d", InvalidResponseErr, info)
+	}
+
+	if size > len(d.data)-d.pos {
+		return 0, fmt.Errorf("%w:unexpected end of CBOR data", InvalidResponseErr)
+	}
+	raw := d.data[d.pos : d.pos+size]
+	d.pos += size
+
+	switch size {
+	case 1:
+		return uint64(raw[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(raw)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(raw)), nil
+	}
+	return binary.BigEndian.Uint64(raw), nil
+}
@@ -0,0 +1,132 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms supported for credential public keys, as defined on:
+// https://www.iana.org/assignments/cose/cose.xhtml#algorithms
+const (
+	ES256 int64 = -7
+	EdDSA int64 = -8
+	RS256 int64 = -257
+)
+
+// COSE key parameters, as defined on: https://tools.ietf.org/html/rfc8152#section-7
+const (
+	coseKeyType   int64 = 1
+	coseAlgorithm int64 = 3
+
+	coseEC2     int64 = 2
+	coseOKP     int64 = 1
+	coseRSA     int64 = 3
+	coseP256    int64 = 1
+	coseEd25519 int64 = 6
+
+	coseCurve int64 = -1
+	coseX     int64 = -2
+	coseY     int64 = -3
+	coseRSAN  int64 = -1
+	coseRSAE  int64 = -2
+
+	minRSAKeyBits = 2048
+)
+
+type publicKey struct {
+	algorithm int64
+	key       crypto.PublicKey
+}
+
+// parsePublicKey parses a COSE encoded public key
+func parsePublicKey(data []byte) (publicKey, error) {
+	item, err := decodeCBOR(data)
+	if err != nil {
+		return publicKey{}, err
+	}
+	params, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return publicKey{}, fmt.Errorf("%w:COSE key is not a map", InvalidResponseErr)
+	}
+
+	keyType, _ := params[coseKeyType].(int64)
+	alg, _ := params[coseAlgorithm].(int64)
+
+	switch {
+	case alg == ES256 && keyType == coseEC2:
+		curve, _ := params[coseCurve].(int64)
+		x, _ := params[coseX].([]byte)
+		y, _ := params[coseY].([]byte)
+		if curve != coseP256 || len(x) != 32 || len(y) != 32 {
+			return publicKey{}, fmt.Errorf("%w:invalid ES256 COSE key", InvalidResponseErr)
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return publicKey{}, fmt.Errorf("%w:ES256 COSE key is not on the curve", InvalidResponseErr)
+		}
+		return publicKey{algorithm: alg, key: key}, nil
+	case alg == EdDSA && keyType == coseOKP:
+		curve, _ := params[coseCurve].(int64)
+		x, _ := params[coseX].([]byte)
+		if curve != coseEd25519 || len(x) != ed25519.PublicKeySize {
+			return publicKey{}, fmt.Errorf("%w:invalid EdDSA COSE key", InvalidResponseErr)
+		}
+		return publicKey{algorithm: alg, key: ed25519.PublicKey(x)}, nil
+	case alg == RS256 && keyType == coseRSA:
+		n, _ := params[coseRSAN].([]byte)
+		e, _ := params[coseRSAE].([]byte)
+		exponent := new(big.Int).SetBytes(e)
+		if len(e) == 0 || !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return publicKey{}, fmt.Errorf("%w:invalid RS256 COSE key exponent", InvalidResponseErr)
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+		if key.N.BitLen() < minRSAKeyBits {
+			return publicKey{}, fmt.Errorf("%w:RS256 COSE key has less than %d bits", InvalidResponseErr, minRSAKeyBits)
+		}
+		return publicKey{algorithm: alg, key: key}, nil
+	}
+	return publicKey{}, fmt.Errorf("%w:unsupported COSE key type %d algorithm %d", InvalidResponseErr, keyType, alg)
+}
+
+// verify verifies the signature of the data, signatures use the
+// encodings defined on: https://www.w3.org/TR/webauthn-2/#sctn-signature-attestation-types
+func (k publicKey) verify(data []byte, signature []byte) error {
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		var sig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(signature, &sig)
+		if err != nil || len(rest) != 0 {
+			return fmt.Errorf("%w:malformed ES256 signature", InvalidResponseErr)
+		}
+		digest := sha256.Sum256(data)
+		if !ecdsa.Verify(key, digest[:], sig.R, sig.S) {
+			return fmt.Errorf("%w:invalid ES256 signature", InvalidResponseErr)
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, data, signature) {
+			return fmt.Errorf("%w:invalid EdDSA signature", InvalidResponseErr)
+		}
+		return nil
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("%w:invalid RS256 signature", InvalidResponseErr)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w:unsupported key %T", InvalidResponseErr, k.key)
+}
@@ -0,0 +1,449 @@
+// Package webauthn implements the relying party side of the WebAuthn
+// registration and authentication ceremonies, as defined on:
+// https://www.w3.org/TR/webauthn-2/
+//
+// Only the verification is done here, storing challenges and
+// credentials is up to the callers.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Error represents errors related to WebAuthn
+// They should always be checked using errors.Is since the
+// error may be wrapped with more context.
+type Error string
+
+const (
+	InvalidResponseErr Error = "invalid WebAuthn response"
+
+	// SignCountErr indicates that the authenticator may have been
+	// cloned, since its signature counter didn't increase.
+	SignCountErr Error = "WebAuthn signature counter did not increase"
+)
+
+// Error returns the string representation of the error
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Bytes is binary data, encoded on JSON as base64url like
+// on the JSON serialization of WebAuthn credentials.
+type Bytes []byte
+
+// MarshalJSON encodes the bytes as a base64url string without padding
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON decodes the bytes from a base64url string, with or without padding
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return fmt.Errorf("invalid base64url data:%v", err)
+	}
+	*b = decoded
+	return nil
+}
+
+// Config has all configuration of the relying party
+type Config struct {
+	// RPID is the relying party ID, the domain of the service
+	// (like stonks.com), credentials are bound to it.
+	RPID   string
+	RPName string
+
+	// Origins are the origins allowed to run the ceremonies,
+	// like https://app.stonks.com
+	Origins []string
+
+	// Timeout is how long users have to finish the ceremonies
+	Timeout time.Duration
+}
+
+// RelyingParty identifies the relying party on creation options
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// User identifies the user on creation options
+type User struct {
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// CredentialParameter is a credential type and algorithm supported by the relying party
+type CredentialParameter struct {
+	Type      string `json:"type"`
+	Algorithm int64  `json:"alg"`
+}
+
+// CredentialDescriptor identifies a credential
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   Bytes  `json:"id"`
+}
+
+// AuthenticatorSelection has the requirements for authenticators
+type AuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// CreationOptions are the options to create credentials,
+// as defined on: https://www.w3.org/TR/webauthn-2/#dictdef-publickeycredentialcreationoptions
+type CreationOptions struct {
+	Challenge              Bytes                  `json:"challenge"`
+	RP                     RelyingParty           `json:"rp"`
+	User                   User                   `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the options to get assertions from credentials,
+// as defined on: https://www.w3.org/TR/webauthn-2/#dictdef-publickeycredentialrequestoptions
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// AttestationResponse is the response of an authenticator to a credential creation
+type AttestationResponse struct {
+	ClientDataJSON    Bytes `json:"clientDataJSON"`
+	AttestationObject Bytes `json:"attestationObject"`
+}
+
+// RegistrationCredential is a created credential, as serialized
+// by PublicKeyCredential.toJSON() on browsers.
+type RegistrationCredential struct {
+	ID       string              `json:"id"`
+	RawID    Bytes               `json:"rawId"`
+	Type     string              `json:"type"`
+	Response AttestationResponse `json:"response"`
+}
+
+// AssertionResponse is the response of an authenticator to an assertion request
+type AssertionResponse struct {
+	ClientDataJSON    Bytes `json:"clientDataJSON"`
+	AuthenticatorData Bytes `json:"authenticatorData"`
+	Signature         Bytes `json:"signature"`
+	UserHandle        Bytes `json:"userHandle,omitempty"`
+}
+
+// AssertionCredential is an assertion of a credential, as serialized
+// by PublicKeyCredential.toJSON() on browsers.
+type AssertionCredential struct {
+	ID       string            `json:"id"`
+	RawID    Bytes             `json:"rawId"`
+	Type     string            `json:"type"`
+	Response AssertionResponse `json:"response"`
+}
+
+// Credential is a verified credential, the public key is COSE encoded.
+type Credential struct {
+	ID        []byte
+	PublicKey []byte
+	SignCount uint32
+}
+
+const (
+	publicKeyType = "public-key"
+
+	createCeremony = "webauthn.create"
+	getCeremony    = "webauthn.get"
+
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+	flagExtensionData          = 0x80
+
+	maxCredentialIDLen = 1023
+)
+
+// Challenge returns the challenge of the client data, encoded as base64url,
+// so callers can find the ceremony the response belongs to.
+func Challenge(clientDataJSON []byte) (string, error) {
+	data, err := parseClientData(clientDataJSON)
+	if err != nil {
+		return "", err
+	}
+	return data.Challenge, nil
+}
+
+// NewCreationOptions creates the options to create a credential for the
+// user, excluding the credentials the user already has. The created
+// credentials are discoverable (passkeys), so they can be used without
+// informing the user first.
+func (c Config) NewCreationOptions(challenge []byte, user User, exclude [][]byte) CreationOptions {
+	return CreationOptions{
+		Challenge: challenge,
+		RP:        RelyingParty{ID: c.RPID, Name: c.RPName},
+		User:      user,
+		PubKeyCredParams: []CredentialParameter{
+			{Type: publicKeyType, Algorithm: ES256},
+			{Type: publicKeyType, Algorithm: EdDSA},
+			{Type: publicKeyType, Algorithm: RS256},
+		},
+		Timeout:            c.Timeout.Milliseconds(),
+		ExcludeCredentials: descriptors(exclude),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   "preferred",
+		},
+		// WHY: the authenticator models are not restricted, so
+		// there is no reason to ask for (and verify) attestations.
+		Attestation: "none",
+	}
+}
+
+// NewRequestOptions creates the options to get an assertion, if no credentials
+// are allowed any discoverable credential of the relying party can be used.
+func (c Config) NewRequestOptions(challenge []byte, allow [][]byte, requireUserVerification bool) RequestOptions {
+	userVerification := "preferred"
+	if requireUserVerification {
+		userVerification = "required"
+	}
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          c.Timeout.Milliseconds(),
+		RPID:             c.RPID,
+		AllowCredentials: descriptors(allow),
+		UserVerification: userVerification,
+	}
+}
+
+// VerifyRegistration verifies the created credential, as defined on:
+// https://www.w3.org/TR/webauthn-2/#sctn-registering-a-new-credential
+// The challenge is the one sent on the creation options.
+// If the credential is invalid it returns InvalidResponseErr.
+func (c Config) VerifyRegistration(challenge []byte, cred RegistrationCredential) (Credential, error) {
+	if cred.Type != publicKeyType {
+		return Credential{}, fmt.Errorf("%w:unsupported credential type %q", InvalidResponseErr, cred.Type)
+	}
+	if err := c.verifyClientData(cred.Response.ClientDataJSON, createCeremony, challenge); err != nil {
+		return Credential{}, err
+	}
+
+	item, err := decodeCBOR(cred.Response.AttestationObject)
+	if err != nil {
+		return Credential{}, err
+	}
+	attestation, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return Credential{}, fmt.Errorf("%w:attestation object is not a map", InvalidResponseErr)
+	}
+	// WHY: attestation statements are not verified, just like when they
+	// are "none", since the authenticator models are not restricted.
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return Credential{}, fmt.Errorf("%w:attestation object has no authenticator data", InvalidResponseErr)
+	}
+
+	authData, err := c.parseAuthenticatorData(rawAuthData, false)
+	if err != nil {
+		return Credential{}, err
+	}
+	if authData.flags&flagAttestedCredentialData == 0 {
+		return Credential{}, fmt.Errorf("%w:authenticator data has no credential", InvalidResponseErr)
+	}
+	if !bytes.Equal(authData.credentialID, cred.RawID) {
+		return Credential{}, fmt.Errorf("%w:credential ID mismatch", InvalidResponseErr)
+	}
+	if _, err := parsePublicKey(authData.publicKey); err != nil {
+		return Credential{}, err
+	}
+
+	return Credential{
+		ID:        authData.credentialID,
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// VerifyAssertion verifies the assertion of the given stored credential, as defined on:
+// https://www.w3.org/TR/webauthn-2/#sctn-verifying-assertion
+// The challenge is the one sent on the request options. It returns the new
+// signature counter of the credential, which must be stored.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the assertion is invalid: InvalidResponseErr
+// - If the signature counter didn't increase: SignCountErr
+//
+// The user must have been verified by the authenticator (like with a
+// PIN or biometrics) if requireUserVerification is true.
+func (c Config) VerifyAssertion(
+	challenge []byte,
+	stored Credential,
+	cred AssertionCredential,
+	requireUserVerification bool,
+) (uint32, error) {
+	if cred.Type != publicKeyType {
+		return 0, fmt.Errorf("%w:unsupported credential type %q", InvalidResponseErr, cred.Type)
+	}
+	if !bytes.Equal(cred.RawID, stored.ID) {
+		return 0, fmt.Errorf("%w:credential ID mismatch", InvalidResponseErr)
+	}
+	if err := c.verifyClientData(cred.Response.ClientDataJSON, getCeremony, challenge); err != nil {
+		return 0, err
+	}
+
+	authData, err := c.parseAuthenticatorData(cred.Response.AuthenticatorData, requireUserVerification)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := parsePublicKey(stored.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(cred.Response.ClientDataJSON)
+	signed := append(append([]byte{}, cred.Response.AuthenticatorData...), clientDataHash[:]...)
+	if err := key.verify(signed, cred.Response.Signature); err != nil {
+		return 0, err
+	}
+
+	// WHY: authenticators that don't support counters (like synced
+	// passkeys) always send zero, which can't be checked.
+	if (authData.signCount != 0 || stored.SignCount != 0) && authData.signCount <= stored.SignCount {
+		return 0, fmt.Errorf("%w:got %d stored %d", SignCountErr, authData.signCount, stored.SignCount)
+	}
+	return authData.signCount, nil
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+func parseClientData(clientDataJSON []byte) (clientData, error) {
+	data := clientData{}
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return clientData{}, fmt.Errorf("%w:invalid client data:%v", InvalidResponseErr, err)
+	}
+	return data, nil
+}
+
+func (c Config) verifyClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	data, err := parseClientData(clientDataJSON)
+	if err != nil {
+		return err
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("%w:got ceremony %q want %q", InvalidResponseErr, data.Type, ceremony)
+	}
+
+	want := base64.RawURLEncoding.EncodeToString(challenge)
+	if subtle.ConstantTimeCompare([]byte(data.Challenge), []byte(want)) != 1 {
+		return fmt.Errorf("%w:challenge mismatch", InvalidResponseErr)
+	}
+	if data.CrossOrigin {
+		return fmt.Errorf("%w:cross origin ceremonies are not allowed", InvalidResponseErr)
+	}
+	for _, origin := range c.Origins {
+		if data.Origin == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w:origin %q is not allowed", InvalidResponseErr, data.Origin)
+}
+
+type authenticatorData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthenticatorData parses and validates the authenticator data, as defined on:
+// https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+func (c Config) parseAuthenticatorData(data []byte, requireUserVerification bool) (authenticatorData, error) {
+	const headerLen = 37
+
+	if len(data) < headerLen {
+		return authenticatorData{}, fmt.Errorf("%w:authenticator data too short", InvalidResponseErr)
+	}
+
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if subtle.ConstantTimeCompare(data[:32], rpIDHash[:]) != 1 {
+		return authenticatorData{}, fmt.Errorf("%w:relying party ID mismatch", InvalidResponseErr)
+	}
+
+	authData := authenticatorData{
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:headerLen]),
+	}
+	if authData.flags&flagUserPresent == 0 {
+		return authenticatorData{}, fmt.Errorf("%w:user not present", InvalidResponseErr)
+	}
+	if requireUserVerification && authData.flags&flagUserVerified == 0 {
+		return authenticatorData{}, fmt.Errorf("%w:user not verified", InvalidResponseErr)
+	}
+
+	rest := data[headerLen:]
+	if authData.flags&flagAttestedCredentialData != 0 {
+		// AAGUID (16 bytes) followed by the credential ID length (2 bytes)
+		if len(rest) < 18 {
+			return authenticatorData{}, fmt.Errorf("%w:attested credential data too short", InvalidResponseErr)
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLen == 0 || idLen > maxCredentialIDLen || idLen > len(rest) {
+			return authenticatorData{}, fmt.Errorf("%w:invalid credential ID length %d", InvalidResponseErr, idLen)
+		}
+		authData.credentialID = append([]byte{}, rest[:idLen]...)
+		rest = rest[idLen:]
+
+		keyLen, err := cborItemLen(rest)
+		if err != nil {
+			return authenticatorData{}, err
+		}
+		authData.publicKey = append([]byte{}, rest[:keyLen]...)
+		rest = rest[keyLen:]
+	}
+	if authData.flags&flagExtensionData != 0 {
+		extensionsLen, err := cborItemLen(rest)
+		if err != nil {
+			return authenticatorData{}, err
+		}
+		rest = rest[extensionsLen:]
+	}
+	if len(rest) != 0 {
+		return authenticatorData{}, fmt.Errorf("%w:%d trailing bytes on authenticator data", InvalidResponseErr, len(rest))
+	}
+	return authData, nil
+}
+
+func descriptors(ids [][]byte) []CredentialDescriptor {
+	descs := make([]CredentialDescriptor, len(ids))
+	for i, id := range ids {
+		descs[i] = CredentialDescriptor{Type: publicKeyType, ID: id}
+	}
+	return descs
+}
@@ -0,0 +1,335 @@
+package webauthn_test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/katcipis/stonks/auth/webauthn"
+	"github.com/katcipis/stonks/auth/webauthn/webauthntest"
+)
+
+const origin = "https://app.stonks.test"
+
+var cfg = webauthn.Config{
+	RPID:    "stonks.test",
+	RPName:  "Stonks",
+	Origins: []string{origin},
+	Timeout: time.Minute,
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	authenticator := webauthntest.New(origin)
+	cred := register(t, authenticator)
+
+	if string(cred.ID) != string(authenticator.CredentialID()) || cred.SignCount != 0 {
+		t.Fatalf("got credential %+v", cred)
+	}
+
+	for want := uint32(1); want <= 3; want++ {
+		challenge := newChallenge(t)
+		assertion := login(t, authenticator, cfg.NewRequestOptions(challenge, [][]byte{cred.ID}, true))
+
+		signCount, err := cfg.VerifyAssertion(challenge, cred, assertion, true)
+		assertNoErr(t, err)
+
+		if signCount != want {
+			t.Fatalf("got sign count %d want %d", signCount, want)
+		}
+		cred.SignCount = signCount
+	}
+}
+
+func TestAssertionSignCount(t *testing.T) {
+	authenticator := webauthntest.New(origin)
+	cred := register(t, authenticator)
+	clone := *authenticator
+
+	challenge := newChallenge(t)
+	signCount, err := cfg.VerifyAssertion(challenge, cred, login(t, authenticator, requestOptions(challenge)), false)
+	assertNoErr(t, err)
+	cred.SignCount = signCount
+
+	// The clone counter is behind the original authenticator
+	challenge = newChallenge(t)
+	_, err = cfg.VerifyAssertion(challenge, cred, login(t, &clone, requestOptions(challenge)), false)
+	if !errors.Is(err, webauthn.SignCountErr) {
+		t.Fatalf("got err[%v] want[%v]", err, webauthn.SignCountErr)
+	}
+
+	// Authenticators without counters always send zero
+	noCounter := webauthntest.New(origin)
+	noCounter.IgnoreSignCount = true
+	cred = register(t, noCounter)
+
+	for i := 0; i < 2; i++ {
+		challenge := newChallenge(t)
+		_, err := cfg.VerifyAssertion(challenge, cred, login(t, noCounter, requestOptions(challenge)), false)
+		assertNoErr(t, err)
+	}
+}
+
+func TestInvalidRegistrations(t *testing.T) {
+	type Test struct {
+		name   string
+		cfg    webauthn.Config
+		origin string
+		modify func(*webauthn.RegistrationCredential, []byte) []byte
+	}
+
+	tests := []Test{
+		{
+			name:   "OtherOrigin",
+			cfg:    cfg,
+			origin: "https://evil.test",
+		},
+		{
+			name:   "OtherRelyingParty",
+			cfg:    webauthn.Config{RPID: "evil.test", Origins: cfg.Origins},
+			origin: origin,
+		},
+		{
+			name:   "OtherChallenge",
+			cfg:    cfg,
+			origin: origin,
+			modify: func(_ *webauthn.RegistrationCredential, challenge []byte) []byte {
+				return newChallenge(t)
+			},
+		},
+		{
+			name:   "OtherCredentialID",
+			cfg:    cfg,
+			origin: origin,
+			modify: func(cred *webauthn.RegistrationCredential, challenge []byte) []byte {
+				cred.RawID = []byte("other")
+				return challenge
+			},
+		},
+		{
+			name:   "MalformedAttestationObject",
+			cfg:    cfg,
+			origin: origin,
+			modify: func(cred *webauthn.RegistrationCredential, challenge []byte) []byte {
+				cred.Response.AttestationObject = cred.Response.AttestationObject[:20]
+				return challenge
+			},
+		},
+		{
+			name:   "TrailingAttestationData",
+			cfg:    cfg,
+			origin: origin,
+			modify: func(cred *webauthn.RegistrationCredential, challenge []byte) []byte {
+				cred.Response.AttestationObject = append(cred.Response.AttestationObject, 0)
+				return challenge
+			},
+		},
+		{
+			name:   "DeeplyNestedAttestationObject",
+			cfg:    cfg,
+			origin: origin,
+			modify: func(cred *webauthn.RegistrationCredential, challenge []byte) []byte {
+				nested := make([]byte, 1000)
+				for i := range nested {
+					nested[i] = 0x81 // array with one item
+				}
+				cred.Response.AttestationObject = nested
+				return challenge
+			},
+		},
+		{
+			name:   "HugeAttestationArray",
+			cfg:    cfg,
+			origin: origin,
+			modify: func(cred *webauthn.RegistrationCredential, challenge []byte) []byte {
+				cred.Response.AttestationObject = []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+				return challenge
+			},
+		},
+		{
+			name:   "UnsupportedType",
+			cfg:    cfg,
+			origin: origin,
+			modify: func(cred *webauthn.RegistrationCredential, challenge []byte) []byte {
+				cred.Type = "password"
+				return challenge
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			challenge := newChallenge(t)
+			opts := test.cfg.NewCreationOptions(challenge, webauthn.User{ID: []byte("1")}, nil)
+
+			cred, err := webauthntest.New(test.origin).Register(opts)
+			assertNoErr(t, err)
+
+			if test.modify != nil {
+				challenge = test.modify(&cred, challenge)
+			}
+
+			_, err = cfg.VerifyRegistration(challenge, cred)
+			if !errors.Is(err, webauthn.InvalidResponseErr) {
+				t.Fatalf("got err[%v] want[%v]", err, webauthn.InvalidResponseErr)
+			}
+		})
+	}
+}
+
+func TestInvalidAssertions(t *testing.T) {
+	authenticator := webauthntest.New(origin)
+	cred := register(t, authenticator)
+	other := webauthntest.New(origin)
+	otherCred := register(t, other)
+
+	type Test struct {
+		name      string
+		requireUV bool
+		assertion func(challenge []byte) webauthn.AssertionCredential
+	}
+
+	tests := []Test{
+		{
+			name: "OtherCredential",
+			assertion: func(challenge []byte) webauthn.AssertionCredential {
+				assertion := login(t, other, requestOptions(challenge))
+				assertion.RawID = cred.ID
+				return assertion
+			},
+		},
+		{
+			name: "OtherChallenge",
+			assertion: func(challenge []byte) webauthn.AssertionCredential {
+				return login(t, authenticator, requestOptions(newChallenge(t)))
+			},
+		},
+		{
+			name: "TamperedSignature",
+			assertion: func(challenge []byte) webauthn.AssertionCredential {
+				assertion := login(t, authenticator, requestOptions(challenge))
+				assertion.Response.Signature[len(assertion.Response.Signature)-1] ^= 0xff
+				return assertion
+			},
+		},
+		{
+			name: "TamperedAuthenticatorData",
+			assertion: func(challenge []byte) webauthn.AssertionCredential {
+				assertion := login(t, authenticator, requestOptions(challenge))
+				assertion.Response.AuthenticatorData[36]++
+				return assertion
+			},
+		},
+		{
+			name: "OtherOrigin",
+			assertion: func(challenge []byte) webauthn.AssertionCredential {
+				evil := *authenticator
+				evil.Origin = "https://evil.test"
+				return login(t, &evil, requestOptions(challenge))
+			},
+		},
+		{
+			name: "RegistrationCeremony",
+			assertion: func(challenge []byte) webauthn.AssertionCredential {
+				assertion := login(t, authenticator, requestOptions(challenge))
+				reg, err := webauthntest.New(origin).Register(cfg.NewCreationOptions(challenge, webauthn.User{}, nil))
+				assertNoErr(t, err)
+				assertion.Response.ClientDataJSON = reg.Response.ClientDataJSON
+				return assertion
+			},
+		},
+		{
+			name:      "UserNotVerified",
+			requireUV: true,
+			assertion: func(challenge []byte) webauthn.AssertionCredential {
+				unverified := *authenticator
+				unverified.SkipUserVerification = true
+				return login(t, &unverified, requestOptions(challenge))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			challenge := newChallenge(t)
+			_, err := cfg.VerifyAssertion(challenge, cred, test.assertion(challenge), test.requireUV)
+			if !errors.Is(err, webauthn.InvalidResponseErr) {
+				t.Fatalf("got err[%v] want[%v]", err, webauthn.InvalidResponseErr)
+			}
+		})
+	}
+
+	// The other credential remains valid
+	challenge := newChallenge(t)
+	_, err := cfg.VerifyAssertion(challenge, otherCred, login(t, other, requestOptions(challenge)), true)
+	assertNoErr(t, err)
+}
+
+func TestCredentialsJSON(t *testing.T) {
+	authenticator := webauthntest.New(origin)
+	challenge := newChallenge(t)
+
+	cred, err := authenticator.Register(cfg.NewCreationOptions(challenge, webauthn.User{ID: []byte("1")}, nil))
+	assertNoErr(t, err)
+
+	data, err := json.Marshal(cred)
+	assertNoErr(t, err)
+
+	parsed := webauthn.RegistrationCredential{}
+	assertNoErr(t, json.Unmarshal(data, &parsed))
+
+	got, err := webauthn.Challenge(parsed.Response.ClientDataJSON)
+	assertNoErr(t, err)
+
+	if want := base64.RawURLEncoding.EncodeToString(challenge); got != want {
+		t.Fatalf("got challenge %q want %q", got, want)
+	}
+
+	_, err = cfg.VerifyRegistration(challenge, parsed)
+	assertNoErr(t, err)
+}
+
+func register(t *testing.T, authenticator *webauthntest.Authenticator) webauthn.Credential {
+	t.Helper()
+
+	challenge := newChallenge(t)
+	opts := cfg.NewCreationOptions(challenge, webauthn.User{ID: []byte("1"), Name: "user@stonks.test"}, nil)
+
+	registration, err := authenticator.Register(opts)
+	assertNoErr(t, err)
+
+	cred, err := cfg.VerifyRegistration(challenge, registration)
+	assertNoErr(t, err)
+	return cred
+}
+
+func login(t *testing.T, authenticator *webauthntest.Authenticator, opts webauthn.RequestOptions) webauthn.AssertionCredential {
+	t.Helper()
+
+	assertion, err := authenticator.Login(opts)
+	assertNoErr(t, err)
+	return assertion
+}
+
+func requestOptions(challenge []byte) webauthn.RequestOptions {
+	return cfg.NewRequestOptions(challenge, nil, false)
+}
+
+func newChallenge(t *testing.T) []byte {
+	t.Helper()
+
+	challenge := make([]byte, 32)
+	_, err := rand.Read(challenge)
+	assertNoErr(t, err)
+	return challenge
+}
+
+func assertNoErr(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
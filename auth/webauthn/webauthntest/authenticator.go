@@ -0,0 +1,244 @@
+// Package webauthntest provides a software WebAuthn authenticator, so the
+// WebAuthn ceremonies can be tested without any real hardware.
+package webauthntest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/katcipis/stonks/auth/webauthn"
+)
+
+// Authenticator is a software authenticator with a single ES256 credential,
+// created on its first registration. Copying an Authenticator clones it,
+// including the signature counter.
+type Authenticator struct {
+	// Origin is the origin informed on the client data
+	Origin string
+
+	// SignCount is the signature counter, incremented on each assertion.
+	// If IgnoreSignCount is true it is always sent as zero.
+	SignCount       uint32
+	IgnoreSignCount bool
+
+	// SkipUserVerification makes the authenticator only test
+	// the user presence, without verifying the user.
+	SkipUserVerification bool
+
+	credentialID []byte
+	key          *ecdsa.PrivateKey
+	userHandle   []byte
+}
+
+// New creates a new Authenticator that runs the ceremonies on the given origin.
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin}
+}
+
+// CredentialID returns the ID of the credential of the authenticator,
+// which is empty before the registration.
+func (a *Authenticator) CredentialID() []byte {
+	return a.credentialID
+}
+
+// Register creates the credential of the authenticator with the given options.
+func (a *Authenticator) Register(opts webauthn.CreationOptions) (webauthn.RegistrationCredential, error) {
+	for _, excluded := range opts.ExcludeCredentials {
+		if a.credentialID != nil && bytes.Equal(excluded.ID, a.credentialID) {
+			return webauthn.RegistrationCredential{}, errors.New("credential already registered")
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return webauthn.RegistrationCredential{}, err
+	}
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		return webauthn.RegistrationCredential{}, err
+	}
+
+	a.key = key
+	a.credentialID = credentialID
+	a.userHandle = opts.User.ID
+
+	clientData, err := a.clientData("webauthn.create", opts.Challenge)
+	if err != nil {
+		return webauthn.RegistrationCredential{}, err
+	}
+
+	// Attested credential data: AAGUID, credential ID length, credential ID and COSE key
+	attested := make([]byte, 16)
+	attested = append(attested, byte(len(credentialID)>>8), byte(len(credentialID)))
+	attested = append(attested, credentialID...)
+	attested = append(attested, a.coseKey()...)
+
+	authData := a.authenticatorData(opts.RP.ID, 0x40, a.signCount())
+	authData = append(authData, attested...)
+
+	// WHY: keys on the CTAP2 canonical order, shorter keys first
+	attestationObject := encodeMap(
+		encodeText("fmt"), encodeText("none"),
+		encodeText("attStmt"), encodeMap(),
+		encodeText("authData"), encodeBytes(authData),
+	)
+
+	return webauthn.RegistrationCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(credentialID),
+		RawID: credentialID,
+		Type:  "public-key",
+		Response: webauthn.AttestationResponse{
+			ClientDataJSON:    clientData,
+			AttestationObject: attestationObject,
+		},
+	}, nil
+}
+
+// Login creates an assertion of the credential with the given options.
+func (a *Authenticator) Login(opts webauthn.RequestOptions) (webauthn.AssertionCredential, error) {
+	if a.key == nil {
+		return webauthn.AssertionCredential{}, errors.New("authenticator has no credential")
+	}
+	if len(opts.AllowCredentials) > 0 {
+		allowed := false
+		for _, desc := range opts.AllowCredentials {
+			allowed = allowed || bytes.Equal(desc.ID, a.credentialID)
+		}
+		if !allowed {
+			return webauthn.AssertionCredential{}, errors.New("credential not allowed")
+		}
+	}
+
+	clientData, err := a.clientData("webauthn.get", opts.Challenge)
+	if err != nil {
+		return webauthn.AssertionCredential{}, err
+	}
+
+	a.SignCount++
+	authData := a.authenticatorData(opts.RPID, 0, a.signCount())
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, digest[:])
+	if err != nil {
+		return webauthn.AssertionCredential{}, err
+	}
+	signature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		return webauthn.AssertionCredential{}, err
+	}
+
+	return webauthn.AssertionCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: a.credentialID,
+		Type:  "public-key",
+		Response: webauthn.AssertionResponse{
+			ClientDataJSON:    clientData,
+			AuthenticatorData: authData,
+			Signature:         signature,
+			UserHandle:        a.userHandle,
+		},
+	}, nil
+}
+
+func (a *Authenticator) signCount() uint32 {
+	if a.IgnoreSignCount {
+		return 0
+	}
+	return a.SignCount
+}
+
+func (a *Authenticator) clientData(ceremony string, challenge []byte) ([]byte, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding client data:%v", err)
+	}
+	return data, nil
+}
+
+func (a *Authenticator) authenticatorData(rpID string, flags byte, signCount uint32) []byte {
+	const userPresent, userVerified = 0x01, 0x04
+
+	flags |= userPresent
+	if !a.SkipUserVerification {
+		flags |= userVerified
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, signCount)
+	return append(data, counter...)
+}
+
+// coseKey encodes the public key as a COSE EC2 key
+func (a *Authenticator) coseKey() []byte {
+	x := padded(a.key.PublicKey.X.Bytes(), 32)
+	y := padded(a.key.PublicKey.Y.Bytes(), 32)
+	return encodeMap(
+		encodeInt(1), encodeInt(2), // kty: EC2
+		encodeInt(3), encodeInt(-7), // alg: ES256
+		encodeInt(-1), encodeInt(1), // crv: P-256
+		encodeInt(-2), encodeBytes(x),
+		encodeInt(-3), encodeBytes(y),
+	)
+}
+
+// padded left pads the big endian number with zeros to the given size
+func padded(num []byte, size int) []byte {
+	return append(make([]byte, size-len(num)), num...)
+}
+
+func encodeHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	}
+	head := []byte{major<<5 | 26, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(head[1:], uint32(n))
+	return head
+}
+
+func encodeInt(n int64) []byte {
+	if n < 0 {
+		return encodeHead(1, uint64(-1-n))
+	}
+	return encodeHead(0, uint64(n))
+}
+
+func encodeBytes(data []byte) []byte {
+	return append(encodeHead(2, uint64(len(data))), data...)
+}
+
+func encodeText(text string) []byte {
+	return append(encodeHead(3, uint64(len(text))), text...)
+}
+
+// encodeMap encodes a map with the given encoded keys and values
+func encodeMap(keyvals ...[]byte) []byte {
+	encoded := encodeHead(5, uint64(len(keyvals)/2))
+	for _, item := range keyvals {
+		encoded = append(encoded, item...)
+	}
+	return encoded
+}
@@ -2,16 +2,33 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/katcipis/stonks/api"
 	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/kvstore"
+	"github.com/katcipis/stonks/auth/webauthn"
+	"github.com/katcipis/stonks/mailer"
+	"github.com/katcipis/stonks/oauth/clients"
+	"github.com/katcipis/stonks/oauth/oidc"
+	"github.com/katcipis/stonks/ratelimit"
+	"github.com/katcipis/stonks/users/magiclink"
 	"github.com/katcipis/stonks/users/manager"
+	"github.com/katcipis/stonks/users/mfa"
+	"github.com/katcipis/stonks/users/passkeys"
+	"github.com/katcipis/stonks/users/passwordpolicy"
+	"github.com/katcipis/stonks/users/recovery"
 	"github.com/katcipis/stonks/users/storage"
+	"github.com/katcipis/stonks/users/verification"
 )
 
 type Config struct {
@@ -19,6 +36,72 @@ type Config struct {
 	UsersDBName     string
 	UsersDBUser     string
 	UsersDBPassword string
+	AuthDBAddr      string
+	AuthDBPassword  string
+
+	// SMTPAddr is the address of the SMTP server used to send
+	// emails, when empty emails are written on MailDir or, if it is
+	// also empty, only logged.
+	SMTPAddr     string
+	SMTPUser     string
+	SMTPPassword string
+
+	// MailDir is a directory where emails are written as files
+	// when there is no SMTP server, useful for local development.
+	MailDir          string
+	MailFrom         string
+	PasswordResetURL string
+	VerifyEmailURL   string
+	MagicLinkURL     string
+
+	// RequireVerifiedEmail makes signin fail until users verify their email
+	RequireVerifiedEmail bool
+
+	// PasswordHashing configures how passwords are hashed, outdated
+	// hashes are upgraded when users sign in.
+	PasswordHashing auth.PasswordHashing
+
+	// PasswordPolicy are the rules passwords must follow, the breached
+	// passwords dir is optional (see passwordpolicy.BreachedDir).
+	PasswordPolicy       passwordpolicy.Config
+	BreachedPasswordsDir string
+
+	// PasswordHistory is how many of the most recent passwords
+	// of users can't be reused, zero allows reusing any password.
+	PasswordHistory int
+
+	// PasswordPepperFile is the secret file with the pepper applied to
+	// passwords before hashing, when empty passwords are not peppered.
+	// Old peppers are only used to verify hashes created before a rotation.
+	PasswordPepperFile     string
+	PasswordOldPepperFiles []string
+
+	// JWTSigningKeyFile is the PEM file with the private key used to sign
+	// access tokens, when empty opaque access tokens are used instead.
+	// The name of the file (without extension) is used as the key ID.
+	JWTSigningKeyFile string
+	// JWTVerificationKeyFiles are PEM files with public keys only used to
+	// verify access tokens, like keys from before or after a rotation.
+	JWTVerificationKeyFiles []string
+	JWTIssuer               string
+
+	// OIDCIssuer is the public URL of the service, when set the service
+	// is also an OpenID Connect provider, which requires signing keys.
+	OIDCIssuer string
+
+	// MFAIssuer identifies the service on authenticator apps
+	MFAIssuer string
+
+	// ClientIPHeader is the header with the IP of clients set by a
+	// proxy in front of the service, like X-Forwarded-For.
+	ClientIPHeader string
+
+	// WebAuthnRPID is the domain passkeys are bound to, when empty
+	// passkeys are disabled. The origins are where the WebAuthn
+	// ceremonies can run, like: https://app.stonks.com
+	WebAuthnRPID    string
+	WebAuthnRPName  string
+	WebAuthnOrigins []string
 }
 
 func main() {
@@ -38,11 +121,92 @@ func main() {
 		panic(err)
 	}
 
-	authorizer := auth.New()
-	usersManager := manager.New(authorizer, usersStorage)
+	authorizer, err := auth.NewWithPasswordHashing(loadPeppers(cfg))
+	if err != nil {
+		panic(err)
+	}
+	roles, err := usersStorage.Roles(ctx)
+	if err != nil {
+		panic(err)
+	}
+	for _, role := range roles {
+		if err := authorizer.AddRole(role); err != nil {
+			panic(err)
+		}
+	}
+
+	authdb := kvstore.New(cfg.AuthDBAddr, cfg.AuthDBPassword)
+	usersManager := manager.New(authorizer, usersStorage, manager.Config{
+		RequireVerifiedEmail: cfg.RequireVerifiedEmail,
+		PasswordPolicy:       newPasswordPolicy(cfg),
+		PasswordHistory:      cfg.PasswordHistory,
+	})
+
+	keys := loadKeyRing(cfg)
+	tokens := auth.NewTokens(authdb, time.Hour)
+	if keys != nil {
+		// WHY: signed tokens can't be revoked on other services
+		// so they are kept short lived.
+		tokens = auth.NewSignedTokens(authdb, 15*time.Minute, keys, cfg.JWTIssuer)
+	}
+
+	refreshTokens := auth.NewRefreshTokens(authdb, 30*24*time.Hour)
+	resetTokens := auth.NewOneTimeTokens(authdb, "password-reset", 30*time.Minute)
+	mailSender := newMailSender(cfg)
+	accountRecovery := recovery.New(usersManager, resetTokens, mailSender, recovery.Config{
+		ResetURL: cfg.PasswordResetURL,
+	})
+
+	magicLinkTokens := auth.NewOneTimeTokens(authdb, "magic-link", 15*time.Minute)
+	magicLinks := magiclink.New(usersManager, magicLinkTokens, mailSender, magiclink.Config{
+		LinkURL: cfg.MagicLinkURL,
+	})
+
+	verificationTokens := auth.NewOneTimeTokens(authdb, "email-verification", 24*time.Hour)
+	emailVerification := verification.New(usersManager, verificationTokens, mailSender, verification.Config{
+		VerifyURL: cfg.VerifyEmailURL,
+	})
+
+	mfaChallenges := auth.NewOneTimeTokens(authdb, "mfa-challenge", 5*time.Minute)
+	multiFactor := mfa.New(usersStorage, usersManager, mfaChallenges, mfa.Config{
+		Issuer: cfg.MFAIssuer,
+	})
 
-	service := api.New(usersManager, api.Config{
+	signinAttempts := auth.NewSigninAttempts(authdb, auth.SigninAttemptsConfig{
+		Window:             15 * time.Minute,
+		MaxAccountFailures: 10,
+		MaxIPFailures:      100,
+		Lockout:            15 * time.Minute,
+		Delay:              time.Second,
+		MaxDelay:           30 * time.Second,
+	})
+
+	oauthClients := clients.New(authorizer, usersStorage)
+	userPasskeys := newPasskeys(cfg, usersStorage, usersManager, authdb)
+	provider := newOIDCProvider(cfg, usersManager, oauthClients, tokens, authdb, keys)
+
+	service := api.New(api.Services{
+		UsersManager:   usersManager,
+		Authorizer:     authorizer,
+		Tokens:         tokens,
+		RefreshTokens:  refreshTokens,
+		APIKeys:        auth.NewAPIKeys(usersStorage),
+		Recovery:       accountRecovery,
+		MagicLink:      magicLinks,
+		Verification:   emailVerification,
+		MFA:            multiFactor,
+		SigninAttempts: signinAttempts,
+		RateLimiter:    ratelimit.New(authdb),
+		Passkeys:       userPasskeys,
+		Clients:        oauthClients,
+		Keys:           keys,
+		OIDC:           provider,
+	}, api.Config{
 		CreateUserTimeout: 10 * time.Second,
+		SigninTimeout:     10 * time.Second,
+		RequestTimeout:    10 * time.Second,
+		ClientIPHeader:    cfg.ClientIPHeader,
+		RateLimits:        rateLimits(),
 	})
 
 	// Usually I add a port flag parameter, running against time :-)
@@ -61,12 +225,215 @@ func main() {
 	log.Fatal(server.ListenAndServe())
 }
 
+func loadKeyRing(cfg Config) *auth.KeyRing {
+	if cfg.JWTSigningKeyFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(cfg.JWTSigningKeyFile)
+	if err != nil {
+		panic(err)
+	}
+	signing, err := auth.ParseSigningKey(keyID(cfg.JWTSigningKeyFile), data)
+	if err != nil {
+		panic(err)
+	}
+
+	verification := []auth.VerificationKey{}
+	for _, path := range cfg.JWTVerificationKeyFiles {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			panic(err)
+		}
+		key, err := auth.ParseVerificationKey(keyID(path), data)
+		if err != nil {
+			panic(err)
+		}
+		verification = append(verification, key)
+	}
+
+	keys, err := auth.NewKeyRing(signing, verification...)
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+func newOIDCProvider(
+	cfg Config,
+	usersManager *manager.Manager,
+	oauthClients *clients.Clients,
+	tokens *auth.Tokens,
+	authdb *kvstore.KVStore,
+	keys *auth.KeyRing,
+) *oidc.Provider {
+	if cfg.OIDCIssuer == "" {
+		return nil
+	}
+	if keys == nil {
+		log.Fatal("OIDC_ISSUER requires JWT_SIGNING_KEY_FILE, ID tokens must be signed")
+	}
+
+	codes := auth.NewOneTimeTokens(authdb, "authorization-code", time.Minute)
+	return oidc.New(usersManager, oauthClients, tokens, codes, keys, oidc.Config{
+		Issuer:     strings.TrimSuffix(cfg.OIDCIssuer, "/"),
+		IDTokenTTL: time.Hour,
+	})
+}
+
+func newPasskeys(
+	cfg Config,
+	usersStorage *storage.Storage,
+	usersManager *manager.Manager,
+	authdb *kvstore.KVStore,
+) *passkeys.Passkeys {
+	if cfg.WebAuthnRPID == "" {
+		return nil
+	}
+	if len(cfg.WebAuthnOrigins) == 0 {
+		log.Fatal("WEBAUTHN_RP_ID requires WEBAUTHN_ORIGINS")
+	}
+
+	challenges := auth.NewOneTimeTokens(authdb, "webauthn-challenge", 5*time.Minute)
+	return passkeys.New(usersStorage, usersManager, challenges, webauthn.Config{
+		RPID:    cfg.WebAuthnRPID,
+		RPName:  cfg.WebAuthnRPName,
+		Origins: cfg.WebAuthnOrigins,
+		Timeout: 5 * time.Minute,
+	})
+}
+
+func newPasswordPolicy(cfg Config) *passwordpolicy.Policy {
+	policy := cfg.PasswordPolicy
+	if cfg.BreachedPasswordsDir != "" {
+		breached, err := passwordpolicy.NewBreachedDir(cfg.BreachedPasswordsDir)
+		if err != nil {
+			panic(err)
+		}
+		policy.Breached = breached
+	}
+	return passwordpolicy.New(policy)
+}
+
+func loadPeppers(cfg Config) auth.PasswordHashing {
+	hashing := cfg.PasswordHashing
+	if cfg.PasswordPepperFile != "" {
+		hashing.Pepper = loadPepper(cfg.PasswordPepperFile)
+	}
+	for _, path := range cfg.PasswordOldPepperFiles {
+		hashing.OldPeppers = append(hashing.OldPeppers, loadPepper(path))
+	}
+	return hashing
+}
+
+func loadPepper(path string) auth.Pepper {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	pepper, err := auth.ParsePepper(keyID(path), data)
+	if err != nil {
+		panic(err)
+	}
+	return pepper
+}
+
+func keyID(path string) string {
+	name := filepath.Base(path)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+type mailSender interface {
+	Send(ctx context.Context, msg mailer.Message) error
+}
+
+func newMailSender(cfg Config) mailSender {
+	if cfg.SMTPAddr == "" && cfg.MailDir != "" {
+		log.Warningf("no SMTP server configured, emails will be written on %q", cfg.MailDir)
+		sender, err := mailer.NewDir(cfg.MailDir, cfg.MailFrom)
+		if err != nil {
+			panic(err)
+		}
+		return sender
+	}
+	if cfg.SMTPAddr == "" {
+		log.Warning("no SMTP server configured, emails will only be logged")
+		return loggingSender{}
+	}
+	sender, err := mailer.NewSMTP(cfg.SMTPAddr, cfg.MailFrom, cfg.SMTPUser, cfg.SMTPPassword)
+	if err != nil {
+		panic(err)
+	}
+	return sender
+}
+
+// loggingSender just logs emails, useful to run the
+// service locally without a SMTP server.
+type loggingSender struct{}
+
+func (loggingSender) Send(ctx context.Context, msg mailer.Message) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"to": msg.To, "subject": msg.Subject}).Info(msg.Body)
+	return nil
+}
+
 func loadCfg() Config {
 	return Config{
 		UsersDBHost:     loadenv("USERS_DB_HOST", "usersdb"),
 		UsersDBName:     loadenv("USERS_DB_NAME", "testing"),
 		UsersDBUser:     loadenv("USERS_DB_USER", "testing"),
 		UsersDBPassword: loadenv("USERS_DB_PASSWORD", "testing"),
+		AuthDBAddr:      loadenv("AUTH_DB_ADDR", "authdb:6379"),
+		AuthDBPassword:  loadenv("AUTH_DB_PASSWORD", ""),
+
+		SMTPAddr:         loadenv("SMTP_ADDR", ""),
+		SMTPUser:         loadenv("SMTP_USER", ""),
+		SMTPPassword:     loadenv("SMTP_PASSWORD", ""),
+		MailDir:          loadenv("MAIL_DIR", ""),
+		MailFrom:         loadenv("MAIL_FROM", "no-reply@stonks.com"),
+		PasswordResetURL: loadenv("PASSWORD_RESET_URL", ""),
+		VerifyEmailURL:   loadenv("VERIFY_EMAIL_URL", ""),
+		MagicLinkURL:     loadenv("MAGIC_LINK_URL", ""),
+
+		RequireVerifiedEmail: loadenv("REQUIRE_VERIFIED_EMAIL", "true") == "true",
+
+		PasswordHashing: auth.PasswordHashing{
+			Scheme: auth.PasswordScheme(loadenv("PASSWORD_HASH_SCHEME", string(auth.Argon2idScheme))),
+			Argon2id: auth.Argon2idParams{
+				Memory:      uint32(loadenvUint("ARGON2ID_MEMORY", 0, 32)),
+				Iterations:  uint32(loadenvUint("ARGON2ID_ITERATIONS", 0, 32)),
+				Parallelism: uint8(loadenvUint("ARGON2ID_PARALLELISM", 0, 8)),
+			},
+			Scrypt: auth.ScryptParams{
+				CostLog2: uint8(loadenvUint("SCRYPT_COST_LOG2", 0, 8)),
+			},
+			BcryptCost: int(loadenvUint("BCRYPT_COST", 0, 8)),
+		},
+		PasswordPolicy: passwordpolicy.Config{
+			MinLength:    int(loadenvUint("PASSWORD_MIN_LENGTH", 8, 16)),
+			MinEntropy:   float64(loadenvUint("PASSWORD_MIN_ENTROPY", 30, 16)),
+			PersonalInfo: loadenv("PASSWORD_PERSONAL_INFO", "true") == "true",
+		},
+		BreachedPasswordsDir: loadenv("BREACHED_PASSWORDS_DIR", ""),
+		PasswordHistory:      int(loadenvUint("PASSWORD_HISTORY", 5, 16)),
+
+		PasswordPepperFile:     loadenv("PASSWORD_PEPPER_FILE", ""),
+		PasswordOldPepperFiles: loadenvList("PASSWORD_OLD_PEPPER_FILES"),
+
+		JWTSigningKeyFile:       loadenv("JWT_SIGNING_KEY_FILE", ""),
+		JWTVerificationKeyFiles: loadenvList("JWT_VERIFICATION_KEY_FILES"),
+		JWTIssuer:               loadenv("JWT_ISSUER", "stonks"),
+
+		OIDCIssuer: loadenv("OIDC_ISSUER", ""),
+		MFAIssuer:  loadenv("MFA_ISSUER", "Stonks"),
+
+		ClientIPHeader: loadenv("CLIENT_IP_HEADER", ""),
+
+		WebAuthnRPID:    loadenv("WEBAUTHN_RP_ID", ""),
+		WebAuthnRPName:  loadenv("WEBAUTHN_RP_NAME", "Stonks"),
+		WebAuthnOrigins: loadenvList("WEBAUTHN_ORIGINS"),
 	}
 }
 
@@ -77,3 +444,50 @@ func loadenv(key string, defaultVal string) string {
 	}
 	return val
 }
+
+// loadenvUint loads an unsigned integer with the given bit size
+// from the environment.
+func loadenvUint(key string, defaultVal uint64, bitSize int) uint64 {
+	val := loadenv(key, "")
+	if val == "" {
+		return defaultVal
+	}
+	parsed, err := strconv.ParseUint(val, 10, bitSize)
+	if err != nil {
+		panic(fmt.Errorf("invalid %s %q:%v", key, val, err))
+	}
+	return parsed
+}
+
+// loadenvList loads a comma separated list from the environment
+func loadenvList(key string) []string {
+	vals := []string{}
+	for _, val := range strings.Split(loadenv(key, ""), ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			vals = append(vals, val)
+		}
+	}
+	return vals
+}
+
+func rateLimits() api.RateLimits {
+	// WHY: routes that send emails or check credentials
+	// are abused way more easily, so they are stricter.
+	strict := ratelimit.Policy{Limit: 10, Window: time.Minute}
+	return api.RateLimits{
+		Default: ratelimit.Policy{Limit: 600, Window: time.Minute},
+		Routes: map[string]ratelimit.Policy{
+			"POST /v1/users":                  strict,
+			"/v1/users/verify/resend":         strict,
+			"/v1/auth/signin":                 strict,
+			"/v1/auth/signin/mfa":             strict,
+			"/v1/auth/signin/passkey":         strict,
+			"/v1/auth/password-reset":         strict,
+			"/v1/auth/password-reset/confirm": strict,
+			"/v1/auth/magic-link":             strict,
+			"/v1/auth/magic-link/confirm":     strict,
+			"/v1/auth/token":                  {Limit: 60, Window: time.Minute},
+			"/v1/oauth/token":                 {Limit: 60, Window: time.Minute},
+		},
+	}
+}
@@ -1,8 +1,93 @@
 CREATE SCHEMA users;
 
 CREATE TABLE users.users (
-    email text PRIMARY KEY,
-    id BIGINT GENERATED ALWAYS AS IDENTITY,
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    email text NOT NULL,
     fullname text,
-    password_hash text
+    password_hash text,
+    role text NOT NULL DEFAULT 'user',
+    status text NOT NULL DEFAULT 'pending_verification',
+    status_reason text NOT NULL DEFAULT '',
+    version bigint NOT NULL DEFAULT 1
 );
+
+-- Deleted users are kept, but their emails can be used by new users.
+CREATE UNIQUE INDEX users_email_idx ON users.users (email) WHERE status <> 'deleted';
+
+-- Custom roles, the builtin roles "user" and "admin" are
+-- defined by the service itself and should not be added here.
+CREATE TABLE users.roles (
+    name text PRIMARY KEY,
+    permissions text[] NOT NULL DEFAULT '{}'
+);
+
+-- OAuth clients allowed to use the OAuth endpoints, like token
+-- introspection. The secret hash must be created the same way
+-- password hashes are (bcrypt), public clients have no secret.
+-- Redirect URIs are used on the authorization code flow.
+-- Scopes are the permissions confidential clients may be granted
+-- on the client credentials grant (like users:list).
+CREATE TABLE users.clients (
+    id text PRIMARY KEY,
+    name text NOT NULL,
+    secret_hash text NOT NULL DEFAULT '',
+    redirect_uris text[] NOT NULL DEFAULT '{}',
+    scopes text[] NOT NULL DEFAULT '{}'
+);
+
+-- Personal API keys of users, only the SHA-256 hash of the key is stored.
+-- Empty scopes means the key has all the permissions of the user.
+CREATE TABLE users.api_keys (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users.users (id),
+    name text NOT NULL,
+    key_hash text NOT NULL UNIQUE,
+    scopes text[] NOT NULL DEFAULT '{}',
+    created_at timestamptz NOT NULL,
+    expires_at timestamptz,
+    last_used_at timestamptz
+);
+
+CREATE INDEX api_keys_user_id_idx ON users.api_keys (user_id);
+
+-- TOTP enrollments, pending until confirmed by the user. The last used
+-- time step avoids the same code being used more than once.
+CREATE TABLE users.mfa_totp (
+    user_id BIGINT PRIMARY KEY REFERENCES users.users (id),
+    secret text NOT NULL,
+    confirmed boolean NOT NULL DEFAULT false,
+    last_used_step BIGINT NOT NULL DEFAULT 0
+);
+
+-- One time MFA recovery codes, only the SHA-256 hash of the code is stored.
+CREATE TABLE users.mfa_recovery_codes (
+    user_id BIGINT NOT NULL REFERENCES users.users (id),
+    code_hash text NOT NULL,
+    PRIMARY KEY (user_id, code_hash)
+);
+
+-- WebAuthn credentials (passkeys) of users, the public key is COSE encoded.
+-- The signature counter is used to detect cloned authenticators.
+CREATE TABLE users.passkeys (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users.users (id),
+    name text NOT NULL,
+    credential_id bytea NOT NULL UNIQUE,
+    public_key bytea NOT NULL,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    created_at timestamptz NOT NULL,
+    last_used_at timestamptz
+);
+
+CREATE INDEX passkeys_user_id_idx ON users.passkeys (user_id);
+
+-- Previous password hashes of users, used to forbid reusing recent passwords.
+-- Only the most recent ones are kept, older hashes are pruned.
+CREATE TABLE users.password_history (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users.users (id),
+    password_hash text NOT NULL,
+    created_at timestamptz NOT NULL
+);
+
+CREATE INDEX password_history_user_id_idx ON users.password_history (user_id, id);
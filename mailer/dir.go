@@ -0,0 +1,51 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Dir is a sender that writes each message to a file on a directory,
+// on the same format they are sent to SMTP servers. It is useful for
+// local development, where emails can be opened with any email client.
+type Dir struct {
+	dir  string
+	from string
+}
+
+// NewDir creates a new Dir sender that writes messages, sent from the
+// given address, on the given directory. The directory is created
+// if it doesn't exist.
+func NewDir(dir string, from string) (*Dir, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating mail dir %q:%v", dir, err)
+	}
+	return &Dir{dir: dir, from: from}, nil
+}
+
+// Send writes the message to a new file with the ".eml" extension.
+// Files names start with the time the message was sent, so
+// sorting them by name sorts them by the sending time.
+func (s *Dir) Send(ctx context.Context, msg Message) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+
+	pattern := fmt.Sprintf("%d-*.eml", time.Now().UnixNano())
+	file, err := ioutil.TempFile(s.dir, pattern)
+	if err != nil {
+		return fmt.Errorf("error creating mail file:%v", err)
+	}
+
+	_, err = file.Write(format(s.from, msg))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing mail file %q:%v", file.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+)
+
+// InMemory is a sender that just keeps sent messages in memory,
+// useful for tests and local development.
+type InMemory struct {
+	mutex    sync.Mutex
+	messages []Message
+}
+
+// NewInMemory creates a new InMemory sender
+func NewInMemory() *InMemory {
+	return &InMemory{}
+}
+
+// Send keeps the message in memory
+func (s *InMemory) Send(ctx context.Context, msg Message) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+// Messages returns all messages sent so far, in the order they were sent
+func (s *InMemory) Messages() []Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	messages := make([]Message, len(s.messages))
+	copy(messages, s.messages)
+	return messages
+}
@@ -0,0 +1,31 @@
+// Package mailer is responsible for sending emails
+package mailer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Message is a plain text email message
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Validate checks if the message can be safely sent,
+// returning a non-nil error if it can't.
+func (m Message) Validate() error {
+	if m.To == "" {
+		return fmt.Errorf("message has no recipient")
+	}
+	// WHY: recipient and subject end up on the message headers,
+	// line breaks on them would allow injecting arbitrary headers.
+	if strings.ContainsAny(m.To, "\r\n") {
+		return fmt.Errorf("message recipient %q has line breaks", m.To)
+	}
+	if strings.ContainsAny(m.Subject, "\r\n") {
+		return fmt.Errorf("message subject %q has line breaks", m.Subject)
+	}
+	return nil
+}
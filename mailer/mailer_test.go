@@ -0,0 +1,271 @@
+package mailer_test
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katcipis/stonks/mailer"
+)
+
+func TestInMemorySender(t *testing.T) {
+	sender := mailer.NewInMemory()
+	ctx := context.Background()
+
+	msgs := []mailer.Message{
+		{To: "first@test.com", Subject: "first", Body: "first body"},
+		{To: "second@test.com", Subject: "second", Body: "second body"},
+	}
+
+	for _, msg := range msgs {
+		assertNoErr(t, sender.Send(ctx, msg))
+	}
+
+	got := sender.Messages()
+	if len(got) != len(msgs) {
+		t.Fatalf("got %d messages want %d", len(got), len(msgs))
+	}
+	for i, msg := range msgs {
+		if got[i] != msg {
+			t.Errorf("got message %v want %v", got[i], msg)
+		}
+	}
+}
+
+func TestSendersRejectInvalidMessages(t *testing.T) {
+	smtpSender, err := mailer.NewSMTP("localhost:25", "from@test.com", "", "")
+	assertNoErr(t, err)
+
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	dirSender, err := mailer.NewDir(dir, "from@test.com")
+	assertNoErr(t, err)
+
+	senders := map[string]interface {
+		Send(context.Context, mailer.Message) error
+	}{
+		"InMemory": mailer.NewInMemory(),
+		"SMTP":     smtpSender,
+		"Dir":      dirSender,
+	}
+
+	msgs := map[string]mailer.Message{
+		"NoRecipient":             {Subject: "subject"},
+		"LineBreakOnRecipient":    {To: "to@test.com\r\nBcc: evil@test.com"},
+		"LineBreakOnSubject":      {To: "to@test.com", Subject: "hi\nBcc: evil@test.com"},
+		"CarriageReturnOnSubject": {To: "to@test.com", Subject: "hi\rBcc: evil@test.com"},
+	}
+
+	for senderName, sender := range senders {
+		for msgName, msg := range msgs {
+			t.Run(senderName+msgName, func(t *testing.T) {
+				err := sender.Send(context.Background(), msg)
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+			})
+		}
+	}
+}
+
+func TestDirSender(t *testing.T) {
+	parent := newTempDir(t)
+	defer os.RemoveAll(parent)
+
+	dir := filepath.Join(parent, "mails")
+	sender, err := mailer.NewDir(dir, "from@test.com")
+	assertNoErr(t, err)
+
+	ctx := context.Background()
+	msgs := []mailer.Message{
+		{To: "first@test.com", Subject: "first", Body: "first body"},
+		{To: "second@test.com", Subject: "second", Body: "second body"},
+	}
+	for _, msg := range msgs {
+		assertNoErr(t, sender.Send(ctx, msg))
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	assertNoErr(t, err)
+
+	if len(files) != len(msgs) {
+		t.Fatalf("got %d mail files want %d", len(files), len(msgs))
+	}
+	sort.Strings(files)
+
+	for i, msg := range msgs {
+		data, err := ioutil.ReadFile(files[i])
+		assertNoErr(t, err)
+
+		got := string(data)
+		wantHeaders := []string{
+			"From: from@test.com",
+			"To: " + msg.To,
+			"Subject: " + msg.Subject,
+		}
+		for _, header := range wantHeaders {
+			if !strings.Contains(got, header+"\r\n") {
+				t.Errorf("header %q not found on file %q:\n%s", header, files[i], got)
+			}
+		}
+		if !strings.HasSuffix(got, "\r\n\r\n"+msg.Body+"\r\n") {
+			t.Errorf("body %q not found on file %q:\n%s", msg.Body, files[i], got)
+		}
+	}
+}
+
+func TestSMTPSender(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoErr(t, err)
+	defer listener.Close()
+
+	received := make(chan smtpTransaction, 1)
+	go serveSMTP(t, listener, received)
+
+	sender, err := mailer.NewSMTP(listener.Addr().String(), "from@test.com", "", "")
+	assertNoErr(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msg := mailer.Message{
+		To:      "to@test.com",
+		Subject: "Test Subject",
+		Body:    "Test body\nwith lines\n.\nand a dot",
+	}
+	assertNoErr(t, sender.Send(ctx, msg))
+
+	var got smtpTransaction
+	select {
+	case got = <-received:
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for SMTP transaction")
+	}
+
+	if got.from != "<from@test.com>" {
+		t.Errorf("got from %q", got.from)
+	}
+	if got.to != "<to@test.com>" {
+		t.Errorf("got to %q", got.to)
+	}
+
+	wantHeaders := []string{
+		"From: from@test.com",
+		"To: to@test.com",
+		"Subject: Test Subject",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	for _, header := range wantHeaders {
+		if !strings.Contains(got.data, header+"\r\n") {
+			t.Errorf("header %q not found on data:\n%s", header, got.data)
+		}
+	}
+
+	wantBody := "\r\n\r\nTest body\r\nwith lines\r\n.\r\nand a dot\r\n"
+	if !strings.HasSuffix(got.data, wantBody) {
+		t.Errorf("got data:\n%q\nwant body:\n%q", got.data, wantBody)
+	}
+}
+
+type smtpTransaction struct {
+	from string
+	to   string
+	data string
+}
+
+// serveSMTP is a minimal SMTP server, just enough to test
+// the client implementation (no extensions are supported).
+func serveSMTP(t *testing.T, listener net.Listener, received chan<- smtpTransaction) {
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Errorf("accepting SMTP connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	reply := func(code int, msg string) {
+		if err := tp.PrintfLine("%d %s", code, msg); err != nil {
+			t.Errorf("writing SMTP reply: %v", err)
+		}
+	}
+
+	transaction := smtpTransaction{}
+	reply(220, "localhost ready")
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			t.Errorf("reading SMTP command: %v", err)
+			return
+		}
+
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			reply(250, "localhost")
+		case "MAIL":
+			transaction.from = strings.TrimPrefix(line, "MAIL FROM:")
+			reply(250, "ok")
+		case "RCPT":
+			transaction.to = strings.TrimPrefix(line, "RCPT TO:")
+			reply(250, "ok")
+		case "DATA":
+			reply(354, "go ahead")
+			data, err := readDotLines(tp.R)
+			if err != nil {
+				t.Errorf("reading SMTP data: %v", err)
+				return
+			}
+			transaction.data = data
+			reply(250, "ok")
+		case "QUIT":
+			reply(221, "bye")
+			received <- transaction
+			return
+		default:
+			reply(502, "not implemented")
+		}
+	}
+}
+
+// readDotLines reads the raw data (with CRLF line endings) undoing
+// the dot stuffing done by the client.
+func readDotLines(r *bufio.Reader) (string, error) {
+	data := strings.Builder{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if line == ".\r\n" {
+			return data.String(), nil
+		}
+		data.WriteString(strings.TrimPrefix(line, "."))
+	}
+}
+
+func assertNoErr(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "mailer-test")
+	assertNoErr(t, err)
+	return dir
+}
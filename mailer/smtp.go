@@ -0,0 +1,111 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTP is a sender that sends messages through an SMTP server
+type SMTP struct {
+	addr     string
+	host     string
+	from     string
+	user     string
+	password string
+}
+
+// NewSMTP creates a new SMTP sender that will connect to the server
+// on the given address (on the form host:port) sending messages from
+// the given address. If user is not empty it will be used, along with
+// the password, to authenticate on the server.
+func NewSMTP(addr string, from string, user string, password string) (*SMTP, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP server address %q:%v", addr, err)
+	}
+	return &SMTP{
+		addr:     addr,
+		host:     host,
+		from:     from,
+		user:     user,
+		password: password,
+	}, nil
+}
+
+// Send sends the message, respecting the deadline of the given ctx.
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("error connecting to SMTP server:%v", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return fmt.Errorf("error setting SMTP connection deadline:%v", err)
+		}
+	}
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		return fmt.Errorf("error starting SMTP session:%v", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return fmt.Errorf("error starting TLS on SMTP session:%v", err)
+		}
+	}
+
+	if s.user != "" {
+		// PlainAuth refuses to send credentials without TLS
+		// unless the server is on localhost, so it is safe to use.
+		auth := smtp.PlainAuth("", s.user, s.password, s.host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("error authenticating on SMTP server:%v", err)
+		}
+	}
+
+	if err := client.Mail(s.from); err != nil {
+		return fmt.Errorf("error setting SMTP sender:%v", err)
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("error setting SMTP recipient:%v", err)
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("error starting SMTP data:%v", err)
+	}
+	if _, err := w.Write(format(s.from, msg)); err != nil {
+		return fmt.Errorf("error writing SMTP data:%v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error sending SMTP data:%v", err)
+	}
+
+	return client.Quit()
+}
+
+func format(from string, msg Message) []byte {
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "\r\n%s\r\n", msg.Body)
+	return buf.Bytes()
+}
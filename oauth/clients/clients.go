@@ -0,0 +1,92 @@
+// Package clients is responsible for authenticating OAuth clients
+package clients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/katcipis/stonks/oauth"
+)
+
+// ClientsStore is responsible for retrieving registered clients
+type ClientsStore interface {
+	// Client retrieves the client with the given ID.
+	// If the client does not exist it MUST return
+	// oauth.ClientNotFoundErr (possibly wrapped).
+	Client(ctx context.Context, id string) (oauth.Client, error)
+}
+
+// Authorizer is responsible for authorization and security related operations
+type Authorizer interface {
+	// HashMatchesPassword checks if the hash matches
+	// the given plain text password (or secret).
+	HashMatchesPassword(hash string, password string) bool
+}
+
+// Clients is responsible for authenticating registered clients
+type Clients struct {
+	auth  Authorizer
+	store ClientsStore
+}
+
+// New creates a new Clients
+func New(a Authorizer, s ClientsStore) *Clients {
+	return &Clients{
+		auth:  a,
+		store: s,
+	}
+}
+
+// Client retrieves the client with the given ID.
+// If the client does not exist it returns oauth.ClientNotFoundErr.
+func (c *Clients) Client(ctx context.Context, id string) (oauth.Client, error) {
+	return c.store.Client(ctx, id)
+}
+
+// Identify identifies the client with the given credentials. Confidential
+// clients are authenticated just like Authenticate, public clients are
+// identified just by their ID and must not send a secret.
+// If the client can't be identified it returns oauth.InvalidClientErr.
+func (c *Clients) Identify(ctx context.Context, id string, secret string) (oauth.Client, error) {
+	if secret != "" {
+		return c.Authenticate(ctx, id, secret)
+	}
+
+	client, err := c.store.Client(ctx, id)
+	if err != nil {
+		if errors.Is(err, oauth.ClientNotFoundErr) {
+			return oauth.Client{}, fmt.Errorf("%w:%v", oauth.InvalidClientErr, err)
+		}
+		return oauth.Client{}, fmt.Errorf("error retrieving client %q:%v", id, err)
+	}
+
+	if !client.Public() {
+		return oauth.Client{}, fmt.Errorf("%w:missing secret of confidential client", oauth.InvalidClientErr)
+	}
+	return client, nil
+}
+
+// Authenticate authenticates the client with the given credentials,
+// returning the authenticated client. If the client doesn't exist, is
+// not confidential or the secret doesn't match it returns
+// oauth.InvalidClientErr.
+func (c *Clients) Authenticate(ctx context.Context, id string, secret string) (oauth.Client, error) {
+	if id == "" || secret == "" {
+		return oauth.Client{}, fmt.Errorf("%w:missing client credentials", oauth.InvalidClientErr)
+	}
+
+	client, err := c.store.Client(ctx, id)
+	if err != nil {
+		if errors.Is(err, oauth.ClientNotFoundErr) {
+			return oauth.Client{}, fmt.Errorf("%w:%v", oauth.InvalidClientErr, err)
+		}
+		return oauth.Client{}, fmt.Errorf("error retrieving client %q:%v", id, err)
+	}
+
+	// WHY: public clients can't authenticate, they have no secret
+	if client.Public() || !c.auth.HashMatchesPassword(client.SecretHash, secret) {
+		return oauth.Client{}, fmt.Errorf("%w:secret mismatch", oauth.InvalidClientErr)
+	}
+	return client, nil
+}
@@ -0,0 +1,193 @@
+package clients_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/oauth"
+	"github.com/katcipis/stonks/oauth/clients"
+)
+
+func TestAuthenticate(t *testing.T) {
+	const (
+		clientID = "gateway"
+		secret   = "gateway secret"
+	)
+
+	authorizer := auth.New()
+	secretHash, err := authorizer.PasswordHash(secret)
+	assertNoErr(t, err)
+
+	store := clientsStore{
+		clientID: {ID: clientID, Name: "API Gateway", SecretHash: secretHash},
+		"public": {ID: "public", Name: "Public Client"},
+	}
+
+	type Test struct {
+		name     string
+		clientID string
+		secret   string
+		wantErr  error
+	}
+
+	tests := []Test{
+		{
+			name:     "Success",
+			clientID: clientID,
+			secret:   secret,
+		},
+		{
+			name:     "WrongSecret",
+			clientID: clientID,
+			secret:   "wrong",
+			wantErr:  oauth.InvalidClientErr,
+		},
+		{
+			name:     "EmptySecret",
+			clientID: clientID,
+			wantErr:  oauth.InvalidClientErr,
+		},
+		{
+			name:     "UnknownClient",
+			clientID: "unknown",
+			secret:   secret,
+			wantErr:  oauth.InvalidClientErr,
+		},
+		{
+			name:     "PublicClient",
+			clientID: "public",
+			secret:   secret,
+			wantErr:  oauth.InvalidClientErr,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := clients.New(authorizer, store)
+			client, err := c.Authenticate(context.Background(), test.clientID, test.secret)
+
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got err[%v] want[%v]", err, test.wantErr)
+				}
+				return
+			}
+
+			assertNoErr(t, err)
+			if !reflect.DeepEqual(client, store[test.clientID]) {
+				t.Fatalf("got client %v want %v", client, store[test.clientID])
+			}
+		})
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	const secret = "confidential secret"
+
+	authorizer := auth.New()
+	secretHash, err := authorizer.PasswordHash(secret)
+	assertNoErr(t, err)
+
+	store := clientsStore{
+		"confidential": {ID: "confidential", SecretHash: secretHash},
+		"public":       {ID: "public", RedirectURIs: []string{"https://app.test/callback"}},
+	}
+
+	type Test struct {
+		name     string
+		clientID string
+		secret   string
+		wantErr  error
+	}
+
+	tests := []Test{
+		{
+			name:     "Confidential",
+			clientID: "confidential",
+			secret:   secret,
+		},
+		{
+			name:     "Public",
+			clientID: "public",
+		},
+		{
+			name:     "ConfidentialWithoutSecret",
+			clientID: "confidential",
+			wantErr:  oauth.InvalidClientErr,
+		},
+		{
+			name:     "ConfidentialWrongSecret",
+			clientID: "confidential",
+			secret:   "wrong",
+			wantErr:  oauth.InvalidClientErr,
+		},
+		{
+			name:     "PublicWithSecret",
+			clientID: "public",
+			secret:   secret,
+			wantErr:  oauth.InvalidClientErr,
+		},
+		{
+			name:     "UnknownClient",
+			clientID: "unknown",
+			wantErr:  oauth.InvalidClientErr,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := clients.New(authorizer, store)
+			client, err := c.Identify(context.Background(), test.clientID, test.secret)
+
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got err[%v] want[%v]", err, test.wantErr)
+				}
+				return
+			}
+
+			assertNoErr(t, err)
+			if !reflect.DeepEqual(client, store[test.clientID]) {
+				t.Fatalf("got client %v want %v", client, store[test.clientID])
+			}
+		})
+	}
+}
+
+func TestAuthenticateStoreFailure(t *testing.T) {
+	c := clients.New(auth.New(), failingStore{})
+
+	_, err := c.Authenticate(context.Background(), "client", "secret")
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if errors.Is(err, oauth.InvalidClientErr) {
+		t.Fatalf("storage failures should not be reported as invalid clients: %v", err)
+	}
+}
+
+type clientsStore map[string]oauth.Client
+
+func (s clientsStore) Client(ctx context.Context, id string) (oauth.Client, error) {
+	client, ok := s[id]
+	if !ok {
+		return oauth.Client{}, oauth.ClientNotFoundErr
+	}
+	return client, nil
+}
+
+type failingStore struct{}
+
+func (failingStore) Client(ctx context.Context, id string) (oauth.Client, error) {
+	return oauth.Client{}, errors.New("storage is down")
+}
+
+func assertNoErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
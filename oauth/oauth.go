@@ -0,0 +1,118 @@
+// Package oauth has the types shared by the OAuth 2.0 related services,
+// like the clients that are allowed to use them.
+package oauth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Error represents errors related to OAuth
+// They should always be checked using errors.Is since the
+// error may be wrapped with more context.
+type Error string
+
+const (
+	ClientNotFoundErr          Error = "client not found"
+	InvalidClientErr           Error = "invalid client"
+	InvalidRedirectURIErr      Error = "invalid redirect URI"
+	InvalidRequestErr          Error = "invalid request"
+	InvalidScopeErr            Error = "invalid scope"
+	InvalidGrantErr            Error = "invalid grant"
+	UnsupportedResponseTypeErr Error = "unsupported response type"
+	UnsupportedGrantTypeErr    Error = "unsupported grant type"
+)
+
+// TokensScope allows clients, like API gateways, to introspect and revoke
+// any token. Without it clients can only handle the tokens issued to them.
+const TokensScope = "oauth:tokens"
+
+// Client is a registered OAuth client, as defined on:
+// https://tools.ietf.org/html/rfc6749#section-2
+type Client struct {
+	ID   string
+	Name string
+
+	// SecretHash is the hash of the client secret, only
+	// confidential clients have secrets.
+	SecretHash string
+
+	// RedirectURIs are the URIs the client can be redirected to after
+	// an authorization, they are matched exactly.
+	RedirectURIs []string
+
+	// Scopes are the scopes the client may be granted on the client
+	// credentials grant, they are the same as user permissions.
+	Scopes []string
+}
+
+// Public returns true if the client is public, as defined on:
+// https://tools.ietf.org/html/rfc6749#section-2.1
+// Public clients can't keep secrets, like browser and native apps.
+func (c Client) Public() bool {
+	return c.SecretHash == ""
+}
+
+// HasRedirectURI returns true if the given URI
+// is one of the client's redirect URIs.
+func (c Client) HasRedirectURI(uri string) bool {
+	return contains(c.RedirectURIs, uri)
+}
+
+// CanHandleToken returns true if the client is allowed to introspect and
+// revoke a token issued to the given client ID, which is empty for tokens
+// not issued to clients, like the ones of sign ins.
+func (c Client) CanHandleToken(tokenClientID string) bool {
+	return (tokenClientID != "" && tokenClientID == c.ID) || c.hasScope(TokensScope)
+}
+
+func (c Client) hasScope(scope string) bool {
+	return contains(c.Scopes, scope)
+}
+
+// GrantScopes returns the scopes granted to the client given the
+// requested ones. If no scopes are requested all the client scopes are
+// granted, as allowed by: https://tools.ietf.org/html/rfc6749#section-3.3
+// If any requested scope is not allowed for the client it returns
+// InvalidScopeErr, instead of silently granting less scopes.
+func (c Client) GrantScopes(requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return c.Scopes, nil
+	}
+
+	granted := []string{}
+	for _, scope := range requested {
+		if !c.hasScope(scope) {
+			return nil, fmt.Errorf("%w:scope %q not allowed for client %q", InvalidScopeErr, scope, c.ID)
+		}
+		if !contains(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	return granted, nil
+}
+
+// ParseScope parses a scope parameter, which is a list of space
+// separated scopes, as defined on: https://tools.ietf.org/html/rfc6749#section-3.3
+func ParseScope(scope string) []string {
+	return strings.Fields(scope)
+}
+
+// FormatScope formats the scopes as a scope parameter
+func FormatScope(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+// Error returns the string representation of the error
+func (e Error) Error() string {
+	return string(e)
+}
+
+func contains(vals []string, val string) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
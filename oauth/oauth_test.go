@@ -0,0 +1,110 @@
+package oauth_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/katcipis/stonks/oauth"
+)
+
+func TestClientRedirectURIs(t *testing.T) {
+	client := oauth.Client{
+		ID:           "app",
+		RedirectURIs: []string{"https://app.test/callback", "http://localhost:8000/callback"},
+	}
+
+	for _, uri := range client.RedirectURIs {
+		if !client.HasRedirectURI(uri) {
+			t.Errorf("redirect URI %q should be allowed", uri)
+		}
+	}
+
+	notAllowed := []string{
+		"",
+		"https://app.test/callback/",
+		"https://app.test/callback?extra=1",
+		"https://APP.test/callback",
+		"https://evil.test/callback",
+	}
+	for _, uri := range notAllowed {
+		if client.HasRedirectURI(uri) {
+			t.Errorf("redirect URI %q should not be allowed", uri)
+		}
+	}
+}
+
+func TestPublicClient(t *testing.T) {
+	if !(oauth.Client{ID: "public"}).Public() {
+		t.Error("client without secret should be public")
+	}
+	if (oauth.Client{ID: "confidential", SecretHash: "hash"}).Public() {
+		t.Error("client with secret should not be public")
+	}
+}
+
+func TestClientCanHandleToken(t *testing.T) {
+	client := oauth.Client{ID: "app", Scopes: []string{"users:read"}}
+	gateway := oauth.Client{ID: "gateway", Scopes: []string{oauth.TokensScope}}
+
+	if !client.CanHandleToken("app") {
+		t.Error("client should handle its own tokens")
+	}
+	for _, tokenClientID := range []string{"", "other"} {
+		if client.CanHandleToken(tokenClientID) {
+			t.Errorf("client should not handle tokens of client %q", tokenClientID)
+		}
+		if !gateway.CanHandleToken(tokenClientID) {
+			t.Errorf("gateway should handle tokens of client %q", tokenClientID)
+		}
+	}
+}
+
+func TestClientGrantScopes(t *testing.T) {
+	client := oauth.Client{
+		ID:     "batch-job",
+		Scopes: []string{"users:list", "users:read"},
+	}
+
+	type Test struct {
+		name      string
+		requested string
+		want      []string
+		wantErr   error
+	}
+
+	tests := []Test{
+		{
+			name:      "NoScopeGrantsAllClientScopes",
+			requested: "",
+			want:      []string{"users:list", "users:read"},
+		},
+		{
+			name:      "SubsetOfClientScopes",
+			requested: "users:read",
+			want:      []string{"users:read"},
+		},
+		{
+			name:      "DuplicatedScopes",
+			requested: "users:read  users:list users:read",
+			want:      []string{"users:read", "users:list"},
+		},
+		{
+			name:      "ScopeNotAllowed",
+			requested: "users:read users:delete",
+			wantErr:   oauth.InvalidScopeErr,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := client.GrantScopes(oauth.ParseScope(test.requested))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got err[%v] want[%v]", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got scopes %v want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,423 @@
+// Package oidc implements an OpenID Connect provider using the
+// authorization code flow with PKCE, as defined on:
+//
+// - https://openid.net/specs/openid-connect-core-1_0.html#CodeFlowAuth
+// - https://tools.ietf.org/html/rfc7636
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/oauth"
+	"github.com/katcipis/stonks/users"
+)
+
+// Supported values of the authorization request parameters
+const (
+	CodeResponseType    = "code"
+	S256ChallengeMethod = "S256"
+
+	OpenIDScope  = "openid"
+	ProfileScope = "profile"
+	EmailScope   = "email"
+)
+
+// SupportedScopes are all the scopes that can be requested
+var SupportedScopes = []string{OpenIDScope, ProfileScope, EmailScope}
+
+// UsersManager is responsible for retrieving users
+type UsersManager interface {
+	// User retrieves the user with the given ID.
+	// If the user does not exist it MUST return
+	// users.UserNotFoundErr (possibly wrapped).
+	User(ctx context.Context, id string) (users.User, error)
+}
+
+// Clients is responsible for retrieving and identifying OAuth clients
+type Clients interface {
+	// Client retrieves the client with the given ID. If the client does
+	// not exist it MUST return oauth.ClientNotFoundErr (possibly wrapped).
+	Client(ctx context.Context, id string) (oauth.Client, error)
+
+	// Identify identifies the client with the given credentials (public
+	// clients have no secret). If the client can't be identified it
+	// MUST return oauth.InvalidClientErr (possibly wrapped).
+	Identify(ctx context.Context, id string, secret string) (oauth.Client, error)
+}
+
+// Tokens is responsible for creating and validating access tokens
+type Tokens interface {
+	// CreateDelegatedToken creates an access token owned by the user,
+	// issued to the client and restricted to the given scopes.
+	CreateDelegatedToken(ctx context.Context, userID string, clientID string, scopes []string) (auth.Token, error)
+
+	// Introspect MUST return auth.InvalidTokenErr (possibly wrapped)
+	// if the token is invalid or expired.
+	Introspect(ctx context.Context, accessToken string) (auth.TokenInfo, error)
+}
+
+// Codes is responsible for creating single use authorization codes
+type Codes interface {
+	Create(ctx context.Context, subject string) (string, error)
+
+	// Consume MUST return auth.InvalidTokenErr (possibly wrapped)
+	// if the code is invalid, expired or already consumed.
+	Consume(ctx context.Context, code string) (string, error)
+}
+
+// Config has all configuration needed by the provider
+type Config struct {
+	// Issuer is the URL of the provider, used as the
+	// issuer of ID tokens and as the base of all endpoints.
+	Issuer string
+
+	// IDTokenTTL is how long ID tokens are valid
+	IDTokenTTL time.Duration
+}
+
+// AuthorizationRequest is an authorization request, as defined on:
+// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+type AuthorizationRequest struct {
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// TokenRequest is a token request using an authorization code, as defined on:
+// https://openid.net/specs/openid-connect-core-1_0.html#TokenRequest
+type TokenRequest struct {
+	ClientID     string
+	ClientSecret string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+}
+
+// TokenResponse is the result of a successful token request
+type TokenResponse struct {
+	AccessToken string
+	ExpiresIn   time.Duration
+	IDToken     string
+	Scope       string
+}
+
+// IDTokenClaims are the claims of ID tokens, as defined on:
+// https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+// The subject and the other claims about the user are on UserInfo.
+type IDTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	AuthTime  int64  `json:"auth_time"`
+	Nonce     string `json:"nonce,omitempty"`
+	UserInfo
+}
+
+// UserInfo are the standard claims about an user, as defined on:
+// https://openid.net/specs/openid-connect-core-1_0.html#StandardClaims
+type UserInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+}
+
+// Provider is an OpenID Connect provider
+type Provider struct {
+	users   UsersManager
+	clients Clients
+	tokens  Tokens
+	codes   Codes
+	keys    *auth.KeyRing
+	cfg     Config
+}
+
+type codeRecord struct {
+	ClientID      string `json:"client_id"`
+	RedirectURI   string `json:"redirect_uri"`
+	UserID        string `json:"user_id"`
+	Scope         string `json:"scope"`
+	Nonce         string `json:"nonce"`
+	CodeChallenge string `json:"code_challenge"`
+	AuthTime      int64  `json:"auth_time"`
+}
+
+// New creates a new Provider. ID tokens are signed using
+// the signing key of the given key ring.
+func New(u UsersManager, c Clients, t Tokens, codes Codes, keys *auth.KeyRing, cfg Config) *Provider {
+	return &Provider{
+		users:   u,
+		clients: c,
+		tokens:  t,
+		codes:   codes,
+		keys:    keys,
+		cfg:     cfg,
+	}
+}
+
+// Issuer is the issuer URL of the provider
+func (p *Provider) Issuer() string {
+	return p.cfg.Issuer
+}
+
+// ValidateClient validates the client and the redirect URI of the request.
+// If it fails the user must not be redirected, since the redirect URI
+// can't be trusted. The following errors can be expected to be wrapped
+// in the returned error giving specific conditions:
+//
+// - If the client is not registered: oauth.InvalidClientErr
+// - If the redirect URI is not registered for the client: oauth.InvalidRedirectURIErr
+//
+// All other errors are to be considered internal errors.
+func (p *Provider) ValidateClient(ctx context.Context, req AuthorizationRequest) (oauth.Client, error) {
+	client, err := p.clients.Client(ctx, req.ClientID)
+	if err != nil {
+		if errors.Is(err, oauth.ClientNotFoundErr) {
+			return oauth.Client{}, fmt.Errorf("%w:%v", oauth.InvalidClientErr, err)
+		}
+		return oauth.Client{}, err
+	}
+	if !client.HasRedirectURI(req.RedirectURI) {
+		return oauth.Client{}, fmt.Errorf("%w:%q", oauth.InvalidRedirectURIErr, req.RedirectURI)
+	}
+	return client, nil
+}
+
+// ValidateRequest validates the parameters of the request, besides
+// the client and redirect URI (see ValidateClient). Errors are reported
+// to the client by redirecting the user back to it.
+// The following errors can be expected giving specific conditions:
+//
+// - If the response type is not code: oauth.UnsupportedResponseTypeErr
+// - If the scope lacks openid or has unknown scopes: oauth.InvalidScopeErr
+// - If the PKCE code challenge is missing or invalid: oauth.InvalidRequestErr
+func (p *Provider) ValidateRequest(req AuthorizationRequest) error {
+	if req.ResponseType != CodeResponseType {
+		return fmt.Errorf("%w:%q", oauth.UnsupportedResponseTypeErr, req.ResponseType)
+	}
+
+	scopes := strings.Fields(req.Scope)
+	if !contains(scopes, OpenIDScope) {
+		return fmt.Errorf("%w:missing %q scope", oauth.InvalidScopeErr, OpenIDScope)
+	}
+	for _, scope := range scopes {
+		if !contains(SupportedScopes, scope) {
+			return fmt.Errorf("%w:unknown scope %q", oauth.InvalidScopeErr, scope)
+		}
+	}
+
+	// WHY: PKCE is required for all clients, as recommended on:
+	// https://tools.ietf.org/html/draft-ietf-oauth-security-topics-15#section-2.1.1
+	// The plain method is not allowed since it offers no protection
+	// if the authorization request is intercepted.
+	if req.CodeChallengeMethod != S256ChallengeMethod {
+		return fmt.Errorf("%w:code challenge method must be %q", oauth.InvalidRequestErr, S256ChallengeMethod)
+	}
+	if !pkceParam.MatchString(req.CodeChallenge) {
+		return fmt.Errorf("%w:invalid code challenge", oauth.InvalidRequestErr)
+	}
+	return nil
+}
+
+// Authorize creates an authorization code for the given request, which
+// must be called only after the user with the given ID authenticated.
+// The request is validated again, returning the same errors of
+// ValidateClient and ValidateRequest.
+func (p *Provider) Authorize(ctx context.Context, req AuthorizationRequest, userID string) (string, error) {
+	if _, err := p.ValidateClient(ctx, req); err != nil {
+		return "", err
+	}
+	if err := p.ValidateRequest(req); err != nil {
+		return "", err
+	}
+
+	record, err := json.Marshal(codeRecord{
+		ClientID:      req.ClientID,
+		RedirectURI:   req.RedirectURI,
+		UserID:        userID,
+		Scope:         req.Scope,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		AuthTime:      time.Now().Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error serializing authorization code record:%v", err)
+	}
+	return p.codes.Create(ctx, string(record))
+}
+
+// Exchange exchanges an authorization code for access and ID tokens.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the client can't be identified: oauth.InvalidClientErr
+// - If the code or the code verifier is invalid: oauth.InvalidGrantErr
+// - If the user is not allowed to access the service: oauth.InvalidGrantErr
+//
+// All other errors are to be considered internal errors.
+func (p *Provider) Exchange(ctx context.Context, req TokenRequest) (TokenResponse, error) {
+	client, err := p.clients.Identify(ctx, req.ClientID, req.ClientSecret)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	val, err := p.codes.Consume(ctx, req.Code)
+	if err != nil {
+		if errors.Is(err, auth.InvalidTokenErr) {
+			return TokenResponse{}, fmt.Errorf("%w:%v", oauth.InvalidGrantErr, err)
+		}
+		return TokenResponse{}, err
+	}
+
+	record := codeRecord{}
+	if err := json.Unmarshal([]byte(val), &record); err != nil {
+		return TokenResponse{}, fmt.Errorf("error parsing authorization code record:%v", err)
+	}
+
+	if record.ClientID != client.ID {
+		return TokenResponse{}, fmt.Errorf("%w:code issued to another client", oauth.InvalidGrantErr)
+	}
+	if record.RedirectURI != req.RedirectURI {
+		return TokenResponse{}, fmt.Errorf("%w:redirect URI mismatch", oauth.InvalidGrantErr)
+	}
+	if !verifyCodeChallenge(record.CodeChallenge, req.CodeVerifier) {
+		return TokenResponse{}, fmt.Errorf("%w:code verifier mismatch", oauth.InvalidGrantErr)
+	}
+
+	user, err := p.activeUser(ctx, record.UserID)
+	if err != nil {
+		if errors.Is(err, users.UserNotFoundErr) ||
+			errors.Is(err, users.UserSuspendedErr) ||
+			errors.Is(err, users.UserLockedErr) {
+			return TokenResponse{}, fmt.Errorf("%w:%v", oauth.InvalidGrantErr, err)
+		}
+		return TokenResponse{}, err
+	}
+
+	// WHY: relying parties only get the granted scopes, which don't
+	// include any permission to manage users on this service.
+	token, err := p.tokens.CreateDelegatedToken(ctx, user.ID, client.ID, strings.Fields(record.Scope))
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	now := time.Now()
+	idToken, err := p.keys.SignJWT(IDTokenClaims{
+		Issuer:    p.cfg.Issuer,
+		Audience:  client.ID,
+		ExpiresAt: now.Add(p.cfg.IDTokenTTL).Unix(),
+		IssuedAt:  now.Unix(),
+		AuthTime:  record.AuthTime,
+		Nonce:     record.Nonce,
+		UserInfo:  newUserInfo(user, record.Scope),
+	})
+	if err != nil {
+		return TokenResponse{}, fmt.Errorf("error signing ID token:%v", err)
+	}
+
+	return TokenResponse{
+		AccessToken: token.AccessToken,
+		ExpiresIn:   token.ExpiresIn,
+		IDToken:     idToken,
+		Scope:       record.Scope,
+	}, nil
+}
+
+// UserInfo returns the claims about the user that owns the given access
+// token, limited to the scopes of the token. If the token is invalid, is
+// not owned by an user, lacks the openid scope or the user is not allowed
+// to access the service anymore it returns auth.InvalidTokenErr.
+func (p *Provider) UserInfo(ctx context.Context, accessToken string) (UserInfo, error) {
+	info, err := p.tokens.Introspect(ctx, accessToken)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	if info.UserID == "" {
+		return UserInfo{}, fmt.Errorf("%w:token owned by client %q", auth.InvalidTokenErr, info.ClientID)
+	}
+
+	// WHY: tokens of sign ins are not bound to scopes, so they
+	// have all claims of the supported scopes.
+	scope := strings.Join(SupportedScopes, " ")
+	if len(info.Scopes) > 0 {
+		if !contains(info.Scopes, OpenIDScope) {
+			return UserInfo{}, fmt.Errorf("%w:token lacks scope %q", auth.InvalidTokenErr, OpenIDScope)
+		}
+		scope = strings.Join(info.Scopes, " ")
+	}
+
+	user, err := p.activeUser(ctx, info.UserID)
+	if err != nil {
+		if errors.Is(err, users.UserNotFoundErr) ||
+			errors.Is(err, users.UserSuspendedErr) ||
+			errors.Is(err, users.UserLockedErr) {
+			return UserInfo{}, fmt.Errorf("%w:%v", auth.InvalidTokenErr, err)
+		}
+		return UserInfo{}, err
+	}
+
+	return newUserInfo(user, scope), nil
+}
+
+func (p *Provider) activeUser(ctx context.Context, userID string) (users.User, error) {
+	user, err := p.users.User(ctx, userID)
+	if err != nil {
+		return users.User{}, err
+	}
+	if err := user.Status.CheckAccess(); err != nil {
+		return users.User{}, err
+	}
+	return user, nil
+}
+
+func newUserInfo(user users.User, scope string) UserInfo {
+	scopes := strings.Fields(scope)
+	info := UserInfo{Subject: user.ID}
+
+	if contains(scopes, EmailScope) {
+		info.Email = string(user.Email)
+		info.EmailVerified = user.Status != users.PendingVerificationStatus
+	}
+	if contains(scopes, ProfileScope) {
+		info.Name = user.FullName
+	}
+	return info
+}
+
+// pkceParam validates code challenges and verifiers, as defined on:
+// https://tools.ietf.org/html/rfc7636#section-4.1
+var pkceParam = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+func verifyCodeChallenge(challenge string, verifier string) bool {
+	if !pkceParam.MatchString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func contains(vals []string, val string) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
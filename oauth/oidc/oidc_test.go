@@ -0,0 +1,471 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/kvstore"
+	"github.com/katcipis/stonks/oauth"
+	"github.com/katcipis/stonks/oauth/clients"
+	"github.com/katcipis/stonks/oauth/oidc"
+	"github.com/katcipis/stonks/users"
+)
+
+const (
+	issuer         = "https://id.stonks.test"
+	redirectURI    = "https://app.stonks.test/callback"
+	publicID       = "public-app"
+	confidentialID = "confidential-app"
+	clientSecret   = "confidential secret"
+	userID         = "42"
+)
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	f := newFixture(t)
+	defer f.close()
+
+	ctx := context.Background()
+	verifier, challenge := newPKCE(t)
+
+	req := f.authorizationRequest(publicID, challenge)
+	req.Nonce = "some nonce"
+
+	code, err := f.provider.Authorize(ctx, req, userID)
+	assertNoErr(t, err)
+
+	res, err := f.provider.Exchange(ctx, oidc.TokenRequest{
+		ClientID:     publicID,
+		Code:         code,
+		RedirectURI:  redirectURI,
+		CodeVerifier: verifier,
+	})
+	assertNoErr(t, err)
+
+	if res.Scope != req.Scope || res.ExpiresIn != time.Hour {
+		t.Fatalf("got token response %+v", res)
+	}
+
+	claims := verifyIDToken(t, f.publicKey, res.IDToken)
+	want := oidc.IDTokenClaims{
+		Issuer:    issuer,
+		Audience:  publicID,
+		ExpiresAt: claims.IssuedAt + int64((10 * time.Minute).Seconds()),
+		IssuedAt:  claims.IssuedAt,
+		AuthTime:  claims.AuthTime,
+		Nonce:     "some nonce",
+		UserInfo: oidc.UserInfo{
+			Subject:       userID,
+			Email:         "oidc@stonks.test",
+			EmailVerified: true,
+			Name:          "OIDC User",
+		},
+	}
+	if claims != want {
+		t.Fatalf("got ID token claims %+v want %+v", claims, want)
+	}
+	if claims.AuthTime == 0 || claims.AuthTime > claims.IssuedAt {
+		t.Fatalf("invalid auth time on ID token claims %+v", claims)
+	}
+
+	info, err := f.provider.UserInfo(ctx, res.AccessToken)
+	assertNoErr(t, err)
+
+	if info != want.UserInfo {
+		t.Fatalf("got user info %+v want %+v", info, want.UserInfo)
+	}
+
+	// Access tokens are restricted to the granted scopes
+	tokenInfo, err := f.tokens.Introspect(ctx, res.AccessToken)
+	assertNoErr(t, err)
+
+	if tokenInfo.UserID != userID || tokenInfo.ClientID != publicID || strings.Join(tokenInfo.Scopes, " ") != req.Scope {
+		t.Fatalf("got access token info %+v", tokenInfo)
+	}
+
+	// Codes can be used only once
+	_, err = f.provider.Exchange(ctx, oidc.TokenRequest{
+		ClientID:     publicID,
+		Code:         code,
+		RedirectURI:  redirectURI,
+		CodeVerifier: verifier,
+	})
+	if !errors.Is(err, oauth.InvalidGrantErr) {
+		t.Fatalf("got err[%v] want[%v]", err, oauth.InvalidGrantErr)
+	}
+}
+
+func TestIDTokenClaimsDependOnScope(t *testing.T) {
+	f := newFixture(t)
+	defer f.close()
+
+	ctx := context.Background()
+	verifier, challenge := newPKCE(t)
+
+	req := f.authorizationRequest(confidentialID, challenge)
+	req.Scope = "openid"
+
+	code, err := f.provider.Authorize(ctx, req, userID)
+	assertNoErr(t, err)
+
+	res, err := f.provider.Exchange(ctx, oidc.TokenRequest{
+		ClientID:     confidentialID,
+		ClientSecret: clientSecret,
+		Code:         code,
+		RedirectURI:  redirectURI,
+		CodeVerifier: verifier,
+	})
+	assertNoErr(t, err)
+
+	claims := verifyIDToken(t, f.publicKey, res.IDToken)
+	if claims.UserInfo != (oidc.UserInfo{Subject: userID}) {
+		t.Fatalf("got user claims %+v with only openid scope", claims.UserInfo)
+	}
+
+	info, err := f.provider.UserInfo(ctx, res.AccessToken)
+	assertNoErr(t, err)
+
+	if info != (oidc.UserInfo{Subject: userID}) {
+		t.Fatalf("got user info %+v with only openid scope", info)
+	}
+}
+
+func TestUserInfoRequiresUserTokens(t *testing.T) {
+	f := newFixture(t)
+	defer f.close()
+
+	ctx := context.Background()
+
+	clientToken, err := f.tokens.CreateClientToken(ctx, confidentialID, []string{"users:read"})
+	assertNoErr(t, err)
+
+	_, err = f.provider.UserInfo(ctx, clientToken.AccessToken)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+
+	withoutOpenID, err := f.tokens.CreateDelegatedToken(ctx, userID, confidentialID, []string{"profile"})
+	assertNoErr(t, err)
+
+	_, err = f.provider.UserInfo(ctx, withoutOpenID.AccessToken)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+func TestInvalidAuthorizationRequests(t *testing.T) {
+	_, challenge := newPKCE(t)
+
+	type Test struct {
+		name    string
+		change  func(*oidc.AuthorizationRequest)
+		wantErr error
+	}
+
+	tests := []Test{
+		{
+			name:    "UnknownClient",
+			change:  func(r *oidc.AuthorizationRequest) { r.ClientID = "unknown" },
+			wantErr: oauth.InvalidClientErr,
+		},
+		{
+			name:    "UnregisteredRedirectURI",
+			change:  func(r *oidc.AuthorizationRequest) { r.RedirectURI = "https://evil.test/callback" },
+			wantErr: oauth.InvalidRedirectURIErr,
+		},
+		{
+			name:    "UnsupportedResponseType",
+			change:  func(r *oidc.AuthorizationRequest) { r.ResponseType = "token" },
+			wantErr: oauth.UnsupportedResponseTypeErr,
+		},
+		{
+			name:    "MissingOpenIDScope",
+			change:  func(r *oidc.AuthorizationRequest) { r.Scope = "email profile" },
+			wantErr: oauth.InvalidScopeErr,
+		},
+		{
+			name:    "UnknownScope",
+			change:  func(r *oidc.AuthorizationRequest) { r.Scope = "openid admin" },
+			wantErr: oauth.InvalidScopeErr,
+		},
+		{
+			name:    "MissingCodeChallenge",
+			change:  func(r *oidc.AuthorizationRequest) { r.CodeChallenge = "" },
+			wantErr: oauth.InvalidRequestErr,
+		},
+		{
+			name:    "PlainCodeChallengeMethod",
+			change:  func(r *oidc.AuthorizationRequest) { r.CodeChallengeMethod = "plain" },
+			wantErr: oauth.InvalidRequestErr,
+		},
+		{
+			name:    "InvalidCodeChallenge",
+			change:  func(r *oidc.AuthorizationRequest) { r.CodeChallenge = "too short" },
+			wantErr: oauth.InvalidRequestErr,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t)
+			defer f.close()
+
+			req := f.authorizationRequest(publicID, challenge)
+			test.change(&req)
+
+			_, err := f.provider.Authorize(context.Background(), req, userID)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got err[%v] want[%v]", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestInvalidTokenRequests(t *testing.T) {
+	verifier, challenge := newPKCE(t)
+	otherVerifier, _ := newPKCE(t)
+
+	type Test struct {
+		name    string
+		change  func(*oidc.TokenRequest)
+		wantErr error
+	}
+
+	tests := []Test{
+		{
+			name:    "WrongCodeVerifier",
+			change:  func(r *oidc.TokenRequest) { r.CodeVerifier = otherVerifier },
+			wantErr: oauth.InvalidGrantErr,
+		},
+		{
+			name:    "MissingCodeVerifier",
+			change:  func(r *oidc.TokenRequest) { r.CodeVerifier = "" },
+			wantErr: oauth.InvalidGrantErr,
+		},
+		{
+			name:    "WrongRedirectURI",
+			change:  func(r *oidc.TokenRequest) { r.RedirectURI = "https://app.stonks.test/other" },
+			wantErr: oauth.InvalidGrantErr,
+		},
+		{
+			name:    "InvalidCode",
+			change:  func(r *oidc.TokenRequest) { r.Code = "invalid" },
+			wantErr: oauth.InvalidGrantErr,
+		},
+		{
+			name: "CodeIssuedToAnotherClient",
+			change: func(r *oidc.TokenRequest) {
+				r.ClientID = confidentialID
+				r.ClientSecret = clientSecret
+			},
+			wantErr: oauth.InvalidGrantErr,
+		},
+		{
+			name:    "PublicClientWithSecret",
+			change:  func(r *oidc.TokenRequest) { r.ClientSecret = "secret" },
+			wantErr: oauth.InvalidClientErr,
+		},
+		{
+			name:    "UnknownClient",
+			change:  func(r *oidc.TokenRequest) { r.ClientID = "unknown" },
+			wantErr: oauth.InvalidClientErr,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t)
+			defer f.close()
+
+			ctx := context.Background()
+			code, err := f.provider.Authorize(ctx, f.authorizationRequest(publicID, challenge), userID)
+			assertNoErr(t, err)
+
+			req := oidc.TokenRequest{
+				ClientID:     publicID,
+				Code:         code,
+				RedirectURI:  redirectURI,
+				CodeVerifier: verifier,
+			}
+			test.change(&req)
+
+			_, err = f.provider.Exchange(ctx, req)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got err[%v] want[%v]", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestSuspendedUsersCantObtainTokens(t *testing.T) {
+	f := newFixture(t)
+	defer f.close()
+
+	ctx := context.Background()
+	verifier, challenge := newPKCE(t)
+
+	code, err := f.provider.Authorize(ctx, f.authorizationRequest(publicID, challenge), userID)
+	assertNoErr(t, err)
+
+	token, err := f.tokens.Create(ctx, userID)
+	assertNoErr(t, err)
+
+	f.users[userID] = users.User{ID: userID, Status: users.SuspendedStatus}
+
+	_, err = f.provider.Exchange(ctx, oidc.TokenRequest{
+		ClientID:     publicID,
+		Code:         code,
+		RedirectURI:  redirectURI,
+		CodeVerifier: verifier,
+	})
+	if !errors.Is(err, oauth.InvalidGrantErr) {
+		t.Fatalf("got err[%v] want[%v]", err, oauth.InvalidGrantErr)
+	}
+
+	_, err = f.provider.UserInfo(ctx, token.AccessToken)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err[%v] want[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+type fixture struct {
+	redis     *miniredis.Miniredis
+	users     usersManager
+	tokens    *auth.Tokens
+	provider  *oidc.Provider
+	publicKey ed25519.PublicKey
+}
+
+func newFixture(t *testing.T) fixture {
+	t.Helper()
+
+	m, err := miniredis.Run()
+	assertNoErr(t, err)
+
+	authorizer := auth.New()
+	secretHash, err := authorizer.PasswordHash(clientSecret)
+	assertNoErr(t, err)
+
+	registered := clientsStore{
+		publicID:       {ID: publicID, RedirectURIs: []string{redirectURI}},
+		confidentialID: {ID: confidentialID, SecretHash: secretHash, RedirectURIs: []string{redirectURI}},
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assertNoErr(t, err)
+
+	keys, err := auth.NewKeyRing(auth.SigningKey{ID: "key", Signer: privateKey})
+	assertNoErr(t, err)
+
+	store := kvstore.New(m.Addr(), "")
+	tokens := auth.NewTokens(store, time.Hour)
+	codes := auth.NewOneTimeTokens(store, "authorization-code", time.Minute)
+	registeredUsers := usersManager{
+		userID: {
+			ID:       userID,
+			Email:    "oidc@stonks.test",
+			FullName: "OIDC User",
+			Status:   users.ActiveStatus,
+		},
+	}
+
+	provider := oidc.New(registeredUsers, clients.New(authorizer, registered), tokens, codes, keys, oidc.Config{
+		Issuer:     issuer,
+		IDTokenTTL: 10 * time.Minute,
+	})
+
+	return fixture{
+		redis:     m,
+		users:     registeredUsers,
+		tokens:    tokens,
+		provider:  provider,
+		publicKey: publicKey,
+	}
+}
+
+func (f fixture) authorizationRequest(clientID string, challenge string) oidc.AuthorizationRequest {
+	return oidc.AuthorizationRequest{
+		ClientID:            clientID,
+		RedirectURI:         redirectURI,
+		ResponseType:        oidc.CodeResponseType,
+		Scope:               "openid email profile",
+		State:               "some state",
+		CodeChallenge:       challenge,
+		CodeChallengeMethod: oidc.S256ChallengeMethod,
+	}
+}
+
+func (f fixture) close() {
+	f.redis.Close()
+}
+
+type usersManager map[string]users.User
+
+func (m usersManager) User(ctx context.Context, id string) (users.User, error) {
+	user, ok := m[id]
+	if !ok {
+		return users.User{}, users.UserNotFoundErr
+	}
+	return user, nil
+}
+
+type clientsStore map[string]oauth.Client
+
+func (s clientsStore) Client(ctx context.Context, id string) (oauth.Client, error) {
+	client, ok := s[id]
+	if !ok {
+		return oauth.Client{}, oauth.ClientNotFoundErr
+	}
+	return client, nil
+}
+
+func newPKCE(t *testing.T) (string, string) {
+	t.Helper()
+
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	assertNoErr(t, err)
+
+	verifier := base64.RawURLEncoding.EncodeToString(random)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func verifyIDToken(t *testing.T, key ed25519.PublicKey, token string) oidc.IDTokenClaims {
+	t.Helper()
+
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		t.Fatalf("ID token %q is not a JWT", token)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	assertNoErr(t, err)
+
+	if !ed25519.Verify(key, []byte(segments[0]+"."+segments[1]), signature) {
+		t.Fatalf("invalid signature on ID token %q", token)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(segments[1])
+	assertNoErr(t, err)
+
+	claims := oidc.IDTokenClaims{}
+	assertNoErr(t, json.Unmarshal(payload, &claims))
+	return claims
+}
+
+func assertNoErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// InMemory is a store that keeps counters in memory, so limits are not
+// shared with other processes. It is useful as a fallback when the
+// shared store is unavailable and for tests.
+type InMemory struct {
+	mutex     sync.Mutex
+	counters  map[string]counter
+	lastSweep time.Time
+}
+
+type counter struct {
+	val       int64
+	expiresAt time.Time
+}
+
+// sweepInterval is how often expired counters are removed
+const sweepInterval = time.Minute
+
+// NewInMemory creates a new InMemory store
+func NewInMemory() *InMemory {
+	return &InMemory{
+		counters:  map[string]counter{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Incr increments the counter stored at key, returning its new value
+func (s *InMemory) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	c, ok := s.counters[key]
+	if !ok || now.After(c.expiresAt) {
+		c = counter{}
+	}
+	c.val++
+	c.expiresAt = now.Add(ttl)
+	s.counters[key] = c
+	return c.val, nil
+}
+
+// Counter retrieves the value of the counter stored at key
+func (s *InMemory) Counter(ctx context.Context, key string) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, ok := s.counters[key]
+	if !ok || time.Now().After(c.expiresAt) {
+		return 0, nil
+	}
+	return c.val, nil
+}
+
+// sweep removes the expired counters, so counters of clients
+// that stopped doing requests don't keep using memory.
+func (s *InMemory) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	for key, c := range s.counters {
+		if now.After(c.expiresAt) {
+			delete(s.counters, key)
+		}
+	}
+	s.lastSweep = now
+}
@@ -0,0 +1,122 @@
+// Package ratelimit is responsible for limiting how many requests
+// clients can do on a period of time.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Store is where the request counters are stored. When it is shared
+// by multiple processes the limits are also shared by them.
+type Store interface {
+	// Incr increments the counter stored at key, returning its new value.
+	// Counters that don't exist are created with zero, the ttl of the
+	// counter MUST be reset to the given ttl.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+
+	// Counter retrieves the value of the counter stored at key,
+	// if the counter does not exist it MUST return zero.
+	Counter(ctx context.Context, key string) (int64, error)
+}
+
+// Policy limits the requests of a client to Limit requests per Window
+type Policy struct {
+	Limit  int64
+	Window time.Duration
+}
+
+// Enabled returns true if the policy limits requests
+func (p Policy) Enabled() bool {
+	return p.Limit > 0 && p.Window > 0
+}
+
+// Result is the result of a request being checked against a policy
+type Result struct {
+	Allowed bool
+	Limit   int64
+
+	// Remaining is how many requests are still allowed on the window
+	Remaining int64
+
+	// Reset is how long until the current window ends
+	Reset time.Duration
+
+	// RetryAfter is how long until requests are allowed
+	// again, it is only set if the request is not allowed.
+	RetryAfter time.Duration
+}
+
+// Limiter limits requests using a sliding window counter, which
+// approximates a sliding window by weighting the counter of the
+// previous fixed window by how much it overlaps with the sliding window.
+type Limiter struct {
+	store Store
+}
+
+// New creates a new Limiter that keeps counters on the given store
+func New(store Store) *Limiter {
+	return &Limiter{store: store}
+}
+
+// Allow counts a request done at the given time by the client identified by
+// key, returning if it is allowed by the policy. Requests that are not allowed
+// are also counted, so clients must respect the RetryAfter of the result.
+// The policy must be enabled. Errors are only returned if the store fails.
+func (l *Limiter) Allow(ctx context.Context, key string, p Policy, at time.Time) (Result, error) {
+	window := at.UnixNano() / int64(p.Window)
+	elapsed := at.Sub(time.Unix(0, window*int64(p.Window)))
+
+	// WHY: counters must live until the end of the next window,
+	// where they are used as the previous window counter.
+	count, err := l.store.Incr(ctx, counterKey(key, window), 2*p.Window)
+	if err != nil {
+		return Result{}, fmt.Errorf("error incrementing rate limit counter:%v", err)
+	}
+	prev, err := l.store.Counter(ctx, counterKey(key, window-1))
+	if err != nil {
+		return Result{}, fmt.Errorf("error retrieving rate limit counter:%v", err)
+	}
+
+	overlap := float64(p.Window-elapsed) / float64(p.Window)
+	estimated := float64(prev)*overlap + float64(count)
+
+	res := Result{
+		Limit: p.Limit,
+		Reset: p.Window - elapsed,
+	}
+	if estimated <= float64(p.Limit) {
+		res.Allowed = true
+		res.Remaining = p.Limit - int64(math.Ceil(estimated))
+		return res, nil
+	}
+
+	res.RetryAfter = retryAfter(p, prev, count, elapsed)
+	return res, nil
+}
+
+// retryAfter calculates how long until the estimated count, including a
+// new request, is within the limit if no more requests are done.
+func retryAfter(p Policy, prev int64, count int64, elapsed time.Duration) time.Duration {
+	window := float64(p.Window)
+
+	if free := p.Limit - count - 1; free >= 0 && prev > 0 {
+		// Allowed on the current window when prev*(1-t/window) <= free
+		allowedAt := time.Duration(window * (1 - float64(free)/float64(prev)))
+		return allowedAt - elapsed
+	}
+
+	// Allowed on the next window, where count becomes the previous
+	// window counter, when count*(1-t/window) + 1 <= limit
+	allowedAt := time.Duration(window * (1 - float64(p.Limit-1)/float64(count)))
+	if allowedAt < 0 {
+		allowedAt = 0
+	}
+	return p.Window - elapsed + allowedAt
+}
+
+func counterKey(key string, window int64) string {
+	return fmt.Sprintf("rate-limit:%s:%d", key, window)
+}
@@ -0,0 +1,167 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/katcipis/stonks/auth/kvstore"
+	"github.com/katcipis/stonks/ratelimit"
+)
+
+func TestLimitWithinWindow(t *testing.T) {
+	testStores(t, func(t *testing.T, limiter *ratelimit.Limiter) {
+		policy := ratelimit.Policy{Limit: 3, Window: time.Minute}
+		at := windowStart(policy).Add(time.Second)
+
+		for remaining := int64(2); remaining >= 0; remaining-- {
+			res := allow(t, limiter, "client", policy, at)
+			assertResult(t, res, ratelimit.Result{
+				Allowed:   true,
+				Limit:     3,
+				Remaining: remaining,
+				Reset:     59 * time.Second,
+			})
+		}
+
+		res := allow(t, limiter, "client", policy, at)
+		// WHY: refused requests are also counted, so the 4 requests become
+		// the previous window, which weights 2 requests half way on it.
+		assertResult(t, res, ratelimit.Result{
+			Limit:      3,
+			Reset:      59 * time.Second,
+			RetryAfter: 59*time.Second + 30*time.Second,
+		})
+
+		// Each client has its own limit
+		res = allow(t, limiter, "another client", policy, at)
+		if !res.Allowed {
+			t.Fatalf("request of another client refused: %+v", res)
+		}
+	})
+}
+
+func TestLimitSlidingWindow(t *testing.T) {
+	testStores(t, func(t *testing.T, limiter *ratelimit.Limiter) {
+		policy := ratelimit.Policy{Limit: 10, Window: time.Minute}
+		start := windowStart(policy)
+
+		for i := 0; i < 10; i++ {
+			res := allow(t, limiter, "client", policy, start)
+			if !res.Allowed {
+				t.Fatalf("request %d refused: %+v", i, res)
+			}
+		}
+
+		// Half way on the next window only half of the
+		// requests of the previous window are counted.
+		at := start.Add(time.Minute + 30*time.Second)
+		for remaining := int64(4); remaining >= 0; remaining-- {
+			res := allow(t, limiter, "client", policy, at)
+			assertResult(t, res, ratelimit.Result{
+				Allowed:   true,
+				Limit:     10,
+				Remaining: remaining,
+				Reset:     30 * time.Second,
+			})
+		}
+
+		res := allow(t, limiter, "client", policy, at)
+		// WHY: with 6 requests counted on the current window the next
+		// one is allowed when the previous window weights 3 requests.
+		assertResult(t, res, ratelimit.Result{
+			Limit:      10,
+			Reset:      30 * time.Second,
+			RetryAfter: 12 * time.Second,
+		})
+
+		res = allow(t, limiter, "client", policy, at.Add(res.RetryAfter))
+		if !res.Allowed {
+			t.Fatalf("request after retry after refused: %+v", res)
+		}
+	})
+}
+
+func TestLimitRetryAfterOnNextWindow(t *testing.T) {
+	testStores(t, func(t *testing.T, limiter *ratelimit.Limiter) {
+		policy := ratelimit.Policy{Limit: 2, Window: time.Minute}
+		at := windowStart(policy).Add(10 * time.Second)
+
+		allow(t, limiter, "client", policy, at)
+		allow(t, limiter, "client", policy, at)
+
+		res := allow(t, limiter, "client", policy, at)
+		assertResult(t, res, ratelimit.Result{
+			Limit:      2,
+			Reset:      50 * time.Second,
+			RetryAfter: 50*time.Second + 40*time.Second,
+		})
+
+		res = allow(t, limiter, "client", policy, at.Add(res.RetryAfter-time.Second))
+		if res.Allowed {
+			t.Fatalf("request before retry after allowed: %+v", res)
+		}
+	})
+}
+
+func TestPolicyEnabled(t *testing.T) {
+	policies := map[ratelimit.Policy]bool{
+		{}:                             false,
+		{Limit: 10}:                    false,
+		{Window: time.Minute}:          false,
+		{Limit: 10, Window: time.Hour}: true,
+	}
+
+	for policy, want := range policies {
+		if got := policy.Enabled(); got != want {
+			t.Errorf("policy %+v: got enabled %t want %t", policy, got, want)
+		}
+	}
+}
+
+// testStores runs the test with limiters using each of the stores
+func testStores(t *testing.T, test func(*testing.T, *ratelimit.Limiter)) {
+	t.Helper()
+
+	t.Run("InMemory", func(t *testing.T) {
+		test(t, ratelimit.New(ratelimit.NewInMemory()))
+	})
+	t.Run("KVStore", func(t *testing.T) {
+		m, err := miniredis.Run()
+		assertNoErr(t, err)
+		defer m.Close()
+
+		test(t, ratelimit.New(kvstore.New(m.Addr(), "")))
+	})
+}
+
+// windowStart returns the start of a window of the policy
+func windowStart(p ratelimit.Policy) time.Time {
+	now := time.Now().UnixNano()
+	return time.Unix(0, now-now%int64(p.Window))
+}
+
+func allow(t *testing.T, limiter *ratelimit.Limiter, key string, p ratelimit.Policy, at time.Time) ratelimit.Result {
+	t.Helper()
+
+	res, err := limiter.Allow(context.Background(), key, p, at)
+	assertNoErr(t, err)
+	return res
+}
+
+func assertResult(t *testing.T, got ratelimit.Result, want ratelimit.Result) {
+	t.Helper()
+
+	if got != want {
+		t.Fatalf("got result %+v want %+v", got, want)
+	}
+}
+
+func assertNoErr(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
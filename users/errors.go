@@ -6,8 +6,18 @@ package users
 type Error string
 
 const (
-	InvalidUserParamErr  Error = "user has invalid param"
-	UserAlreadyExistsErr Error = "user already exists"
+	InvalidUserParamErr        Error = "user has invalid param"
+	UserAlreadyExistsErr       Error = "user already exists"
+	UserNotFoundErr            Error = "user not found"
+	InvalidCredentialsErr      Error = "invalid credentials"
+	InvalidListParamErr        Error = "invalid list param"
+	VersionMismatchErr         Error = "user version mismatch"
+	UserNotVerifiedErr         Error = "user email not verified"
+	UserSuspendedErr           Error = "user suspended"
+	UserLockedErr              Error = "user locked"
+	InvalidStatusTransitionErr Error = "invalid user status transition"
+	EmailMismatchErr           Error = "user email mismatch"
+	PasswordRehashErr          Error = "password rehash failed"
 )
 
 // Error returns the string representation of the error
@@ -0,0 +1,165 @@
+// Package magiclink is responsible for signing in users without a
+// password, using single use links sent to their email.
+package magiclink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/katcipis/stonks/mailer"
+	"github.com/katcipis/stonks/users"
+)
+
+// UsersManager is responsible for retrieving users
+type UsersManager interface {
+	// UserByEmail retrieves the user with the given email.
+	// The following errors MUST be returned (possibly wrapped)
+	// giving specific conditions:
+	//
+	// - If the email is invalid: users.InvalidUserParamErr
+	// - If the user does not exist: users.UserNotFoundErr
+	UserByEmail(ctx context.Context, email string) (users.User, error)
+
+	// SigninUser retrieves the user with the given ID, checking that the
+	// user can sign in. The following errors MUST be returned (possibly
+	// wrapped) giving specific conditions:
+	//
+	// - If the user does not exist: users.UserNotFoundErr
+	// - If the user can't sign in: users.UserNotVerifiedErr, users.UserSuspendedErr or users.UserLockedErr
+	SigninUser(ctx context.Context, id string) (users.User, error)
+}
+
+// Tokens is responsible for creating single use tokens
+type Tokens interface {
+	// Create creates a new single use token for the given subject
+	Create(ctx context.Context, subject string) (string, error)
+
+	// Consume validates the token returning its subject, after that the
+	// token is not valid anymore. If the token is invalid it MUST
+	// return auth.InvalidTokenErr (possibly wrapped).
+	Consume(ctx context.Context, token string) (string, error)
+}
+
+// Sender is responsible for sending email messages
+type Sender interface {
+	Send(ctx context.Context, msg mailer.Message) error
+}
+
+// Config has all configuration needed to sign in with magic links
+type Config struct {
+	// LinkURL is the URL of the page that confirms the sign in, the
+	// sign in token is added to it as the "token" query parameter.
+	// If empty only the token itself is sent to users.
+	LinkURL string
+}
+
+// MagicLink is responsible for signing in users with magic links
+type MagicLink struct {
+	usersManager UsersManager
+	tokens       Tokens
+	sender       Sender
+	cfg          Config
+}
+
+// New creates a new MagicLink. The tokens must be exclusively used
+// for magic links and they should be short lived, since anyone with
+// access to the email can use them to sign in.
+func New(m UsersManager, t Tokens, s Sender, cfg Config) *MagicLink {
+	return &MagicLink{
+		usersManager: m,
+		tokens:       t,
+		sender:       s,
+		cfg:          cfg,
+	}
+}
+
+// RequestLink sends a sign in link to the given email, if it belongs
+// to a registered user. If the email does not belong to any user
+// nothing is done and no error is returned, so callers can't
+// leak which emails are registered.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the email is invalid: users.InvalidUserParamErr
+//
+// All other errors are to be considered internal errors.
+func (l *MagicLink) RequestLink(ctx context.Context, email string) error {
+	user, err := l.usersManager.UserByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, users.UserNotFoundErr) {
+			return nil
+		}
+		return err
+	}
+
+	token, err := l.tokens.Create(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("error creating magic link token:%v", err)
+	}
+
+	body, err := l.linkBody(user, token)
+	if err != nil {
+		return err
+	}
+
+	err = l.sender.Send(ctx, mailer.Message{
+		To:      string(user.Email),
+		Subject: "Sign in link",
+		Body:    body,
+	})
+	if err != nil {
+		return fmt.Errorf("error sending magic link email:%v", err)
+	}
+	return nil
+}
+
+// Signin consumes the token sent on the magic link, returning the user
+// that requested it. Each token can be used only once.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the token is invalid, expired or already used: auth.InvalidTokenErr
+// - If the user does not exist anymore: users.UserNotFoundErr
+// - If verified emails are required and the user is pending verification: users.UserNotVerifiedErr
+// - If the user is suspended: users.UserSuspendedErr
+// - If the user is locked: users.UserLockedErr
+//
+// All other errors are to be considered internal errors.
+func (l *MagicLink) Signin(ctx context.Context, token string) (users.User, error) {
+	userID, err := l.tokens.Consume(ctx, token)
+	if err != nil {
+		return users.User{}, err
+	}
+
+	user, err := l.usersManager.SigninUser(ctx, userID)
+	if err != nil {
+		return users.User{}, fmt.Errorf("error signing in user %q with magic link:%w", userID, err)
+	}
+	return user, nil
+}
+
+func (l *MagicLink) linkBody(user users.User, token string) (string, error) {
+	link := token
+	if l.cfg.LinkURL != "" {
+		linkURL, err := url.Parse(l.cfg.LinkURL)
+		if err != nil {
+			return "", fmt.Errorf("invalid magic link URL %q:%v", l.cfg.LinkURL, err)
+		}
+		query := linkURL.Query()
+		query.Set("token", token)
+		linkURL.RawQuery = query.Encode()
+		link = linkURL.String()
+	}
+
+	return fmt.Sprintf(`Hi %s,
+
+A sign in link was requested for your account, to sign in use:
+
+%s
+
+The link expires in a few minutes and can be used only once.
+If you didn't request it just ignore this message.
+`, user.FullName, link), nil
+}
@@ -0,0 +1,262 @@
+package magiclink_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/kvstore"
+	"github.com/katcipis/stonks/mailer"
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/magiclink"
+)
+
+func TestMagicLinkSignin(t *testing.T) {
+	const (
+		userID  = "13"
+		email   = "magic@test.com"
+		linkURL = "https://stonks.com/magic?lang=en"
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	sender := mailer.NewInMemory()
+	l := newMagicLink(m, sender, linkURL, users.User{
+		ID:       userID,
+		Email:    email,
+		FullName: "Magic User",
+		Status:   users.ActiveStatus,
+	})
+	ctx := context.Background()
+
+	err := l.RequestLink(ctx, email)
+	assertNoErr(t, err)
+
+	msgs := sender.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages want 1", len(msgs))
+	}
+	if msgs[0].To != email {
+		t.Fatalf("got message to %q want %q", msgs[0].To, email)
+	}
+
+	token := parseLinkToken(t, msgs[0].Body)
+
+	user, err := l.Signin(ctx, token)
+	assertNoErr(t, err)
+
+	if user.ID != userID {
+		t.Fatalf("got user ID %q want %q", user.ID, userID)
+	}
+
+	_, err = l.Signin(ctx, token)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("reusing token: got err [%v] but want err[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+func TestMagicLinkUnknownEmail(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	sender := mailer.NewInMemory()
+	l := newMagicLink(m, sender, "")
+
+	err := l.RequestLink(context.Background(), "unknown@test.com")
+	assertNoErr(t, err)
+
+	if len(sender.Messages()) != 0 {
+		t.Fatalf("want no messages sent, got %v", sender.Messages())
+	}
+
+	err = l.RequestLink(context.Background(), "invalid")
+	if !errors.Is(err, users.InvalidUserParamErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidUserParamErr)
+	}
+}
+
+func TestMagicLinkInvalidToken(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	l := newMagicLink(m, mailer.NewInMemory(), "")
+
+	_, err := l.Signin(context.Background(), "invalid")
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+func TestMagicLinkExpiredToken(t *testing.T) {
+	const email = "magic@test.com"
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	sender := mailer.NewInMemory()
+	l := newMagicLink(m, sender, "https://stonks.com/magic?lang=en", users.User{
+		ID:     "1",
+		Email:  email,
+		Status: users.ActiveStatus,
+	})
+
+	assertNoErr(t, l.RequestLink(context.Background(), email))
+	token := parseLinkToken(t, sender.Messages()[0].Body)
+
+	m.FastForward(tokenTTL + time.Second)
+
+	_, err := l.Signin(context.Background(), token)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+func TestMagicLinkUserCantSignin(t *testing.T) {
+	statuses := map[users.Status]error{
+		users.SuspendedStatus: users.UserSuspendedErr,
+		users.LockedStatus:    users.UserLockedErr,
+	}
+
+	for status, wantErr := range statuses {
+		t.Run(string(status), func(t *testing.T) {
+			const email = "magic@test.com"
+
+			m := newTestRedis(t)
+			defer m.Close()
+
+			sender := mailer.NewInMemory()
+			l := newMagicLink(m, sender, "https://stonks.com/magic?lang=en", users.User{
+				ID:     "1",
+				Email:  email,
+				Status: status,
+			})
+
+			assertNoErr(t, l.RequestLink(context.Background(), email))
+			token := parseLinkToken(t, sender.Messages()[0].Body)
+
+			_, err := l.Signin(context.Background(), token)
+			if !errors.Is(err, wantErr) {
+				t.Fatalf("got err [%v] but want err[%v]", err, wantErr)
+			}
+		})
+	}
+}
+
+func TestMagicLinkFailsWhenSendingFails(t *testing.T) {
+	const email = "magic@test.com"
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	l := newMagicLink(m, explodingSender{}, "", users.User{ID: "1", Email: email})
+
+	err := l.RequestLink(context.Background(), email)
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
+const tokenTTL = 15 * time.Minute
+
+func newMagicLink(
+	m *miniredis.Miniredis,
+	sender magiclink.Sender,
+	linkURL string,
+	registered ...users.User,
+) *magiclink.MagicLink {
+	tokens := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "magic-link", tokenTTL)
+	return magiclink.New(newUsersManager(registered...), tokens, sender, magiclink.Config{
+		LinkURL: linkURL,
+	})
+}
+
+// usersManager is a simple in memory users manager used in tests
+type usersManager struct {
+	users map[users.Email]users.User
+}
+
+func newUsersManager(registered ...users.User) *usersManager {
+	m := &usersManager{users: map[users.Email]users.User{}}
+	for _, user := range registered {
+		m.users[user.Email] = user
+	}
+	return m
+}
+
+func (m *usersManager) UserByEmail(ctx context.Context, email string) (users.User, error) {
+	validEmail, err := users.ParseEmail(email)
+	if err != nil {
+		return users.User{}, users.InvalidUserParamErr
+	}
+	user, ok := m.users[validEmail]
+	if !ok {
+		return users.User{}, users.UserNotFoundErr
+	}
+	return user, nil
+}
+
+func (m *usersManager) SigninUser(ctx context.Context, id string) (users.User, error) {
+	for _, user := range m.users {
+		if user.ID != id {
+			continue
+		}
+		switch user.Status {
+		case users.SuspendedStatus:
+			return users.User{}, users.UserSuspendedErr
+		case users.LockedStatus:
+			return users.User{}, users.UserLockedErr
+		}
+		return user, nil
+	}
+	return users.User{}, users.UserNotFoundErr
+}
+
+type explodingSender struct{}
+
+func (explodingSender) Send(context.Context, mailer.Message) error {
+	return errors.New("injected error from explodingSender")
+}
+
+func parseLinkToken(t *testing.T, body string) string {
+	t.Helper()
+
+	link := regexp.MustCompile(`https://\S+`).FindString(body)
+	if link == "" {
+		t.Fatalf("magic link not found on message body:\n%s", body)
+	}
+
+	parsed, err := url.Parse(link)
+	assertNoErr(t, err)
+
+	if parsed.Query().Get("lang") != "en" {
+		t.Fatalf("magic link %q lost the original query", link)
+	}
+
+	token := parsed.Query().Get("token")
+	if token == "" {
+		t.Fatalf("magic link token not found on link %q", link)
+	}
+	return token
+}
+
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+
+	m, err := miniredis.Run()
+	assertNoErr(t, err)
+	return m
+}
+
+func assertNoErr(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,7 +4,11 @@ package manager
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"strconv"
+	"sync"
 
 	"github.com/katcipis/stonks/users"
 )
@@ -19,7 +23,79 @@ type UsersStore interface {
 	// - If the user already exists: users.UserAlreadyExistsErr
 	//
 	// All other errors are to be considered internal errors.
-	AddUser(ctx context.Context, email users.Email, fullname string, hashedPassword string) (string, error)
+	AddUser(ctx context.Context, email users.Email, fullname string, hashedPassword string, status users.Status) (string, error)
+
+	// UserByEmail retrieves the user with the given email.
+	// The following errors MUST be returned (possibly wrapped)
+	// giving specific conditions:
+	//
+	// - If the user does not exist: users.UserNotFoundErr
+	//
+	// All other errors are to be considered internal errors.
+	UserByEmail(ctx context.Context, email users.Email) (users.User, error)
+
+	// UserByID retrieves the user with the given ID.
+	// The following errors MUST be returned (possibly wrapped)
+	// giving specific conditions:
+	//
+	// - If the user does not exist: users.UserNotFoundErr
+	//
+	// All other errors are to be considered internal errors.
+	UserByID(ctx context.Context, id string) (users.User, error)
+
+	// ListUsers lists at most limit users ordered by ID in descending order.
+	// If afterID is not empty only users with an ID lesser than afterID
+	// are listed, otherwise the listing starts with the greatest ID.
+	// All errors are to be considered internal errors.
+	ListUsers(ctx context.Context, afterID string, limit int) ([]users.User, error)
+
+	// DeleteUser deletes the user with the given ID, deleted users
+	// MUST NOT be retrieved or updated by any other method.
+	// The following errors MUST be returned (possibly wrapped)
+	// giving specific conditions:
+	//
+	// - If the user does not exist: users.UserNotFoundErr
+	//
+	// All other errors are to be considered internal errors.
+	DeleteUser(ctx context.Context, id string) error
+
+	// UpdateUser updates the email, the fullname, the status and the status reason of the user with the
+	// ID user.ID, but only if its current version is user.Version.
+	// On success the updated user is returned, with its new version.
+	// The following errors MUST be returned (possibly wrapped)
+	// giving specific conditions:
+	//
+	// - If the user does not exist: users.UserNotFoundErr
+	// - If the user version doesn't match: users.VersionMismatchErr
+	// - If the email belongs to another user: users.UserAlreadyExistsErr
+	//
+	// All other errors are to be considered internal errors.
+	UpdateUser(ctx context.Context, user users.User) (users.User, error)
+
+	// UpdatePasswordHash updates the password hash of the user with the given ID.
+	// The following errors MUST be returned (possibly wrapped)
+	// giving specific conditions:
+	//
+	// - If the user does not exist: users.UserNotFoundErr
+	//
+	// All other errors are to be considered internal errors.
+	UpdatePasswordHash(ctx context.Context, id string, hashedPassword string) error
+
+	// ReplacePasswordHash updates the password hash of the user with the given ID,
+	// adding the replaced hash to the password history of the user. Only the
+	// historySize most recent hashes are kept on the history, zero clears it.
+	// The following errors MUST be returned (possibly wrapped)
+	// giving specific conditions:
+	//
+	// - If the user does not exist: users.UserNotFoundErr
+	//
+	// All other errors are to be considered internal errors.
+	ReplacePasswordHash(ctx context.Context, id string, hashedPassword string, historySize int) error
+
+	// PasswordHistory returns at most limit hashes from the password history
+	// of the user with the given ID, ordered from the most recent to the oldest.
+	// Unknown users have an empty history.
+	PasswordHistory(ctx context.Context, id string, limit int) ([]string, error)
 }
 
 // Authorizer is responsible for authorization and security related operations
@@ -27,8 +103,46 @@ type Authorizer interface {
 
 	// PasswordHash creates safe hashes from
 	// passwords, suitable for storage and comparison later
-	// using IsPasswordMatch.
+	// using HashMatchesPassword.
 	PasswordHash(pass string) (string, error)
+
+	// HashMatchesPassword checks if the hash created with
+	// PasswordHash matches the given plain text password.
+	HashMatchesPassword(hash string, password string) bool
+
+	// PasswordNeedsRehash returns true if the hash was created
+	// with an outdated scheme or parameters.
+	PasswordNeedsRehash(hash string) bool
+}
+
+// PasswordPolicy checks if passwords are strong enough to be used
+type PasswordPolicy interface {
+
+	// Check checks the password of the user with the given email and
+	// full name. If the password violates the policy it MUST return
+	// users.InvalidUserParamErr (possibly wrapped), preferably
+	// as a *users.PasswordPolicyError with the violated rules.
+	Check(password string, email string, fullname string) error
+}
+
+// MaxListLimit is the maximum amount of users that can be listed at once
+const MaxListLimit = 100
+
+// Config has all configuration needed by the manager, like
+// policies that may change between deployments.
+type Config struct {
+	// RequireVerifiedEmail makes authentication fail for users
+	// that didn't verify their email yet.
+	RequireVerifiedEmail bool
+
+	// PasswordPolicy is checked every time a password is set, if
+	// it is nil only empty passwords are rejected.
+	PasswordPolicy PasswordPolicy
+
+	// PasswordHistory is how many of the most recent passwords of a user,
+	// including the current one, can't be reused when the password is
+	// changed or reset. Zero allows reusing any password.
+	PasswordHistory int
 }
 
 // Manager is responsible for managing users, doing
@@ -38,18 +152,24 @@ type Authorizer interface {
 type Manager struct {
 	auth  Authorizer
 	store UsersStore
+	cfg   Config
+
+	dummyHashOnce sync.Once
+	dummyHash     string
 }
 
 // New creates a new users manager
-func New(a Authorizer, s UsersStore) *Manager {
+func New(a Authorizer, s UsersStore, cfg Config) *Manager {
 	return &Manager{
 		auth:  a,
 		store: s,
+		cfg:   cfg,
 	}
 }
 
 // Creates a new user, returning its ID in the case of success
-// or a non-nil error in the case of failure.
+// or a non-nil error in the case of failure. Users are created
+// pending verification, see VerifyUser.
 // The following errors can be expected to be wrapped in the returned
 // error giving specific conditions:
 //
@@ -68,10 +188,559 @@ func (m *Manager) CreateUser(ctx context.Context, email string, fullname string,
 	if err != nil {
 		return "", fmt.Errorf("%w:invalid email:%v", users.InvalidUserParamErr, err)
 	}
+	if err := m.checkPassword(password, validEmail, fullname); err != nil {
+		return "", err
+	}
 
 	hashed, err := m.auth.PasswordHash(password)
 	if err != nil {
 		return "", fmt.Errorf("error creating password hash:%v", err)
 	}
-	return m.store.AddUser(ctx, validEmail, fullname, hashed)
+	return m.store.AddUser(ctx, validEmail, fullname, hashed, users.PendingVerificationStatus)
+}
+
+// Authenticate checks the given credentials, returning the authenticated
+// user in the case of success or a non-nil error in the case of failure.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the email or the password is invalid: users.InvalidCredentialsErr
+// - If verified emails are required and the user is pending verification: users.UserNotVerifiedErr
+// - If the user is suspended: users.UserSuspendedErr
+// - If the user is locked: users.UserLockedErr
+// - If the outdated password hash of the user could not be upgraded: users.PasswordRehashErr
+//
+// When users.PasswordRehashErr is returned the user is still authenticated
+// and returned, the error is only informative and the upgrade is tried
+// again on the next authentication.
+// No distinction is made between an unknown email and a wrong password,
+// so callers can't leak which emails are registered.
+// All other errors are to be considered internal errors.
+func (m *Manager) Authenticate(ctx context.Context, email string, password string) (users.User, error) {
+	validEmail, err := users.ParseEmail(email)
+	if err != nil {
+		return users.User{}, fmt.Errorf("%w:invalid email:%v", users.InvalidCredentialsErr, err)
+	}
+
+	user, err := m.store.UserByEmail(ctx, validEmail)
+	if err != nil {
+		if errors.Is(err, users.UserNotFoundErr) {
+			// WHY: otherwise unknown emails would fail much faster
+			// than wrong passwords, leaking which emails are registered.
+			m.auth.HashMatchesPassword(m.dummyPasswordHash(), password)
+			return users.User{}, fmt.Errorf("%w:%v", users.InvalidCredentialsErr, err)
+		}
+		return users.User{}, fmt.Errorf("error retrieving user:%v", err)
+	}
+
+	if !m.auth.HashMatchesPassword(user.PasswordHash, password) {
+		return users.User{}, fmt.Errorf("%w:password mismatch", users.InvalidCredentialsErr)
+	}
+
+	// WHY: signing in is the only moment the plain text password is
+	// known, so outdated hashes are upgraded without resetting passwords.
+	// Failing to upgrade does not fail the sign in, the upgrade is
+	// just tried again on the next one.
+	rehashErr := m.rehashPassword(ctx, &user, password)
+
+	// WHY: checked only after the password, otherwise the
+	// status of any email could be discovered.
+	if err := m.checkSignin(user); err != nil {
+		return users.User{}, err
+	}
+	return user, rehashErr
+}
+
+// rehashPassword upgrades the password hash of the user if it is outdated,
+// returning users.PasswordRehashErr (wrapped) if it fails.
+func (m *Manager) rehashPassword(ctx context.Context, user *users.User, password string) error {
+	if !m.auth.PasswordNeedsRehash(user.PasswordHash) {
+		return nil
+	}
+	hashed, err := m.auth.PasswordHash(password)
+	if err != nil {
+		return fmt.Errorf("%w:user %s:error creating password hash:%v", users.PasswordRehashErr, user.ID, err)
+	}
+	if err := m.store.UpdatePasswordHash(ctx, user.ID, hashed); err != nil {
+		return fmt.Errorf("%w:user %s:error updating password hash:%v", users.PasswordRehashErr, user.ID, err)
+	}
+	user.PasswordHash = hashed
+	return nil
+}
+
+// dummyPasswordHash returns a password hash created with the current
+// scheme, to be compared when there is no user, taking as long as
+// comparing the hash of a real user. It is created only once, if
+// creating it fails the comparison is just faster.
+func (m *Manager) dummyPasswordHash() string {
+	m.dummyHashOnce.Do(func() {
+		if hashed, err := m.auth.PasswordHash("dummy password"); err == nil {
+			m.dummyHash = hashed
+		}
+	})
+	return m.dummyHash
+}
+
+// SigninUser retrieves the user with the given ID to sign in, checking
+// that the user can sign in just like Authenticate. It is used when the
+// user was authenticated without a password, like with a passkey.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the user does not exist: users.UserNotFoundErr
+// - If verified emails are required and the user is pending verification: users.UserNotVerifiedErr
+// - If the user is suspended: users.UserSuspendedErr
+// - If the user is locked: users.UserLockedErr
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) SigninUser(ctx context.Context, id string) (users.User, error) {
+	user, err := m.store.UserByID(ctx, id)
+	if err != nil {
+		return users.User{}, err
+	}
+	if err := m.checkSignin(user); err != nil {
+		return users.User{}, err
+	}
+	return user, nil
+}
+
+// checkSignin checks if the user status allows it to sign in
+func (m *Manager) checkSignin(user users.User) error {
+	if err := user.Status.CheckAccess(); err != nil {
+		return fmt.Errorf("%w:user %s", err, user.ID)
+	}
+	if m.cfg.RequireVerifiedEmail && user.Status == users.PendingVerificationStatus {
+		return fmt.Errorf("%w:user %s", users.UserNotVerifiedErr, user.ID)
+	}
+	return nil
+}
+
+// VerifyUser marks the user with the given ID as verified, the caller
+// is responsible for guaranteeing that the user owns the given email.
+// Verifying users that are not pending verification does nothing.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the user does not exist: users.UserNotFoundErr
+// - If the email is not the current email of the user: users.EmailMismatchErr
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) VerifyUser(ctx context.Context, id string, email string) error {
+	user, err := m.store.UserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	// WHY: the email may have changed after the verification was
+	// requested, verifying the old email says nothing about the new one.
+	if string(user.Email) != email {
+		return fmt.Errorf("%w:user %s email changed", users.EmailMismatchErr, id)
+	}
+	if user.Status != users.PendingVerificationStatus {
+		return nil
+	}
+
+	user.Status = users.ActiveStatus
+	_, err = m.store.UpdateUser(ctx, user)
+	return err
+}
+
+// UserByEmail retrieves the user with the given email.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the email is invalid: users.InvalidUserParamErr
+// - If the user does not exist: users.UserNotFoundErr
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) UserByEmail(ctx context.Context, email string) (users.User, error) {
+	validEmail, err := users.ParseEmail(email)
+	if err != nil {
+		return users.User{}, fmt.Errorf("%w:invalid email:%v", users.InvalidUserParamErr, err)
+	}
+	return m.store.UserByEmail(ctx, validEmail)
+}
+
+// User retrieves the user with the given ID.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the user does not exist: users.UserNotFoundErr
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) User(ctx context.Context, id string) (users.User, error) {
+	return m.store.UserByID(ctx, id)
+}
+
+// DeleteUser deletes the user with the given ID.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the user does not exist: users.UserNotFoundErr
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) DeleteUser(ctx context.Context, id string) error {
+	return m.store.DeleteUser(ctx, id)
+}
+
+// UpdateUser applies the given partial update to the user with the given ID.
+// The version must be the current version of the user, guaranteeing
+// that concurrent updates don't overwrite each other silently.
+// On success the updated user is returned, with its new version.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If any of the updated fields is invalid: users.InvalidUserParamErr
+// - If the user does not exist: users.UserNotFoundErr
+// - If the version is not the current one: users.VersionMismatchErr
+// - If the new email belongs to another user: users.UserAlreadyExistsErr
+// - If the email changes while the user is suspended or locked: users.InvalidStatusTransitionErr
+//
+// Changing the email of active users makes them pending verification
+// again, since the new email is not verified yet.
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) UpdateUser(ctx context.Context, id string, version int64, update users.UserUpdate) (users.User, error) {
+	if update.FullName == nil && update.Email == nil {
+		return users.User{}, fmt.Errorf("%w:no fields to update", users.InvalidUserParamErr)
+	}
+
+	user, err := m.store.UserByID(ctx, id)
+	if err != nil {
+		return users.User{}, err
+	}
+	if user.Version != version {
+		return users.User{}, fmt.Errorf("%w:got version %d but current is %d", users.VersionMismatchErr, version, user.Version)
+	}
+
+	if update.FullName != nil {
+		if *update.FullName == "" {
+			return users.User{}, fmt.Errorf("%w:empty name", users.InvalidUserParamErr)
+		}
+		user.FullName = *update.FullName
+	}
+	if update.Email != nil {
+		validEmail, err := users.ParseEmail(*update.Email)
+		if err != nil {
+			return users.User{}, fmt.Errorf("%w:invalid email:%v", users.InvalidUserParamErr, err)
+		}
+		if validEmail != user.Email {
+			switch user.Status {
+			case users.ActiveStatus:
+				user.Status = users.PendingVerificationStatus
+			case users.PendingVerificationStatus:
+			default:
+				// WHY: verifying the new email would lift the restriction
+				// of suspended or locked users, keeping it would leave
+				// the new email unverified.
+				return users.User{}, fmt.Errorf("%w:can't change the email of %q user", users.InvalidStatusTransitionErr, user.Status)
+			}
+		}
+		user.Email = validEmail
+	}
+
+	return m.store.UpdateUser(ctx, user)
+}
+
+// ChangeStatus changes the status of the user with the given ID, the reason
+// of the change is required and kept with the user. Only the transitions
+// allowed by users.Status.CanTransitionTo are possible.
+// On success the updated user is returned, with its new version.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the status is unknown or the reason is empty: users.InvalidUserParamErr
+// - If the user can't transition to the status: users.InvalidStatusTransitionErr
+// - If the user does not exist: users.UserNotFoundErr
+// - If the user was modified concurrently: users.VersionMismatchErr
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) ChangeStatus(ctx context.Context, id string, status users.Status, reason string) (users.User, error) {
+	if !status.Valid() {
+		return users.User{}, fmt.Errorf("%w:unknown status %q", users.InvalidUserParamErr, status)
+	}
+	if reason == "" {
+		return users.User{}, fmt.Errorf("%w:empty status reason", users.InvalidUserParamErr)
+	}
+
+	user, err := m.store.UserByID(ctx, id)
+	if err != nil {
+		return users.User{}, err
+	}
+	if !user.Status.CanTransitionTo(status) {
+		return users.User{}, fmt.Errorf("%w:from %q to %q", users.InvalidStatusTransitionErr, user.Status, status)
+	}
+
+	user.Status = status
+	user.StatusReason = reason
+	return m.store.UpdateUser(ctx, user)
+}
+
+// ReactivateUser reactivates the suspended user with the given ID, the
+// reason is required just like on ChangeStatus. Only suspended users can
+// be reactivated, locked users are unlocked with UnlockUser and users
+// pending verification must verify their email.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the reason is empty: users.InvalidUserParamErr
+// - If the user is not suspended: users.InvalidStatusTransitionErr
+// - If the user does not exist: users.UserNotFoundErr
+// - If the user was modified concurrently: users.VersionMismatchErr
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) ReactivateUser(ctx context.Context, id string, reason string) (users.User, error) {
+	return m.changeStatusFrom(ctx, id, users.SuspendedStatus, users.ActiveStatus, reason)
+}
+
+// LockUser locks the active user with the given ID for security reasons,
+// like a compromised account, until it is unlocked with UnlockUser.
+// The reason is required just like on ChangeStatus.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the reason is empty: users.InvalidUserParamErr
+// - If the user is not active: users.InvalidStatusTransitionErr
+// - If the user does not exist: users.UserNotFoundErr
+// - If the user was modified concurrently: users.VersionMismatchErr
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) LockUser(ctx context.Context, id string, reason string) (users.User, error) {
+	// WHY: only active users are locked, since unlocked users become
+	// active again, users pending verification would skip it.
+	return m.changeStatusFrom(ctx, id, users.ActiveStatus, users.LockedStatus, reason)
+}
+
+// UnlockUser unlocks the locked user with the given ID, which becomes
+// active again. The reason is required just like on ChangeStatus.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the reason is empty: users.InvalidUserParamErr
+// - If the user is not locked: users.InvalidStatusTransitionErr
+// - If the user does not exist: users.UserNotFoundErr
+// - If the user was modified concurrently: users.VersionMismatchErr
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) UnlockUser(ctx context.Context, id string, reason string) (users.User, error) {
+	return m.changeStatusFrom(ctx, id, users.LockedStatus, users.ActiveStatus, reason)
+}
+
+// changeStatusFrom changes the status of the user to the given status,
+// but only if the user currently has the from status.
+func (m *Manager) changeStatusFrom(ctx context.Context, id string, from users.Status, to users.Status, reason string) (users.User, error) {
+	if reason == "" {
+		return users.User{}, fmt.Errorf("%w:empty status reason", users.InvalidUserParamErr)
+	}
+
+	user, err := m.store.UserByID(ctx, id)
+	if err != nil {
+		return users.User{}, err
+	}
+	if user.Status != from {
+		return users.User{}, fmt.Errorf("%w:from %q to %q, only from %q", users.InvalidStatusTransitionErr, user.Status, to, from)
+	}
+
+	user.Status = to
+	user.StatusReason = reason
+	return m.store.UpdateUser(ctx, user)
+}
+
+// ChangePassword changes the password of the user with the given ID,
+// the current password of the user must be provided.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the new password is invalid: users.InvalidUserParamErr
+// - If the current password doesn't match: users.InvalidCredentialsErr
+// - If the user does not exist: users.UserNotFoundErr
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) ChangePassword(ctx context.Context, id string, currentPassword string, newPassword string) error {
+	if newPassword == "" {
+		return fmt.Errorf("%w:empty password", users.InvalidUserParamErr)
+	}
+
+	user, err := m.store.UserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if !m.auth.HashMatchesPassword(user.PasswordHash, currentPassword) {
+		return fmt.Errorf("%w:current password mismatch", users.InvalidCredentialsErr)
+	}
+	if err := m.checkNewPassword(ctx, user, newPassword); err != nil {
+		return err
+	}
+
+	return m.setPassword(ctx, user, newPassword)
+}
+
+// ResetPassword sets a new password for the user with the given ID,
+// without requiring the current one. The caller is responsible for
+// guaranteeing that the password reset was legitimately requested.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the new password is invalid: users.InvalidUserParamErr
+// - If the user does not exist: users.UserNotFoundErr
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) ResetPassword(ctx context.Context, id string, newPassword string) error {
+	if newPassword == "" {
+		return fmt.Errorf("%w:empty password", users.InvalidUserParamErr)
+	}
+
+	user, err := m.store.UserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := m.checkNewPassword(ctx, user, newPassword); err != nil {
+		return err
+	}
+
+	return m.setPassword(ctx, user, newPassword)
+}
+
+// CheckNewPassword checks if the password can be set as the new password
+// of the user with the given ID, according to the password policy and the
+// password history, without changing it. Useful to validate passwords before
+// consuming what authorizes the change, like password reset tokens.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the new password is invalid: users.InvalidUserParamErr
+// - If the user does not exist: users.UserNotFoundErr
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) CheckNewPassword(ctx context.Context, id string, newPassword string) error {
+	if newPassword == "" {
+		return fmt.Errorf("%w:empty password", users.InvalidUserParamErr)
+	}
+
+	user, err := m.store.UserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	return m.checkNewPassword(ctx, user, newPassword)
+}
+
+// ListUsers lists at most limit users ordered by ID in descending order.
+// The cursor is opaque and should be empty to start a new listing,
+// to list the next page of users use the returned cursor.
+// When there are no more users to list the returned cursor is empty.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the limit is invalid or the cursor is malformed: users.InvalidListParamErr
+//
+// All other errors are to be considered internal errors.
+func (m *Manager) ListUsers(ctx context.Context, limit int, cursor string) ([]users.User, string, error) {
+	if limit <= 0 || limit > MaxListLimit {
+		return nil, "", fmt.Errorf("%w:limit must be in the range [1,%d], got %d", users.InvalidListParamErr, MaxListLimit, limit)
+	}
+
+	afterID, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// WHY: fetching one extra user tells us if there is a next page,
+	// so clients don't need to do an extra request to find out
+	// that the listing is over.
+	listed, err := m.store.ListUsers(ctx, afterID, limit+1)
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing users:%v", err)
+	}
+
+	if len(listed) <= limit {
+		return listed, "", nil
+	}
+
+	listed = listed[:limit]
+	return listed, newCursor(listed[limit-1].ID), nil
+}
+
+func (m *Manager) checkPassword(password string, email users.Email, fullname string) error {
+	if m.cfg.PasswordPolicy == nil {
+		return nil
+	}
+	if err := m.cfg.PasswordPolicy.Check(password, string(email), fullname); err != nil {
+		if errors.Is(err, users.InvalidUserParamErr) {
+			return err
+		}
+		return fmt.Errorf("error checking password policy:%v", err)
+	}
+	return nil
+}
+
+func (m *Manager) checkNewPassword(ctx context.Context, user users.User, password string) error {
+	if err := m.checkPassword(password, user.Email, user.FullName); err != nil {
+		return err
+	}
+	return m.checkPasswordReuse(ctx, user, password)
+}
+
+func (m *Manager) setPassword(ctx context.Context, user users.User, password string) error {
+	hashed, err := m.auth.PasswordHash(password)
+	if err != nil {
+		return fmt.Errorf("error creating password hash:%v", err)
+	}
+
+	// WHY: the current password is part of the forbidden passwords
+	// but it is not on the history, so the history keeps one less.
+	historySize := 0
+	if m.cfg.PasswordHistory > 1 {
+		historySize = m.cfg.PasswordHistory - 1
+	}
+	return m.store.ReplacePasswordHash(ctx, user.ID, hashed, historySize)
+}
+
+func (m *Manager) checkPasswordReuse(ctx context.Context, user users.User, password string) error {
+	if m.cfg.PasswordHistory <= 0 {
+		return nil
+	}
+
+	hashes := []string{user.PasswordHash}
+	if m.cfg.PasswordHistory > 1 {
+		history, err := m.store.PasswordHistory(ctx, user.ID, m.cfg.PasswordHistory-1)
+		if err != nil {
+			return fmt.Errorf("error getting password history:%v", err)
+		}
+		hashes = append(hashes, history...)
+	}
+
+	for _, hash := range hashes {
+		if m.auth.HashMatchesPassword(hash, password) {
+			return &users.PasswordPolicyError{
+				Violations: []users.PasswordViolation{
+					{
+						Rule:    users.PasswordReusedRule,
+						Message: fmt.Sprintf("password must not be one of the last %d passwords", m.cfg.PasswordHistory),
+					},
+				},
+			}
+		}
+	}
+	return nil
+}
+
+func newCursor(afterID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(afterID))
+}
+
+func parseCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+	afterID, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(afterID) == 0 {
+		return "", fmt.Errorf("%w:malformed cursor %q", users.InvalidListParamErr, cursor)
+	}
+	// WHY: cursors are sent by clients, only IDs of users
+	// should reach the storage.
+	id, err := strconv.ParseInt(string(afterID), 10, 64)
+	if err != nil || id <= 0 {
+		return "", fmt.Errorf("%w:cursor %q has invalid user ID %q", users.InvalidListParamErr, cursor, afterID)
+	}
+	return string(afterID), nil
 }
@@ -2,7 +2,10 @@ package manager_test
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
@@ -69,7 +72,7 @@ func TestUserCreation(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			storage := newUsersStorage()
 			authorizer := auth.New()
-			usersManager := manager.New(authorizer, storage)
+			usersManager := manager.New(authorizer, storage, manager.Config{})
 			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 			defer cancel()
 
@@ -106,13 +109,1201 @@ func TestUserCreation(t *testing.T) {
 }
 
 func TestUserCreationFailsOnFailedPasswordHashing(t *testing.T) {
-	usersManager := manager.New(&explodingAuthorizer{}, newUsersStorage())
+	usersManager := manager.New(&explodingAuthorizer{}, newUsersStorage(), manager.Config{})
 	_, err := usersManager.CreateUser(context.Background(), "test@test.com", "whatever", "pass")
 	if err == nil {
 		t.Fatal("expected an error, got none")
 	}
 }
 
+func TestAuthentication(t *testing.T) {
+	const (
+		email    = "auth@test.com"
+		fullname = "Auth User"
+		password = "auth password"
+	)
+
+	type Test struct {
+		name     string
+		email    string
+		password string
+		wantErr  error
+	}
+
+	tests := []Test{
+		{
+			name:     "Success",
+			email:    email,
+			password: password,
+		},
+		{
+			name:     "SuccessWithSpacesOnEmail",
+			email:    "  " + email + " ",
+			password: password,
+		},
+		{
+			name:     "FailureOnWrongPassword",
+			email:    email,
+			password: "wrong password",
+			wantErr:  users.InvalidCredentialsErr,
+		},
+		{
+			name:     "FailureOnEmptyPassword",
+			email:    email,
+			password: "",
+			wantErr:  users.InvalidCredentialsErr,
+		},
+		{
+			name:     "FailureOnUnknownEmail",
+			email:    "unknown@test.com",
+			password: password,
+			wantErr:  users.InvalidCredentialsErr,
+		},
+		{
+			name:     "FailureOnInvalidEmail",
+			email:    "invalid",
+			password: password,
+			wantErr:  users.InvalidCredentialsErr,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := newUsersStorage()
+			usersManager := manager.New(auth.New(), storage, manager.Config{})
+			ctx := context.Background()
+
+			userID, err := usersManager.CreateUser(ctx, email, fullname, password)
+			assertNoErr(t, err)
+
+			user, err := usersManager.Authenticate(ctx, test.email, test.password)
+
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got err [%v] but want err[%v]", err, test.wantErr)
+				}
+				return
+			}
+			assertNoErr(t, err)
+
+			if user.ID != userID {
+				t.Errorf("got user ID %q want %q", user.ID, userID)
+			}
+			if user.FullName != fullname {
+				t.Errorf("got name %q want %q", user.FullName, fullname)
+			}
+		})
+	}
+}
+
+func TestAuthenticationRequiresVerifiedEmail(t *testing.T) {
+	const (
+		email    = "verify@test.com"
+		password = "verify password"
+	)
+
+	storage := newUsersStorage()
+	usersManager := manager.New(auth.New(), storage, manager.Config{RequireVerifiedEmail: true})
+	ctx := context.Background()
+
+	userID, err := usersManager.CreateUser(ctx, email, "Verify User", password)
+	assertNoErr(t, err)
+
+	_, err = usersManager.Authenticate(ctx, email, password)
+	if !errors.Is(err, users.UserNotVerifiedErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotVerifiedErr)
+	}
+
+	// Wrong passwords must not reveal the verification state
+	_, err = usersManager.Authenticate(ctx, email, "wrong password")
+	if !errors.Is(err, users.InvalidCredentialsErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidCredentialsErr)
+	}
+
+	assertNoErr(t, usersManager.VerifyUser(ctx, userID, email))
+
+	user, err := usersManager.Authenticate(ctx, email, password)
+	assertNoErr(t, err)
+
+	if user.ID != userID {
+		t.Fatalf("got user ID %q want %q", user.ID, userID)
+	}
+}
+
+func TestAuthenticationRehashesOutdatedPasswords(t *testing.T) {
+	const (
+		email    = "rehash@test.com"
+		password = "rehash password"
+	)
+
+	storage := newUsersStorage()
+	ctx := context.Background()
+
+	userID, err := manager.New(auth.New(), storage, manager.Config{}).CreateUser(ctx, email, "Rehash User", password)
+	assertNoErr(t, err)
+
+	oldUser, _ := storage.userByID(userID)
+
+	authorizer, err := auth.NewWithPasswordHashing(auth.PasswordHashing{
+		Scheme:   auth.Argon2idScheme,
+		Argon2id: auth.Argon2idParams{Memory: 64, Iterations: 1, Parallelism: 1},
+	})
+	assertNoErr(t, err)
+
+	usersManager := manager.New(authorizer, storage, manager.Config{})
+
+	_, err = usersManager.Authenticate(ctx, email, "wrong password")
+	if !errors.Is(err, users.InvalidCredentialsErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidCredentialsErr)
+	}
+	if gotUser, _ := storage.userByID(userID); gotUser.hashedPassword != oldUser.hashedPassword {
+		t.Fatal("password hash changed after failed authentication")
+	}
+
+	_, err = usersManager.Authenticate(ctx, email, password)
+	assertNoErr(t, err)
+
+	rehashedUser, _ := storage.userByID(userID)
+	if rehashedUser.hashedPassword == oldUser.hashedPassword {
+		t.Fatal("outdated password hash was not upgraded after authentication")
+	}
+	if authorizer.PasswordNeedsRehash(rehashedUser.hashedPassword) {
+		t.Fatalf("upgraded password hash %q is still outdated", rehashedUser.hashedPassword)
+	}
+
+	_, err = usersManager.Authenticate(ctx, email, password)
+	assertNoErr(t, err)
+
+	if gotUser, _ := storage.userByID(userID); gotUser.hashedPassword != rehashedUser.hashedPassword {
+		t.Fatal("up to date password hash should not be changed")
+	}
+}
+
+func TestAuthenticationReportsFailedRehash(t *testing.T) {
+	const (
+		email    = "failedrehash@test.com"
+		password = "failed rehash password"
+	)
+
+	storage := newUsersStorage()
+	ctx := context.Background()
+
+	userID, err := manager.New(auth.New(), storage, manager.Config{}).CreateUser(ctx, email, "Failed Rehash User", password)
+	assertNoErr(t, err)
+
+	oldUser, _ := storage.userByID(userID)
+	usersManager := manager.New(&failingRehashAuthorizer{Authorizer: auth.New()}, storage, manager.Config{})
+
+	// WHY: failing to upgrade the hash doesn't fail the authentication,
+	// but the failure must be reported so it can be logged.
+	user, err := usersManager.Authenticate(ctx, email, password)
+	if !errors.Is(err, users.PasswordRehashErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.PasswordRehashErr)
+	}
+	if user.ID != userID {
+		t.Fatalf("got user ID %q want %q", user.ID, userID)
+	}
+	if gotUser, _ := storage.userByID(userID); gotUser.hashedPassword != oldUser.hashedPassword {
+		t.Fatal("password hash changed after failed rehash")
+	}
+
+	_, err = usersManager.Authenticate(ctx, email, "wrong password")
+	if !errors.Is(err, users.InvalidCredentialsErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidCredentialsErr)
+	}
+}
+
+func TestAuthenticationUnknownEmailComparesHash(t *testing.T) {
+	authorizer := &recordingAuthorizer{Authorizer: auth.New()}
+	usersManager := manager.New(authorizer, newUsersStorage(), manager.Config{})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := usersManager.Authenticate(ctx, "unknown@test.com", "some password")
+		if !errors.Is(err, users.InvalidCredentialsErr) {
+			t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidCredentialsErr)
+		}
+	}
+
+	// WHY: unknown emails must take as long as wrong passwords,
+	// so the hash compared must be created with the current scheme.
+	if len(authorizer.matched) != 2 {
+		t.Fatalf("got %d hashes compared want 2", len(authorizer.matched))
+	}
+	for _, hash := range authorizer.matched {
+		if hash == "" || authorizer.PasswordNeedsRehash(hash) {
+			t.Fatalf("compared hash %q is not created with the current scheme", hash)
+		}
+	}
+	if authorizer.hashed != 1 {
+		t.Fatalf("got %d hashes created want the dummy hash created once", authorizer.hashed)
+	}
+}
+
+func TestVerifyUser(t *testing.T) {
+	storage := newUsersStorage()
+	usersManager := manager.New(auth.New(), storage, manager.Config{})
+	ctx := context.Background()
+
+	const email = "verify@test.com"
+
+	userID, err := usersManager.CreateUser(ctx, email, "Verify User", "pass")
+	assertNoErr(t, err)
+
+	user, err := usersManager.User(ctx, userID)
+	assertNoErr(t, err)
+
+	if user.Status != users.PendingVerificationStatus {
+		t.Fatalf("got status %q want %q", user.Status, users.PendingVerificationStatus)
+	}
+
+	err = usersManager.VerifyUser(ctx, userID, "other@test.com")
+	if !errors.Is(err, users.EmailMismatchErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.EmailMismatchErr)
+	}
+
+	assertNoErr(t, usersManager.VerifyUser(ctx, userID, email))
+
+	verified, err := usersManager.User(ctx, userID)
+	assertNoErr(t, err)
+
+	if verified.Status != users.ActiveStatus {
+		t.Fatalf("got status %q want %q", verified.Status, users.ActiveStatus)
+	}
+	if verified.Version != user.Version+1 {
+		t.Fatalf("got version %d want %d", verified.Version, user.Version+1)
+	}
+
+	// Verifying again is a no-op
+	assertNoErr(t, usersManager.VerifyUser(ctx, userID, email))
+
+	again, err := usersManager.User(ctx, userID)
+	assertNoErr(t, err)
+
+	if again != verified {
+		t.Fatalf("got user %v want %v", again, verified)
+	}
+
+	err = usersManager.VerifyUser(ctx, "unknown", email)
+	if !errors.Is(err, users.UserNotFoundErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotFoundErr)
+	}
+}
+
+func TestAuthenticationFailsForInactiveUsers(t *testing.T) {
+	const (
+		email    = "inactive@test.com"
+		password = "inactive password"
+	)
+
+	tests := map[users.Status]error{
+		users.SuspendedStatus: users.UserSuspendedErr,
+		users.LockedStatus:    users.UserLockedErr,
+	}
+
+	for status, wantErr := range tests {
+		t.Run(string(status), func(t *testing.T) {
+			usersManager := manager.New(auth.New(), newUsersStorage(), manager.Config{})
+			ctx := context.Background()
+
+			userID, err := usersManager.CreateUser(ctx, email, "Inactive User", password)
+			assertNoErr(t, err)
+
+			_, err = usersManager.ChangeStatus(ctx, userID, status, "testing")
+			assertNoErr(t, err)
+
+			_, err = usersManager.Authenticate(ctx, email, password)
+			if !errors.Is(err, wantErr) {
+				t.Fatalf("got err [%v] but want err[%v]", err, wantErr)
+			}
+
+			// Wrong passwords must not reveal the status
+			_, err = usersManager.Authenticate(ctx, email, "wrong password")
+			if !errors.Is(err, users.InvalidCredentialsErr) {
+				t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidCredentialsErr)
+			}
+
+			_, err = usersManager.ChangeStatus(ctx, userID, users.ActiveStatus, "testing")
+			assertNoErr(t, err)
+
+			_, err = usersManager.Authenticate(ctx, email, password)
+			assertNoErr(t, err)
+		})
+	}
+}
+
+func TestSigninUser(t *testing.T) {
+	storage := newUsersStorage()
+	usersManager := manager.New(auth.New(), storage, manager.Config{RequireVerifiedEmail: true})
+	ctx := context.Background()
+
+	const email = "signin@test.com"
+
+	userID, err := usersManager.CreateUser(ctx, email, "Signin User", "signin password")
+	assertNoErr(t, err)
+
+	_, err = usersManager.SigninUser(ctx, userID)
+	if !errors.Is(err, users.UserNotVerifiedErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotVerifiedErr)
+	}
+
+	assertNoErr(t, usersManager.VerifyUser(ctx, userID, email))
+
+	user, err := usersManager.SigninUser(ctx, userID)
+	assertNoErr(t, err)
+
+	if user.ID != userID {
+		t.Fatalf("got user ID %q want %q", user.ID, userID)
+	}
+
+	_, err = usersManager.ChangeStatus(ctx, userID, users.SuspendedStatus, "testing")
+	assertNoErr(t, err)
+
+	_, err = usersManager.SigninUser(ctx, userID)
+	if !errors.Is(err, users.UserSuspendedErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserSuspendedErr)
+	}
+
+	_, err = usersManager.SigninUser(ctx, "unknown")
+	if !errors.Is(err, users.UserNotFoundErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotFoundErr)
+	}
+}
+
+func TestChangeStatus(t *testing.T) {
+	type Test struct {
+		name       string
+		transition []users.Status
+		status     users.Status
+		reason     string
+		wantErr    error
+	}
+
+	tests := []Test{
+		{
+			name:   "SuspendPendingUser",
+			status: users.SuspendedStatus,
+			reason: "spam",
+		},
+		{
+			name:       "SuspendActiveUser",
+			transition: []users.Status{users.ActiveStatus},
+			status:     users.SuspendedStatus,
+			reason:     "abuse",
+		},
+		{
+			name:       "ReactivateSuspendedUser",
+			transition: []users.Status{users.ActiveStatus, users.SuspendedStatus},
+			status:     users.ActiveStatus,
+			reason:     "appeal accepted",
+		},
+		{
+			name:       "UnlockLockedUser",
+			transition: []users.Status{users.ActiveStatus, users.LockedStatus},
+			status:     users.ActiveStatus,
+			reason:     "identity confirmed",
+		},
+		{
+			name:    "FailsOnEmptyReason",
+			status:  users.SuspendedStatus,
+			wantErr: users.InvalidUserParamErr,
+		},
+		{
+			name:    "FailsOnUnknownStatus",
+			status:  "unknown",
+			reason:  "whatever",
+			wantErr: users.InvalidUserParamErr,
+		},
+		{
+			name:       "FailsOnSuspendingSuspendedUser",
+			transition: []users.Status{users.SuspendedStatus},
+			status:     users.SuspendedStatus,
+			reason:     "again",
+			wantErr:    users.InvalidStatusTransitionErr,
+		},
+		{
+			name:       "FailsOnGoingBackToPendingVerification",
+			transition: []users.Status{users.ActiveStatus},
+			status:     users.PendingVerificationStatus,
+			reason:     "whatever",
+			wantErr:    users.InvalidStatusTransitionErr,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := newUsersStorage()
+			usersManager := manager.New(auth.New(), storage, manager.Config{})
+			ctx := context.Background()
+
+			userID, err := usersManager.CreateUser(ctx, "status@test.com", "Status User", "pass")
+			assertNoErr(t, err)
+
+			for _, status := range test.transition {
+				_, err := usersManager.ChangeStatus(ctx, userID, status, "setup")
+				assertNoErr(t, err)
+			}
+
+			before, err := usersManager.User(ctx, userID)
+			assertNoErr(t, err)
+
+			updated, err := usersManager.ChangeStatus(ctx, userID, test.status, test.reason)
+
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got err [%v] but want err[%v]", err, test.wantErr)
+				}
+				after, err := usersManager.User(ctx, userID)
+				assertNoErr(t, err)
+				if after != before {
+					t.Fatalf("failed status change modified user from %v to %v", before, after)
+				}
+				return
+			}
+			assertNoErr(t, err)
+
+			if updated.Status != test.status {
+				t.Errorf("got status %q want %q", updated.Status, test.status)
+			}
+			if updated.StatusReason != test.reason {
+				t.Errorf("got status reason %q want %q", updated.StatusReason, test.reason)
+			}
+			if updated.Version != before.Version+1 {
+				t.Errorf("got version %d want %d", updated.Version, before.Version+1)
+			}
+
+			stored, err := usersManager.User(ctx, userID)
+			assertNoErr(t, err)
+
+			if stored != updated {
+				t.Errorf("got stored user %v want %v", stored, updated)
+			}
+		})
+	}
+}
+
+func TestChangeStatusUserNotFound(t *testing.T) {
+	usersManager := manager.New(auth.New(), newUsersStorage(), manager.Config{})
+
+	_, err := usersManager.ChangeStatus(context.Background(), "unknown", users.SuspendedStatus, "reason")
+	if !errors.Is(err, users.UserNotFoundErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotFoundErr)
+	}
+}
+
+func TestRestrictedStatusChanges(t *testing.T) {
+	type change func(*manager.Manager, context.Context, string, string) (users.User, error)
+
+	type Test struct {
+		name       string
+		transition []users.Status
+		change     change
+		reason     string
+		wantStatus users.Status
+		wantErr    error
+	}
+
+	tests := []Test{
+		{
+			name:       "ReactivateSuspendedUser",
+			transition: []users.Status{users.ActiveStatus, users.SuspendedStatus},
+			change:     (*manager.Manager).ReactivateUser,
+			reason:     "appeal accepted",
+			wantStatus: users.ActiveStatus,
+		},
+		{
+			name:    "FailsOnReactivatingPendingUser",
+			change:  (*manager.Manager).ReactivateUser,
+			reason:  "skip verification",
+			wantErr: users.InvalidStatusTransitionErr,
+		},
+		{
+			name:       "FailsOnReactivatingLockedUser",
+			transition: []users.Status{users.ActiveStatus, users.LockedStatus},
+			change:     (*manager.Manager).ReactivateUser,
+			reason:     "whatever",
+			wantErr:    users.InvalidStatusTransitionErr,
+		},
+		{
+			name:       "FailsOnReactivatingWithEmptyReason",
+			transition: []users.Status{users.ActiveStatus, users.SuspendedStatus},
+			change:     (*manager.Manager).ReactivateUser,
+			wantErr:    users.InvalidUserParamErr,
+		},
+		{
+			name:       "LockActiveUser",
+			transition: []users.Status{users.ActiveStatus},
+			change:     (*manager.Manager).LockUser,
+			reason:     "too many failed sign in attempts",
+			wantStatus: users.LockedStatus,
+		},
+		{
+			name:    "FailsOnLockingPendingUser",
+			change:  (*manager.Manager).LockUser,
+			reason:  "too many failed sign in attempts",
+			wantErr: users.InvalidStatusTransitionErr,
+		},
+		{
+			name:       "FailsOnLockingSuspendedUser",
+			transition: []users.Status{users.SuspendedStatus},
+			change:     (*manager.Manager).LockUser,
+			reason:     "too many failed sign in attempts",
+			wantErr:    users.InvalidStatusTransitionErr,
+		},
+		{
+			name:       "UnlockLockedUser",
+			transition: []users.Status{users.ActiveStatus, users.LockedStatus},
+			change:     (*manager.Manager).UnlockUser,
+			reason:     "lockout expired",
+			wantStatus: users.ActiveStatus,
+		},
+		{
+			name:       "FailsOnUnlockingSuspendedUser",
+			transition: []users.Status{users.ActiveStatus, users.SuspendedStatus},
+			change:     (*manager.Manager).UnlockUser,
+			reason:     "whatever",
+			wantErr:    users.InvalidStatusTransitionErr,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usersManager := manager.New(auth.New(), newUsersStorage(), manager.Config{})
+			ctx := context.Background()
+
+			userID, err := usersManager.CreateUser(ctx, "restricted@test.com", "Restricted User", "pass")
+			assertNoErr(t, err)
+
+			for _, status := range test.transition {
+				_, err := usersManager.ChangeStatus(ctx, userID, status, "setup")
+				assertNoErr(t, err)
+			}
+
+			before, err := usersManager.User(ctx, userID)
+			assertNoErr(t, err)
+
+			updated, err := test.change(usersManager, ctx, userID, test.reason)
+
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got err [%v] but want err[%v]", err, test.wantErr)
+				}
+				after, err := usersManager.User(ctx, userID)
+				assertNoErr(t, err)
+				if after != before {
+					t.Fatalf("failed status change modified user from %v to %v", before, after)
+				}
+				return
+			}
+			assertNoErr(t, err)
+
+			if updated.Status != test.wantStatus {
+				t.Errorf("got status %q want %q", updated.Status, test.wantStatus)
+			}
+			if updated.StatusReason != test.reason {
+				t.Errorf("got status reason %q want %q", updated.StatusReason, test.reason)
+			}
+
+			stored, err := usersManager.User(ctx, userID)
+			assertNoErr(t, err)
+
+			if stored != updated {
+				t.Errorf("got stored user %v want %v", stored, updated)
+			}
+		})
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	const usersCount = 5
+
+	storage := newUsersStorage()
+	usersManager := manager.New(auth.New(), storage, manager.Config{})
+	ctx := context.Background()
+
+	wantIDs := make([]string, usersCount)
+	for i := 0; i < usersCount; i++ {
+		email := fmt.Sprintf("user%d@test.com", i)
+		userID, err := usersManager.CreateUser(ctx, email, "User", "pass")
+		assertNoErr(t, err)
+
+		// Listing is ordered by ID in descending order
+		wantIDs[usersCount-1-i] = userID
+	}
+
+	for _, limit := range []int{1, 2, 3, usersCount, manager.MaxListLimit} {
+		t.Run(fmt.Sprintf("Limit%d", limit), func(t *testing.T) {
+			gotIDs := []string{}
+			cursor := ""
+
+			for {
+				listed, nextCursor, err := usersManager.ListUsers(ctx, limit, cursor)
+				assertNoErr(t, err)
+
+				if len(listed) > limit {
+					t.Fatalf("listed %d users with limit %d", len(listed), limit)
+				}
+				for _, user := range listed {
+					gotIDs = append(gotIDs, user.ID)
+				}
+				if nextCursor == "" {
+					break
+				}
+				if len(gotIDs) > usersCount {
+					t.Fatalf("listed more users than existent, got IDs: %v", gotIDs)
+				}
+				cursor = nextCursor
+			}
+
+			if !reflect.DeepEqual(gotIDs, wantIDs) {
+				t.Fatalf("got IDs %v want %v", gotIDs, wantIDs)
+			}
+		})
+	}
+}
+
+func TestListUsersInvalidParams(t *testing.T) {
+	type Test struct {
+		name   string
+		limit  int
+		cursor string
+	}
+
+	tests := []Test{
+		{
+			name:  "ZeroLimit",
+			limit: 0,
+		},
+		{
+			name:  "NegativeLimit",
+			limit: -1,
+		},
+		{
+			name:  "LimitTooBig",
+			limit: manager.MaxListLimit + 1,
+		},
+		{
+			name:   "MalformedCursor",
+			limit:  1,
+			cursor: "not base64 @#$%",
+		},
+		{
+			name:   "NonNumericCursor",
+			limit:  1,
+			cursor: base64.RawURLEncoding.EncodeToString([]byte("abc")),
+		},
+		{
+			name:   "NegativeCursor",
+			limit:  1,
+			cursor: base64.RawURLEncoding.EncodeToString([]byte("-1")),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usersManager := manager.New(auth.New(), newUsersStorage(), manager.Config{})
+			_, _, err := usersManager.ListUsers(context.Background(), test.limit, test.cursor)
+			if !errors.Is(err, users.InvalidListParamErr) {
+				t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidListParamErr)
+			}
+		})
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	storage := newUsersStorage()
+	usersManager := manager.New(auth.New(), storage, manager.Config{})
+	ctx := context.Background()
+
+	userID, err := usersManager.CreateUser(ctx, "delete@test.com", "Delete", "pass")
+	assertNoErr(t, err)
+
+	anotherUserID, err := usersManager.CreateUser(ctx, "keep@test.com", "Keep", "pass")
+	assertNoErr(t, err)
+
+	_, err = usersManager.User(ctx, userID)
+	assertNoErr(t, err)
+
+	err = usersManager.DeleteUser(ctx, userID)
+	assertNoErr(t, err)
+
+	_, err = usersManager.User(ctx, userID)
+	if !errors.Is(err, users.UserNotFoundErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotFoundErr)
+	}
+
+	err = usersManager.DeleteUser(ctx, userID)
+	if !errors.Is(err, users.UserNotFoundErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotFoundErr)
+	}
+
+	_, err = usersManager.User(ctx, anotherUserID)
+	assertNoErr(t, err)
+}
+
+func TestUpdateUser(t *testing.T) {
+	const (
+		email      = "update@test.com"
+		fullname   = "Update User"
+		otherEmail = "other@test.com"
+	)
+
+	type Test struct {
+		name         string
+		update       users.UserUpdate
+		version      int64
+		wantEmail    users.Email
+		wantFullName string
+		wantErr      error
+	}
+
+	tests := []Test{
+		{
+			name:         "UpdateFullName",
+			update:       users.UserUpdate{FullName: strptr("New Name")},
+			version:      1,
+			wantEmail:    email,
+			wantFullName: "New Name",
+		},
+		{
+			name:         "UpdateEmail",
+			update:       users.UserUpdate{Email: strptr("  new@test.com ")},
+			version:      1,
+			wantEmail:    "new@test.com",
+			wantFullName: fullname,
+		},
+		{
+			name: "UpdateAll",
+			update: users.UserUpdate{
+				FullName: strptr("New Name"),
+				Email:    strptr("new@test.com"),
+			},
+			version:      1,
+			wantEmail:    "new@test.com",
+			wantFullName: "New Name",
+		},
+		{
+			name:         "UpdateEmailToSameEmail",
+			update:       users.UserUpdate{Email: strptr(email)},
+			version:      1,
+			wantEmail:    email,
+			wantFullName: fullname,
+		},
+		{
+			name:    "FailureOnEmptyUpdate",
+			version: 1,
+			wantErr: users.InvalidUserParamErr,
+		},
+		{
+			name:    "FailureOnEmptyName",
+			update:  users.UserUpdate{FullName: strptr("")},
+			version: 1,
+			wantErr: users.InvalidUserParamErr,
+		},
+		{
+			name:    "FailureOnInvalidEmail",
+			update:  users.UserUpdate{Email: strptr("invalid")},
+			version: 1,
+			wantErr: users.InvalidUserParamErr,
+		},
+		{
+			name:    "FailureOnEmailFromAnotherUser",
+			update:  users.UserUpdate{Email: strptr(otherEmail)},
+			version: 1,
+			wantErr: users.UserAlreadyExistsErr,
+		},
+		{
+			name:    "FailureOnOutdatedVersion",
+			update:  users.UserUpdate{FullName: strptr("New Name")},
+			version: 0,
+			wantErr: users.VersionMismatchErr,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := newUsersStorage()
+			usersManager := manager.New(auth.New(), storage, manager.Config{})
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			userID, err := usersManager.CreateUser(ctx, email, fullname, "pass")
+			assertNoErr(t, err)
+
+			_, err = usersManager.CreateUser(ctx, otherEmail, "Other", "pass")
+			assertNoErr(t, err)
+
+			updated, err := usersManager.UpdateUser(ctx, userID, test.version, test.update)
+
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got err [%v] but want err[%v]", err, test.wantErr)
+				}
+				return
+			}
+			assertNoErr(t, err)
+
+			if updated.Email != test.wantEmail {
+				t.Errorf("got email %q want %q", updated.Email, test.wantEmail)
+			}
+			if updated.FullName != test.wantFullName {
+				t.Errorf("got name %q want %q", updated.FullName, test.wantFullName)
+			}
+			if updated.Version <= test.version {
+				t.Errorf("got version %d, want it to be greater than %d", updated.Version, test.version)
+			}
+
+			gotUser, ok := storage.userByID(userID)
+			if !ok {
+				t.Fatalf("unable to find user id %q on storage", userID)
+			}
+			if gotUser.toUser() != updated {
+				t.Errorf("got stored user %v want %v", gotUser.toUser(), updated)
+			}
+			assertValidDeadline(t, gotUser.ctx, ctx)
+
+			_, err = usersManager.UpdateUser(ctx, userID, test.version, test.update)
+			if !errors.Is(err, users.VersionMismatchErr) {
+				t.Fatalf("reusing old version: got err [%v] but want err[%v]", err, users.VersionMismatchErr)
+			}
+		})
+	}
+}
+
+func TestUpdateUserEmailRequiresVerification(t *testing.T) {
+	const (
+		email    = "updateverified@test.com"
+		newEmail = "newverified@test.com"
+	)
+
+	usersManager := manager.New(auth.New(), newUsersStorage(), manager.Config{})
+	ctx := context.Background()
+
+	userID, err := usersManager.CreateUser(ctx, email, "Verified User", "pass")
+	assertNoErr(t, err)
+	assertNoErr(t, usersManager.VerifyUser(ctx, userID, email))
+
+	user, err := usersManager.User(ctx, userID)
+	assertNoErr(t, err)
+
+	user, err = usersManager.UpdateUser(ctx, userID, user.Version, users.UserUpdate{FullName: strptr("New Name")})
+	assertNoErr(t, err)
+
+	if user.Status != users.ActiveStatus {
+		t.Fatalf("updating name: got status %q want %q", user.Status, users.ActiveStatus)
+	}
+
+	user, err = usersManager.UpdateUser(ctx, userID, user.Version, users.UserUpdate{Email: strptr(newEmail)})
+	assertNoErr(t, err)
+
+	if user.Status != users.PendingVerificationStatus {
+		t.Fatalf("updating email: got status %q want %q", user.Status, users.PendingVerificationStatus)
+	}
+
+	err = usersManager.VerifyUser(ctx, userID, email)
+	if !errors.Is(err, users.EmailMismatchErr) {
+		t.Fatalf("verifying old email: got err [%v] but want err[%v]", err, users.EmailMismatchErr)
+	}
+	assertNoErr(t, usersManager.VerifyUser(ctx, userID, newEmail))
+
+	user, err = usersManager.ChangeStatus(ctx, userID, users.SuspendedStatus, "testing")
+	assertNoErr(t, err)
+
+	// WHY: the new email can't be verified without lifting the suspension
+	_, err = usersManager.UpdateUser(ctx, userID, user.Version, users.UserUpdate{Email: strptr(email)})
+	if !errors.Is(err, users.InvalidStatusTransitionErr) {
+		t.Fatalf("updating email of suspended user: got err [%v] but want err[%v]", err, users.InvalidStatusTransitionErr)
+	}
+
+	user, err = usersManager.UpdateUser(ctx, userID, user.Version, users.UserUpdate{FullName: strptr("Suspended Name")})
+	assertNoErr(t, err)
+
+	if user.Status != users.SuspendedStatus || user.Email != newEmail {
+		t.Fatalf("updating name of suspended user: got status %q email %q", user.Status, user.Email)
+	}
+}
+
+func TestUpdateUserNotFound(t *testing.T) {
+	usersManager := manager.New(auth.New(), newUsersStorage(), manager.Config{})
+	_, err := usersManager.UpdateUser(context.Background(), "666", 1, users.UserUpdate{
+		FullName: strptr("name"),
+	})
+	if !errors.Is(err, users.UserNotFoundErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotFoundErr)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	const (
+		email       = "password@test.com"
+		oldPassword = "old password"
+	)
+
+	type Test struct {
+		name            string
+		currentPassword string
+		newPassword     string
+		wantErr         error
+	}
+
+	tests := []Test{
+		{
+			name:            "Success",
+			currentPassword: oldPassword,
+			newPassword:     "new password",
+		},
+		{
+			name:            "FailureOnWrongCurrentPassword",
+			currentPassword: "wrong password",
+			newPassword:     "new password",
+			wantErr:         users.InvalidCredentialsErr,
+		},
+		{
+			name:            "FailureOnEmptyNewPassword",
+			currentPassword: oldPassword,
+			newPassword:     "",
+			wantErr:         users.InvalidUserParamErr,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := newUsersStorage()
+			authorizer := auth.New()
+			usersManager := manager.New(authorizer, storage, manager.Config{})
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			userID, err := usersManager.CreateUser(ctx, email, "Password User", oldPassword)
+			assertNoErr(t, err)
+
+			err = usersManager.ChangePassword(ctx, userID, test.currentPassword, test.newPassword)
+
+			gotUser, ok := storage.userByID(userID)
+			if !ok {
+				t.Fatalf("unable to find user id %q on storage", userID)
+			}
+
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got err [%v] but want err[%v]", err, test.wantErr)
+				}
+				if !authorizer.HashMatchesPassword(gotUser.hashedPassword, oldPassword) {
+					t.Fatal("password changed on failure")
+				}
+				return
+			}
+			assertNoErr(t, err)
+
+			if !authorizer.HashMatchesPassword(gotUser.hashedPassword, test.newPassword) {
+				t.Fatalf("got hashed password %q that doesn't match new password %q", gotUser.hashedPassword, test.newPassword)
+			}
+			assertValidDeadline(t, gotUser.ctx, ctx)
+
+			_, err = usersManager.Authenticate(ctx, email, oldPassword)
+			if !errors.Is(err, users.InvalidCredentialsErr) {
+				t.Fatalf("authenticating with old password: got err [%v] but want err[%v]", err, users.InvalidCredentialsErr)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	const (
+		email       = "policy@test.com"
+		fullname    = "Policy User"
+		oldPassword = "old password"
+		weak        = "weak password"
+	)
+
+	storage := newUsersStorage()
+	policy := &passwordPolicy{rejected: map[string]bool{weak: true}}
+	usersManager := manager.New(auth.New(), storage, manager.Config{PasswordPolicy: policy})
+	ctx := context.Background()
+
+	_, err := usersManager.CreateUser(ctx, email, fullname, weak)
+	assertPasswordPolicyErr(t, err)
+
+	userID, err := usersManager.CreateUser(ctx, email, fullname, oldPassword)
+	assertNoErr(t, err)
+
+	wantChecked := passwordCheck{password: oldPassword, email: email, fullname: fullname}
+	if policy.checked != wantChecked {
+		t.Fatalf("got policy checked %v want %v", policy.checked, wantChecked)
+	}
+
+	err = usersManager.ChangePassword(ctx, userID, oldPassword, weak)
+	assertPasswordPolicyErr(t, err)
+
+	err = usersManager.ResetPassword(ctx, userID, weak)
+	assertPasswordPolicyErr(t, err)
+
+	err = usersManager.CheckNewPassword(ctx, userID, weak)
+	assertPasswordPolicyErr(t, err)
+
+	err = usersManager.CheckNewPassword(ctx, userID, "new password")
+	assertNoErr(t, err)
+
+	err = usersManager.CheckNewPassword(ctx, "666", "new password")
+	if !errors.Is(err, users.UserNotFoundErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotFoundErr)
+	}
+
+	_, err = usersManager.Authenticate(ctx, email, oldPassword)
+	assertNoErr(t, err)
+
+	policy.err = errors.New("injected policy error")
+
+	err = usersManager.ResetPassword(ctx, userID, "new password")
+	if err == nil || errors.Is(err, users.InvalidUserParamErr) {
+		t.Fatalf("got err [%v] but want an internal error", err)
+	}
+}
+
+func TestPasswordHistory(t *testing.T) {
+	const (
+		email    = "history@test.com"
+		password = "password 0"
+	)
+
+	storage := newUsersStorage()
+	authorizer := auth.New()
+	usersManager := manager.New(authorizer, storage, manager.Config{PasswordHistory: 3})
+	ctx := context.Background()
+
+	userID, err := usersManager.CreateUser(ctx, email, "History User", password)
+	assertNoErr(t, err)
+
+	err = usersManager.ChangePassword(ctx, userID, password, password)
+	assertPasswordReusedErr(t, err)
+
+	current := password
+	for i := 1; i <= 4; i++ {
+		newPassword := fmt.Sprintf("password %d", i)
+		err := usersManager.ChangePassword(ctx, userID, current, newPassword)
+		assertNoErr(t, err)
+		current = newPassword
+	}
+
+	// WHY: with a history of 3 the current password (4) and the
+	// two previous ones (3 and 2) can't be reused, older ones can.
+	for _, reused := range []string{"password 4", "password 3", "password 2"} {
+		err := usersManager.ChangePassword(ctx, userID, current, reused)
+		assertPasswordReusedErr(t, err)
+
+		err = usersManager.ResetPassword(ctx, userID, reused)
+		assertPasswordReusedErr(t, err)
+
+		err = usersManager.CheckNewPassword(ctx, userID, reused)
+		assertPasswordReusedErr(t, err)
+	}
+
+	gotUser, _ := storage.userByID(userID)
+	if len(gotUser.history) != 2 {
+		t.Fatalf("got password history %v with %d hashes, want history pruned to 2", gotUser.history, len(gotUser.history))
+	}
+	if !authorizer.HashMatchesPassword(gotUser.hashedPassword, current) {
+		t.Fatal("password changed on reuse")
+	}
+
+	err = usersManager.ResetPassword(ctx, userID, "password 1")
+	assertNoErr(t, err)
+
+	_, err = usersManager.Authenticate(ctx, email, "password 1")
+	assertNoErr(t, err)
+}
+
+func TestPasswordHistoryDisabled(t *testing.T) {
+	const password = "same password"
+
+	storage := newUsersStorage()
+	usersManager := manager.New(auth.New(), storage, manager.Config{})
+	ctx := context.Background()
+
+	userID, err := usersManager.CreateUser(ctx, "nohistory@test.com", "No History User", password)
+	assertNoErr(t, err)
+
+	err = usersManager.ChangePassword(ctx, userID, password, password)
+	assertNoErr(t, err)
+
+	err = usersManager.ResetPassword(ctx, userID, password)
+	assertNoErr(t, err)
+
+	if gotUser, _ := storage.userByID(userID); len(gotUser.history) != 0 {
+		t.Fatalf("got password history %v, want none", gotUser.history)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	const (
+		email       = "reset@test.com"
+		oldPassword = "old password"
+		newPassword = "new password"
+	)
+
+	storage := newUsersStorage()
+	usersManager := manager.New(auth.New(), storage, manager.Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	userID, err := usersManager.CreateUser(ctx, email, "Reset User", oldPassword)
+	assertNoErr(t, err)
+
+	err = usersManager.ResetPassword(ctx, userID, "")
+	if !errors.Is(err, users.InvalidUserParamErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidUserParamErr)
+	}
+
+	err = usersManager.ResetPassword(ctx, "666", newPassword)
+	if !errors.Is(err, users.UserNotFoundErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotFoundErr)
+	}
+
+	err = usersManager.ResetPassword(ctx, userID, newPassword)
+	assertNoErr(t, err)
+
+	_, err = usersManager.Authenticate(ctx, email, newPassword)
+	assertNoErr(t, err)
+
+	_, err = usersManager.Authenticate(ctx, email, oldPassword)
+	if !errors.Is(err, users.InvalidCredentialsErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidCredentialsErr)
+	}
+}
+
+func TestUserByEmail(t *testing.T) {
+	usersManager := manager.New(auth.New(), newUsersStorage(), manager.Config{})
+	ctx := context.Background()
+
+	userID, err := usersManager.CreateUser(ctx, "byemail@test.com", "By Email", "pass")
+	assertNoErr(t, err)
+
+	user, err := usersManager.UserByEmail(ctx, " byemail@test.com ")
+	assertNoErr(t, err)
+
+	if user.ID != userID {
+		t.Fatalf("got user ID %q want %q", user.ID, userID)
+	}
+
+	_, err = usersManager.UserByEmail(ctx, "unknown@test.com")
+	if !errors.Is(err, users.UserNotFoundErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotFoundErr)
+	}
+
+	_, err = usersManager.UserByEmail(ctx, "invalid")
+	if !errors.Is(err, users.InvalidUserParamErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidUserParamErr)
+	}
+}
+
+func TestChangePasswordUserNotFound(t *testing.T) {
+	usersManager := manager.New(auth.New(), newUsersStorage(), manager.Config{})
+	err := usersManager.ChangePassword(context.Background(), "666", "old", "new")
+	if !errors.Is(err, users.UserNotFoundErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotFoundErr)
+	}
+}
+
 // UsersStorage is a simple in memory user storage implementation used in tests
 type UsersStorage struct {
 	idCount int
@@ -125,7 +1316,25 @@ type User struct {
 	id             string
 	fullname       string
 	hashedPassword string
+	history        []string
 	email          users.Email
+	role           string
+	status         users.Status
+	statusReason   string
+	version        int64
+}
+
+func (u User) toUser() users.User {
+	return users.User{
+		ID:           u.id,
+		Email:        u.email,
+		FullName:     u.fullname,
+		PasswordHash: u.hashedPassword,
+		Role:         u.role,
+		Status:       u.status,
+		StatusReason: u.statusReason,
+		Version:      u.version,
+	}
 }
 
 func newUsersStorage() *UsersStorage {
@@ -144,7 +1353,13 @@ func newUsersStorage() *UsersStorage {
 	}
 }
 
-func (s *UsersStorage) AddUser(ctx context.Context, email users.Email, fullname string, pass string) (string, error) {
+func (s *UsersStorage) AddUser(
+	ctx context.Context,
+	email users.Email,
+	fullname string,
+	pass string,
+	status users.Status,
+) (string, error) {
 	s.idCount++
 	id := strconv.Itoa(s.idCount)
 	s.users[id] = User{
@@ -153,15 +1368,177 @@ func (s *UsersStorage) AddUser(ctx context.Context, email users.Email, fullname
 		fullname:       fullname,
 		hashedPassword: pass,
 		email:          email,
+		role:           users.UserRole,
+		status:         status,
+		version:        1,
 	}
 	return id, nil
 }
 
+func (s *UsersStorage) UserByEmail(ctx context.Context, email users.Email) (users.User, error) {
+	for _, user := range s.users {
+		if user.email == email {
+			return user.toUser(), nil
+		}
+	}
+	return users.User{}, users.UserNotFoundErr
+}
+
+func (s *UsersStorage) UserByID(ctx context.Context, id string) (users.User, error) {
+	user, ok := s.users[id]
+	if !ok {
+		return users.User{}, users.UserNotFoundErr
+	}
+	return user.toUser(), nil
+}
+
+func (s *UsersStorage) ListUsers(ctx context.Context, afterID string, limit int) ([]users.User, error) {
+	after := s.idCount + 1
+	if afterID != "" {
+		var err error
+		after, err = strconv.Atoi(afterID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	listed := []users.User{}
+	for id := after - 1; id > 0 && len(listed) < limit; id-- {
+		user, ok := s.users[strconv.Itoa(id)]
+		if !ok {
+			continue
+		}
+		listed = append(listed, user.toUser())
+	}
+	return listed, nil
+}
+
+func (s *UsersStorage) DeleteUser(ctx context.Context, id string) error {
+	if _, ok := s.users[id]; !ok {
+		return users.UserNotFoundErr
+	}
+	delete(s.users, id)
+	return nil
+}
+
+func (s *UsersStorage) UpdateUser(ctx context.Context, user users.User) (users.User, error) {
+	stored, ok := s.users[user.ID]
+	if !ok {
+		return users.User{}, users.UserNotFoundErr
+	}
+	if stored.version != user.Version {
+		return users.User{}, users.VersionMismatchErr
+	}
+	for id, other := range s.users {
+		if id != user.ID && other.email == user.Email {
+			return users.User{}, users.UserAlreadyExistsErr
+		}
+	}
+
+	stored.ctx = ctx
+	stored.email = user.Email
+	stored.fullname = user.FullName
+	stored.status = user.Status
+	stored.statusReason = user.StatusReason
+	stored.version++
+	s.users[user.ID] = stored
+	return stored.toUser(), nil
+}
+
+func (s *UsersStorage) UpdatePasswordHash(ctx context.Context, id string, hashedPassword string) error {
+	stored, ok := s.users[id]
+	if !ok {
+		return users.UserNotFoundErr
+	}
+	stored.ctx = ctx
+	stored.hashedPassword = hashedPassword
+	s.users[id] = stored
+	return nil
+}
+
+func (s *UsersStorage) ReplacePasswordHash(ctx context.Context, id string, hashedPassword string, historySize int) error {
+	stored, ok := s.users[id]
+	if !ok {
+		return users.UserNotFoundErr
+	}
+	history := append([]string{stored.hashedPassword}, stored.history...)
+	if len(history) > historySize {
+		history = history[:historySize]
+	}
+	stored.ctx = ctx
+	stored.hashedPassword = hashedPassword
+	stored.history = history
+	s.users[id] = stored
+	return nil
+}
+
+func (s *UsersStorage) PasswordHistory(ctx context.Context, id string, limit int) ([]string, error) {
+	history := s.users[id].history
+	if len(history) > limit {
+		history = history[:limit]
+	}
+	return history, nil
+}
+
 func (s *UsersStorage) userByID(id string) (User, bool) {
 	v, ok := s.users[id]
 	return v, ok
 }
 
+type passwordCheck struct {
+	password string
+	email    string
+	fullname string
+}
+
+// passwordPolicy is a simple password policy used in
+// tests that rejects specific passwords.
+type passwordPolicy struct {
+	rejected map[string]bool
+	checked  passwordCheck
+	err      error
+}
+
+func (p *passwordPolicy) Check(password string, email string, fullname string) error {
+	p.checked = passwordCheck{password: password, email: email, fullname: fullname}
+	if p.err != nil {
+		return p.err
+	}
+	if p.rejected[password] {
+		return &users.PasswordPolicyError{
+			Violations: []users.PasswordViolation{
+				{Rule: users.PasswordStrengthRule, Message: "weak"},
+			},
+		}
+	}
+	return nil
+}
+
+func assertPasswordPolicyErr(t *testing.T, err error) {
+	t.Helper()
+
+	var policyErr *users.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("got err [%v] but want a password policy error", err)
+	}
+	if !errors.Is(err, users.InvalidUserParamErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidUserParamErr)
+	}
+}
+
+func assertPasswordReusedErr(t *testing.T, err error) {
+	t.Helper()
+
+	assertPasswordPolicyErr(t, err)
+
+	var policyErr *users.PasswordPolicyError
+	errors.As(err, &policyErr)
+
+	if len(policyErr.Violations) != 1 || policyErr.Violations[0].Rule != users.PasswordReusedRule {
+		t.Fatalf("got violations %v want only rule %q", policyErr.Violations, users.PasswordReusedRule)
+	}
+}
+
 type explodingAuthorizer struct{}
 
 func (*explodingAuthorizer) PasswordHash(string) (string, error) {
@@ -172,6 +1549,40 @@ func (*explodingAuthorizer) HashMatchesPassword(saltedhash string, password stri
 	return false
 }
 
+func (*explodingAuthorizer) PasswordNeedsRehash(saltedhash string) bool {
+	return false
+}
+
+// failingRehashAuthorizer considers all hashes outdated but fails to create new ones
+type failingRehashAuthorizer struct {
+	*auth.Authorizer
+}
+
+func (*failingRehashAuthorizer) PasswordHash(string) (string, error) {
+	return "", errors.New("injected error from failingRehashAuthorizer")
+}
+
+func (*failingRehashAuthorizer) PasswordNeedsRehash(string) bool {
+	return true
+}
+
+// recordingAuthorizer records the hashes created and compared
+type recordingAuthorizer struct {
+	*auth.Authorizer
+	hashed  int
+	matched []string
+}
+
+func (a *recordingAuthorizer) PasswordHash(pass string) (string, error) {
+	a.hashed++
+	return a.Authorizer.PasswordHash(pass)
+}
+
+func (a *recordingAuthorizer) HashMatchesPassword(saltedhash string, password string) bool {
+	a.matched = append(a.matched, saltedhash)
+	return a.Authorizer.HashMatchesPassword(saltedhash, password)
+}
+
 func parseEmail(t *testing.T, email string) users.Email {
 	t.Helper()
 
@@ -183,6 +1594,18 @@ func parseEmail(t *testing.T, email string) users.Email {
 	return s
 }
 
+func strptr(s string) *string {
+	return &s
+}
+
+func assertNoErr(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func assertValidDeadline(t *testing.T, got context.Context, want context.Context) {
 	gotDeadline, ok := got.Deadline()
 	if !ok {
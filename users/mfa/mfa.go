@@ -0,0 +1,335 @@
+// Package mfa is responsible for the multi-factor authentication of users,
+// using time based one time passwords (TOTP) and recovery codes.
+package mfa
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/users"
+)
+
+// Error represents errors related to multi-factor authentication
+// They should always be checked using errors.Is since the
+// error may be wrapped with more context.
+type Error string
+
+const (
+	NotEnrolledErr    Error = "MFA not enrolled"
+	AlreadyEnabledErr Error = "MFA already enabled"
+	InvalidCodeErr    Error = "invalid MFA code"
+)
+
+// Error returns the string representation of the error
+func (e Error) Error() string {
+	return string(e)
+}
+
+// TOTP is the TOTP enrollment of an user, it is pending
+// until the user confirms it with a valid code.
+type TOTP struct {
+	UserID    string
+	Secret    string
+	Confirmed bool
+
+	// LastUsedStep is the time step of the last code used, codes from
+	// it or previous time steps are rejected so codes can't be replayed.
+	LastUsedStep int64
+}
+
+// Store is where the MFA enrollments and recovery codes are stored.
+type Store interface {
+	// TOTP retrieves the TOTP enrollment of the user, it MUST
+	// return NotEnrolledErr (possibly wrapped) if there is none.
+	TOTP(ctx context.Context, userID string) (TOTP, error)
+
+	// SaveTOTP saves a pending TOTP enrollment, replacing any pending
+	// one. It MUST return AlreadyEnabledErr (possibly wrapped) if
+	// the user already has a confirmed enrollment.
+	SaveTOTP(ctx context.Context, userID string, secret string) error
+
+	// ConfirmTOTP confirms the pending TOTP enrollment, recording the used
+	// time step and replacing the recovery code hashes of the user.
+	// It MUST return NotEnrolledErr (possibly wrapped) if
+	// there is no pending enrollment.
+	ConfirmTOTP(ctx context.Context, userID string, step int64, recoveryCodeHashes []string) error
+
+	// UseTOTPStep records the time step as used only if it is after
+	// the last used one, otherwise it MUST return InvalidCodeErr
+	// (possibly wrapped), even when called concurrently.
+	UseTOTPStep(ctx context.Context, userID string, step int64) error
+
+	// UseRecoveryCode removes the recovery code with the given hash, it MUST
+	// return InvalidCodeErr (possibly wrapped) if the user has no such code.
+	UseRecoveryCode(ctx context.Context, userID string, hash string) error
+
+	// DeleteTOTP deletes the TOTP enrollment and the recovery codes of the
+	// user, it MUST return NotEnrolledErr (possibly wrapped) if there is none.
+	DeleteTOTP(ctx context.Context, userID string) error
+}
+
+// UsersManager is responsible for retrieving users
+type UsersManager interface {
+	// User retrieves the user with the given ID.
+	// If the user does not exist it MUST return
+	// users.UserNotFoundErr (possibly wrapped).
+	User(ctx context.Context, id string) (users.User, error)
+}
+
+// Tokens is responsible for creating single use tokens
+type Tokens interface {
+	// Create creates a new single use token for the given subject
+	Create(ctx context.Context, subject string) (string, error)
+
+	// Consume validates the token returning its subject, after that the
+	// token is not valid anymore. If the token is invalid it MUST
+	// return auth.InvalidTokenErr (possibly wrapped).
+	Consume(ctx context.Context, token string) (string, error)
+}
+
+// Config has all configuration needed for multi-factor authentication
+type Config struct {
+	// Issuer identifies the service on authenticator apps
+	Issuer string
+}
+
+// Enrollment has what users need to add the TOTP secret to their
+// authenticator apps, the URI is usually shown as a QR code.
+type Enrollment struct {
+	Secret string
+	URI    string
+}
+
+// MFA is responsible for the multi-factor authentication of users
+type MFA struct {
+	store        Store
+	usersManager UsersManager
+	challenges   Tokens
+	cfg          Config
+}
+
+// RecoveryCodesCount is how many recovery codes users get
+// when they enable MFA, each one can be used only once.
+const RecoveryCodesCount = 10
+
+// New creates a new MFA. The tokens must be exclusively
+// used for MFA challenges during sign in.
+func New(s Store, m UsersManager, challenges Tokens, cfg Config) *MFA {
+	return &MFA{
+		store:        s,
+		usersManager: m,
+		challenges:   challenges,
+		cfg:          cfg,
+	}
+}
+
+// Enroll starts the TOTP enrollment of the user, which is pending until
+// it is confirmed. Enrolling again replaces the pending enrollment.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the user does not exist: users.UserNotFoundErr
+// - If the user already has MFA enabled: AlreadyEnabledErr
+//
+// All other errors are to be considered internal errors.
+func (m *MFA) Enroll(ctx context.Context, userID string) (Enrollment, error) {
+	user, err := m.usersManager.User(ctx, userID)
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	if err := m.store.SaveTOTP(ctx, userID, secret); err != nil {
+		return Enrollment{}, err
+	}
+
+	return Enrollment{
+		Secret: secret,
+		URI:    auth.TOTPURI(m.cfg.Issuer, string(user.Email), secret),
+	}, nil
+}
+
+// Confirm confirms the pending TOTP enrollment of the user with a code
+// from the authenticator app, enabling MFA. It returns the recovery
+// codes, which must be shown to the user since they can't be retrieved
+// anymore. The following errors can be expected to be wrapped in the
+// returned error giving specific conditions:
+//
+// - If there is no pending enrollment: NotEnrolledErr
+// - If MFA is already enabled: AlreadyEnabledErr
+// - If the code is invalid: InvalidCodeErr
+//
+// All other errors are to be considered internal errors.
+func (m *MFA) Confirm(ctx context.Context, userID string, code string) ([]string, error) {
+	totp, err := m.store.TOTP(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if totp.Confirmed {
+		return nil, fmt.Errorf("%w:user %s", AlreadyEnabledErr, userID)
+	}
+
+	step, ok := auth.ValidateTOTP(totp.Secret, normalizeCode(code), time.Now())
+	if !ok {
+		return nil, fmt.Errorf("%w:user %s", InvalidCodeErr, userID)
+	}
+
+	codes := make([]string, RecoveryCodesCount)
+	hashes := make([]string, RecoveryCodesCount)
+	for i := range codes {
+		codes[i], err = newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = recoveryCodeHash(codes[i])
+	}
+
+	if err := m.store.ConfirmTOTP(ctx, userID, step, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Enabled returns true if the user has MFA enabled.
+func (m *MFA) Enabled(ctx context.Context, userID string) (bool, error) {
+	totp, err := m.store.TOTP(ctx, userID)
+	if err != nil {
+		if errors.Is(err, NotEnrolledErr) {
+			return false, nil
+		}
+		return false, err
+	}
+	return totp.Confirmed, nil
+}
+
+// Challenge creates a MFA challenge for an user that already authenticated
+// with its password, the challenge must be sent along with a code to Verify.
+func (m *MFA) Challenge(ctx context.Context, userID string) (string, error) {
+	challenge, err := m.challenges.Create(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("error creating MFA challenge:%v", err)
+	}
+	return challenge, nil
+}
+
+// Verify verifies the code (a TOTP code or a recovery code) for the given
+// challenge, returning the ID of the challenged user. Each challenge can
+// be verified only once, even if the code is invalid.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the challenge is invalid, expired or already used: auth.InvalidTokenErr
+// - If the code is invalid or MFA is not enabled anymore: InvalidCodeErr
+//
+// All other errors are to be considered internal errors.
+func (m *MFA) Verify(ctx context.Context, challenge string, code string) (string, error) {
+	// WHY: consuming the challenge on each attempt means that guessing
+	// codes requires a new challenge each time. Challenges are cheap with
+	// the password, so callers must also limit the invalid codes.
+	userID, err := m.ConsumeChallenge(ctx, challenge)
+	if err != nil {
+		return "", err
+	}
+
+	err = m.VerifyCode(ctx, userID, code)
+	if err != nil {
+		if errors.Is(err, NotEnrolledErr) {
+			return "", fmt.Errorf("%w:%v", InvalidCodeErr, err)
+		}
+		return "", err
+	}
+	return userID, nil
+}
+
+// ConsumeChallenge consumes the challenge, returning the ID of the
+// challenged user, so it can be answered by other factors than codes,
+// like passkeys. After that the challenge can't be used anymore.
+// If the challenge is invalid, expired or already used it
+// returns auth.InvalidTokenErr.
+func (m *MFA) ConsumeChallenge(ctx context.Context, challenge string) (string, error) {
+	return m.challenges.Consume(ctx, challenge)
+}
+
+// VerifyCode verifies the code (a TOTP code or a recovery code) of the user,
+// each code can be used only once.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the user doesn't have MFA enabled: NotEnrolledErr
+// - If the code is invalid or was already used: InvalidCodeErr
+//
+// All other errors are to be considered internal errors.
+func (m *MFA) VerifyCode(ctx context.Context, userID string, code string) error {
+	totp, err := m.store.TOTP(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !totp.Confirmed {
+		return fmt.Errorf("%w:user %s has a pending enrollment", NotEnrolledErr, userID)
+	}
+
+	code = normalizeCode(code)
+	if len(code) != auth.TOTPDigits {
+		return m.store.UseRecoveryCode(ctx, userID, recoveryCodeHash(code))
+	}
+
+	step, ok := auth.ValidateTOTP(totp.Secret, code, time.Now())
+	if !ok || step <= totp.LastUsedStep {
+		return fmt.Errorf("%w:user %s", InvalidCodeErr, userID)
+	}
+	return m.store.UseTOTPStep(ctx, userID, step)
+}
+
+// Reset disables MFA for the user, removing its enrollment and
+// recovery codes, like when users lose their authenticator.
+// If the user has no enrollment it returns NotEnrolledErr.
+func (m *MFA) Reset(ctx context.Context, userID string) error {
+	return m.store.DeleteTOTP(ctx, userID)
+}
+
+const recoveryCodeSize = 10
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCode creates a random recovery code formatted as
+// groups of characters separated by dashes, like: abcd-efgh-ijkl-mnop.
+func newRecoveryCode() (string, error) {
+	data := make([]byte, recoveryCodeSize)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("error generating recovery code:%v", err)
+	}
+
+	encoded := strings.ToLower(recoveryCodeEncoding.EncodeToString(data))
+	groups := []string{}
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// normalizeCode removes the formatting users may add or keep when
+// typing codes, like spaces and the dashes of recovery codes.
+func normalizeCode(code string) string {
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return strings.ToLower(code)
+}
+
+// WHY: recovery codes have enough entropy (80 bits) that a plain hash is
+// safe, unlike passwords, and it allows finding the code by its hash.
+func recoveryCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(normalizeCode(code)))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,348 @@
+package mfa_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/kvstore"
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/mfa"
+)
+
+const (
+	userID = "7"
+	email  = "mfa@test.com"
+)
+
+func TestMFAEnrollment(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	service := newMFA(m)
+	ctx := context.Background()
+
+	_, err := service.Confirm(ctx, userID, "123456")
+	assertErrIs(t, err, mfa.NotEnrolledErr)
+
+	enrollment, err := service.Enroll(ctx, userID)
+	assertNoErr(t, err)
+
+	uri, err := url.Parse(enrollment.URI)
+	assertNoErr(t, err)
+
+	if uri.Path != "/Stonks:"+email || uri.Query().Get("secret") != enrollment.Secret {
+		t.Fatalf("got URI %q for secret %q", enrollment.URI, enrollment.Secret)
+	}
+
+	assertEnabled(t, service, false)
+
+	_, err = service.Confirm(ctx, userID, "000000")
+	assertErrIs(t, err, mfa.InvalidCodeErr)
+
+	codes, err := service.Confirm(ctx, userID, totpCode(t, enrollment.Secret, time.Now()))
+	assertNoErr(t, err)
+
+	if len(codes) != mfa.RecoveryCodesCount {
+		t.Fatalf("got %d recovery codes want %d", len(codes), mfa.RecoveryCodesCount)
+	}
+	for i, code := range codes {
+		for _, other := range codes[i+1:] {
+			if code == other {
+				t.Fatalf("got repeated recovery code %q", code)
+			}
+		}
+	}
+
+	assertEnabled(t, service, true)
+
+	_, err = service.Enroll(ctx, userID)
+	assertErrIs(t, err, mfa.AlreadyEnabledErr)
+
+	_, err = service.Confirm(ctx, userID, totpCode(t, enrollment.Secret, time.Now()))
+	assertErrIs(t, err, mfa.AlreadyEnabledErr)
+
+	_, err = service.Enroll(ctx, "unknown")
+	assertErrIs(t, err, users.UserNotFoundErr)
+}
+
+func TestMFAEnrollmentCanBeRestartedUntilConfirmed(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	service := newMFA(m)
+	ctx := context.Background()
+
+	first, err := service.Enroll(ctx, userID)
+	assertNoErr(t, err)
+
+	second, err := service.Enroll(ctx, userID)
+	assertNoErr(t, err)
+
+	_, err = service.Confirm(ctx, userID, totpCode(t, first.Secret, time.Now()))
+	assertErrIs(t, err, mfa.InvalidCodeErr)
+
+	_, err = service.Confirm(ctx, userID, totpCode(t, second.Secret, time.Now()))
+	assertNoErr(t, err)
+}
+
+func TestMFAChallenge(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	service := newMFA(m)
+	ctx := context.Background()
+
+	enrollment, err := service.Enroll(ctx, userID)
+	assertNoErr(t, err)
+
+	secret := enrollment.Secret
+	confirmationCode := totpCode(t, secret, time.Now())
+	recoveryCodes, err := service.Confirm(ctx, userID, confirmationCode)
+	assertNoErr(t, err)
+
+	// The code used on the confirmation can't be used again
+	challenge := newChallenge(t, service)
+	_, err = service.Verify(ctx, challenge, confirmationCode)
+	assertErrIs(t, err, mfa.InvalidCodeErr)
+
+	// Challenges can't be used again, even after a failed attempt
+	_, err = service.Verify(ctx, challenge, totpCode(t, secret, time.Now().Add(auth.TOTPPeriod)))
+	assertErrIs(t, err, auth.InvalidTokenErr)
+
+	nextCode := totpCode(t, secret, time.Now().Add(auth.TOTPPeriod))
+	gotUserID, err := service.Verify(ctx, newChallenge(t, service), nextCode)
+	assertNoErr(t, err)
+
+	if gotUserID != userID {
+		t.Fatalf("got user ID %q want %q", gotUserID, userID)
+	}
+
+	_, err = service.Verify(ctx, newChallenge(t, service), nextCode)
+	assertErrIs(t, err, mfa.InvalidCodeErr)
+
+	// Recovery codes are accepted with any formatting, but only once
+	_, err = service.Verify(ctx, newChallenge(t, service), " "+recoveryCodes[0]+" ")
+	assertNoErr(t, err)
+
+	_, err = service.Verify(ctx, newChallenge(t, service), recoveryCodes[0])
+	assertErrIs(t, err, mfa.InvalidCodeErr)
+
+	assertNoErr(t, service.VerifyCode(ctx, userID, strings.ToUpper(recoveryCodes[1])))
+
+	_, err = service.Verify(ctx, "invalid", recoveryCodes[2])
+	assertErrIs(t, err, auth.InvalidTokenErr)
+
+	// Challenges can be consumed to be answered by other factors
+	challenge = newChallenge(t, service)
+	gotUserID, err = service.ConsumeChallenge(ctx, challenge)
+	assertNoErr(t, err)
+
+	if gotUserID != userID {
+		t.Fatalf("got user ID %q want %q", gotUserID, userID)
+	}
+
+	_, err = service.Verify(ctx, challenge, recoveryCodes[2])
+	assertErrIs(t, err, auth.InvalidTokenErr)
+}
+
+func TestMFAReset(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	service := newMFA(m)
+	ctx := context.Background()
+
+	err := service.Reset(ctx, userID)
+	assertErrIs(t, err, mfa.NotEnrolledErr)
+
+	_, recoveryCodes := enable(t, service)
+	challenge := newChallenge(t, service)
+
+	assertNoErr(t, service.Reset(ctx, userID))
+	assertEnabled(t, service, false)
+
+	_, err = service.Verify(ctx, challenge, recoveryCodes[0])
+	assertErrIs(t, err, mfa.InvalidCodeErr)
+
+	err = service.VerifyCode(ctx, userID, recoveryCodes[0])
+	assertErrIs(t, err, mfa.NotEnrolledErr)
+
+	// After a reset users can enroll again
+	enable(t, service)
+}
+
+func newMFA(m *miniredis.Miniredis) *mfa.MFA {
+	challenges := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "mfa-challenge", time.Minute)
+	usersManager := usersManager{userID: {ID: userID, Email: email}}
+	return mfa.New(newStore(), usersManager, challenges, mfa.Config{Issuer: "Stonks"})
+}
+
+// enable enables MFA for the test user, returning its secret and recovery codes
+func enable(t *testing.T, service *mfa.MFA) (string, []string) {
+	t.Helper()
+
+	enrollment, err := service.Enroll(context.Background(), userID)
+	assertNoErr(t, err)
+
+	codes, err := service.Confirm(context.Background(), userID, totpCode(t, enrollment.Secret, time.Now()))
+	assertNoErr(t, err)
+	return enrollment.Secret, codes
+}
+
+func newChallenge(t *testing.T, service *mfa.MFA) string {
+	t.Helper()
+
+	challenge, err := service.Challenge(context.Background(), userID)
+	assertNoErr(t, err)
+	return challenge
+}
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+
+	code, err := auth.TOTPCode(secret, at)
+	assertNoErr(t, err)
+	return code
+}
+
+func assertEnabled(t *testing.T, service *mfa.MFA, want bool) {
+	t.Helper()
+
+	enabled, err := service.Enabled(context.Background(), userID)
+	assertNoErr(t, err)
+
+	if enabled != want {
+		t.Fatalf("got MFA enabled %t want %t", enabled, want)
+	}
+}
+
+type usersManager map[string]users.User
+
+func (m usersManager) User(ctx context.Context, id string) (users.User, error) {
+	user, ok := m[id]
+	if !ok {
+		return users.User{}, users.UserNotFoundErr
+	}
+	return user, nil
+}
+
+type store struct {
+	mutex         sync.Mutex
+	totps         map[string]mfa.TOTP
+	recoveryCodes map[string]map[string]bool
+}
+
+func newStore() *store {
+	return &store{
+		totps:         map[string]mfa.TOTP{},
+		recoveryCodes: map[string]map[string]bool{},
+	}
+}
+
+func (s *store) TOTP(ctx context.Context, userID string) (mfa.TOTP, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	totp, ok := s.totps[userID]
+	if !ok {
+		return mfa.TOTP{}, mfa.NotEnrolledErr
+	}
+	return totp, nil
+}
+
+func (s *store) SaveTOTP(ctx context.Context, userID string, secret string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.totps[userID].Confirmed {
+		return mfa.AlreadyEnabledErr
+	}
+	s.totps[userID] = mfa.TOTP{UserID: userID, Secret: secret}
+	return nil
+}
+
+func (s *store) ConfirmTOTP(ctx context.Context, userID string, step int64, hashes []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	totp, ok := s.totps[userID]
+	if !ok || totp.Confirmed {
+		return mfa.NotEnrolledErr
+	}
+	totp.Confirmed = true
+	totp.LastUsedStep = step
+	s.totps[userID] = totp
+
+	s.recoveryCodes[userID] = map[string]bool{}
+	for _, hash := range hashes {
+		s.recoveryCodes[userID][hash] = true
+	}
+	return nil
+}
+
+func (s *store) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	totp, ok := s.totps[userID]
+	if !ok || step <= totp.LastUsedStep {
+		return mfa.InvalidCodeErr
+	}
+	totp.LastUsedStep = step
+	s.totps[userID] = totp
+	return nil
+}
+
+func (s *store) UseRecoveryCode(ctx context.Context, userID string, hash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.recoveryCodes[userID][hash] {
+		return mfa.InvalidCodeErr
+	}
+	delete(s.recoveryCodes[userID], hash)
+	return nil
+}
+
+func (s *store) DeleteTOTP(ctx context.Context, userID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.totps[userID]; !ok {
+		return mfa.NotEnrolledErr
+	}
+	delete(s.totps, userID)
+	delete(s.recoveryCodes, userID)
+	return nil
+}
+
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+
+	m, err := miniredis.Run()
+	assertNoErr(t, err)
+	return m
+}
+
+func assertErrIs(t *testing.T, err error, want error) {
+	t.Helper()
+
+	if !errors.Is(err, want) {
+		t.Fatalf("got err[%v] want[%v]", err, want)
+	}
+}
+
+func assertNoErr(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
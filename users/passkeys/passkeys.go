@@ -0,0 +1,308 @@
+// Package passkeys is responsible for the WebAuthn credentials (passkeys)
+// of users, which can be used to sign in without a password or
+// as a second factor.
+package passkeys
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/webauthn"
+	"github.com/katcipis/stonks/users"
+)
+
+// Error represents errors related to passkeys
+// They should always be checked using errors.Is since the
+// error may be wrapped with more context.
+type Error string
+
+const (
+	PasskeyNotFoundErr      Error = "passkey not found"
+	PasskeyAlreadyExistsErr Error = "passkey already exists"
+	InvalidPasskeyErr       Error = "invalid passkey"
+	InvalidPasskeyParamErr  Error = "invalid passkey parameter"
+)
+
+// Error returns the string representation of the error
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Passkey is a WebAuthn credential registered by an user
+type Passkey struct {
+	ID         string
+	UserID     string
+	Name       string
+	Credential webauthn.Credential
+	CreatedAt  time.Time
+
+	// LastUsedAt is zero if the passkey was never used to sign in
+	LastUsedAt time.Time
+}
+
+// Store is where the passkeys are stored.
+type Store interface {
+	// AddPasskey adds the passkey, returning its ID. It MUST return
+	// PasskeyAlreadyExistsErr (possibly wrapped) if there is already
+	// a passkey with the same credential ID.
+	AddPasskey(ctx context.Context, passkey Passkey) (string, error)
+
+	// PasskeyByCredentialID retrieves the passkey with the given credential
+	// ID, it MUST return PasskeyNotFoundErr (possibly wrapped) if there is none.
+	PasskeyByCredentialID(ctx context.Context, credentialID []byte) (Passkey, error)
+
+	// Passkeys retrieves all passkeys of the user, oldest first
+	Passkeys(ctx context.Context, userID string) ([]Passkey, error)
+
+	// UpdatePasskeyUsage records the new signature counter of the passkey
+	// and when it was used. It MUST return PasskeyNotFoundErr (possibly
+	// wrapped) if there is no such passkey.
+	UpdatePasskeyUsage(ctx context.Context, id string, signCount uint32, usedAt time.Time) error
+
+	// DeletePasskey deletes the passkey of the user, it MUST return
+	// PasskeyNotFoundErr (possibly wrapped) if the user has no such passkey.
+	DeletePasskey(ctx context.Context, userID string, id string) error
+}
+
+// UsersManager is responsible for retrieving users
+type UsersManager interface {
+	// User retrieves the user with the given ID.
+	// If the user does not exist it MUST return
+	// users.UserNotFoundErr (possibly wrapped).
+	User(ctx context.Context, id string) (users.User, error)
+}
+
+// Tokens is responsible for creating single use tokens
+type Tokens interface {
+	// Create creates a new single use token for the given subject
+	Create(ctx context.Context, subject string) (string, error)
+
+	// Consume validates the token returning its subject, after that the
+	// token is not valid anymore. If the token is invalid it MUST
+	// return auth.InvalidTokenErr (possibly wrapped).
+	Consume(ctx context.Context, token string) (string, error)
+}
+
+// Passkeys is responsible for the passkeys of users
+type Passkeys struct {
+	store        Store
+	usersManager UsersManager
+	challenges   Tokens
+	cfg          webauthn.Config
+}
+
+// MaxNameLen is the maximum length (in characters) of passkey names
+const MaxNameLen = 100
+
+const (
+	registrationSubject = "registration:"
+	signinSubject       = "signin"
+)
+
+// New creates a new Passkeys. The tokens must be exclusively used
+// for WebAuthn challenges and they must be base64url encoded, since
+// the challenge sent to authenticators is the decoded token.
+func New(s Store, m UsersManager, challenges Tokens, cfg webauthn.Config) *Passkeys {
+	return &Passkeys{
+		store:        s,
+		usersManager: m,
+		challenges:   challenges,
+		cfg:          cfg,
+	}
+}
+
+// BeginRegistration starts the registration of a passkey for the user,
+// returning the options that must be sent to the authenticator.
+// If the user does not exist it returns users.UserNotFoundErr.
+func (p *Passkeys) BeginRegistration(ctx context.Context, userID string) (webauthn.CreationOptions, error) {
+	user, err := p.usersManager.User(ctx, userID)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+
+	passkeys, err := p.store.Passkeys(ctx, userID)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+	exclude := make([][]byte, len(passkeys))
+	for i, passkey := range passkeys {
+		exclude[i] = passkey.Credential.ID
+	}
+
+	challenge, err := p.newChallenge(ctx, registrationSubject+userID)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+
+	// WHY: the user handle is the user ID, so signing in with
+	// discoverable credentials identifies the user directly.
+	return p.cfg.NewCreationOptions(challenge, webauthn.User{
+		ID:          []byte(userID),
+		Name:        string(user.Email),
+		DisplayName: user.FullName,
+	}, exclude), nil
+}
+
+// FinishRegistration verifies the credential created with the options from
+// BeginRegistration and adds it as a passkey of the user with the given name.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the name is invalid: InvalidPasskeyParamErr
+// - If the credential or its challenge is invalid: InvalidPasskeyErr
+// - If the credential is already registered: PasskeyAlreadyExistsErr
+//
+// All other errors are to be considered internal errors.
+func (p *Passkeys) FinishRegistration(
+	ctx context.Context,
+	userID string,
+	name string,
+	cred webauthn.RegistrationCredential,
+) (Passkey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > MaxNameLen {
+		return Passkey{}, fmt.Errorf(
+			"%w:name must have between 1 and %d characters", InvalidPasskeyParamErr, MaxNameLen)
+	}
+
+	challenge, err := p.consumeChallenge(ctx, cred.Response.ClientDataJSON, registrationSubject+userID)
+	if err != nil {
+		return Passkey{}, err
+	}
+
+	credential, err := p.cfg.VerifyRegistration(challenge, cred)
+	if err != nil {
+		return Passkey{}, fmt.Errorf("%w:%v", InvalidPasskeyErr, err)
+	}
+
+	passkey := Passkey{
+		UserID:     userID,
+		Name:       name,
+		Credential: credential,
+		CreatedAt:  time.Now(),
+	}
+	passkey.ID, err = p.store.AddPasskey(ctx, passkey)
+	if err != nil {
+		return Passkey{}, err
+	}
+	return passkey, nil
+}
+
+// BeginSignin starts the authentication with a passkey, returning the options
+// that must be sent to the authenticator. Any passkey can be used, since
+// the user is identified by the passkey.
+func (p *Passkeys) BeginSignin(ctx context.Context) (webauthn.RequestOptions, error) {
+	challenge, err := p.newChallenge(ctx, signinSubject)
+	if err != nil {
+		return webauthn.RequestOptions{}, err
+	}
+	// WHY: the same options are used for passkeys as a second factor,
+	// where user verification is not required. When it is required
+	// it is enforced by Authenticate.
+	return p.cfg.NewRequestOptions(challenge, nil, false), nil
+}
+
+// Authenticate verifies the assertion obtained with the options from
+// BeginSignin, returning the passkey used, which identifies the user.
+// When the passkey is the only factor used to sign in the user must
+// have been verified by the authenticator, so requireUserVerification
+// must be true. The following errors can be expected to be wrapped in
+// the returned error giving specific conditions:
+//
+// - If the assertion, its passkey or its challenge is invalid: InvalidPasskeyErr
+//
+// All other errors are to be considered internal errors.
+func (p *Passkeys) Authenticate(
+	ctx context.Context,
+	cred webauthn.AssertionCredential,
+	requireUserVerification bool,
+) (Passkey, error) {
+	challenge, err := p.consumeChallenge(ctx, cred.Response.ClientDataJSON, signinSubject)
+	if err != nil {
+		return Passkey{}, err
+	}
+
+	passkey, err := p.store.PasskeyByCredentialID(ctx, cred.RawID)
+	if err != nil {
+		if errors.Is(err, PasskeyNotFoundErr) {
+			return Passkey{}, fmt.Errorf("%w:%v", InvalidPasskeyErr, err)
+		}
+		return Passkey{}, err
+	}
+
+	// WHY: authenticators may omit the user handle, but if it is
+	// informed it must match the owner of the passkey.
+	userHandle := string(cred.Response.UserHandle)
+	if userHandle != "" && userHandle != passkey.UserID {
+		return Passkey{}, fmt.Errorf("%w:user handle mismatch for passkey %s", InvalidPasskeyErr, passkey.ID)
+	}
+
+	signCount, err := p.cfg.VerifyAssertion(challenge, passkey.Credential, cred, requireUserVerification)
+	if err != nil {
+		// WHY: a sign count that didn't increase may indicate a cloned
+		// authenticator, it is rejected just like invalid assertions.
+		return Passkey{}, fmt.Errorf("%w:passkey %s:%v", InvalidPasskeyErr, passkey.ID, err)
+	}
+
+	passkey.Credential.SignCount = signCount
+	passkey.LastUsedAt = time.Now()
+	if err := p.store.UpdatePasskeyUsage(ctx, passkey.ID, signCount, passkey.LastUsedAt); err != nil {
+		return Passkey{}, err
+	}
+	return passkey, nil
+}
+
+// Passkeys retrieves all passkeys of the user
+func (p *Passkeys) Passkeys(ctx context.Context, userID string) ([]Passkey, error) {
+	return p.store.Passkeys(ctx, userID)
+}
+
+// Delete deletes the passkey of the user, after that it can't be used
+// anymore. If the user has no such passkey it returns PasskeyNotFoundErr.
+func (p *Passkeys) Delete(ctx context.Context, userID string, id string) error {
+	return p.store.DeletePasskey(ctx, userID, id)
+}
+
+func (p *Passkeys) newChallenge(ctx context.Context, subject string) ([]byte, error) {
+	token, err := p.challenges.Create(ctx, subject)
+	if err != nil {
+		return nil, fmt.Errorf("error creating WebAuthn challenge:%v", err)
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("WebAuthn challenge token is not base64url:%v", err)
+	}
+	return challenge, nil
+}
+
+// consumeChallenge consumes the challenge of the client data, which must
+// have been created for the given subject, returning the raw challenge.
+func (p *Passkeys) consumeChallenge(ctx context.Context, clientDataJSON []byte, subject string) ([]byte, error) {
+	token, err := webauthn.Challenge(clientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("%w:%v", InvalidPasskeyErr, err)
+	}
+
+	gotSubject, err := p.challenges.Consume(ctx, token)
+	if err != nil {
+		if errors.Is(err, auth.InvalidTokenErr) {
+			return nil, fmt.Errorf("%w:%v", InvalidPasskeyErr, err)
+		}
+		return nil, err
+	}
+	if gotSubject != subject {
+		return nil, fmt.Errorf("%w:challenge is for %q not %q", InvalidPasskeyErr, gotSubject, subject)
+	}
+
+	challenge, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w:challenge is not base64url:%v", InvalidPasskeyErr, err)
+	}
+	return challenge, nil
+}
@@ -0,0 +1,396 @@
+package passkeys_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/kvstore"
+	"github.com/katcipis/stonks/auth/webauthn"
+	"github.com/katcipis/stonks/auth/webauthn/webauthntest"
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/passkeys"
+)
+
+const (
+	userID = "7"
+	email  = "passkeys@test.com"
+	origin = "https://stonks.test"
+)
+
+func TestPasskeyRegistration(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	service := newPasskeys(m)
+	ctx := context.Background()
+
+	opts, err := service.BeginRegistration(ctx, userID)
+	assertNoErr(t, err)
+
+	if string(opts.User.ID) != userID || opts.User.Name != email || opts.RP.ID != "stonks.test" {
+		t.Fatalf("got creation options %+v", opts)
+	}
+
+	authenticator := webauthntest.New(origin)
+	cred, err := authenticator.Register(opts)
+	assertNoErr(t, err)
+
+	passkey, err := service.FinishRegistration(ctx, userID, " laptop ", cred)
+	assertNoErr(t, err)
+
+	if passkey.ID == "" || passkey.UserID != userID || passkey.Name != "laptop" ||
+		!bytes.Equal(passkey.Credential.ID, authenticator.CredentialID()) {
+		t.Fatalf("got passkey %+v", passkey)
+	}
+
+	// The challenge can't be used again
+	_, err = service.FinishRegistration(ctx, userID, "laptop", cred)
+	assertErrIs(t, err, passkeys.InvalidPasskeyErr)
+
+	// Registered passkeys are excluded from new registrations
+	opts, err = service.BeginRegistration(ctx, userID)
+	assertNoErr(t, err)
+
+	if len(opts.ExcludeCredentials) != 1 || !bytes.Equal(opts.ExcludeCredentials[0].ID, passkey.Credential.ID) {
+		t.Fatalf("got excluded credentials %+v", opts.ExcludeCredentials)
+	}
+
+	got, err := service.Passkeys(ctx, userID)
+	assertNoErr(t, err)
+
+	if len(got) != 1 || got[0].ID != passkey.ID {
+		t.Fatalf("got passkeys %+v want %+v", got, passkey)
+	}
+
+	_, err = service.BeginRegistration(ctx, "unknown")
+	assertErrIs(t, err, users.UserNotFoundErr)
+}
+
+func TestInvalidPasskeyRegistration(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	service := newPasskeys(m)
+	ctx := context.Background()
+
+	register := func(name string, origin string) error {
+		opts, err := service.BeginRegistration(ctx, userID)
+		assertNoErr(t, err)
+
+		cred, err := webauthntest.New(origin).Register(opts)
+		assertNoErr(t, err)
+
+		_, err = service.FinishRegistration(ctx, userID, name, cred)
+		return err
+	}
+
+	assertErrIs(t, register("", origin), passkeys.InvalidPasskeyParamErr)
+	assertErrIs(t, register("   ", origin), passkeys.InvalidPasskeyParamErr)
+	assertErrIs(t, register(strings.Repeat("a", passkeys.MaxNameLen+1), origin), passkeys.InvalidPasskeyParamErr)
+	assertErrIs(t, register("phone", "https://evil.test"), passkeys.InvalidPasskeyErr)
+	assertNoErr(t, register(strings.Repeat("a", passkeys.MaxNameLen), origin))
+
+	// Registration challenges are bound to the user
+	opts, err := service.BeginRegistration(ctx, userID)
+	assertNoErr(t, err)
+
+	cred, err := webauthntest.New(origin).Register(opts)
+	assertNoErr(t, err)
+
+	_, err = service.FinishRegistration(ctx, "other", "phone", cred)
+	assertErrIs(t, err, passkeys.InvalidPasskeyErr)
+
+	// Signin challenges can't be used to register
+	signinOpts, err := service.BeginSignin(ctx)
+	assertNoErr(t, err)
+
+	opts.Challenge = signinOpts.Challenge
+	cred, err = webauthntest.New(origin).Register(opts)
+	assertNoErr(t, err)
+
+	_, err = service.FinishRegistration(ctx, userID, "phone", cred)
+	assertErrIs(t, err, passkeys.InvalidPasskeyErr)
+}
+
+func TestPasskeySignin(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	service := newPasskeys(m)
+	ctx := context.Background()
+
+	authenticator, registered := register(t, service)
+
+	for i := 0; i < 3; i++ {
+		passkey, err := service.Authenticate(ctx, login(t, service, authenticator), true)
+		assertNoErr(t, err)
+
+		if passkey.ID != registered.ID || passkey.UserID != userID || passkey.LastUsedAt.IsZero() {
+			t.Fatalf("got passkey %+v want %+v", passkey, registered)
+		}
+	}
+
+	// Challenges can't be used again
+	opts, err := service.BeginSignin(ctx)
+	assertNoErr(t, err)
+
+	assertion, err := authenticator.Login(opts)
+	assertNoErr(t, err)
+
+	_, err = service.Authenticate(ctx, assertion, true)
+	assertNoErr(t, err)
+
+	assertion, err = authenticator.Login(opts)
+	assertNoErr(t, err)
+
+	_, err = service.Authenticate(ctx, assertion, true)
+	assertErrIs(t, err, passkeys.InvalidPasskeyErr)
+
+	// Registration challenges can't be used to sign in
+	regOpts, err := service.BeginRegistration(ctx, userID)
+	assertNoErr(t, err)
+
+	opts.Challenge = regOpts.Challenge
+	assertion, err = authenticator.Login(opts)
+	assertNoErr(t, err)
+
+	_, err = service.Authenticate(ctx, assertion, true)
+	assertErrIs(t, err, passkeys.InvalidPasskeyErr)
+}
+
+func TestPasskeySigninUserVerification(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	service := newPasskeys(m)
+	ctx := context.Background()
+
+	authenticator, _ := register(t, service)
+	authenticator.SkipUserVerification = true
+
+	_, err := service.Authenticate(ctx, login(t, service, authenticator), true)
+	assertErrIs(t, err, passkeys.InvalidPasskeyErr)
+
+	// As a second factor the user presence is enough
+	_, err = service.Authenticate(ctx, login(t, service, authenticator), false)
+	assertNoErr(t, err)
+}
+
+func TestPasskeySigninRejectsClonedAuthenticators(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	service := newPasskeys(m)
+	ctx := context.Background()
+
+	authenticator, _ := register(t, service)
+	clone := *authenticator
+
+	_, err := service.Authenticate(ctx, login(t, service, authenticator), true)
+	assertNoErr(t, err)
+
+	_, err = service.Authenticate(ctx, login(t, service, &clone), true)
+	assertErrIs(t, err, passkeys.InvalidPasskeyErr)
+}
+
+func TestPasskeySigninRejectsUnknownPasskeys(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	service := newPasskeys(m)
+	ctx := context.Background()
+
+	authenticator, passkey := register(t, service)
+	assertNoErr(t, service.Delete(ctx, userID, passkey.ID))
+
+	_, err := service.Authenticate(ctx, login(t, service, authenticator), true)
+	assertErrIs(t, err, passkeys.InvalidPasskeyErr)
+
+	err = service.Delete(ctx, userID, passkey.ID)
+	assertErrIs(t, err, passkeys.PasskeyNotFoundErr)
+
+	// User handles must match the owner of the passkey
+	authenticator, _ = register(t, service)
+	assertion := login(t, service, authenticator)
+	assertion.Response.UserHandle = []byte("other")
+
+	_, err = service.Authenticate(ctx, assertion, true)
+	assertErrIs(t, err, passkeys.InvalidPasskeyErr)
+}
+
+func TestPasskeyDeleteIsScopedToTheUser(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	service := newPasskeys(m)
+	ctx := context.Background()
+
+	_, passkey := register(t, service)
+
+	err := service.Delete(ctx, "other", passkey.ID)
+	assertErrIs(t, err, passkeys.PasskeyNotFoundErr)
+
+	got, err := service.Passkeys(ctx, userID)
+	assertNoErr(t, err)
+
+	if len(got) != 1 {
+		t.Fatalf("got passkeys %+v", got)
+	}
+}
+
+func newPasskeys(m *miniredis.Miniredis) *passkeys.Passkeys {
+	challenges := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "webauthn-challenge", time.Minute)
+	usersManager := usersManager{userID: {ID: userID, Email: email, FullName: "Passkeys"}}
+	return passkeys.New(newStore(), usersManager, challenges, webauthn.Config{
+		RPID:    "stonks.test",
+		RPName:  "Stonks",
+		Origins: []string{origin},
+		Timeout: time.Minute,
+	})
+}
+
+// register registers a new passkey for the test user
+func register(t *testing.T, service *passkeys.Passkeys) (*webauthntest.Authenticator, passkeys.Passkey) {
+	t.Helper()
+
+	opts, err := service.BeginRegistration(context.Background(), userID)
+	assertNoErr(t, err)
+
+	authenticator := webauthntest.New(origin)
+	cred, err := authenticator.Register(opts)
+	assertNoErr(t, err)
+
+	passkey, err := service.FinishRegistration(context.Background(), userID, "passkey", cred)
+	assertNoErr(t, err)
+	return authenticator, passkey
+}
+
+func login(t *testing.T, service *passkeys.Passkeys, authenticator *webauthntest.Authenticator) webauthn.AssertionCredential {
+	t.Helper()
+
+	opts, err := service.BeginSignin(context.Background())
+	assertNoErr(t, err)
+
+	assertion, err := authenticator.Login(opts)
+	assertNoErr(t, err)
+	return assertion
+}
+
+type usersManager map[string]users.User
+
+func (m usersManager) User(ctx context.Context, id string) (users.User, error) {
+	user, ok := m[id]
+	if !ok {
+		return users.User{}, users.UserNotFoundErr
+	}
+	return user, nil
+}
+
+type store struct {
+	mutex    sync.Mutex
+	nextID   int
+	passkeys []passkeys.Passkey
+}
+
+func newStore() *store {
+	return &store{}
+}
+
+func (s *store) AddPasskey(ctx context.Context, passkey passkeys.Passkey) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, p := range s.passkeys {
+		if bytes.Equal(p.Credential.ID, passkey.Credential.ID) {
+			return "", passkeys.PasskeyAlreadyExistsErr
+		}
+	}
+	s.nextID++
+	passkey.ID = strconv.Itoa(s.nextID)
+	s.passkeys = append(s.passkeys, passkey)
+	return passkey.ID, nil
+}
+
+func (s *store) PasskeyByCredentialID(ctx context.Context, credentialID []byte) (passkeys.Passkey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, p := range s.passkeys {
+		if bytes.Equal(p.Credential.ID, credentialID) {
+			return p, nil
+		}
+	}
+	return passkeys.Passkey{}, passkeys.PasskeyNotFoundErr
+}
+
+func (s *store) Passkeys(ctx context.Context, userID string) ([]passkeys.Passkey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	found := []passkeys.Passkey{}
+	for _, p := range s.passkeys {
+		if p.UserID == userID {
+			found = append(found, p)
+		}
+	}
+	return found, nil
+}
+
+func (s *store) UpdatePasskeyUsage(ctx context.Context, id string, signCount uint32, usedAt time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, p := range s.passkeys {
+		if p.ID == id {
+			s.passkeys[i].Credential.SignCount = signCount
+			s.passkeys[i].LastUsedAt = usedAt
+			return nil
+		}
+	}
+	return passkeys.PasskeyNotFoundErr
+}
+
+func (s *store) DeletePasskey(ctx context.Context, userID string, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, p := range s.passkeys {
+		if p.ID == id && p.UserID == userID {
+			s.passkeys = append(s.passkeys[:i], s.passkeys[i+1:]...)
+			return nil
+		}
+	}
+	return passkeys.PasskeyNotFoundErr
+}
+
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+
+	m, err := miniredis.Run()
+	assertNoErr(t, err)
+	return m
+}
+
+func assertErrIs(t *testing.T, err error, want error) {
+	t.Helper()
+
+	if !errors.Is(err, want) {
+		t.Fatalf("got err[%v] want[%v]", err, want)
+	}
+}
+
+func assertNoErr(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
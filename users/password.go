@@ -0,0 +1,52 @@
+package users
+
+import "strings"
+
+// PasswordRule identifies a rule of a password policy
+type PasswordRule string
+
+const (
+	// PasswordMinLengthRule requires passwords with a minimum length
+	PasswordMinLengthRule PasswordRule = "min_length"
+
+	// PasswordStrengthRule requires passwords hard to guess, like
+	// passwords without common words, sequences or repetitions.
+	PasswordStrengthRule PasswordRule = "strength"
+
+	// PasswordPersonalInfoRule forbids passwords containing information
+	// of the user, like the email or the name.
+	PasswordPersonalInfoRule PasswordRule = "personal_info"
+
+	// PasswordBreachedRule forbids passwords leaked on data breaches
+	PasswordBreachedRule PasswordRule = "breached"
+
+	// PasswordReusedRule forbids reusing the most recent passwords of the user
+	PasswordReusedRule PasswordRule = "reused"
+)
+
+// PasswordViolation is a rule of a password policy violated by a password
+type PasswordViolation struct {
+	Rule    PasswordRule
+	Message string
+}
+
+// PasswordPolicyError is the error of passwords that violate a password
+// policy, it wraps InvalidUserParamErr so it can be checked with errors.Is
+// like any other invalid param. To get the violated rules use errors.As.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+// Error returns the string representation of the error
+func (e *PasswordPolicyError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		msgs[i] = violation.Message
+	}
+	return string(InvalidUserParamErr) + ":password violates policy:" + strings.Join(msgs, ", ")
+}
+
+// Unwrap returns InvalidUserParamErr
+func (e *PasswordPolicyError) Unwrap() error {
+	return InvalidUserParamErr
+}
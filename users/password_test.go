@@ -0,0 +1,40 @@
+package users_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/katcipis/stonks/users"
+)
+
+func TestPasswordPolicyError(t *testing.T) {
+	violations := []users.PasswordViolation{
+		{Rule: users.PasswordMinLengthRule, Message: "too short"},
+		{Rule: users.PasswordBreachedRule, Message: "breached"},
+	}
+
+	err := fmt.Errorf("wrapped:%w", &users.PasswordPolicyError{Violations: violations})
+
+	if !errors.Is(err, users.InvalidUserParamErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidUserParamErr)
+	}
+
+	var policyErr *users.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("err [%v] should be a password policy error", err)
+	}
+	if len(policyErr.Violations) != len(violations) {
+		t.Fatalf("got violations %v want %v", policyErr.Violations, violations)
+	}
+	for i, want := range violations {
+		if got := policyErr.Violations[i]; got != want {
+			t.Errorf("got violation %v want %v", got, want)
+		}
+	}
+
+	const wantMsg = "user has invalid param:password violates policy:too short, breached"
+	if got := policyErr.Error(); got != wantMsg {
+		t.Fatalf("got message %q want %q", got, wantMsg)
+	}
+}
@@ -0,0 +1,94 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BreachedDir checks passwords against a corpus of SHA-1 hashes of breached
+// passwords stored on a directory, so it works offline. The corpus uses
+// the k-anonymity range format of the Have I Been Pwned API:
+// https://haveibeenpwned.com/API/v3#SearchingPwnedPasswordsByRange
+//
+// Each file is named with the first 5 hexadecimal characters of the hashes
+// (like 21BD1 or 21BD1.txt), with one line per hash with the remaining
+// 35 characters and how many times the password was seen, like:
+//
+//	0018A45C4D1DEF81644B54AB7F969B88D65:10
+//
+// Only the file with the prefix of the checked password is read,
+// missing files are considered to have no breached passwords.
+type BreachedDir struct {
+	dir string
+}
+
+const breachedPrefixSize = 5
+
+// NewBreachedDir creates a new BreachedDir with the corpus on the given dir.
+func NewBreachedDir(dir string) (*BreachedDir, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid breached passwords dir:%v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("breached passwords path %q is not a directory", dir)
+	}
+	return &BreachedDir{dir: dir}, nil
+}
+
+// Breached returns true if the password is on the corpus.
+func (b *BreachedDir) Breached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:breachedPrefixSize], hash[breachedPrefixSize:]
+
+	file, err := b.openRange(prefix)
+	if err != nil {
+		return false, err
+	}
+	if file == nil {
+		return false, nil
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 || !strings.EqualFold(fields[0], suffix) {
+			continue
+		}
+		// WHY: ranges may be padded with fake hashes seen zero times, see:
+		// https://haveibeenpwned.com/API/v3#PwnedPasswordsPadding
+		count, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid breached passwords range %q line %q:%v", prefix, line, err)
+		}
+		return count > 0, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("error reading breached passwords range %q:%v", prefix, err)
+	}
+	return false, nil
+}
+
+// openRange opens the file of the range with the given prefix,
+// returning nil if there is no file for the range.
+func (b *BreachedDir) openRange(prefix string) (*os.File, error) {
+	for _, name := range []string{prefix, prefix + ".txt"} {
+		file, err := os.Open(filepath.Join(b.dir, name))
+		if err == nil {
+			return file, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error opening breached passwords range %q:%v", prefix, err)
+		}
+	}
+	return nil, nil
+}
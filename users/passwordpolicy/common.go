@@ -0,0 +1,49 @@
+package passwordpolicy
+
+// commonPasswords are some of the most used passwords (and words used on
+// passwords) ordered by popularity, compiled from public data breaches.
+var commonPasswords = []string{
+	"123456", "password", "12345678", "qwerty", "123456789", "12345", "1234",
+	"111111", "1234567", "dragon", "123123", "baseball", "abc123", "football",
+	"monkey", "letmein", "696969", "shadow", "master", "666666", "qwertyuiop",
+	"123321", "mustang", "1234567890", "michael", "654321", "superman",
+	"1qaz2wsx", "7777777", "121212", "000000", "qazwsx", "123qwe", "killer",
+	"trustno1", "jordan", "jennifer", "zxcvbnm", "asdfgh", "hunter", "buster",
+	"soccer", "harley", "batman", "andrew", "tigger", "sunshine", "iloveyou",
+	"2000", "charlie", "robert", "thomas", "hockey", "ranger", "daniel",
+	"starwars", "klaster", "112233", "george", "computer", "michelle",
+	"jessica", "pepper", "1111", "zxcvbn", "555555", "11111111", "131313",
+	"freedom", "777777", "pass", "maggie", "159753", "aaaaaa", "ginger",
+	"princess", "joshua", "cheese", "amanda", "summer", "love", "ashley",
+	"nicole", "chelsea", "biteme", "matthew", "access", "yankees", "987654321",
+	"dallas", "austin", "thunder", "taylor", "matrix", "admin", "welcome",
+	"login", "passw0rd", "solo", "hello", "secret", "qwerty123", "football1",
+	"monkey1", "changeme", "default", "guest", "root", "test", "user",
+	"stonks", "money", "winter", "spring", "autumn", "flower", "dragon1",
+	"lovely", "friend", "family", "orange", "purple", "banana", "cookie",
+	"chocolate", "angel", "baby", "blink182", "shadow1", "soccer1",
+	"whatever", "nothing", "letmein1", "sunshine1", "iloveyou1", "password1",
+	"password123", "welcome1", "admin123", "abc", "qwe", "asd", "zxc",
+}
+
+// maxWordSize is the size of the longest common password
+// (years are shorter), no longer words need to be checked.
+var maxWordSize = func() int {
+	size := 0
+	for _, password := range commonPasswords {
+		if n := len([]rune(password)); n > size {
+			size = n
+		}
+	}
+	return size
+}()
+
+var commonPasswordsRank = func() map[string]int {
+	ranks := make(map[string]int, len(commonPasswords))
+	for i, password := range commonPasswords {
+		if _, ok := ranks[password]; !ok {
+			ranks[password] = i + 1
+		}
+	}
+	return ranks
+}()
@@ -0,0 +1,183 @@
+package passwordpolicy
+
+import (
+	"math"
+	"strconv"
+	"unicode"
+)
+
+// Entropy estimates the entropy of the password in bits, considering how
+// attackers guess passwords: common passwords, keyboard patterns, sequences,
+// repetitions and years are much cheaper to guess than random characters.
+//
+// It is a simplified version of zxcvbn (https://github.com/dropbox/zxcvbn),
+// the password is split in the sequence of patterns that is the cheapest
+// to guess and the entropy is the sum of the entropy of each pattern.
+func Entropy(password string) float64 {
+	runes := []rune(password)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	// WHY: best[i] is the entropy of the cheapest way to guess the
+	// first i characters, patterns can only extend a guessed prefix.
+	best := make([]float64, len(runes)+1)
+	for i := 1; i < len(best); i++ {
+		best[i] = math.Inf(1)
+	}
+
+	for start := 0; start < len(runes); start++ {
+		guess := func(end int, bits float64) {
+			if best[start]+bits < best[end] {
+				best[end] = best[start] + bits
+			}
+		}
+
+		guess(start+1, charBits(runes[start]))
+
+		for end := start + minPatternSize; end <= len(runes) && end-start <= maxWordSize; end++ {
+			word := string(lower[start:end])
+			if rank, ok := commonPasswordsRank[word]; ok {
+				guess(end, math.Log2(float64(rank))+caseBits(runes[start:end]))
+			}
+			if rank, ok := commonPasswordsRank[reverse(word)]; ok {
+				guess(end, math.Log2(float64(rank))+caseBits(runes[start:end])+1)
+			}
+			if year, err := strconv.Atoi(word); err == nil && len(word) == 4 && year >= 1900 && year < 2100 {
+				guess(end, math.Log2(200))
+			}
+		}
+
+		if size := repeatSize(lower[start:]); size >= minPatternSize {
+			for end := start + minPatternSize; end <= start+size; end++ {
+				guess(end, charBits(runes[start])+math.Log2(float64(end-start)))
+			}
+		}
+
+		if size := sequenceSize(lower[start:]); size >= minPatternSize {
+			for end := start + minPatternSize; end <= start+size; end++ {
+				guess(end, charBits(runes[start])+math.Log2(float64(end-start))+1)
+			}
+		}
+
+		if size := keyboardSize(lower[start:]); size >= minPatternSize {
+			for end := start + minPatternSize; end <= start+size; end++ {
+				guess(end, math.Log2(float64(keyboardKeys))+math.Log2(float64(end-start))+1)
+			}
+		}
+	}
+
+	return best[len(runes)]
+}
+
+// minPatternSize is the minimum size of patterns, smaller
+// patterns are not cheaper to guess than their characters.
+const minPatternSize = 3
+
+// charBits is the entropy of a random character from the same class
+func charBits(r rune) float64 {
+	switch {
+	case r >= '0' && r <= '9':
+		return math.Log2(10)
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		return math.Log2(26)
+	case r < unicode.MaxASCII:
+		return math.Log2(33)
+	}
+	return math.Log2(100)
+}
+
+// caseBits is the entropy added by the capitalization of a word, the
+// usual capitalizations (all lower, all upper or only the first upper)
+// add a single bit, others add a bit per upper case character.
+func caseBits(word []rune) float64 {
+	upper := 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 0
+	case upper == len(word), upper == 1 && unicode.IsUpper(word[0]):
+		return 1
+	}
+	return float64(upper)
+}
+
+// repeatSize returns how many times the first character is repeated
+func repeatSize(runes []rune) int {
+	size := 1
+	for size < len(runes) && runes[size] == runes[0] {
+		size++
+	}
+	return size
+}
+
+// sequenceSize returns the size of the ascending or descending sequence
+// of characters (like "abc" or "987") at the start of runes.
+func sequenceSize(runes []rune) int {
+	if len(runes) < 2 || !sameClass(runes[0], runes[1]) {
+		return 1
+	}
+	delta := runes[1] - runes[0]
+	if delta != 1 && delta != -1 {
+		return 1
+	}
+	size := 2
+	for size < len(runes) && runes[size]-runes[size-1] == delta && sameClass(runes[size], runes[0]) {
+		size++
+	}
+	return size
+}
+
+func sameClass(a rune, b rune) bool {
+	return unicode.IsDigit(a) == unicode.IsDigit(b) && unicode.IsLetter(a) == unicode.IsLetter(b)
+}
+
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+const keyboardKeys = 47
+
+// keyboardSize returns the size of the sequence of adjacent keys on the same
+// row of the keyboard (like "qwerty" or "lkjh") at the start of runes.
+func keyboardSize(runes []rune) int {
+	best := 1
+	for _, row := range keyboardRows {
+		keys := []rune(row)
+		for i, key := range keys {
+			if key != runes[0] {
+				continue
+			}
+			for _, step := range []int{1, -1} {
+				size := 1
+				for size < len(runes) {
+					next := i + step*size
+					if next < 0 || next >= len(keys) || keys[next] != runes[size] {
+						break
+					}
+					size++
+				}
+				if size > best {
+					best = size
+				}
+			}
+		}
+	}
+	return best
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
@@ -0,0 +1,59 @@
+package passwordpolicy_test
+
+import (
+	"testing"
+
+	"github.com/katcipis/stonks/users/passwordpolicy"
+)
+
+func TestEntropy(t *testing.T) {
+	type Test struct {
+		password string
+		min      float64
+		max      float64
+	}
+
+	tests := []Test{
+		{password: "", min: 0, max: 0},
+		{password: "password", min: 0, max: 2},
+		{password: "Password", min: 1, max: 3},
+		{password: "drowssap", min: 1, max: 3},
+		{password: "password123", min: 1, max: 10},
+		{password: "aaaaaaaaaaaaaaaa", min: 4, max: 10},
+		{password: "abcdefghijklmnop", min: 4, max: 10},
+		{password: "9876543210", min: 4, max: 10},
+		{password: "qwertyuiop", min: 4, max: 12},
+		{password: "1984", min: 4, max: 10},
+		{password: "x7#Kq2!m", min: 35, max: 50},
+		{password: "correct horse battery staple", min: 100, max: 150},
+	}
+
+	for _, test := range tests {
+		got := passwordpolicy.Entropy(test.password)
+		if got < test.min || got > test.max {
+			t.Errorf("password %q: got entropy %.2f want between %.2f and %.2f", test.password, got, test.min, test.max)
+		}
+	}
+}
+
+func TestEntropyPatternsAreCheaperThanRandomCharacters(t *testing.T) {
+	type Test struct {
+		weak   string
+		strong string
+	}
+
+	tests := []Test{
+		{weak: "monkeymonkey", strong: "mqnkeyzonkwy"},
+		{weak: "abc123xyz", strong: "akc193xqz"},
+		{weak: "asdfghjkl", strong: "asfdhgjlk"},
+		{weak: "dragon2020", strong: "drxgon2q20"},
+	}
+
+	for _, test := range tests {
+		weak := passwordpolicy.Entropy(test.weak)
+		strong := passwordpolicy.Entropy(test.strong)
+		if weak >= strong {
+			t.Errorf("password %q (%.2f bits) should be weaker than %q (%.2f bits)", test.weak, weak, test.strong, strong)
+		}
+	}
+}
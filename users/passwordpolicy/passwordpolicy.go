@@ -0,0 +1,118 @@
+// Package passwordpolicy checks if passwords are strong enough
+// to be used, according to a configurable policy.
+package passwordpolicy
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/katcipis/stonks/users"
+)
+
+// BreachedPasswords checks if passwords were leaked on data breaches
+type BreachedPasswords interface {
+	Breached(password string) (bool, error)
+}
+
+// Config has the rules of the policy, zero values disable rules
+type Config struct {
+	// MinLength is the minimum number of characters of passwords
+	MinLength int
+
+	// MinEntropy is the minimum entropy of passwords in bits, as estimated
+	// by Entropy. Around 30 bits is enough against online attacks
+	// (attackers are rate limited), offline attacks need way more.
+	MinEntropy float64
+
+	// PersonalInfo forbids passwords containing the email
+	// (without the domain) or the name of the user.
+	PersonalInfo bool
+
+	// Breached forbids passwords leaked on data breaches, see BreachedDir.
+	Breached BreachedPasswords
+}
+
+// Policy checks passwords against the rules of its configuration
+type Policy struct {
+	cfg Config
+}
+
+// minPersonalInfoSize avoids forbidding passwords because of
+// short names, like "Li", that are common in any text.
+const minPersonalInfoSize = 3
+
+// New creates a new password policy with the given rules.
+func New(cfg Config) *Policy {
+	return &Policy{cfg: cfg}
+}
+
+// Check checks the password of the user with the given email and
+// full name, returning a *users.PasswordPolicyError with all the
+// rules violated by the password.
+// All other errors are to be considered internal errors.
+func (p *Policy) Check(password string, email string, fullname string) error {
+	violations := []users.PasswordViolation{}
+
+	if utf8.RuneCountInString(password) < p.cfg.MinLength {
+		violations = append(violations, users.PasswordViolation{
+			Rule:    users.PasswordMinLengthRule,
+			Message: fmt.Sprintf("password must have at least %d characters", p.cfg.MinLength),
+		})
+	}
+
+	if p.cfg.MinEntropy > 0 && Entropy(password) < p.cfg.MinEntropy {
+		violations = append(violations, users.PasswordViolation{
+			Rule:    users.PasswordStrengthRule,
+			Message: "password is too easy to guess, avoid common words, sequences and repetitions",
+		})
+	}
+
+	if p.cfg.PersonalInfo && hasPersonalInfo(password, email, fullname) {
+		violations = append(violations, users.PasswordViolation{
+			Rule:    users.PasswordPersonalInfoRule,
+			Message: "password must not contain the email or name of the user",
+		})
+	}
+
+	if p.cfg.Breached != nil {
+		breached, err := p.cfg.Breached.Breached(password)
+		if err != nil {
+			return fmt.Errorf("error checking breached passwords:%v", err)
+		}
+		if breached {
+			violations = append(violations, users.PasswordViolation{
+				Rule:    users.PasswordBreachedRule,
+				Message: "password was leaked on a data breach",
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &users.PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func hasPersonalInfo(password string, email string, fullname string) bool {
+	password = strings.ToLower(password)
+
+	infos := strings.Fields(strings.ToLower(fullname))
+	if len(infos) > 1 {
+		infos = append(infos, strings.Join(infos, ""))
+	}
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		email = email[:i]
+	}
+	infos = append(infos, strings.ToLower(strings.TrimSpace(email)))
+
+	for _, info := range infos {
+		if utf8.RuneCountInString(info) < minPersonalInfoSize {
+			continue
+		}
+		if strings.Contains(password, info) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,282 @@
+package passwordpolicy_test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/passwordpolicy"
+)
+
+func TestPolicy(t *testing.T) {
+	const (
+		email    = "jane.doe@stonks.com"
+		fullname = "Jane Smith"
+	)
+
+	breached := breachedPasswords{"leaked password 2020": true}
+
+	type Test struct {
+		name     string
+		cfg      passwordpolicy.Config
+		password string
+		want     []users.PasswordRule
+	}
+
+	tests := []Test{
+		{
+			name:     "NoRules",
+			cfg:      passwordpolicy.Config{},
+			password: "a",
+		},
+		{
+			name:     "MinLength",
+			cfg:      passwordpolicy.Config{MinLength: 8},
+			password: "1234567",
+			want:     []users.PasswordRule{users.PasswordMinLengthRule},
+		},
+		{
+			name:     "MinLengthCountsCharacters",
+			cfg:      passwordpolicy.Config{MinLength: 4},
+			password: "ççç",
+			want:     []users.PasswordRule{users.PasswordMinLengthRule},
+		},
+		{
+			name:     "MinLengthSatisfied",
+			cfg:      passwordpolicy.Config{MinLength: 8},
+			password: "12345678",
+		},
+		{
+			name:     "WeakPassword",
+			cfg:      passwordpolicy.Config{MinEntropy: 30},
+			password: "Password123",
+			want:     []users.PasswordRule{users.PasswordStrengthRule},
+		},
+		{
+			name:     "StrongPassword",
+			cfg:      passwordpolicy.Config{MinEntropy: 30},
+			password: "correct horse battery staple",
+		},
+		{
+			name:     "ContainsEmail",
+			cfg:      passwordpolicy.Config{PersonalInfo: true},
+			password: "my Jane.Doe password",
+			want:     []users.PasswordRule{users.PasswordPersonalInfoRule},
+		},
+		{
+			name:     "ContainsName",
+			cfg:      passwordpolicy.Config{PersonalInfo: true},
+			password: "smith for president",
+			want:     []users.PasswordRule{users.PasswordPersonalInfoRule},
+		},
+		{
+			name:     "ContainsFullName",
+			cfg:      passwordpolicy.Config{PersonalInfo: true},
+			password: "iamjanesmith",
+			want:     []users.PasswordRule{users.PasswordPersonalInfoRule},
+		},
+		{
+			name:     "ContainsEmailDomain",
+			cfg:      passwordpolicy.Config{PersonalInfo: true},
+			password: "stonks to the moon",
+		},
+		{
+			name:     "Breached",
+			cfg:      passwordpolicy.Config{Breached: breached},
+			password: "leaked password 2020",
+			want:     []users.PasswordRule{users.PasswordBreachedRule},
+		},
+		{
+			name:     "NotBreached",
+			cfg:      passwordpolicy.Config{Breached: breached},
+			password: "unknown password 2020",
+		},
+		{
+			name: "AllRules",
+			cfg: passwordpolicy.Config{
+				MinLength:    8,
+				MinEntropy:   30,
+				PersonalInfo: true,
+				Breached:     breachedPasswords{"jane": true},
+			},
+			password: "jane",
+			want: []users.PasswordRule{
+				users.PasswordMinLengthRule,
+				users.PasswordStrengthRule,
+				users.PasswordPersonalInfoRule,
+				users.PasswordBreachedRule,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := passwordpolicy.New(test.cfg)
+			err := policy.Check(test.password, email, fullname)
+
+			if len(test.want) == 0 {
+				assertNoErr(t, err)
+				return
+			}
+
+			if !errors.Is(err, users.InvalidUserParamErr) {
+				t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidUserParamErr)
+			}
+
+			var policyErr *users.PasswordPolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("err [%v] should be a password policy error", err)
+			}
+
+			got := []users.PasswordRule{}
+			for _, violation := range policyErr.Violations {
+				if violation.Message == "" {
+					t.Errorf("violation of rule %q has no message", violation.Rule)
+				}
+				got = append(got, violation.Rule)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got violated rules %v want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPolicyFailsWhenBreachedCheckFails(t *testing.T) {
+	policy := passwordpolicy.New(passwordpolicy.Config{Breached: explodingBreachedPasswords{}})
+
+	err := policy.Check("some password", "test@stonks.com", "Test")
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if errors.Is(err, users.InvalidUserParamErr) {
+		t.Fatalf("got err [%v] but want an internal error", err)
+	}
+}
+
+func TestBreachedDir(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeBreachedRange(t, dir, "", map[string]string{
+		"password": "3303003",
+		"padding":  "0",
+	})
+	writeBreachedRange(t, dir, ".txt", map[string]string{
+		"123456": "24230577",
+	})
+
+	breached, err := passwordpolicy.NewBreachedDir(dir)
+	assertNoErr(t, err)
+
+	type Test struct {
+		password string
+		want     bool
+	}
+
+	tests := []Test{
+		{password: "password", want: true},
+		{password: "123456", want: true},
+		{password: "padding", want: false},
+		{password: "Password", want: false},
+		{password: "unknown", want: false},
+	}
+
+	for _, test := range tests {
+		got, err := breached.Breached(test.password)
+		assertNoErr(t, err)
+
+		if got != test.want {
+			t.Errorf("password %q: got breached %t want %t", test.password, got, test.want)
+		}
+	}
+}
+
+func TestBreachedDirInvalidRange(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeBreachedRange(t, dir, "", map[string]string{"password": "many"})
+
+	breached, err := passwordpolicy.NewBreachedDir(dir)
+	assertNoErr(t, err)
+
+	_, err = breached.Breached("password")
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
+func TestNewBreachedDirFailsWithoutDir(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	_, err := passwordpolicy.NewBreachedDir(filepath.Join(dir, "unknown"))
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+
+	file := filepath.Join(dir, "file")
+	assertNoErr(t, ioutil.WriteFile(file, nil, 0600))
+
+	_, err = passwordpolicy.NewBreachedDir(file)
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
+// breachedPasswords is a simple in memory corpus used in tests
+type breachedPasswords map[string]bool
+
+func (b breachedPasswords) Breached(password string) (bool, error) {
+	return b[password], nil
+}
+
+type explodingBreachedPasswords struct{}
+
+func (explodingBreachedPasswords) Breached(string) (bool, error) {
+	return false, errors.New("injected error from explodingBreachedPasswords")
+}
+
+// writeBreachedRange writes the ranges of the given passwords (with
+// their counts) on dir, each range file has the given extension.
+func writeBreachedRange(t *testing.T, dir string, ext string, passwords map[string]string) {
+	t.Helper()
+
+	for password, count := range passwords {
+		sum := sha1.Sum([]byte(password))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		path := filepath.Join(dir, hash[:5]+ext)
+
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		assertNoErr(t, err)
+
+		// WHY: other hashes on the same range must be ignored
+		_, err = file.WriteString("0000000000000000000000000000000000A:1\r\n" + hash[5:] + ":" + count + "\r\n")
+		assertNoErr(t, err)
+		assertNoErr(t, file.Close())
+	}
+}
+
+func newTempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "passwordpolicy-test")
+	assertNoErr(t, err)
+	return dir
+}
+
+func assertNoErr(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,187 @@
+// Package recovery is responsible for recovering access to user accounts,
+// like resetting forgotten passwords.
+package recovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/katcipis/stonks/mailer"
+	"github.com/katcipis/stonks/users"
+)
+
+// UsersManager is responsible for retrieving users and changing their passwords
+type UsersManager interface {
+	// UserByEmail retrieves the user with the given email.
+	// The following errors MUST be returned (possibly wrapped)
+	// giving specific conditions:
+	//
+	// - If the email is invalid: users.InvalidUserParamErr
+	// - If the user does not exist: users.UserNotFoundErr
+	UserByEmail(ctx context.Context, email string) (users.User, error)
+
+	// ResetPassword sets a new password for the user with the given ID.
+	// The following errors MUST be returned (possibly wrapped)
+	// giving specific conditions:
+	//
+	// - If the new password is invalid: users.InvalidUserParamErr
+	// - If the user does not exist: users.UserNotFoundErr
+	ResetPassword(ctx context.Context, id string, newPassword string) error
+
+	// CheckNewPassword checks if the password can be set as the new
+	// password of the user with the given ID, without changing it.
+	// The following errors MUST be returned (possibly wrapped)
+	// giving specific conditions:
+	//
+	// - If the new password is invalid: users.InvalidUserParamErr
+	// - If the user does not exist: users.UserNotFoundErr
+	CheckNewPassword(ctx context.Context, id string, newPassword string) error
+}
+
+// Tokens is responsible for creating single use tokens
+type Tokens interface {
+	// Create creates a new single use token for the given subject
+	Create(ctx context.Context, subject string) (string, error)
+
+	// Subject validates the token returning its subject, without
+	// consuming it. If the token is invalid it MUST return
+	// auth.InvalidTokenErr (possibly wrapped).
+	Subject(ctx context.Context, token string) (string, error)
+
+	// Consume validates the token returning its subject, after that the
+	// token is not valid anymore. If the token is invalid it MUST
+	// return auth.InvalidTokenErr (possibly wrapped).
+	Consume(ctx context.Context, token string) (string, error)
+}
+
+// Sender is responsible for sending email messages
+type Sender interface {
+	Send(ctx context.Context, msg mailer.Message) error
+}
+
+// Config has all configuration needed to recover accounts
+type Config struct {
+	// ResetURL is the URL of the page where users can choose a new
+	// password, the reset token is added to it as the "token" query
+	// parameter. If empty only the token itself is sent to users.
+	ResetURL string
+}
+
+// Recovery is responsible for recovering access to user accounts
+type Recovery struct {
+	usersManager UsersManager
+	tokens       Tokens
+	sender       Sender
+	cfg          Config
+}
+
+// New creates a new Recovery. The tokens must be exclusively
+// used for password resets.
+func New(m UsersManager, t Tokens, s Sender, cfg Config) *Recovery {
+	return &Recovery{
+		usersManager: m,
+		tokens:       t,
+		sender:       s,
+		cfg:          cfg,
+	}
+}
+
+// RequestPasswordReset sends a password reset token to the given email,
+// if it belongs to a registered user. If the email does not belong to
+// any user nothing is done and no error is returned, so callers can't
+// leak which emails are registered.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the email is invalid: users.InvalidUserParamErr
+//
+// All other errors are to be considered internal errors.
+func (r *Recovery) RequestPasswordReset(ctx context.Context, email string) error {
+	user, err := r.usersManager.UserByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, users.UserNotFoundErr) {
+			return nil
+		}
+		return err
+	}
+
+	token, err := r.tokens.Create(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("error creating password reset token:%v", err)
+	}
+
+	body, err := r.resetBody(user, token)
+	if err != nil {
+		return err
+	}
+
+	err = r.sender.Send(ctx, mailer.Message{
+		To:      string(user.Email),
+		Subject: "Password reset",
+		Body:    body,
+	})
+	if err != nil {
+		return fmt.Errorf("error sending password reset email:%v", err)
+	}
+	return nil
+}
+
+// ResetPassword sets the new password for the user that requested the
+// given password reset token, returning the ID of the user.
+// Each token can be used only once, it is not consumed if the password
+// is rejected, so users can try again with another password.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the new password is invalid: users.InvalidUserParamErr
+// - If the token is invalid, expired or already used: auth.InvalidTokenErr
+//
+// All other errors are to be considered internal errors.
+func (r *Recovery) ResetPassword(ctx context.Context, token string, newPassword string) (string, error) {
+	userID, err := r.tokens.Subject(ctx, token)
+	if err != nil {
+		return "", err
+	}
+
+	// WHY: checking before consuming the token allows users to try
+	// another password with the same token if the password is rejected.
+	err = r.usersManager.CheckNewPassword(ctx, userID, newPassword)
+	if err != nil {
+		return "", fmt.Errorf("error checking new password of user %q:%w", userID, err)
+	}
+
+	if _, err := r.tokens.Consume(ctx, token); err != nil {
+		return "", err
+	}
+
+	err = r.usersManager.ResetPassword(ctx, userID, newPassword)
+	if err != nil {
+		return "", fmt.Errorf("error resetting password of user %q:%w", userID, err)
+	}
+	return userID, nil
+}
+
+func (r *Recovery) resetBody(user users.User, token string) (string, error) {
+	reset := token
+	if r.cfg.ResetURL != "" {
+		resetURL, err := url.Parse(r.cfg.ResetURL)
+		if err != nil {
+			return "", fmt.Errorf("invalid password reset URL %q:%v", r.cfg.ResetURL, err)
+		}
+		query := resetURL.Query()
+		query.Set("token", token)
+		resetURL.RawQuery = query.Encode()
+		reset = resetURL.String()
+	}
+
+	return fmt.Sprintf(`Hi %s,
+
+A password reset was requested for your account, to choose a new password use:
+
+%s
+
+If you didn't request a password reset just ignore this message.
+`, user.FullName, reset), nil
+}
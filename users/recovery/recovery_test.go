@@ -0,0 +1,215 @@
+package recovery_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/kvstore"
+	"github.com/katcipis/stonks/mailer"
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/recovery"
+)
+
+func TestPasswordReset(t *testing.T) {
+	const (
+		userID   = "13"
+		email    = "reset@test.com"
+		resetURL = "https://stonks.com/reset?lang=en"
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	usersManager := newUsersManager(users.User{
+		ID:       userID,
+		Email:    email,
+		FullName: "Reset User",
+	})
+	sender := mailer.NewInMemory()
+	tokens := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "password-reset", time.Hour)
+	r := recovery.New(usersManager, tokens, sender, recovery.Config{ResetURL: resetURL})
+	ctx := context.Background()
+
+	err := r.RequestPasswordReset(ctx, email)
+	assertNoErr(t, err)
+
+	msgs := sender.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages want 1", len(msgs))
+	}
+	if msgs[0].To != email {
+		t.Fatalf("got message to %q want %q", msgs[0].To, email)
+	}
+
+	token := parseResetToken(t, msgs[0].Body)
+
+	_, err = r.ResetPassword(ctx, token, "")
+	if !errors.Is(err, users.InvalidUserParamErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidUserParamErr)
+	}
+
+	// WHY: rejected passwords don't consume the token,
+	// so the same token can be used again.
+
+	gotUserID, err := r.ResetPassword(ctx, token, "new password")
+	assertNoErr(t, err)
+
+	if gotUserID != userID {
+		t.Fatalf("got user ID %q want %q", gotUserID, userID)
+	}
+	if got := usersManager.passwords[userID]; got != "new password" {
+		t.Fatalf("got password %q want %q", got, "new password")
+	}
+
+	_, err = r.ResetPassword(ctx, token, "another password")
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("reusing token: got err [%v] but want err[%v]", err, auth.InvalidTokenErr)
+	}
+	if got := usersManager.passwords[userID]; got != "new password" {
+		t.Fatalf("got password %q want %q", got, "new password")
+	}
+}
+
+func TestPasswordResetUnknownEmail(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	sender := mailer.NewInMemory()
+	tokens := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "password-reset", time.Hour)
+	r := recovery.New(newUsersManager(), tokens, sender, recovery.Config{})
+
+	err := r.RequestPasswordReset(context.Background(), "unknown@test.com")
+	assertNoErr(t, err)
+
+	if len(sender.Messages()) != 0 {
+		t.Fatalf("want no messages sent, got %v", sender.Messages())
+	}
+
+	err = r.RequestPasswordReset(context.Background(), "invalid")
+	if !errors.Is(err, users.InvalidUserParamErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidUserParamErr)
+	}
+}
+
+func TestPasswordResetInvalidToken(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	tokens := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "password-reset", time.Hour)
+	r := recovery.New(newUsersManager(), tokens, mailer.NewInMemory(), recovery.Config{})
+
+	_, err := r.ResetPassword(context.Background(), "invalid", "new password")
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+func TestPasswordResetFailsWhenSendingFails(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	const email = "reset@test.com"
+
+	usersManager := newUsersManager(users.User{ID: "1", Email: email})
+	tokens := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "password-reset", time.Hour)
+	r := recovery.New(usersManager, tokens, explodingSender{}, recovery.Config{})
+
+	err := r.RequestPasswordReset(context.Background(), email)
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
+// usersManager is a simple in memory users manager used in tests
+type usersManager struct {
+	users     map[users.Email]users.User
+	passwords map[string]string
+}
+
+func newUsersManager(registered ...users.User) *usersManager {
+	m := &usersManager{
+		users:     map[users.Email]users.User{},
+		passwords: map[string]string{},
+	}
+	for _, user := range registered {
+		m.users[user.Email] = user
+	}
+	return m
+}
+
+func (m *usersManager) UserByEmail(ctx context.Context, email string) (users.User, error) {
+	validEmail, err := users.ParseEmail(email)
+	if err != nil {
+		return users.User{}, users.InvalidUserParamErr
+	}
+	user, ok := m.users[validEmail]
+	if !ok {
+		return users.User{}, users.UserNotFoundErr
+	}
+	return user, nil
+}
+
+func (m *usersManager) ResetPassword(ctx context.Context, id string, newPassword string) error {
+	if err := m.CheckNewPassword(ctx, id, newPassword); err != nil {
+		return err
+	}
+	m.passwords[id] = newPassword
+	return nil
+}
+
+func (m *usersManager) CheckNewPassword(ctx context.Context, id string, newPassword string) error {
+	if newPassword == "" {
+		return users.InvalidUserParamErr
+	}
+	return nil
+}
+
+type explodingSender struct{}
+
+func (explodingSender) Send(context.Context, mailer.Message) error {
+	return errors.New("injected error from explodingSender")
+}
+
+func parseResetToken(t *testing.T, body string) string {
+	t.Helper()
+
+	link := regexp.MustCompile(`https://\S+`).FindString(body)
+	if link == "" {
+		t.Fatalf("reset link not found on message body:\n%s", body)
+	}
+
+	parsed, err := url.Parse(link)
+	assertNoErr(t, err)
+
+	if parsed.Query().Get("lang") != "en" {
+		t.Fatalf("reset link %q lost the original query", link)
+	}
+
+	token := parsed.Query().Get("token")
+	if token == "" {
+		t.Fatalf("reset token not found on link %q", link)
+	}
+	return token
+}
+
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+
+	m, err := miniredis.Run()
+	assertNoErr(t, err)
+	return m
+}
+
+func assertNoErr(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,35 @@
+package users
+
+// Permission represents the permission to perform some operation
+type Permission string
+
+const (
+	// AnyPermission grants all permissions, including
+	// the ones that may be added in the future.
+	AnyPermission         Permission = "*"
+	ListUsersPermission   Permission = "users:list"
+	ReadUsersPermission   Permission = "users:read"
+	UpdateUsersPermission Permission = "users:update"
+	DeleteUsersPermission Permission = "users:delete"
+
+	// SuspendUsersPermission allows suspending, reactivating and
+	// unlocking users locked by failed sign in attempts.
+	SuspendUsersPermission Permission = "users:suspend"
+
+	// ResetMFAPermission allows disabling the MFA of users,
+	// like when they lose their authenticator.
+	ResetMFAPermission Permission = "users:reset-mfa"
+)
+
+// Builtin roles, they are always available and can't be redefined.
+const (
+	UserRole  = "user"
+	AdminRole = "admin"
+)
+
+// Role is a named set of permissions.
+// Users are granted all the permissions of their role.
+type Role struct {
+	Name        string
+	Permissions []Permission
+}
@@ -0,0 +1,69 @@
+package users
+
+// Status represents the state of a user account.
+// Users can only change their status following
+// the transitions allowed by CanTransitionTo.
+type Status string
+
+const (
+	// PendingVerificationStatus is the status of created users
+	// until they verify that they own their email.
+	PendingVerificationStatus Status = "pending_verification"
+
+	// ActiveStatus is the status of users with a verified email
+	ActiveStatus Status = "active"
+
+	// SuspendedStatus is the status of users suspended by an
+	// administrator, they can't access the service until reactivated.
+	SuspendedStatus Status = "suspended"
+
+	// LockedStatus is the status of users locked for security
+	// reasons, they can't access the service until unlocked.
+	LockedStatus Status = "locked"
+
+	// DeletedStatus is the final status of deleted users
+	DeletedStatus Status = "deleted"
+)
+
+var statusTransitions = map[Status][]Status{
+	PendingVerificationStatus: {ActiveStatus, SuspendedStatus, LockedStatus, DeletedStatus},
+	ActiveStatus:              {SuspendedStatus, LockedStatus, DeletedStatus},
+	SuspendedStatus:           {ActiveStatus, DeletedStatus},
+	LockedStatus:              {ActiveStatus, SuspendedStatus, DeletedStatus},
+	DeletedStatus:             {},
+}
+
+// Valid returns true if the status is a known status
+func (s Status) Valid() bool {
+	_, ok := statusTransitions[s]
+	return ok
+}
+
+// CanTransitionTo returns true if a user with status s
+// can have its status changed to the given status.
+func (s Status) CanTransitionTo(to Status) bool {
+	for _, allowed := range statusTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckAccess checks if users with status s can access the service,
+// returning nil if they can or one of the following errors if they can't:
+//
+// - If the user is suspended: UserSuspendedErr
+// - If the user is locked: UserLockedErr
+// - If the user is deleted: UserNotFoundErr
+func (s Status) CheckAccess() error {
+	switch s {
+	case SuspendedStatus:
+		return UserSuspendedErr
+	case LockedStatus:
+		return UserLockedErr
+	case DeletedStatus:
+		return UserNotFoundErr
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package users_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/katcipis/stonks/users"
+)
+
+func TestStatusTransitions(t *testing.T) {
+	type Test struct {
+		from users.Status
+		to   users.Status
+		want bool
+	}
+
+	tests := []Test{
+		{from: users.PendingVerificationStatus, to: users.ActiveStatus, want: true},
+		{from: users.PendingVerificationStatus, to: users.SuspendedStatus, want: true},
+		{from: users.PendingVerificationStatus, to: users.DeletedStatus, want: true},
+		{from: users.ActiveStatus, to: users.SuspendedStatus, want: true},
+		{from: users.ActiveStatus, to: users.LockedStatus, want: true},
+		{from: users.ActiveStatus, to: users.DeletedStatus, want: true},
+		{from: users.ActiveStatus, to: users.PendingVerificationStatus, want: false},
+		{from: users.ActiveStatus, to: users.ActiveStatus, want: false},
+		{from: users.SuspendedStatus, to: users.ActiveStatus, want: true},
+		{from: users.SuspendedStatus, to: users.LockedStatus, want: false},
+		{from: users.SuspendedStatus, to: users.SuspendedStatus, want: false},
+		{from: users.LockedStatus, to: users.ActiveStatus, want: true},
+		{from: users.LockedStatus, to: users.SuspendedStatus, want: true},
+		{from: users.DeletedStatus, to: users.ActiveStatus, want: false},
+		{from: users.DeletedStatus, to: users.SuspendedStatus, want: false},
+		{from: "unknown", to: users.ActiveStatus, want: false},
+		{from: users.ActiveStatus, to: "unknown", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.from)+"To"+string(test.to), func(t *testing.T) {
+			got := test.from.CanTransitionTo(test.to)
+			if got != test.want {
+				t.Fatalf("got %t want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStatusAccess(t *testing.T) {
+	tests := map[users.Status]error{
+		users.PendingVerificationStatus: nil,
+		users.ActiveStatus:              nil,
+		users.SuspendedStatus:           users.UserSuspendedErr,
+		users.LockedStatus:              users.UserLockedErr,
+		users.DeletedStatus:             users.UserNotFoundErr,
+	}
+
+	for status, wantErr := range tests {
+		t.Run(string(status), func(t *testing.T) {
+			if !status.Valid() {
+				t.Fatalf("status %q should be valid", status)
+			}
+			err := status.CheckAccess()
+			if !errors.Is(err, wantErr) {
+				t.Fatalf("got err [%v] but want err[%v]", err, wantErr)
+			}
+		})
+	}
+
+	if users.Status("unknown").Valid() {
+		t.Fatal("unknown status should be invalid")
+	}
+}
@@ -3,13 +3,19 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/oauth"
 	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/mfa"
+	"github.com/katcipis/stonks/users/passkeys"
 )
 
 // Storage is responsible for storing and retrieving users
@@ -44,9 +50,10 @@ func (s *Storage) AddUser(
 	email users.Email,
 	fullname string,
 	hashedPassword string,
+	status users.Status,
 ) (string, error) {
-	sqlStatement := `INSERT INTO users.users (email, fullname, password_hash) VALUES ($1, $2, $3) RETURNING id`
-	rows, err := s.connPool.Query(ctx, sqlStatement, email, fullname, hashedPassword)
+	sqlStatement := `INSERT INTO users.users (email, fullname, password_hash, status) VALUES ($1, $2, $3, $4) RETURNING id`
+	rows, err := s.connPool.Query(ctx, sqlStatement, email, fullname, hashedPassword, status)
 	if err != nil {
 		return "", fmt.Errorf("error inserting new user:%v", err)
 	}
@@ -56,17 +63,10 @@ func (s *Storage) AddUser(
 	rows.Next()
 	err = rows.Err()
 	if err != nil {
-		pgerr, ok := err.(*pgconn.PgError)
-		err := fmt.Errorf("error scanning new user result:%v", err)
-		if !ok {
-			return "", err
-		}
-		// From: https://www.postgresql.org/docs/11/errcodes-appendix.html
-		const uniqueViolationErrorCode = "23505"
-		if pgerr.Code == uniqueViolationErrorCode {
+		if isUniqueViolation(err) {
 			return "", fmt.Errorf("%w:%s", users.UserAlreadyExistsErr, email)
 		}
-		return "", err
+		return "", fmt.Errorf("error scanning new user result:%v", err)
 	}
 	err = rows.Scan(&userID)
 	if err != nil {
@@ -74,3 +74,784 @@ func (s *Storage) AddUser(
 	}
 	return strconv.FormatInt(userID, 10), nil
 }
+
+// UserByEmail retrieves the user with the given email.
+// If the user does not exist it returns users.UserNotFoundErr.
+func (s *Storage) UserByEmail(ctx context.Context, email users.Email) (users.User, error) {
+	sqlStatement := `SELECT ` + userColumns + ` FROM users.users WHERE email = $1 AND ` + notDeleted
+	user, err := scanUser(s.connPool.QueryRow(ctx, sqlStatement, email))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return users.User{}, fmt.Errorf("%w:%s", users.UserNotFoundErr, email)
+		}
+		return users.User{}, fmt.Errorf("error retrieving user:%v", err)
+	}
+	return user, nil
+}
+
+// UserByID retrieves the user with the given ID.
+// If the user does not exist it returns users.UserNotFoundErr.
+func (s *Storage) UserByID(ctx context.Context, id string) (users.User, error) {
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		// WHY: IDs are opaque to clients, so an ID that is not
+		// a valid integer just doesn't exist.
+		return users.User{}, fmt.Errorf("%w:invalid ID %q", users.UserNotFoundErr, id)
+	}
+
+	sqlStatement := `SELECT ` + userColumns + ` FROM users.users WHERE id = $1 AND ` + notDeleted
+	user, err := scanUser(s.connPool.QueryRow(ctx, sqlStatement, userID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return users.User{}, fmt.Errorf("%w:%s", users.UserNotFoundErr, id)
+		}
+		return users.User{}, fmt.Errorf("error retrieving user:%v", err)
+	}
+	return user, nil
+}
+
+// DeleteUser deletes the user with the given ID.
+// If the user does not exist it returns users.UserNotFoundErr.
+//
+// Users are not removed, just marked as deleted, so they can still
+// be audited but are not retrieved anymore by any other method.
+func (s *Storage) DeleteUser(ctx context.Context, id string) error {
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w:invalid ID %q", users.UserNotFoundErr, id)
+	}
+
+	sqlStatement := `UPDATE users.users SET status = $1, version = version + 1
+		WHERE id = $2 AND ` + notDeleted
+	tag, err := s.connPool.Exec(ctx, sqlStatement, users.DeletedStatus, userID)
+	if err != nil {
+		return fmt.Errorf("error deleting user:%v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w:%s", users.UserNotFoundErr, id)
+	}
+	return nil
+}
+
+// UpdateUser updates the email, fullname, status and status reason of the user with ID user.ID,
+// only if its current version is user.Version. On success the version
+// is incremented and the updated user is returned.
+// If the user does not exist it returns users.UserNotFoundErr, if the
+// version doesn't match users.VersionMismatchErr and if the email belongs
+// to another user users.UserAlreadyExistsErr.
+func (s *Storage) UpdateUser(ctx context.Context, user users.User) (users.User, error) {
+	userID, err := strconv.ParseInt(user.ID, 10, 64)
+	if err != nil {
+		return users.User{}, fmt.Errorf("%w:invalid ID %q", users.UserNotFoundErr, user.ID)
+	}
+
+	sqlStatement := `UPDATE users.users SET email = $1, fullname = $2, status = $3, status_reason = $4,
+		version = version + 1 WHERE id = $5 AND version = $6 AND ` + notDeleted + ` RETURNING ` + userColumns
+	updated, err := scanUser(s.connPool.QueryRow(
+		ctx, sqlStatement, user.Email, user.FullName, user.Status, user.StatusReason, userID, user.Version,
+	))
+	if err == nil {
+		return updated, nil
+	}
+
+	if isUniqueViolation(err) {
+		return users.User{}, fmt.Errorf("%w:%s", users.UserAlreadyExistsErr, user.Email)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return users.User{}, fmt.Errorf("error updating user:%v", err)
+	}
+
+	// WHY: no rows updated means that either the user doesn't exist
+	// or its version changed, we need to tell them apart.
+	_, err = s.UserByID(ctx, user.ID)
+	if err != nil {
+		return users.User{}, err
+	}
+	return users.User{}, fmt.Errorf("%w:user %s version %d", users.VersionMismatchErr, user.ID, user.Version)
+}
+
+// UpdatePasswordHash updates the password hash of the user with the given ID.
+// If the user does not exist it returns users.UserNotFoundErr.
+func (s *Storage) UpdatePasswordHash(ctx context.Context, id string, hashedPassword string) error {
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w:invalid ID %q", users.UserNotFoundErr, id)
+	}
+
+	sqlStatement := `UPDATE users.users SET password_hash = $1 WHERE id = $2 AND ` + notDeleted
+	tag, err := s.connPool.Exec(ctx, sqlStatement, hashedPassword, userID)
+	if err != nil {
+		return fmt.Errorf("error updating password hash:%v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w:%s", users.UserNotFoundErr, id)
+	}
+	return nil
+}
+
+// ReplacePasswordHash updates the password hash of the user with the given ID,
+// adding the replaced hash to the password history of the user. Only the
+// historySize most recent hashes are kept on the history.
+func (s *Storage) ReplacePasswordHash(ctx context.Context, id string, hashedPassword string, historySize int) error {
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w:invalid ID %q", users.UserNotFoundErr, id)
+	}
+
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction:%v", err)
+	}
+	// WHY: rollback is a no-op after commit
+	defer tx.Rollback(ctx)
+
+	// WHY: locking the user serializes concurrent password changes,
+	// so no replaced hash is lost from the history.
+	var oldHash string
+	sqlStatement := `SELECT password_hash FROM users.users WHERE id = $1 AND ` + notDeleted + ` FOR UPDATE`
+	err = tx.QueryRow(ctx, sqlStatement, userID).Scan(&oldHash)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("%w:%s", users.UserNotFoundErr, id)
+		}
+		return fmt.Errorf("error getting password hash:%v", err)
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE users.users SET password_hash = $1 WHERE id = $2`, hashedPassword, userID)
+	if err != nil {
+		return fmt.Errorf("error updating password hash:%v", err)
+	}
+
+	sqlStatement = `INSERT INTO users.password_history (user_id, password_hash, created_at) VALUES ($1, $2, $3)`
+	_, err = tx.Exec(ctx, sqlStatement, userID, oldHash, time.Now())
+	if err != nil {
+		return fmt.Errorf("error inserting password history:%v", err)
+	}
+
+	sqlStatement = `DELETE FROM users.password_history WHERE user_id = $1 AND id NOT IN (
+		SELECT id FROM users.password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2)`
+	_, err = tx.Exec(ctx, sqlStatement, userID, historySize)
+	if err != nil {
+		return fmt.Errorf("error pruning password history:%v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("error committing password hash:%v", err)
+	}
+	return nil
+}
+
+// PasswordHistory returns at most limit hashes from the password history
+// of the user with the given ID, ordered from the most recent to the oldest.
+func (s *Storage) PasswordHistory(ctx context.Context, id string, limit int) ([]string, error) {
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return []string{}, nil
+	}
+
+	sqlStatement := `SELECT password_hash FROM users.password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2`
+	rows, err := s.connPool.Query(ctx, sqlStatement, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting password history:%v", err)
+	}
+	defer rows.Close()
+
+	hashes := []string{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("error scanning password history:%v", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error getting password history:%v", err)
+	}
+	return hashes, nil
+}
+
+// ListUsers lists at most limit users ordered by ID in descending order.
+// If afterID is not empty only users with an ID lesser than afterID are listed.
+func (s *Storage) ListUsers(ctx context.Context, afterID string, limit int) ([]users.User, error) {
+	var (
+		rows pgx.Rows
+		err  error
+	)
+
+	if afterID == "" {
+		sqlStatement := `SELECT ` + userColumns + ` FROM users.users WHERE ` + notDeleted + ` ORDER BY id DESC LIMIT $1`
+		rows, err = s.connPool.Query(ctx, sqlStatement, limit)
+	} else {
+		id, parseErr := strconv.ParseInt(afterID, 10, 64)
+		if parseErr != nil {
+			return nil, fmt.Errorf("invalid after ID %q:%v", afterID, parseErr)
+		}
+		sqlStatement := `SELECT ` + userColumns + ` FROM users.users WHERE id < $1 AND ` + notDeleted + `
+			ORDER BY id DESC LIMIT $2`
+		rows, err = s.connPool.Query(ctx, sqlStatement, id, limit)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing users:%v", err)
+	}
+	defer rows.Close()
+
+	listed := []users.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning listed user:%v", err)
+		}
+		listed = append(listed, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing users:%v", err)
+	}
+	return listed, nil
+}
+
+// Roles retrieves all custom roles.
+func (s *Storage) Roles(ctx context.Context) ([]users.Role, error) {
+	sqlStatement := `SELECT name, permissions FROM users.roles`
+	rows, err := s.connPool.Query(ctx, sqlStatement)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving roles:%v", err)
+	}
+	defer rows.Close()
+
+	roles := []users.Role{}
+	for rows.Next() {
+		var (
+			name        string
+			permissions []string
+		)
+		if err := rows.Scan(&name, &permissions); err != nil {
+			return nil, fmt.Errorf("error scanning role:%v", err)
+		}
+		role := users.Role{Name: name}
+		for _, perm := range permissions {
+			role.Permissions = append(role.Permissions, users.Permission(perm))
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error retrieving roles:%v", err)
+	}
+	return roles, nil
+}
+
+// Client retrieves the OAuth client with the given ID.
+// If the client does not exist it returns oauth.ClientNotFoundErr.
+func (s *Storage) Client(ctx context.Context, id string) (oauth.Client, error) {
+	sqlStatement := `SELECT id, name, secret_hash, redirect_uris, scopes FROM users.clients WHERE id = $1`
+
+	client := oauth.Client{}
+	err := s.connPool.QueryRow(ctx, sqlStatement, id).Scan(
+		&client.ID,
+		&client.Name,
+		&client.SecretHash,
+		&client.RedirectURIs,
+		&client.Scopes,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return oauth.Client{}, fmt.Errorf("%w:id %q", oauth.ClientNotFoundErr, id)
+		}
+		return oauth.Client{}, fmt.Errorf("error retrieving client %q:%v", id, err)
+	}
+	return client, nil
+}
+
+// AddAPIKey adds the API key, returning its ID.
+func (s *Storage) AddAPIKey(ctx context.Context, key auth.APIKey) (string, error) {
+	userID, err := strconv.ParseInt(key.UserID, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w:invalid ID %q", users.UserNotFoundErr, key.UserID)
+	}
+
+	sqlStatement := `INSERT INTO users.api_keys (user_id, name, key_hash, scopes, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+
+	var id int64
+	err = s.connPool.QueryRow(
+		ctx, sqlStatement, userID, key.Name, key.Hash, key.Scopes, key.CreatedAt, nullableTime(key.ExpiresAt),
+	).Scan(&id)
+	if err != nil {
+		return "", fmt.Errorf("error inserting API key:%v", err)
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+// APIKeyByHash retrieves the API key with the given hash.
+// If there is no such key it returns auth.APIKeyNotFoundErr.
+func (s *Storage) APIKeyByHash(ctx context.Context, hash string) (auth.APIKey, error) {
+	sqlStatement := `SELECT ` + apiKeyColumns + ` FROM users.api_keys WHERE key_hash = $1`
+	key, err := scanAPIKey(s.connPool.QueryRow(ctx, sqlStatement, hash))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return auth.APIKey{}, auth.APIKeyNotFoundErr
+		}
+		return auth.APIKey{}, fmt.Errorf("error retrieving API key:%v", err)
+	}
+	return key, nil
+}
+
+// APIKeys retrieves all API keys of the given user, ordered by ID.
+func (s *Storage) APIKeys(ctx context.Context, userID string) ([]auth.APIKey, error) {
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return []auth.APIKey{}, nil
+	}
+
+	sqlStatement := `SELECT ` + apiKeyColumns + ` FROM users.api_keys WHERE user_id = $1 ORDER BY id`
+	rows, err := s.connPool.Query(ctx, sqlStatement, id)
+	if err != nil {
+		return nil, fmt.Errorf("error listing API keys:%v", err)
+	}
+	defer rows.Close()
+
+	keys := []auth.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning API key:%v", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing API keys:%v", err)
+	}
+	return keys, nil
+}
+
+// DeleteAPIKey deletes the API key with the given ID of the given user.
+// If the user has no such key it returns auth.APIKeyNotFoundErr.
+func (s *Storage) DeleteAPIKey(ctx context.Context, userID string, id string) error {
+	parsedUserID, userErr := strconv.ParseInt(userID, 10, 64)
+	parsedID, idErr := strconv.ParseInt(id, 10, 64)
+	if userErr != nil || idErr != nil {
+		return fmt.Errorf("%w:user %q key %q", auth.APIKeyNotFoundErr, userID, id)
+	}
+
+	sqlStatement := `DELETE FROM users.api_keys WHERE id = $1 AND user_id = $2`
+	tag, err := s.connPool.Exec(ctx, sqlStatement, parsedID, parsedUserID)
+	if err != nil {
+		return fmt.Errorf("error deleting API key:%v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w:user %q key %q", auth.APIKeyNotFoundErr, userID, id)
+	}
+	return nil
+}
+
+// DeleteUserAPIKeys deletes all API keys of the given user.
+func (s *Storage) DeleteUserAPIKeys(ctx context.Context, userID string) error {
+	parsedUserID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	_, err = s.connPool.Exec(ctx, `DELETE FROM users.api_keys WHERE user_id = $1`, parsedUserID)
+	if err != nil {
+		return fmt.Errorf("error deleting API keys:%v", err)
+	}
+	return nil
+}
+
+// UpdateAPIKeyLastUsed updates the last time the API key with the given ID was used.
+func (s *Storage) UpdateAPIKeyLastUsed(ctx context.Context, id string, lastUsed time.Time) error {
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid API key ID %q:%v", id, err)
+	}
+
+	sqlStatement := `UPDATE users.api_keys SET last_used_at = $1 WHERE id = $2`
+	_, err = s.connPool.Exec(ctx, sqlStatement, lastUsed, parsedID)
+	if err != nil {
+		return fmt.Errorf("error updating API key last used time:%v", err)
+	}
+	return nil
+}
+
+// TOTP retrieves the TOTP enrollment of the user.
+// If the user has no enrollment it returns mfa.NotEnrolledErr.
+func (s *Storage) TOTP(ctx context.Context, userID string) (mfa.TOTP, error) {
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return mfa.TOTP{}, fmt.Errorf("%w:invalid ID %q", mfa.NotEnrolledErr, userID)
+	}
+
+	totp := mfa.TOTP{UserID: userID}
+	sqlStatement := `SELECT secret, confirmed, last_used_step FROM users.mfa_totp WHERE user_id = $1`
+	err = s.connPool.QueryRow(ctx, sqlStatement, id).Scan(&totp.Secret, &totp.Confirmed, &totp.LastUsedStep)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return mfa.TOTP{}, fmt.Errorf("%w:user %s", mfa.NotEnrolledErr, userID)
+		}
+		return mfa.TOTP{}, fmt.Errorf("error retrieving TOTP enrollment:%v", err)
+	}
+	return totp, nil
+}
+
+// SaveTOTP saves a pending TOTP enrollment, replacing any pending one.
+// If the user already has a confirmed enrollment it returns mfa.AlreadyEnabledErr.
+func (s *Storage) SaveTOTP(ctx context.Context, userID string, secret string) error {
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w:invalid ID %q", users.UserNotFoundErr, userID)
+	}
+
+	sqlStatement := `INSERT INTO users.mfa_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = $2, last_used_step = 0
+		WHERE NOT users.mfa_totp.confirmed`
+	tag, err := s.connPool.Exec(ctx, sqlStatement, id, secret)
+	if err != nil {
+		return fmt.Errorf("error saving TOTP enrollment:%v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w:user %s", mfa.AlreadyEnabledErr, userID)
+	}
+	return nil
+}
+
+// ConfirmTOTP confirms the pending TOTP enrollment, replacing the recovery codes.
+// If there is no pending enrollment it returns mfa.NotEnrolledErr.
+func (s *Storage) ConfirmTOTP(ctx context.Context, userID string, step int64, recoveryCodeHashes []string) error {
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w:invalid ID %q", mfa.NotEnrolledErr, userID)
+	}
+
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction:%v", err)
+	}
+	// WHY: rollback is a no-op after commit
+	defer tx.Rollback(ctx)
+
+	sqlStatement := `UPDATE users.mfa_totp SET confirmed = true, last_used_step = $1
+		WHERE user_id = $2 AND NOT confirmed`
+	tag, err := tx.Exec(ctx, sqlStatement, step, id)
+	if err != nil {
+		return fmt.Errorf("error confirming TOTP enrollment:%v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w:no pending enrollment for user %s", mfa.NotEnrolledErr, userID)
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM users.mfa_recovery_codes WHERE user_id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error deleting recovery codes:%v", err)
+	}
+	for _, hash := range recoveryCodeHashes {
+		_, err := tx.Exec(ctx, `INSERT INTO users.mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, id, hash)
+		if err != nil {
+			return fmt.Errorf("error inserting recovery code:%v", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("error committing TOTP confirmation:%v", err)
+	}
+	return nil
+}
+
+// UseTOTPStep records the time step as used only if it is after the
+// last used one, otherwise it returns mfa.InvalidCodeErr.
+func (s *Storage) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w:invalid ID %q", mfa.InvalidCodeErr, userID)
+	}
+
+	sqlStatement := `UPDATE users.mfa_totp SET last_used_step = $1
+		WHERE user_id = $2 AND confirmed AND last_used_step < $1`
+	tag, err := s.connPool.Exec(ctx, sqlStatement, step, id)
+	if err != nil {
+		return fmt.Errorf("error updating TOTP last used step:%v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w:time step %d already used by user %s", mfa.InvalidCodeErr, step, userID)
+	}
+	return nil
+}
+
+// UseRecoveryCode removes the recovery code with the given hash.
+// If the user has no such code it returns mfa.InvalidCodeErr.
+func (s *Storage) UseRecoveryCode(ctx context.Context, userID string, hash string) error {
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w:invalid ID %q", mfa.InvalidCodeErr, userID)
+	}
+
+	sqlStatement := `DELETE FROM users.mfa_recovery_codes WHERE user_id = $1 AND code_hash = $2`
+	tag, err := s.connPool.Exec(ctx, sqlStatement, id, hash)
+	if err != nil {
+		return fmt.Errorf("error deleting recovery code:%v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w:recovery code not found for user %s", mfa.InvalidCodeErr, userID)
+	}
+	return nil
+}
+
+// DeleteTOTP deletes the TOTP enrollment and the recovery codes of the user.
+// If the user has no enrollment it returns mfa.NotEnrolledErr.
+func (s *Storage) DeleteTOTP(ctx context.Context, userID string) error {
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w:invalid ID %q", mfa.NotEnrolledErr, userID)
+	}
+
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction:%v", err)
+	}
+	// WHY: rollback is a no-op after commit
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `DELETE FROM users.mfa_recovery_codes WHERE user_id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error deleting recovery codes:%v", err)
+	}
+
+	tag, err := tx.Exec(ctx, `DELETE FROM users.mfa_totp WHERE user_id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error deleting TOTP enrollment:%v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w:user %s", mfa.NotEnrolledErr, userID)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("error committing TOTP deletion:%v", err)
+	}
+	return nil
+}
+
+// AddPasskey adds the passkey, returning its ID. If there is already a
+// passkey with the same credential ID it returns passkeys.PasskeyAlreadyExistsErr.
+func (s *Storage) AddPasskey(ctx context.Context, passkey passkeys.Passkey) (string, error) {
+	userID, err := strconv.ParseInt(passkey.UserID, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w:invalid ID %q", users.UserNotFoundErr, passkey.UserID)
+	}
+
+	sqlStatement := `INSERT INTO users.passkeys (user_id, name, credential_id, public_key, sign_count, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+
+	var id int64
+	err = s.connPool.QueryRow(
+		ctx,
+		sqlStatement,
+		userID,
+		passkey.Name,
+		passkey.Credential.ID,
+		passkey.Credential.PublicKey,
+		int64(passkey.Credential.SignCount),
+		passkey.CreatedAt,
+	).Scan(&id)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return "", fmt.Errorf("%w:%v", passkeys.PasskeyAlreadyExistsErr, err)
+		}
+		return "", fmt.Errorf("error inserting passkey:%v", err)
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+// PasskeyByCredentialID retrieves the passkey with the given credential ID.
+// If there is no such passkey it returns passkeys.PasskeyNotFoundErr.
+func (s *Storage) PasskeyByCredentialID(ctx context.Context, credentialID []byte) (passkeys.Passkey, error) {
+	sqlStatement := `SELECT ` + passkeyColumns + ` FROM users.passkeys WHERE credential_id = $1`
+	passkey, err := scanPasskey(s.connPool.QueryRow(ctx, sqlStatement, credentialID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return passkeys.Passkey{}, passkeys.PasskeyNotFoundErr
+		}
+		return passkeys.Passkey{}, fmt.Errorf("error retrieving passkey:%v", err)
+	}
+	return passkey, nil
+}
+
+// Passkeys retrieves all passkeys of the given user, ordered by ID.
+func (s *Storage) Passkeys(ctx context.Context, userID string) ([]passkeys.Passkey, error) {
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return []passkeys.Passkey{}, nil
+	}
+
+	sqlStatement := `SELECT ` + passkeyColumns + ` FROM users.passkeys WHERE user_id = $1 ORDER BY id`
+	rows, err := s.connPool.Query(ctx, sqlStatement, id)
+	if err != nil {
+		return nil, fmt.Errorf("error listing passkeys:%v", err)
+	}
+	defer rows.Close()
+
+	found := []passkeys.Passkey{}
+	for rows.Next() {
+		passkey, err := scanPasskey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning passkey:%v", err)
+		}
+		found = append(found, passkey)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing passkeys:%v", err)
+	}
+	return found, nil
+}
+
+// UpdatePasskeyUsage updates the signature counter and the last time the
+// passkey was used. If there is no such passkey it returns passkeys.PasskeyNotFoundErr.
+func (s *Storage) UpdatePasskeyUsage(ctx context.Context, id string, signCount uint32, usedAt time.Time) error {
+	parsedID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w:invalid ID %q", passkeys.PasskeyNotFoundErr, id)
+	}
+
+	sqlStatement := `UPDATE users.passkeys SET sign_count = $1, last_used_at = $2 WHERE id = $3`
+	tag, err := s.connPool.Exec(ctx, sqlStatement, int64(signCount), usedAt, parsedID)
+	if err != nil {
+		return fmt.Errorf("error updating passkey usage:%v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w:id %q", passkeys.PasskeyNotFoundErr, id)
+	}
+	return nil
+}
+
+// DeletePasskey deletes the passkey with the given ID of the given user.
+// If the user has no such passkey it returns passkeys.PasskeyNotFoundErr.
+func (s *Storage) DeletePasskey(ctx context.Context, userID string, id string) error {
+	parsedUserID, userErr := strconv.ParseInt(userID, 10, 64)
+	parsedID, idErr := strconv.ParseInt(id, 10, 64)
+	if userErr != nil || idErr != nil {
+		return fmt.Errorf("%w:user %q passkey %q", passkeys.PasskeyNotFoundErr, userID, id)
+	}
+
+	sqlStatement := `DELETE FROM users.passkeys WHERE id = $1 AND user_id = $2`
+	tag, err := s.connPool.Exec(ctx, sqlStatement, parsedID, parsedUserID)
+	if err != nil {
+		return fmt.Errorf("error deleting passkey:%v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w:user %q passkey %q", passkeys.PasskeyNotFoundErr, userID, id)
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pgerr *pgconn.PgError
+	if !errors.As(err, &pgerr) {
+		return false
+	}
+	// From: https://www.postgresql.org/docs/11/errcodes-appendix.html
+	const uniqueViolationErrorCode = "23505"
+	return pgerr.Code == uniqueViolationErrorCode
+}
+
+const (
+	userColumns   = `id, email, fullname, password_hash, role, status, status_reason, version`
+	apiKeyColumns = `id, user_id, name, key_hash, scopes, created_at, expires_at, last_used_at`
+
+	passkeyColumns = `id, user_id, name, credential_id, public_key, sign_count, created_at, last_used_at`
+
+	// notDeleted is the condition that filters out deleted users
+	notDeleted = `status <> 'deleted'`
+)
+
+func scanUser(row pgx.Row) (users.User, error) {
+	var (
+		userID    int64
+		userEmail string
+		status    string
+		user      users.User
+	)
+	err := row.Scan(
+		&userID,
+		&userEmail,
+		&user.FullName,
+		&user.PasswordHash,
+		&user.Role,
+		&status,
+		&user.StatusReason,
+		&user.Version,
+	)
+	if err != nil {
+		return users.User{}, err
+	}
+	user.ID = strconv.FormatInt(userID, 10)
+	user.Email = users.Email(userEmail)
+	user.Status = users.Status(status)
+	return user, nil
+}
+
+func scanAPIKey(row pgx.Row) (auth.APIKey, error) {
+	var (
+		id         int64
+		userID     int64
+		expiresAt  *time.Time
+		lastUsedAt *time.Time
+		key        auth.APIKey
+	)
+	err := row.Scan(
+		&id,
+		&userID,
+		&key.Name,
+		&key.Hash,
+		&key.Scopes,
+		&key.CreatedAt,
+		&expiresAt,
+		&lastUsedAt,
+	)
+	if err != nil {
+		return auth.APIKey{}, err
+	}
+	key.ID = strconv.FormatInt(id, 10)
+	key.UserID = strconv.FormatInt(userID, 10)
+	if expiresAt != nil {
+		key.ExpiresAt = *expiresAt
+	}
+	if lastUsedAt != nil {
+		key.LastUsedAt = *lastUsedAt
+	}
+	return key, nil
+}
+
+func scanPasskey(row pgx.Row) (passkeys.Passkey, error) {
+	var (
+		id         int64
+		userID     int64
+		signCount  int64
+		lastUsedAt *time.Time
+		passkey    passkeys.Passkey
+	)
+	err := row.Scan(
+		&id,
+		&userID,
+		&passkey.Name,
+		&passkey.Credential.ID,
+		&passkey.Credential.PublicKey,
+		&signCount,
+		&passkey.CreatedAt,
+		&lastUsedAt,
+	)
+	if err != nil {
+		return passkeys.Passkey{}, err
+	}
+	passkey.ID = strconv.FormatInt(id, 10)
+	passkey.UserID = strconv.FormatInt(userID, 10)
+	passkey.Credential.SignCount = uint32(signCount)
+	if lastUsedAt != nil {
+		passkey.LastUsedAt = *lastUsedAt
+	}
+	return passkey, nil
+}
+
+// nullableTime maps zero times to NULL
+func nullableTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
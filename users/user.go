@@ -0,0 +1,25 @@
+package users
+
+// User represents a registered user
+type User struct {
+	ID           string
+	Email        Email
+	FullName     string
+	PasswordHash string
+	Role         string
+	Status       Status
+
+	// StatusReason is why the user has its current status,
+	// it is empty unless the status was changed by ChangeStatus.
+	StatusReason string
+
+	// Version is incremented at each update of the user
+	Version int64
+}
+
+// UserUpdate represents a partial update of a user,
+// only the non-nil fields are updated.
+type UserUpdate struct {
+	FullName *string
+	Email    *string
+}
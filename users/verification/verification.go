@@ -0,0 +1,220 @@
+// Package verification is responsible for verifying that
+// users own the email they registered with.
+package verification
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/mailer"
+	"github.com/katcipis/stonks/users"
+)
+
+// UsersManager is responsible for retrieving and verifying users
+type UsersManager interface {
+	// User retrieves the user with the given ID.
+	// The following errors MUST be returned (possibly wrapped)
+	// giving specific conditions:
+	//
+	// - If the user does not exist: users.UserNotFoundErr
+	User(ctx context.Context, id string) (users.User, error)
+
+	// UserByEmail retrieves the user with the given email.
+	// The following errors MUST be returned (possibly wrapped)
+	// giving specific conditions:
+	//
+	// - If the email is invalid: users.InvalidUserParamErr
+	// - If the user does not exist: users.UserNotFoundErr
+	UserByEmail(ctx context.Context, email string) (users.User, error)
+
+	// VerifyUser marks the user with the given ID as verified,
+	// if the given email is still the email of the user.
+	// The following errors MUST be returned (possibly wrapped)
+	// giving specific conditions:
+	//
+	// - If the user does not exist: users.UserNotFoundErr
+	// - If the email is not the current email of the user: users.EmailMismatchErr
+	VerifyUser(ctx context.Context, id string, email string) error
+}
+
+// Tokens is responsible for creating single use tokens
+type Tokens interface {
+	// Create creates a new single use token for the given subject
+	Create(ctx context.Context, subject string) (string, error)
+
+	// Consume validates the token returning its subject, after that the
+	// token is not valid anymore. If the token is invalid it MUST
+	// return auth.InvalidTokenErr (possibly wrapped).
+	Consume(ctx context.Context, token string) (string, error)
+}
+
+// Sender is responsible for sending email messages
+type Sender interface {
+	Send(ctx context.Context, msg mailer.Message) error
+}
+
+// Config has all configuration needed to verify users
+type Config struct {
+	// VerifyURL is the URL of the page where users verify their email,
+	// the verification token is added to it as the "token" query
+	// parameter. If empty only the token itself is sent to users.
+	VerifyURL string
+}
+
+// Verification is responsible for verifying users emails
+type Verification struct {
+	usersManager UsersManager
+	tokens       Tokens
+	sender       Sender
+	cfg          Config
+}
+
+// New creates a new Verification. The tokens must be exclusively
+// used for email verification.
+func New(m UsersManager, t Tokens, s Sender, cfg Config) *Verification {
+	return &Verification{
+		usersManager: m,
+		tokens:       t,
+		sender:       s,
+		cfg:          cfg,
+	}
+}
+
+// RequestVerification sends a verification token to the email of the
+// user with the given ID. If the user is not pending verification
+// nothing is done.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the user does not exist: users.UserNotFoundErr
+//
+// All other errors are to be considered internal errors.
+func (v *Verification) RequestVerification(ctx context.Context, userID string) error {
+	user, err := v.usersManager.User(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return v.sendVerification(ctx, user)
+}
+
+// ResendVerification sends a new verification token to the given email,
+// if it belongs to a user pending verification, like when the previous
+// token expired. If the email does not belong to any user nothing is done
+// and no error is returned, so callers can't leak which emails are registered.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the email is invalid: users.InvalidUserParamErr
+//
+// All other errors are to be considered internal errors.
+func (v *Verification) ResendVerification(ctx context.Context, email string) error {
+	user, err := v.usersManager.UserByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, users.UserNotFoundErr) {
+			return nil
+		}
+		return err
+	}
+	return v.sendVerification(ctx, user)
+}
+
+func (v *Verification) sendVerification(ctx context.Context, user users.User) error {
+	if user.Status != users.PendingVerificationStatus {
+		return nil
+	}
+
+	token, err := v.tokens.Create(ctx, tokenSubject(user.ID, string(user.Email)))
+	if err != nil {
+		return fmt.Errorf("error creating verification token:%v", err)
+	}
+
+	body, err := v.verifyBody(user, token)
+	if err != nil {
+		return err
+	}
+
+	err = v.sender.Send(ctx, mailer.Message{
+		To:      string(user.Email),
+		Subject: "Verify your email",
+		Body:    body,
+	})
+	if err != nil {
+		return fmt.Errorf("error sending verification email:%v", err)
+	}
+	return nil
+}
+
+// Verify verifies the user that received the given token,
+// returning the ID of the user. Each token can be used only once.
+// The following errors can be expected to be wrapped in the returned
+// error giving specific conditions:
+//
+// - If the token is invalid, expired or already used: auth.InvalidTokenErr
+// - If the user does not exist anymore: users.UserNotFoundErr
+//
+// Tokens sent to an email that is not the email of the user anymore
+// are invalid.
+//
+// All other errors are to be considered internal errors.
+func (v *Verification) Verify(ctx context.Context, token string) (string, error) {
+	subject, err := v.tokens.Consume(ctx, token)
+	if err != nil {
+		return "", err
+	}
+
+	userID, email, err := parseTokenSubject(subject)
+	if err != nil {
+		return "", err
+	}
+
+	err = v.usersManager.VerifyUser(ctx, userID, email)
+	if err != nil {
+		if errors.Is(err, users.EmailMismatchErr) {
+			return "", fmt.Errorf("%w:token of user %q sent to another email", auth.InvalidTokenErr, userID)
+		}
+		return "", fmt.Errorf("error verifying user %q:%w", userID, err)
+	}
+	return userID, nil
+}
+
+// WHY: tokens are bound to the email they were sent to, so they
+// can't verify another email if the user changes its email.
+// IDs have no spaces, so the email is everything after the first one.
+func tokenSubject(userID string, email string) string {
+	return userID + " " + email
+}
+
+func parseTokenSubject(subject string) (string, string, error) {
+	parts := strings.SplitN(subject, " ", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("%w:verification token without email", auth.InvalidTokenErr)
+	}
+	return parts[0], parts[1], nil
+}
+
+func (v *Verification) verifyBody(user users.User, token string) (string, error) {
+	verify := token
+	if v.cfg.VerifyURL != "" {
+		verifyURL, err := url.Parse(v.cfg.VerifyURL)
+		if err != nil {
+			return "", fmt.Errorf("invalid verification URL %q:%v", v.cfg.VerifyURL, err)
+		}
+		query := verifyURL.Query()
+		query.Set("token", token)
+		verifyURL.RawQuery = query.Encode()
+		verify = verifyURL.String()
+	}
+
+	return fmt.Sprintf(`Hi %s,
+
+Welcome! To verify your email and activate your account use:
+
+%s
+
+If you didn't create an account just ignore this message.
+`, user.FullName, verify), nil
+}
@@ -0,0 +1,310 @@
+package verification_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/katcipis/stonks/auth"
+	"github.com/katcipis/stonks/auth/kvstore"
+	"github.com/katcipis/stonks/mailer"
+	"github.com/katcipis/stonks/users"
+	"github.com/katcipis/stonks/users/verification"
+)
+
+func TestVerification(t *testing.T) {
+	const (
+		userID    = "7"
+		email     = "verify@test.com"
+		verifyURL = "https://stonks.com/verify?lang=en"
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	usersManager := newUsersManager(users.User{
+		ID:       userID,
+		Email:    email,
+		FullName: "Verify User",
+		Status:   users.PendingVerificationStatus,
+	})
+	sender := mailer.NewInMemory()
+	tokens := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "email-verification", time.Hour)
+	v := verification.New(usersManager, tokens, sender, verification.Config{VerifyURL: verifyURL})
+	ctx := context.Background()
+
+	assertNoErr(t, v.RequestVerification(ctx, userID))
+
+	msgs := sender.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages want 1", len(msgs))
+	}
+	if msgs[0].To != email {
+		t.Fatalf("got message to %q want %q", msgs[0].To, email)
+	}
+
+	token := parseVerifyToken(t, msgs[0].Body)
+
+	gotUserID, err := v.Verify(ctx, token)
+	assertNoErr(t, err)
+
+	if gotUserID != userID {
+		t.Fatalf("got user ID %q want %q", gotUserID, userID)
+	}
+	if got := usersManager.users[userID].Status; got != users.ActiveStatus {
+		t.Fatalf("got status %q want %q", got, users.ActiveStatus)
+	}
+
+	_, err = v.Verify(ctx, token)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("reusing token: got err [%v] but want err[%v]", err, auth.InvalidTokenErr)
+	}
+
+	// Verified users don't get new verification emails
+	assertNoErr(t, v.RequestVerification(ctx, userID))
+
+	if len(sender.Messages()) != 1 {
+		t.Fatalf("want no new messages sent, got %v", sender.Messages())
+	}
+}
+
+func TestResendVerification(t *testing.T) {
+	const (
+		userID    = "7"
+		email     = "resend@test.com"
+		verifyURL = "https://stonks.com/verify?lang=en"
+	)
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	usersManager := newUsersManager(users.User{
+		ID:       userID,
+		Email:    email,
+		FullName: "Resend User",
+		Status:   users.PendingVerificationStatus,
+	})
+	sender := mailer.NewInMemory()
+	tokens := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "email-verification", time.Minute)
+	v := verification.New(usersManager, tokens, sender, verification.Config{VerifyURL: verifyURL})
+	ctx := context.Background()
+
+	assertNoErr(t, v.RequestVerification(ctx, userID))
+	expiredToken := parseVerifyToken(t, sender.Messages()[0].Body)
+
+	m.FastForward(time.Minute)
+
+	_, err := v.Verify(ctx, expiredToken)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, auth.InvalidTokenErr)
+	}
+
+	assertNoErr(t, v.ResendVerification(ctx, email))
+
+	msgs := sender.Messages()
+	if len(msgs) != 2 || msgs[1].To != email {
+		t.Fatalf("got messages %v, want a new message to %q", msgs, email)
+	}
+
+	_, err = v.Verify(ctx, parseVerifyToken(t, msgs[1].Body))
+	assertNoErr(t, err)
+
+	// Unknown emails and verified users get no emails
+	assertNoErr(t, v.ResendVerification(ctx, "unknown@test.com"))
+	assertNoErr(t, v.ResendVerification(ctx, email))
+
+	if len(sender.Messages()) != 2 {
+		t.Fatalf("want no new messages sent, got %v", sender.Messages())
+	}
+
+	err = v.ResendVerification(ctx, "invalid")
+	if !errors.Is(err, users.InvalidUserParamErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.InvalidUserParamErr)
+	}
+}
+
+func TestVerificationUnknownUser(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	tokens := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "email-verification", time.Hour)
+	v := verification.New(newUsersManager(), tokens, mailer.NewInMemory(), verification.Config{})
+	ctx := context.Background()
+
+	err := v.RequestVerification(ctx, "unknown")
+	if !errors.Is(err, users.UserNotFoundErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotFoundErr)
+	}
+
+	usersManager := newUsersManager(users.User{
+		ID:     "1",
+		Email:  "deleted@test.com",
+		Status: users.PendingVerificationStatus,
+	})
+	sender := mailer.NewInMemory()
+	v = verification.New(usersManager, tokens, sender, verification.Config{})
+
+	assertNoErr(t, v.RequestVerification(ctx, "1"))
+	delete(usersManager.users, "1")
+
+	_, err = v.Verify(ctx, mailToken(t, sender.Messages()[0]))
+	if !errors.Is(err, users.UserNotFoundErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, users.UserNotFoundErr)
+	}
+}
+
+func TestVerificationTokensAreBoundToEmail(t *testing.T) {
+	const userID = "7"
+
+	m := newTestRedis(t)
+	defer m.Close()
+
+	usersManager := newUsersManager(users.User{
+		ID:     userID,
+		Email:  "old@test.com",
+		Status: users.PendingVerificationStatus,
+	})
+	sender := mailer.NewInMemory()
+	tokens := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "email-verification", time.Hour)
+	v := verification.New(usersManager, tokens, sender, verification.Config{})
+	ctx := context.Background()
+
+	assertNoErr(t, v.RequestVerification(ctx, userID))
+	oldToken := mailToken(t, sender.Messages()[0])
+
+	user := usersManager.users[userID]
+	user.Email = "new@test.com"
+	usersManager.users[userID] = user
+
+	_, err := v.Verify(ctx, oldToken)
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, auth.InvalidTokenErr)
+	}
+	if got := usersManager.users[userID].Status; got != users.PendingVerificationStatus {
+		t.Fatalf("got status %q want %q", got, users.PendingVerificationStatus)
+	}
+
+	assertNoErr(t, v.RequestVerification(ctx, userID))
+
+	msgs := sender.Messages()
+	if len(msgs) != 2 || msgs[1].To != "new@test.com" {
+		t.Fatalf("got messages %v, want a new message to the new email", msgs)
+	}
+
+	_, err = v.Verify(ctx, mailToken(t, msgs[1]))
+	assertNoErr(t, err)
+}
+
+func TestVerificationInvalidToken(t *testing.T) {
+	m := newTestRedis(t)
+	defer m.Close()
+
+	tokens := auth.NewOneTimeTokens(kvstore.New(m.Addr(), ""), "email-verification", time.Hour)
+	v := verification.New(newUsersManager(), tokens, mailer.NewInMemory(), verification.Config{})
+
+	_, err := v.Verify(context.Background(), "invalid")
+	if !errors.Is(err, auth.InvalidTokenErr) {
+		t.Fatalf("got err [%v] but want err[%v]", err, auth.InvalidTokenErr)
+	}
+}
+
+// usersManager is a simple in memory users manager used in tests
+type usersManager struct {
+	users map[string]users.User
+}
+
+func newUsersManager(registered ...users.User) *usersManager {
+	m := &usersManager{users: map[string]users.User{}}
+	for _, user := range registered {
+		m.users[user.ID] = user
+	}
+	return m
+}
+
+func (m *usersManager) User(ctx context.Context, id string) (users.User, error) {
+	user, ok := m.users[id]
+	if !ok {
+		return users.User{}, users.UserNotFoundErr
+	}
+	return user, nil
+}
+
+func (m *usersManager) UserByEmail(ctx context.Context, email string) (users.User, error) {
+	validEmail, err := users.ParseEmail(email)
+	if err != nil {
+		return users.User{}, users.InvalidUserParamErr
+	}
+	for _, user := range m.users {
+		if user.Email == validEmail {
+			return user, nil
+		}
+	}
+	return users.User{}, users.UserNotFoundErr
+}
+
+func (m *usersManager) VerifyUser(ctx context.Context, id string, email string) error {
+	user, ok := m.users[id]
+	if !ok {
+		return users.UserNotFoundErr
+	}
+	if string(user.Email) != email {
+		return users.EmailMismatchErr
+	}
+	user.Status = users.ActiveStatus
+	m.users[id] = user
+	return nil
+}
+
+func parseVerifyToken(t *testing.T, body string) string {
+	t.Helper()
+
+	link := regexp.MustCompile(`https://\S+`).FindString(body)
+	if link == "" {
+		t.Fatalf("verification link not found on message body:\n%s", body)
+	}
+
+	parsed, err := url.Parse(link)
+	assertNoErr(t, err)
+
+	if parsed.Query().Get("lang") != "en" {
+		t.Fatalf("verification link %q lost the original query", link)
+	}
+
+	token := parsed.Query().Get("token")
+	if token == "" {
+		t.Fatalf("verification token not found on link %q", link)
+	}
+	return token
+}
+
+// mailToken extracts the token from emails sent without
+// a configured URL, where it is alone on its own paragraph.
+func mailToken(t *testing.T, msg mailer.Message) string {
+	t.Helper()
+
+	match := regexp.MustCompile(`\n\n(\S+)\n\n`).FindStringSubmatch(msg.Body)
+	if match == nil {
+		t.Fatalf("token not found on message body:\n%s", msg.Body)
+	}
+	return match[1]
+}
+
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+
+	m, err := miniredis.Run()
+	assertNoErr(t, err)
+	return m
+}
+
+func assertNoErr(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}